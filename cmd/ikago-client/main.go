@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -10,6 +12,7 @@
 	"github.com/sparrc/go-ping"
 	"github.com/xtaci/kcp-go"
 	"github.com/zhxie/ikago/internal/addr"
+	"github.com/zhxie/ikago/internal/clock"
 	"github.com/zhxie/ikago/internal/config"
 	"github.com/zhxie/ikago/internal/crypto"
 	"github.com/zhxie/ikago/internal/exec"
@@ -24,8 +27,10 @@
 	"os"
 	"os/signal"
 	"runtime"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -60,6 +65,7 @@ type natIndicator struct {
 	argMonitor        = flag.Int("monitor", 0, "Port for monitoring.")
 	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
 	argLog            = flag.String("log", "", "Log.")
+	argDumpDrops      = flag.Int("dump-drops", 0, "Size of dropped packets to dump in hex for debugging.")
 	argMTU            = flag.Int("mtu", pcap.MaxEthernetMTU, "MTU.")
 	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
 	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
@@ -72,11 +78,26 @@ type natIndicator struct {
 	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
 	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
 	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
+	argFingerprint    = flag.String("fingerprint", pcap.FingerprintNone, "TCP fingerprint of FakeTCP.")
+	argWindowScale    = flag.Int("window-scale", -1, "TCP window scale of FakeTCP.")
+	argTimestamps     = flag.Bool("timestamps", false, "Enable TCP timestamps option of FakeTCP.")
+	argECN            = flag.Bool("ecn", false, "Forward ECN between embedded packets and FakeTCP.")
+	argReplayWindow   = flag.Int("replay-window", 0, "Size of replay protection window.")
+	argPadding        = flag.String("padding", "", "Padding policy of packets.")
+	argBatchDelay     = flag.Int("batch-delay", 0, "Delay for coalescing packets into batches in milliseconds.")
+	argBatchSize      = flag.Int("batch-size", 1200, "Maximum size of batches in Bytes.")
+	argPinThread      = flag.Bool("pin-thread", false, "Pin each listen handle to an OS thread and a CPU.")
+	argEgress         = flag.String("egress", pcap.EgressPcap, "Backend for writing packets.")
+	argLazyDecode     = flag.Bool("lazy-decode", false, "Decode captured packets lazily.")
+	argMaxLatency     = flag.Int("max-latency", 0, "Maximum latency of packets in the system in milliseconds.")
+	argWaitDevs       = flag.Bool("wait-devices", false, "Wait for devices to appear.")
 	argPublish        = flag.String("publish", "", "ARP publishing address.")
+	argClampMSS       = flag.Bool("clamp-mss", false, "Clamp MSS of TCP connections to fit in the carrier.")
 	argFragment       = flag.Int("fragment", pcap.MaxEthernetMTU, "Fragmentation size for listening.")
 	argUpPort         = flag.Int("p", 0, "Port for routing upstream.")
 	argSources        = flag.String("r", "", "Sources.")
 	argServer         = flag.String("s", "", "Server.")
+	argKey            = flag.String("key", "", "Private key for authentication.")
 )
 
 var (
@@ -94,10 +115,18 @@ type natIndicator struct {
 	mtu        int
 	isKCP      bool
 	kcpConfig  *config.KCPConfig
+	clampMSS   bool
+	pinThread  bool
+	waitDevs   bool
+	batchDelay time.Duration
+	batchSize  int
+	maxLatency time.Duration
+	privateKey ed25519.PrivateKey
 )
 
 var (
 	isClosed    bool
+	listenLock  sync.Mutex
 	listenConns []*pcap.RawConn
 	upConn      net.Conn
 	c           chan pcap.ConnPacket
@@ -109,6 +138,10 @@ type natIndicator struct {
 	monitor     *stat.TrafficMonitor
 	dnsLock     sync.RWMutex
 	dns         map[string]string
+	mssLock     sync.RWMutex
+	mss         int
+	peerVersion uint32
+	lateDrops   uint64
 )
 
 func init() {
@@ -130,7 +163,7 @@ func init() {
 	log.Infof("%s %s\n\n", name, versionInfo)
 
 	// Start time
-	startTime = time.Now()
+	startTime = clock.Now()
 
 	// Parse arguments
 	flag.Parse()
@@ -179,6 +212,7 @@ func main() {
 		cfg.Monitor = *argMonitor
 		cfg.Verbose = *argVerbose
 		cfg.Log = *argLog
+		cfg.DumpDrops = *argDumpDrops
 		cfg.MTU = *argMTU
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
@@ -192,11 +226,26 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.Fingerprint = *argFingerprint
+		cfg.WindowScale = *argWindowScale
+		cfg.Timestamps = *argTimestamps
+		cfg.ECN = *argECN
+		cfg.ReplayWindow = *argReplayWindow
+		cfg.Padding = *argPadding
+		cfg.BatchDelay = *argBatchDelay
+		cfg.BatchSize = *argBatchSize
+		cfg.PinThread = *argPinThread
+		cfg.Egress = *argEgress
+		cfg.LazyDecode = *argLazyDecode
+		cfg.MaxLatency = *argMaxLatency
+		cfg.WaitDevs = *argWaitDevs
 		cfg.Publish = *argPublish
+		cfg.ClampMSS = *argClampMSS
 		cfg.Fragment = *argFragment
 		cfg.Port = *argUpPort
 		cfg.Sources = splitArg(*argSources)
 		cfg.Server = *argServer
+		cfg.Key = *argKey
 	}
 
 	// Log
@@ -249,6 +298,9 @@ func main() {
 		if gateway == nil {
 			log.Fatalln(fmt.Errorf("invalid gateway %s", cfg.Gateway))
 		}
+		if gateway.To4() == nil {
+			log.Fatalln(fmt.Errorf("gateway %s in ipv6 not support", cfg.Gateway))
+		}
 	}
 	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
 		log.Fatalln(fmt.Errorf("monitor port %d out of range", cfg.Monitor))
@@ -280,6 +332,21 @@ func main() {
 	if cfg.KCPConfig.NC < 0 {
 		log.Fatalln(fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC))
 	}
+	if cfg.ReplayWindow < 0 || cfg.ReplayWindow > pcap.MaxReplayWindow {
+		log.Fatalln(fmt.Errorf("replay window %d out of range", cfg.ReplayWindow))
+	}
+	if cfg.DumpDrops < 0 {
+		log.Fatalln(fmt.Errorf("dump drops %d out of range", cfg.DumpDrops))
+	}
+	if cfg.BatchDelay < 0 {
+		log.Fatalln(fmt.Errorf("batch delay %d out of range", cfg.BatchDelay))
+	}
+	if cfg.MaxLatency < 0 {
+		log.Fatalln(fmt.Errorf("max latency %d out of range", cfg.MaxLatency))
+	}
+	if cfg.BatchSize <= 0 || cfg.BatchSize > pcap.MaxCoalesceSize {
+		log.Fatalln(fmt.Errorf("batch size %d out of range", cfg.BatchSize))
+	}
 	if cfg.Fragment < 576 || cfg.Fragment > pcap.MaxMTU {
 		log.Fatalln(fmt.Errorf("fragment %d out of range", cfg.Fragment))
 	}
@@ -294,7 +361,11 @@ func main() {
 	}
 
 	// Find devices
-	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
+	if cfg.WaitDevs {
+		listenDevs, err = pcap.WaitListenDevs(cfg.ListenDevs)
+	} else {
+		listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
+	}
 	if err != nil {
 		log.Fatalln(fmt.Errorf("find listen devices: %w", err))
 	}
@@ -315,7 +386,11 @@ func main() {
 		log.Fatalln(errors.New("cannot determine listen device"))
 	}
 
-	upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
+	if cfg.WaitDevs {
+		upDev, gatewayDev, err = pcap.WaitUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
+	} else {
+		upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
+	}
 	if err != nil {
 		log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
 	}
@@ -367,12 +442,18 @@ func main() {
 				Time    int                  `json:"time"`
 				Monitor *stat.TrafficMonitor `json:"monitor"`
 				Ping    int64                `json:"ping"`
+				Replays uint64               `json:"replays"`
+				Parses  map[string]uint64    `json:"parse-failures"`
+				Late    uint64               `json:"late-drops"`
 			}{
 				Name:    name,
 				Version: versionInfo,
-				Time:    int(time.Now().Sub(startTime).Seconds()),
+				Time:    int(clock.Since(startTime).Seconds()),
 				Monitor: monitor,
 				Ping:    pingTime,
+				Replays: pcap.Replays(),
+				Parses:  pcap.ParseFailures(),
+				Late:    atomic.LoadUint64(&lateDrops),
 			})
 			if err != nil {
 				log.Errorln(fmt.Errorf("monitor: %w", err))
@@ -477,18 +558,125 @@ type IPName struct {
 		if isKCP {
 			log.Infoln("Enable KCP")
 		}
+
+		// Fingerprint
+		err = pcap.SetFingerprint(cfg.Fingerprint)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set fingerprint: %w", err))
+		}
+		if cfg.Fingerprint != pcap.FingerprintNone {
+			log.Infof("Mimic TCP fingerprint of %s\n", cfg.Fingerprint)
+		}
+
+		// Window scale
+		err = pcap.SetWindowScale(cfg.WindowScale)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set window scale: %w", err))
+		}
+		if cfg.WindowScale >= 0 {
+			log.Infof("Announce TCP window scale %d\n", cfg.WindowScale)
+		}
+
+		// Timestamps
+		pcap.SetTimestamps(cfg.Timestamps)
+		if cfg.Timestamps {
+			log.Infoln("Enable TCP timestamps option")
+		}
+
+		// ECN
+		pcap.SetECN(cfg.ECN)
+		if cfg.ECN {
+			log.Infoln("Forward ECN between embedded packets and FakeTCP")
+		}
+
+		// Replay protection
+		err = pcap.SetReplayWindow(cfg.ReplayWindow)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set replay window: %w", err))
+		}
+		if cfg.ReplayWindow > 0 {
+			log.Infof("Enable replay protection with window of %d packets\n", cfg.ReplayWindow)
+		}
+
+		// Padding
+		err = pcap.SetPadding(cfg.Padding)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set padding: %w", err))
+		}
+		if cfg.Padding != "" {
+			log.Infof("Pad packets by %s\n", cfg.Padding)
+		}
+
+		// Clamp MSS
+		clampMSS = cfg.ClampMSS
+		if clampMSS {
+			mss = pcap.MaxSegmentSize(mtu, crypt)
+			if mss <= 0 {
+				log.Fatalln(fmt.Errorf("mtu %d too small to clamp mss", mtu))
+			}
+			log.Infof("Clamp MSS to %d Bytes\n", mss)
+		}
 	case "tcp":
 		break
 	default:
 		log.Fatalln(fmt.Errorf("mode %s not support", mode))
 	}
 
+	// Dump dropped packets
+	log.SetDump(cfg.DumpDrops)
+	if cfg.DumpDrops > 0 {
+		log.Infof("Dump first %d Bytes of dropped packets\n", cfg.DumpDrops)
+	}
+
+	// Batch
+	batchDelay = time.Duration(cfg.BatchDelay) * time.Millisecond
+	batchSize = cfg.BatchSize
+	if batchDelay > 0 {
+		log.Infof("Coalesce packets into batches of %d Bytes in %d ms\n", batchSize, cfg.BatchDelay)
+	}
+
+	// Pin thread
+	pinThread = cfg.PinThread
+	if pinThread {
+		log.Infoln("Pin listen handles to threads")
+	}
+
+	// Egress
+	err = pcap.SetEgress(cfg.Egress)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("set egress: %w", err))
+	}
+	if cfg.Egress != pcap.EgressPcap {
+		log.Infof("Write packets through %s\n", cfg.Egress)
+	}
+
+	// Lazy decode
+	pcap.SetLazyDecode(cfg.LazyDecode)
+	if cfg.LazyDecode {
+		log.Infoln("Decode captured packets lazily")
+	}
+
+	// Max latency
+	maxLatency = time.Duration(cfg.MaxLatency) * time.Millisecond
+	if maxLatency > 0 {
+		log.Infof("Drop packets in the system for more than %d ms\n", cfg.MaxLatency)
+	}
+
+	// Wait devices
+	waitDevs = cfg.WaitDevs
+	if waitDevs {
+		log.Infoln("Reopen listen handles after their devices come back")
+	}
+
 	// Publish
 	if cfg.Publish != "" {
 		ip := net.ParseIP(cfg.Publish)
 		if ip == nil {
 			log.Errorln(fmt.Errorf("invalid publish %s", cfg.Publish))
 		}
+		if ip != nil && ip.To4() == nil {
+			log.Fatalln(fmt.Errorf("publish %s in ipv6 not support", cfg.Publish))
+		}
 		publishIP = &net.IPAddr{IP: ip}
 	}
 	if publishIP != nil {
@@ -515,6 +703,9 @@ type IPName struct {
 		if ip == nil {
 			log.Fatalln(fmt.Errorf("invalid source %s", source))
 		}
+		if ip.To4() == nil {
+			log.Fatalln(fmt.Errorf("source %s in ipv6 not support", source))
+		}
 		sources = append(sources, &net.IPAddr{IP: ip})
 	}
 
@@ -523,9 +714,25 @@ type IPName struct {
 	if err != nil {
 		log.Fatalln(fmt.Errorf("parse server %s: %w", cfg.Server, err))
 	}
+	if serverAddr.IP.To4() == nil {
+		log.Fatalln(fmt.Errorf("server %s in ipv6 not support", cfg.Server))
+	}
 	serverIP = serverAddr.IP
 	serverPort = uint16(serverAddr.Port)
 
+	// Key
+	if cfg.Key != "" {
+		seed, err := base64.StdEncoding.DecodeString(cfg.Key)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse key: %w", err))
+		}
+		if len(seed) != ed25519.SeedSize {
+			log.Fatalln(fmt.Errorf("key size %d out of range", len(seed)))
+		}
+		privateKey = ed25519.NewKeyFromSeed(seed)
+		log.Infof("Authenticate with public key %s\n", base64.StdEncoding.EncodeToString(privateKey.Public().(ed25519.PublicKey)))
+	}
+
 	// Add firewall rule (delay)
 	if cfg.Rule {
 		// Firewall
@@ -601,8 +808,12 @@ func open() error {
 		fs = append(fs, s)
 	}
 	f := strings.Join(fs, " || ")
-	filter := fmt.Sprintf("ip && (((tcp || udp) && (%s) && not (src host %s && src port %d)) || ((icmp || (ip[6:2] & 0x1fff) != 0) && (%s) && not src host %s))",
-		f, serverIP, serverPort, f, serverIP)
+	others := "icmp || (ip[6:2] & 0x1fff) != 0"
+	if tf := pcap.TransportFilter(); tf != "" {
+		others = others + " || " + tf
+	}
+	filter := fmt.Sprintf("ip && (((tcp || udp) && (%s) && not (src host %s && src port %d)) || ((%s) && (%s) && not src host %s))",
+		f, serverIP, serverPort, others, f, serverIP)
 	if publishIP != nil {
 		s, err := addr.DstBPFFilter(publishIP)
 		if err != nil {
@@ -646,6 +857,15 @@ func open() error {
 	if err != nil {
 		return fmt.Errorf("open upstream: %w", err)
 	}
+	if batchDelay > 0 {
+		upConn = pcap.NewCoalescedConn(upConn, batchDelay, batchSize)
+	}
+
+	// Hello
+	err = sendHello()
+	if err != nil {
+		return fmt.Errorf("send hello: %w", err)
+	}
 
 	// Ping
 	if monitor != nil {
@@ -683,15 +903,30 @@ func open() error {
 
 	// Start handling
 	for i := 0; i < len(listenConns); i++ {
+		index := i
 		conn := listenConns[i]
+		cpu := i % runtime.NumCPU()
 
 		go func() {
+			if pinThread {
+				pin(cpu)
+			}
+
 			for {
 				packet, err := conn.ReadPacket()
 				if err != nil {
 					if isClosed {
 						return
 					}
+					if waitDevs && (errors.Is(err, io.EOF) || isDevMissing(conn.LocalDev())) {
+						alias := conn.LocalDev().Alias()
+						conn, err = reopen(index, conn, filter)
+						if err != nil {
+							log.Errorln(fmt.Errorf("reopen listen device %s: %w", alias, err))
+							return
+						}
+						continue
+					}
 					log.Errorln(fmt.Errorf("read listen device %s: %w", conn.LocalDev().Alias(), err))
 					continue
 				}
@@ -703,10 +938,22 @@ func open() error {
 
 	go func() {
 		for cp := range c {
-			err := handleListen(cp.Packet, cp.Conn)
+			// Drop packets queued for too long, which are worse delivered late than dropped
+			ts := cp.Packet.Metadata().Timestamp
+			if maxLatency > 0 && !ts.IsZero() && clock.Since(ts) > maxLatency {
+				atomic.AddUint64(&lateDrops, 1)
+				log.Verbosef("Drop a packet from device %s for latency (%d Bytes)\n", cp.Conn.LocalDev().Alias(), len(cp.Packet.Data()))
+				log.Dump("latency", cp.Packet.Data())
+				continue
+			}
+
+			err := recoverHandle(func() error {
+				return handleListen(cp.Packet, cp.Conn)
+			})
 			if err != nil {
 				log.Errorln(fmt.Errorf("handle listen in device %s: %w", cp.Conn.LocalDev().Alias(), err))
 				log.Verboseln(cp.Packet)
+				log.Dump("error", cp.Packet.Data())
 				continue
 			}
 		}
@@ -726,10 +973,13 @@ func open() error {
 			continue
 		}
 
-		err = handleUpstream(b[:n])
+		err = recoverHandle(func() error {
+			return handleUpstream(b[:n])
+		})
 		if err != nil {
 			log.Errorln(fmt.Errorf("handle upstream in address %s: %w", upConn.LocalAddr().String(), err))
 			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", upConn.RemoteAddr().String(), n)
+			log.Dump("error", b[:n])
 			continue
 		}
 	}
@@ -737,11 +987,13 @@ func open() error {
 
 func closeAll() {
 	isClosed = true
+	listenLock.Lock()
 	for _, handle := range listenConns {
 		if handle != nil {
 			handle.Close()
 		}
 	}
+	listenLock.Unlock()
 	if upConn != nil {
 		upConn.Close()
 	}
@@ -750,6 +1002,52 @@ func closeAll() {
 	}
 }
 
+// reopen closes the listen handle of the given index, and opens it again after its device appears.
+func reopen(index int, conn *pcap.RawConn, filter string) (*pcap.RawConn, error) {
+	var (
+		err     error
+		newConn *pcap.RawConn
+	)
+
+	alias := conn.LocalDev().Alias()
+	conn.Close()
+	log.Infof("Listen device %s is down\n", alias)
+
+	devs, err := pcap.WaitListenDevs([]string{alias})
+	if err != nil {
+		return nil, fmt.Errorf("wait listen device: %w", err)
+	}
+	dev := devs[0]
+
+	if dev.IsLoop() {
+		newConn, err = pcap.CreateRawConn(dev, dev, filter)
+	} else {
+		newConn, err = pcap.CreateRawConn(dev, gatewayDev, filter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open listen device: %w", err)
+	}
+
+	listenLock.Lock()
+	defer listenLock.Unlock()
+
+	if isClosed {
+		newConn.Close()
+		return nil, errors.New("closed")
+	}
+	listenConns[index] = newConn
+
+	log.Infof("Reopen listen device %s\n", dev.String())
+
+	return newConn, nil
+}
+
+// isDevMissing returns if the device no longer exists.
+func isDevMissing(dev *pcap.Device) bool {
+	_, err := pcap.FindListenDevs([]string{dev.Alias()})
+	return errors.Is(err, pcap.ErrMissingDevice)
+}
+
 func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 	var (
 		indicator    *pcap.PacketIndicator
@@ -811,9 +1109,13 @@ func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 
 	// Reconnect
 	if upConn != nil {
-		switch upConn.(type) {
+		conn := upConn
+		if coalescedConn, ok := conn.(*pcap.CoalescedConn); ok {
+			conn = coalescedConn.Conn
+		}
+		switch conn.(type) {
 		case *pcap.FakeTCPConn:
-			err = upConn.(*pcap.FakeTCPConn).Reconnect()
+			err = conn.(*pcap.FakeTCPConn).Reconnect()
 		default:
 			break
 		}
@@ -821,6 +1123,10 @@ func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 	if err != nil {
 		return fmt.Errorf("reconnect: %w", err)
 	}
+	err = sendHello()
+	if err != nil {
+		return fmt.Errorf("send hello: %w", err)
+	}
 
 	log.Infof("Device %s [%s] joined the network\n", indicator.SrcIP(), net.HardwareAddr(arpLayer.SourceHwAddress))
 	log.Verbosef("Reply an %s request: %s -> %s\n", indicator.NetworkLayer().LayerType(), indicator.SrcIP(), indicator.DstIP())
@@ -828,6 +1134,80 @@ func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 	return nil
 }
 
+func sendHello() error {
+	var (
+		err  error
+		data []byte
+	)
+
+	hello := pcap.NewClientHello(mode, mtu, isKCP)
+	if privateKey != nil {
+		data, err = hello.Sign(privateKey)
+		if err != nil {
+			return fmt.Errorf("sign: %w", err)
+		}
+	} else {
+		data, err = hello.Serialize()
+		if err != nil {
+			return fmt.Errorf("serialize: %w", err)
+		}
+	}
+
+	_, err = upConn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
+
+func handleHello(contents []byte) error {
+	// Parse hello
+	hello, err := pcap.ParseHello(contents)
+	if err != nil {
+		return fmt.Errorf("parse hello: %w", err)
+	}
+	if !hello.IsServer {
+		return errors.New("unexpected client hello")
+	}
+
+	// Verify
+	err = hello.Verify(mode, isKCP)
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+
+	// Negotiate version, which is resolved once and applied to all following payloads of the server
+	version := pcap.NegotiateVersion(hello.Version)
+	atomic.StoreUint32(&peerVersion, uint32(version))
+	if coalescedConn, ok := upConn.(*pcap.CoalescedConn); ok {
+		err = coalescedConn.SetVersion(version)
+		if err != nil {
+			return fmt.Errorf("set version: %w", err)
+		}
+	}
+
+	log.Verbosef("Receive hello from server %s (version %d, MTU %d)\n", upConn.RemoteAddr(), version, hello.MTU)
+
+	if hello.Addr != nil {
+		log.Infof("Assigned %s by server %s\n", hello.Addr, upConn.RemoteAddr())
+	}
+
+	// Lower MSS to the path MTU between the client and the server
+	if clampMSS && int(hello.MTU) < mtu {
+		newMSS := pcap.MaxSegmentSize(int(hello.MTU), crypt)
+
+		mssLock.Lock()
+		if newMSS > 0 && newMSS < mss {
+			mss = newMSS
+			log.Infof("Clamp MSS to %d Bytes by server %s\n", mss, upConn.RemoteAddr())
+		}
+		mssLock.Unlock()
+	}
+
+	return nil
+}
+
 func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
 	var (
 		err          error
@@ -852,16 +1232,28 @@ func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
 	}
 
 	// Record source hardware address
-	switch t := indicator.LinkLayer().LayerType(); t {
-	case layers.LayerTypeEthernet:
+	if indicator.LinkLayer() != nil && indicator.LinkLayer().LayerType() == layers.LayerTypeEthernet {
 		hardwareAddr = indicator.SrcHardwareAddr()
-	default:
+	} else {
 		hardwareAddr, _ = net.ParseMAC("00:00:00:00:00:00")
 	}
 
-	data = make([]byte, 0)
-	data = append(data, packet.NetworkLayer().LayerContents()...)
-	data = append(data, packet.NetworkLayer().LayerPayload()...)
+	// Clamp MSS
+	if clampMSS && indicator.TCPLayer() != nil && indicator.IPv4Layer() != nil && clamp(indicator.TCPLayer()) {
+		err = indicator.TCPLayer().SetNetworkLayerForChecksum(indicator.IPv4Layer())
+		if err != nil {
+			return fmt.Errorf("set network layer for checksum: %w", err)
+		}
+
+		data, err = pcap.Serialize(indicator.IPv4Layer(), indicator.TCPLayer(), gopacket.Payload(indicator.Payload()))
+		if err != nil {
+			return fmt.Errorf("serialize: %w", err)
+		}
+	} else {
+		data = make([]byte, 0)
+		data = append(data, packet.NetworkLayer().LayerContents()...)
+		data = append(data, packet.NetworkLayer().LayerPayload()...)
+	}
 
 	// Write packet data
 	_, err = upConn.Write(data)
@@ -904,12 +1296,44 @@ func handleUpstream(contents []byte) error {
 		return nil
 	}
 
+	// Hello
+	if pcap.IsHello(contents) {
+		err := handleHello(contents)
+		if err != nil {
+			return fmt.Errorf("handle hello: %w", err)
+		}
+		return nil
+	}
+
+	// Batch
+	if atomic.LoadUint32(&peerVersion) >= pcap.BatchVersion && pcap.IsBatch(contents) {
+		records, err := pcap.ParseBatch(contents)
+		if err != nil {
+			return fmt.Errorf("parse batch: %w", err)
+		}
+
+		for i, record := range records {
+			err := handleUpstream(record)
+			if err != nil {
+				return fmt.Errorf("handle record %d in batch: %w", i, err)
+			}
+		}
+		return nil
+	}
+
 	// Parse embedded packet
 	embIndicator, err = pcap.ParseEmbPacket(contents)
 	if err != nil {
 		return fmt.Errorf("parse embedded packet: %w", err)
 	}
 
+	// Drop packets which are neither fragments nor have a transport layer
+	if !embIndicator.IsFrag() && embIndicator.TransportLayer() == nil {
+		log.Verbosef("Drop an inbound packet for missing transport layer: %s -> %s\n", embIndicator.SrcIP(), embIndicator.DstIP())
+		log.Dump("missing transport layer", contents)
+		return nil
+	}
+
 	// Check map
 	natLock.RLock()
 	ni, ok := nat[embIndicator.DstIP().String()]
@@ -918,8 +1342,10 @@ func handleUpstream(contents []byte) error {
 		return fmt.Errorf("missing nat to %s", embIndicator.DstIP())
 	}
 
-	// Decide Loopback or Ethernet
-	if ni.conn.IsLoop() {
+	// Decide Loopback or Ethernet, raw connections have no link layer
+	if ni.conn.IsRaw() {
+		newLinkLayerType = gopacket.LayerTypeZero
+	} else if ni.conn.IsLoop() {
 		newLinkLayerType = layers.LayerTypeLoopback
 	} else {
 		newLinkLayerType = layers.LayerTypeEthernet
@@ -927,6 +1353,8 @@ func handleUpstream(contents []byte) error {
 
 	// Create new link layer
 	switch newLinkLayerType {
+	case gopacket.LayerTypeZero:
+		break
 	case layers.LayerTypeLoopback:
 		newLinkLayer, err = pcap.CreateLoopbackLayer(embIndicator.NetworkLayer().(gopacket.NetworkLayer))
 	case layers.LayerTypeEthernet:
@@ -938,6 +1366,14 @@ func handleUpstream(contents []byte) error {
 		return fmt.Errorf("create link layer: %w", err)
 	}
 
+	// Clamp MSS
+	if clampMSS && embIndicator.TCPLayer() != nil && clamp(embIndicator.TCPLayer()) {
+		err = embIndicator.TCPLayer().SetNetworkLayerForChecksum(embIndicator.IPv4Layer())
+		if err != nil {
+			return fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	}
+
 	// Fragment
 	fragments, err = pcap.CreateFragmentPackets(newLinkLayer, embIndicator.NetworkLayer(), embIndicator.TransportLayer(), gopacket.Payload(embIndicator.Payload()), fragment)
 	if err != nil {
@@ -985,6 +1421,37 @@ func handleUpstream(contents []byte) error {
 	return nil
 }
 
+func clamp(layer *layers.TCP) bool {
+	mssLock.RLock()
+	size := mss
+	mssLock.RUnlock()
+
+	return pcap.ClampMSS(layer, uint16(size))
+}
+
+// recoverHandle calls the handler and converts a panic in it into an error, so a malformed packet will not crash the
+// process.
+func recoverHandle(handle func() error) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			log.Verboseln(string(debug.Stack()))
+		}
+	}()
+
+	return handle()
+}
+
+func pin(cpu int) {
+	runtime.LockOSThread()
+
+	err := exec.SetAffinity(cpu)
+	if err != nil {
+		log.Errorln(fmt.Errorf("set affinity to cpu %d: %w", cpu, err))
+	}
+}
+
 func splitArg(s string) []string {
 	if s == "" {
 		return nil
@@ -1,6 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -9,21 +18,27 @@
 	"github.com/google/gopacket/layers"
 	"github.com/xtaci/kcp-go"
 	"github.com/zhxie/ikago/internal/addr"
+	"github.com/zhxie/ikago/internal/clock"
 	"github.com/zhxie/ikago/internal/config"
 	"github.com/zhxie/ikago/internal/crypto"
 	"github.com/zhxie/ikago/internal/exec"
 	"github.com/zhxie/ikago/internal/log"
 	"github.com/zhxie/ikago/internal/pcap"
 	"github.com/zhxie/ikago/internal/stat"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -34,6 +49,13 @@ type quintuple struct {
 	protocol gopacket.LayerType
 }
 
+// natKey identifies a flow of a client in NAT by its source before translation, which is comparable without
+// formatting addresses.
+type natKey struct {
+	src    pcap.NATGuide
+	client string
+}
+
 type natIndicator struct {
 	src    net.Addr
 	embSrc net.Addr
@@ -50,15 +72,208 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 		return indicator.embSrc.(*net.UDPAddr).IP
 	case *addr.ICMPQueryAddr:
 		return indicator.embSrc.(*addr.ICMPQueryAddr).IP
+	case *addr.PortAddr:
+		return indicator.embSrc.(*addr.PortAddr).IP
 	default:
 		panic(fmt.Errorf("type %T not support", t))
 	}
 }
 
+// egressPacket describes fragments of a packet delayed by the egress rate, and when it is due to be written.
+type egressPacket struct {
+	conn      *pcap.RawConn
+	fragments [][]byte
+	due       time.Time
+}
+
+type proxyFlow struct {
+	// seq is the sequence number of the first data byte from the source.
+	seq        uint32
+	offset     uint32
+	isInjected bool
+}
+
+type payloadLimit struct {
+	min int
+	max int
+}
+
+// policy describes policies of packets from clients, which can be reloaded without restart.
+type policy struct {
+	payloadLimits map[gopacket.LayerType]*payloadLimit
+	allowPorts    map[gopacket.LayerType][]*portRange
+	maxFlows      int
+	maxQueued     int
+}
+
+type portRange struct {
+	min uint16
+	max uint16
+}
+
+// serverStats describes statistics of the server.
+type serverStats struct {
+	Name    string               `json:"name"`
+	Version string               `json:"version"`
+	Time    int                  `json:"time"`
+	Monitor *stat.TrafficMonitor `json:"monitor"`
+	Replays uint64               `json:"replays"`
+	Parses  map[string]uint64    `json:"parse-failures"`
+	Drops   uint64               `json:"drops"`
+	Paused  bool                 `json:"paused"`
+	Memory  int64                `json:"memory"`
+	Rejects uint64               `json:"handshake-drops"`
+	Unmatch uint64               `json:"unmatched"`
+	Denied  uint64               `json:"port-drops"`
+	Probes  uint64               `json:"probes"`
+	Late    uint64               `json:"late-drops"`
+	Queues  []queueStats         `json:"queues"`
+	Killed  bool                 `json:"killed"`
+	Kills   uint64               `json:"kill-drops"`
+	Shaped  uint64               `json:"shaped"`
+	Excess  uint64               `json:"shaping-drops"`
+}
+
+// queueStats describes statistics of a queue of packets from clients.
+type queueStats struct {
+	Name  string `json:"name"`
+	Depth int    `json:"depth"`
+	Late  uint64 `json:"late-drops"`
+}
+
+type weightedGateway struct {
+	ip     net.IP
+	weight int
+}
+
+// namedGateway is a gateway for TLS flows whose server names match the pattern.
+type namedGateway struct {
+	pattern string
+	ip      net.IP
+}
+
+// stateVersion is the version of the format of NAT state.
+const stateVersion = 1
+
+// natState describes NAT state which can be exported and imported across restarts.
+type natState struct {
+	Version int            `json:"version"`
+	Flows   []natStateFlow `json:"flows"`
+}
+
+type natStateFlow struct {
+	Src      string `json:"src"`
+	Client   string `json:"client"`
+	Protocol string `json:"protocol"`
+	Value    uint16 `json:"value"`
+	LastSeen int64  `json:"last-seen"`
+	TCPState uint8  `json:"tcp-state"`
+}
+
+// flowEvent describes an event in the lifecycle of a flow in NAT logged in JSON.
+type flowEvent struct {
+	Time     string `json:"time"`
+	Event    string `json:"event"`
+	Protocol string `json:"protocol"`
+	Src      string `json:"src"`
+	Client   string `json:"client"`
+	NAT      string `json:"nat"`
+}
+
+// flowSummary describes a summary of an unidirectional flow before and after translation logged in JSON.
+type flowSummary struct {
+	Time     string  `json:"time"`
+	Event    string  `json:"event"`
+	Protocol string  `json:"protocol"`
+	Src      string  `json:"src"`
+	Dst      string  `json:"dst"`
+	PostSrc  string  `json:"post-src"`
+	PostDst  string  `json:"post-dst"`
+	Bytes    uint64  `json:"bytes"`
+	Packets  uint64  `json:"packets"`
+	Start    string  `json:"start"`
+	End      string  `json:"end"`
+	Duration float64 `json:"duration"`
+}
+
+// requestError describes an error caused by an admin request itself, which is responded as a bad request.
+type requestError struct {
+	Err error
+}
+
+func (err *requestError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *requestError) Unwrap() error {
+	return err.Err
+}
+
 const name string = "IkaGo-server"
 
-const keepAlive = 30 * time.Second
 const keepFragments = 30 * time.Second
+const keepARP = 60 * time.Second
+const keepIdle = 5 * time.Second
+const logUnmatchedInterval = time.Second
+
+// killHandshakes is the count of TCP handshakes unanswered by the upstream for engaging the kill switch.
+const killHandshakes = 3
+
+// defaultDrain is the default duration of draining flows when migrating to an upstream device with another address.
+const defaultDrain = 30 * time.Second
+
+// closeGrace is the duration before closing the old upstream handle, so that packets being written to it can finish.
+const closeGrace = time.Second
+
+// shutdownTimeout is the maximum duration of waiting for goroutines handling packets to exit in shutdown, since reads
+// in pcap handles may not be interrupted by closing in some platforms.
+const shutdownTimeout = 10 * time.Second
+
+const (
+	// unsupportedLog drops packets of unsupported protocols from clients with errors logged.
+	unsupportedLog = "log"
+	// unsupportedDrop drops packets of unsupported protocols from clients silently.
+	unsupportedDrop = "drop"
+)
+
+const (
+	// ipOptionsStrip strips IP options of packets from clients before forwarding.
+	ipOptionsStrip = "strip"
+	// ipOptionsDrop drops packets with IP options from clients with logs.
+	ipOptionsDrop = "drop"
+	// ipOptionsPreserve forwards IP options of packets from clients as is.
+	ipOptionsPreserve = "preserve"
+)
+
+const (
+	// multicastDrop drops packets from clients to multicast or broadcast addresses.
+	multicastDrop = "drop"
+	// multicastForward forwards packets from clients to multicast or broadcast addresses without NAT, so replies to
+	// them will not be routed back.
+	multicastForward = "forward"
+)
+
+const (
+	// logFormatText logs events of flows in lines of text.
+	logFormatText = "text"
+	// logFormatJSON logs events and summaries of flows in JSON objects, one object per line.
+	logFormatJSON = "json"
+)
+
+const (
+	tcpEstablished = iota
+	tcpSYNSent
+	tcpClosing
+)
+
+// flowMemory is the approximate size of a flow in NAT.
+const flowMemory = 256
+
+// flowActiveTimeout is the duration after which records of long-lived flows are exported and restarted.
+const flowActiveTimeout = 60 * time.Second
+
+// maxHashProbes is the max count of ports or Ids probed from the hash of a flow before distributing in sequence.
+const maxHashProbes = 64
 
 var (
 	version     = ""
@@ -81,6 +296,7 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 	argMonitor        = flag.Int("monitor", 0, "Port for monitoring.")
 	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
 	argLog            = flag.String("log", "", "Log.")
+	argDumpDrops      = flag.Int("dump-drops", 0, "Size of dropped packets to dump in hex for debugging.")
 	argMTU            = flag.Int("mtu", pcap.MaxEthernetMTU, "MTU.")
 	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
 	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
@@ -93,41 +309,194 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
 	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
 	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
+	argFingerprint    = flag.String("fingerprint", pcap.FingerprintNone, "TCP fingerprint of FakeTCP.")
+	argWindowScale    = flag.Int("window-scale", -1, "TCP window scale of FakeTCP.")
+	argTimestamps     = flag.Bool("timestamps", false, "Enable TCP timestamps option of FakeTCP.")
+	argECN            = flag.Bool("ecn", false, "Forward ECN between embedded packets and FakeTCP.")
+	argIPId           = flag.String("ip-id", pcap.IPIdCounter, "IPv4 identification of FakeTCP.")
+	argReplayWindow   = flag.Int("replay-window", 0, "Size of replay protection window.")
+	argPadding        = flag.String("padding", "", "Padding policy of packets.")
+	argBatchDelay     = flag.Int("batch-delay", 0, "Delay for coalescing packets into batches in milliseconds.")
+	argBatchSize      = flag.Int("batch-size", 1200, "Maximum size of batches in Bytes.")
+	argPinThread      = flag.Bool("pin-thread", false, "Pin each listen handle to an OS thread and a CPU.")
+	argEgress         = flag.String("egress", pcap.EgressPcap, "Backend for writing packets.")
+	argLazyDecode     = flag.Bool("lazy-decode", false, "Decode captured packets lazily.")
+	argMaxLatency     = flag.Int("max-latency", 0, "Maximum latency of packets in the system in milliseconds.")
+	argSplitUpstream  = flag.Bool("split-upstream", false, "Write upstream through a separate handle.")
+	argVLAN           = flag.Int("vlan", 0, "VLAN ID of frames routed upstream.")
+	argWaitDevs       = flag.Bool("wait-devices", false, "Wait for devices to appear.")
 	argFragment       = flag.Int("fragment", pcap.MaxEthernetMTU, "Fragmentation size for routing upstream.")
+	argUpMTU          = flag.Int("upstream-mtu", 0, "MTU of the upstream device.")
 	argPort           = flag.Int("p", 0, "Port for listening.")
+	argDecrementTTL   = flag.Bool("decrement-ttl", true, "Decrement TTL when routing.")
+	argExpectedFlows  = flag.Int("expected-flows", 0, "Expected count of flows for preallocating.")
+	argPool           = flag.String("pool", "", "Address pool for assigning to clients.")
+	argClientSubnets  = flag.String("client-subnets", "", "Subnets of clients.")
+	argPayloadLimits  = flag.String("payload-limits", "", "Limits of payload size for routing upstream.")
+	argAllowPorts     = flag.String("allow-ports", "", "Allowed destination ports for routing upstream.")
+	argPriority       = flag.String("priority", "", "Destination ports and DSCPs of packets with priority.")
+	argProxyProtocol  = flag.String("proxy-protocol", "", "Destinations for sending PROXY protocol headers.")
+	argPreserveUDP    = flag.Bool("preserve-udp-port", false, "Preserve source ports of UDP packets if possible.")
+	argHashPorts      = flag.Bool("hash-ports", false, "Distribute ports and IDs by hashes of flows.")
+	argHashSeed       = flag.String("hash-seed", "", "Secret seed of hashes of flows.")
+	argAnswerPing     = flag.Bool("answer-ping", false, "Answer ICMP echo requests to listen devices.")
+	argMaxMemory      = flag.Int("max-memory", 0, "Approximate memory budget of NAT and fragments in Bytes.")
+	argHousekeeping   = flag.Int("housekeeping", 1000, "Interval of housekeeping in milliseconds.")
+	argFlowExport     = flag.String("flow-export", "", "Collector address for exporting flows in NetFlow v9.")
+	argChecksums      = flag.Bool("verify-checksums", false, "Verify checksums of received packets.")
+	argClientFlows    = flag.Int("client-flows", 0, "Maximum count of concurrent flows of a client.")
+	argClientBytes    = flag.Int("client-bytes", 0, "Maximum size of queued packets of a client in Bytes.")
+	argEgressRate     = flag.Int("egress-rate", 0, "Maximum rate of traffic to the upstream in Bytes per second.")
+	argEgressBurst    = flag.Int("egress-burst", 0, "Burst of traffic to the upstream in Bytes.")
+	argAdmin          = flag.String("admin", "", "Address for serving admin API.")
+	argAdminToken     = flag.String("admin-token", "", "Bearer token of admin API.")
+	argNATTCPSYN      = flag.Int("nat-tcp-syn", 30, "NAT idle timeout of TCP in SYN sent state in seconds.")
+	argNATTCPEst      = flag.Int("nat-tcp-established", 30, "NAT idle timeout of TCP in established state in seconds.")
+	argNATTCPClosing  = flag.Int("nat-tcp-closing", 30, "NAT idle timeout of TCP in closing state in seconds.")
+	argNATUDP         = flag.Int("nat-udp", 30, "NAT idle timeout of UDP in seconds.")
+	argNATICMP        = flag.Int("nat-icmp", 30, "NAT idle timeout of ICMP in seconds.")
+	argHandshakeRate  = flag.Int("handshake-rate", 0, "Maximum rate of handshakes per second.")
+	argSYNCookies     = flag.Bool("syn-cookies", false, "Answer handshakes with SYN cookies.")
+	argMaxClients     = flag.Int("max-clients", 0, "Maximum count of clients of a listener.")
+	argRSTProbes      = flag.Bool("rst-probes", false, "Reset clients not speaking the carrier.")
+	argResume         = flag.Bool("resume", false, "Resume established connections of unknown clients.")
+	argClientKeys     = flag.String("client-keys", "", "Public keys of clients allowed to connect.")
+	argKeepAlive      = flag.Int("keepalive", 0, "Interval of sending keepalive probes in seconds.")
+	argState          = flag.String("state", "", "File for saving and restoring NAT state.")
+	argGateways       = flag.String("gateways", "", "Gateways with weights for distributing flows.")
+	argSNIGateways    = flag.String("sni-gateways", "", "Gateways for TLS flows by server names.")
+	argGratuitousARP  = flag.Int("gratuitous-arp", 0, "Interval of announcing the upstream address by gratuitous ARP in seconds.")
+	argLogUnmatched   = flag.Bool("log-unmatched", false, "Log upstream packets not matching any flow.")
+	argLogNAT         = flag.Bool("log-nat", false, "Log allocation and release of flows in NAT.")
+	argLogFormat      = flag.String("log-format", logFormatText, "Format of logs of flows.")
+	argUnsupported    = flag.String("unsupported", unsupportedLog, "Handling of packets of unsupported protocols.")
+	argIPOptions      = flag.String("ip-options", ipOptionsStrip, "Handling of IP options.")
+	argDropSrcRoute   = flag.Bool("drop-source-route", false, "Drop packets with source routing options.")
+	argMulticast      = flag.String("multicast", multicastDrop, "Handling of packets to multicast or broadcast addresses.")
+	argKillSwitch     = flag.Int("kill-switch", 0, "Timeout of unanswered handshakes to upstream in seconds for dropping all traffic.")
 )
 
 var (
-	fragment   int
-	port       uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
+	fragment      int
+	port          uint16
+	decrementTTL  bool
+	expectedFlows int
+	pool          *addr.Pool
+	prioPorts     map[gopacket.LayerType][]*portRange
+	prioDSCPs     map[uint8]bool
+	proxyDsts     map[string]bool
+	preserveUDP   bool
+	hashPorts     bool
+	hashSeed      []byte
+	answerPing    bool
+	maxMemory     int
+	housekeeping  time.Duration
+	flowExporter  *stat.FlowExporter
+	egressRate    int
+	egressBurst   int
+	natConfig     *config.NATConfig
+	stateFile     string
+	gateways      []*weightedGateway
+	totalWeight   int
+	sniGateways   []*namedGateway
+	clientKeys    map[string]string
+	gratuitousARP time.Duration
+	logUnmatched  bool
+	logNAT        bool
+	logFormat     string
+	unsupported   string
+	ipOptions     string
+	dropSrcRoute  bool
+	resumeConns   bool
+	multicast     string
+	killSwitch    time.Duration
+	listenDevs    []*pcap.Device
+	upDev         *pcap.Device
+	gatewayDev    *pcap.Device
+	mode          string
+	crypt         crypto.Crypt
+	mtu           int
+	isKCP         bool
+	kcpConfig     *config.KCPConfig
+	pinThread     bool
+	splitUpstream bool
+	vlan          uint16
+	batchDelay    time.Duration
+	batchSize     int
+	maxLatency    time.Duration
+	keepAlive     time.Duration
 )
 
 var (
 	isClosed     bool
 	listeners    []net.Listener
-	upConn       *pcap.RawConn
+	echoConns    []*pcap.RawConn
+	helloLock    sync.RWMutex
+	hellos       map[net.Conn]*pcap.Hello
+	clientAddrs  map[net.Conn]net.IP
+	clientIDs    map[net.Conn]string
+	upConn       atomic.Value
 	c            chan pcap.ConnBytes
+	prioQueue    chan pcap.ConnBytes
 	defrag       *pcap.EasyDefragmenter
+	arpCache     *pcap.ARPCache
+	policies     atomic.Value
+	gatewayMAC   atomic.Value
 	nextTCPPort  uint16
 	tcpPortPool  []time.Time
+	tcpStates    []uint8
 	nextUDPPort  uint16
 	udpPortPool  []time.Time
 	nextICMPv4Id uint16
 	icmpv4IdPool []time.Time
-	patMap       map[quintuple]uint16
+	nextPorts    map[gopacket.LayerType]uint16
+	portPools    map[gopacket.LayerType][]time.Time
+	patMap       map[natKey]uint16
 	natLock      sync.RWMutex
 	nat          map[pcap.NATGuide]*natIndicator
 	monitor      *stat.TrafficMonitor
 	dnsLock      sync.RWMutex
 	dns          map[string]string
+	limitDrops   uint64
+	portDrops    uint64
+	lateDrops    uint64
+	prioLate     uint64
+	paused       int32
+	killed       int32
+	killedAt     time.Time
+	synPending   int64
+	synUnacked   int32
+	killDrops    uint64
+	egressLock   sync.Mutex
+	egressToken  float64
+	egressLast   time.Time
+	shaped       uint64
+	shapeDrops   uint64
+	egressQueue  chan *egressPacket
+	egressQueued int
+	proxyLock    sync.RWMutex
+	proxyFlows   map[string]*proxyFlow
+	sniLock      sync.RWMutex
+	sniFlows     map[pcap.NATGuide]net.IP
+	memoryUsage  int64
+	fragsSize    int64
+	overBudget   int32
+	unmatched    uint64
+	lastLogged   int64
+	flowLock     sync.Mutex
+	flowRecords  map[quintuple]*stat.FlowRecord
+	usageLock    sync.RWMutex
+	clientFlows  map[string]int
+	clientQueues map[net.Conn]*int64
+	lastProbe    time.Time
+	lastAnnounce time.Time
+	upLooping    int32
+	upFilter     string
+	migrateLock  sync.Mutex
+	closeOnce    sync.Once
+	handlers     sync.WaitGroup
+	connLock     sync.Mutex
+	clientConns  map[net.Conn]bool
 )
 
 func init() {
@@ -149,31 +518,34 @@ func init() {
 	log.Infof("%s %s\n\n", name, versionInfo)
 
 	// Start time
-	startTime = time.Now()
-
-	// Parse arguments
-	flag.Parse()
-
-	// Load config.json by default
-	if len(os.Args) <= 1 {
-		_, err := os.Stat("config.json")
-		if err == nil {
-			*argConfig = "config.json"
-		}
-	}
+	startTime = clock.Now()
 
 	listenDevs = make([]*pcap.Device, 0)
 
 	listeners = make([]net.Listener, 0)
+	hellos = make(map[net.Conn]*pcap.Hello)
+	clientAddrs = make(map[net.Conn]net.IP)
+	clientIDs = make(map[net.Conn]string)
 	c = make(chan pcap.ConnBytes, 1000)
+	prioQueue = make(chan pcap.ConnBytes, 1000)
+	egressQueue = make(chan *egressPacket, 1000)
 	defrag = pcap.NewEasyDefragmenter()
 	defrag.SetDeadline(keepFragments)
+	arpCache = pcap.NewARPCache()
+	arpCache.SetDeadline(keepARP)
 	tcpPortPool = make([]time.Time, 16384)
-	udpPortPool = make([]time.Time, 16384)
+	tcpStates = make([]uint8, 16384)
+	udpPortPool = make([]time.Time, 65536)
 	icmpv4IdPool = make([]time.Time, 65536)
-	patMap = make(map[quintuple]uint16)
-	nat = make(map[pcap.NATGuide]*natIndicator)
+	nextPorts = make(map[gopacket.LayerType]uint16)
+	portPools = make(map[gopacket.LayerType][]time.Time)
+	for _, t := range pcap.Transports() {
+		if t != layers.LayerTypeTCP && t != layers.LayerTypeUDP {
+			portPools[t] = make([]time.Time, 16384)
+		}
+	}
 	dns = make(map[string]string)
+	proxyFlows = make(map[string]*proxyFlow)
 }
 
 func main() {
@@ -183,6 +555,17 @@ func main() {
 		gateway net.IP
 	)
 
+	// Parse arguments, which is not in init so that tests can parse their own
+	flag.Parse()
+
+	// Load config.json by default
+	if len(os.Args) <= 1 {
+		_, err := os.Stat("config.json")
+		if err == nil {
+			*argConfig = "config.json"
+		}
+	}
+
 	// Configuration file
 	if *argConfig != "" {
 		cfg, err = config.ParseFile(*argConfig)
@@ -202,6 +585,7 @@ func main() {
 		cfg.Monitor = *argMonitor
 		cfg.Verbose = *argVerbose
 		cfg.Log = *argLog
+		cfg.DumpDrops = *argDumpDrops
 		cfg.MTU = *argMTU
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
@@ -215,8 +599,72 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.Fingerprint = *argFingerprint
+		cfg.WindowScale = *argWindowScale
+		cfg.Timestamps = *argTimestamps
+		cfg.ECN = *argECN
+		cfg.IPId = *argIPId
+		cfg.ReplayWindow = *argReplayWindow
+		cfg.Padding = *argPadding
+		cfg.BatchDelay = *argBatchDelay
+		cfg.BatchSize = *argBatchSize
+		cfg.PinThread = *argPinThread
+		cfg.Egress = *argEgress
+		cfg.LazyDecode = *argLazyDecode
+		cfg.MaxLatency = *argMaxLatency
+		cfg.SplitUpstream = *argSplitUpstream
+		cfg.VLAN = *argVLAN
+		cfg.WaitDevs = *argWaitDevs
 		cfg.Fragment = *argFragment
+		cfg.UpMTU = *argUpMTU
 		cfg.Port = *argPort
+		cfg.DecrementTTL = *argDecrementTTL
+		cfg.ExpectedFlows = *argExpectedFlows
+		cfg.Pool = *argPool
+		cfg.ClientSubnets = splitArg(*argClientSubnets)
+		cfg.PayloadLimits = splitArg(*argPayloadLimits)
+		cfg.AllowPorts = splitArg(*argAllowPorts)
+		cfg.Priority = splitArg(*argPriority)
+		cfg.ProxyProtocol = splitArg(*argProxyProtocol)
+		cfg.PreserveUDP = *argPreserveUDP
+		cfg.HashPorts = *argHashPorts
+		cfg.HashSeed = *argHashSeed
+		cfg.AnswerPing = *argAnswerPing
+		cfg.MaxMemory = *argMaxMemory
+		cfg.Housekeeping = *argHousekeeping
+		cfg.FlowExport = *argFlowExport
+		cfg.Checksums = *argChecksums
+		cfg.ClientFlows = *argClientFlows
+		cfg.ClientBytes = *argClientBytes
+		cfg.EgressRate = *argEgressRate
+		cfg.EgressBurst = *argEgressBurst
+		cfg.Admin = *argAdmin
+		cfg.AdminToken = *argAdminToken
+		cfg.NATConfig = *config.NewNATConfig()
+		cfg.NATConfig.TCPSYN = *argNATTCPSYN
+		cfg.NATConfig.TCPEstablished = *argNATTCPEst
+		cfg.NATConfig.TCPClosing = *argNATTCPClosing
+		cfg.NATConfig.UDP = *argNATUDP
+		cfg.NATConfig.ICMP = *argNATICMP
+		cfg.HandshakeRate = *argHandshakeRate
+		cfg.SYNCookies = *argSYNCookies
+		cfg.MaxClients = *argMaxClients
+		cfg.RSTProbes = *argRSTProbes
+		cfg.Resume = *argResume
+		cfg.ClientKeys = splitArg(*argClientKeys)
+		cfg.KeepAlive = *argKeepAlive
+		cfg.State = *argState
+		cfg.Gateways = splitArg(*argGateways)
+		cfg.SNIGateways = splitArg(*argSNIGateways)
+		cfg.GratuitousARP = *argGratuitousARP
+		cfg.LogUnmatched = *argLogUnmatched
+		cfg.LogNAT = *argLogNAT
+		cfg.LogFormat = *argLogFormat
+		cfg.Unsupported = *argUnsupported
+		cfg.IPOptions = *argIPOptions
+		cfg.DropSrcRoute = *argDropSrcRoute
+		cfg.Multicast = *argMulticast
+		cfg.KillSwitch = *argKillSwitch
 	}
 
 	// Log
@@ -269,6 +717,9 @@ func main() {
 		if gateway == nil {
 			log.Fatalln(fmt.Errorf("invalid gateway %s", cfg.Gateway))
 		}
+		if gateway.To4() == nil {
+			log.Fatalln(fmt.Errorf("gateway %s in ipv6 not support", cfg.Gateway))
+		}
 	}
 	if cfg.Monitor < 0 || cfg.Monitor > 65535 {
 		log.Fatalln(fmt.Errorf("monitor port %d out of range", cfg.Monitor))
@@ -300,18 +751,88 @@ func main() {
 	if cfg.KCPConfig.NC < 0 {
 		log.Fatalln(fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC))
 	}
-	if cfg.Fragment < 576 || cfg.Fragment > pcap.MaxMTU {
+	if cfg.ReplayWindow < 0 || cfg.ReplayWindow > pcap.MaxReplayWindow {
+		log.Fatalln(fmt.Errorf("replay window %d out of range", cfg.ReplayWindow))
+	}
+	if cfg.DumpDrops < 0 {
+		log.Fatalln(fmt.Errorf("dump drops %d out of range", cfg.DumpDrops))
+	}
+	if cfg.BatchDelay < 0 {
+		log.Fatalln(fmt.Errorf("batch delay %d out of range", cfg.BatchDelay))
+	}
+	if cfg.MaxLatency < 0 {
+		log.Fatalln(fmt.Errorf("max latency %d out of range", cfg.MaxLatency))
+	}
+	if cfg.BatchSize <= 0 || cfg.BatchSize > pcap.MaxCoalesceSize {
+		log.Fatalln(fmt.Errorf("batch size %d out of range", cfg.BatchSize))
+	}
+	if cfg.Fragment != 0 && (cfg.Fragment < 576 || cfg.Fragment > pcap.MaxMTU) {
 		log.Fatalln(fmt.Errorf("fragment %d out of range", cfg.Fragment))
 	}
+	if cfg.UpMTU != 0 && (cfg.UpMTU < 576 || cfg.UpMTU > pcap.MaxMTU) {
+		log.Fatalln(fmt.Errorf("upstream mtu %d out of range", cfg.UpMTU))
+	}
 	if cfg.Port == 0 {
 		log.Fatalln("Please provide listen port by -p port.")
 	}
 	if cfg.Port <= 0 || cfg.Port > 65535 {
 		log.Fatalln(fmt.Errorf("listen port %d out of range", cfg.Port))
 	}
+	if cfg.ExpectedFlows < 0 {
+		log.Fatalln(fmt.Errorf("expected flows %d out of range", cfg.ExpectedFlows))
+	}
+	if cfg.MaxMemory < 0 {
+		log.Fatalln(fmt.Errorf("max memory %d out of range", cfg.MaxMemory))
+	}
+	if cfg.Housekeeping <= 0 {
+		log.Fatalln(fmt.Errorf("housekeeping interval %d out of range", cfg.Housekeeping))
+	}
+	if cfg.ClientFlows < 0 {
+		log.Fatalln(fmt.Errorf("client flows %d out of range", cfg.ClientFlows))
+	}
+	if cfg.ClientBytes < 0 {
+		log.Fatalln(fmt.Errorf("client bytes %d out of range", cfg.ClientBytes))
+	}
+	if cfg.EgressRate < 0 {
+		log.Fatalln(fmt.Errorf("egress rate %d out of range", cfg.EgressRate))
+	}
+	if cfg.EgressBurst < 0 || (cfg.EgressBurst > 0 && cfg.EgressBurst < cfg.Fragment) {
+		log.Fatalln(fmt.Errorf("egress burst %d out of range", cfg.EgressBurst))
+	}
+	if cfg.KeepAlive < 0 {
+		log.Fatalln(fmt.Errorf("keepalive %d out of range", cfg.KeepAlive))
+	}
+	if cfg.GratuitousARP < 0 {
+		log.Fatalln(fmt.Errorf("gratuitous arp %d out of range", cfg.GratuitousARP))
+	}
+	if cfg.KillSwitch < 0 {
+		log.Fatalln(fmt.Errorf("kill switch %d out of range", cfg.KillSwitch))
+	}
+	if cfg.Admin != "" && cfg.AdminToken == "" {
+		log.Fatalln(errors.New("missing admin token"))
+	}
+	if cfg.NATConfig.TCPSYN <= 0 {
+		log.Fatalln(fmt.Errorf("nat tcp syn %d out of range", cfg.NATConfig.TCPSYN))
+	}
+	if cfg.NATConfig.TCPEstablished <= 0 {
+		log.Fatalln(fmt.Errorf("nat tcp established %d out of range", cfg.NATConfig.TCPEstablished))
+	}
+	if cfg.NATConfig.TCPClosing <= 0 {
+		log.Fatalln(fmt.Errorf("nat tcp closing %d out of range", cfg.NATConfig.TCPClosing))
+	}
+	if cfg.NATConfig.UDP <= 0 {
+		log.Fatalln(fmt.Errorf("nat udp %d out of range", cfg.NATConfig.UDP))
+	}
+	if cfg.NATConfig.ICMP <= 0 {
+		log.Fatalln(fmt.Errorf("nat icmp %d out of range", cfg.NATConfig.ICMP))
+	}
 
 	// Find devices
-	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
+	if cfg.WaitDevs {
+		listenDevs, err = pcap.WaitListenDevs(cfg.ListenDevs)
+	} else {
+		listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
+	}
 	if err != nil {
 		log.Fatalln(fmt.Errorf("find listen devices: %w", err))
 	}
@@ -332,7 +853,11 @@ func main() {
 		log.Fatalln(errors.New("cannot determine listen device"))
 	}
 
-	upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
+	if cfg.WaitDevs {
+		upDev, gatewayDev, err = pcap.WaitUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
+	} else {
+		upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
+	}
 	if err != nil {
 		log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
 	}
@@ -343,7 +868,7 @@ func main() {
 		log.Fatalln(errors.New("cannot determine upstream device"))
 	}
 	if gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine gateway device"))
+		log.Infoln("Cannot determine gateway device, destinations are regarded as directly connected")
 	}
 
 	// Mode
@@ -415,17 +940,60 @@ func main() {
 
 		// Host HTTP server
 		http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-			b, err := json.Marshal(&struct {
-				Name    string               `json:"name"`
-				Version string               `json:"version"`
-				Time    int                  `json:"time"`
-				Monitor *stat.TrafficMonitor `json:"monitor"`
-			}{
-				Name:    name,
-				Version: versionInfo,
-				Time:    int(time.Now().Sub(startTime).Seconds()),
-				Monitor: monitor,
-			})
+			b, err := json.Marshal(stats())
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+				return
+			}
+
+			// Handle CORS
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+
+			_, err = io.WriteString(w, string(b))
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		})
+		http.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+			ok, reason := healthy()
+			if !ok {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, err := io.WriteString(w, reason)
+				if err != nil {
+					log.Errorln(fmt.Errorf("monitor: %w", err))
+				}
+				return
+			}
+
+			_, err := io.WriteString(w, "ok")
+			if err != nil {
+				log.Errorln(fmt.Errorf("monitor: %w", err))
+			}
+		})
+		http.HandleFunc("/clients", func(w http.ResponseWriter, req *http.Request) {
+			type ClientUsage struct {
+				Client string `json:"client"`
+				Flows  int    `json:"flows"`
+				Queued int64  `json:"queued"`
+			}
+
+			usages := make([]ClientUsage, 0)
+			usageLock.RLock()
+			conns := make([]net.Conn, 0, len(clientQueues))
+			for conn := range clientQueues {
+				conns = append(conns, conn)
+			}
+			usageLock.RUnlock()
+			for _, conn := range conns {
+				name := clientName(conn)
+				usages = append(usages, ClientUsage{
+					Client: name,
+					Flows:  countFlows(name),
+					Queued: atomic.LoadInt64(clientQueue(conn)),
+				})
+			}
+
+			b, err := json.Marshal(usages)
 			if err != nil {
 				log.Errorln(fmt.Errorf("monitor: %w", err))
 				return
@@ -480,6 +1048,28 @@ type IPName struct {
 		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
 	}
 
+	// Admin
+	if cfg.Admin != "" {
+		host, p, err := net.SplitHostPort(cfg.Admin)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse admin address %s: %w", cfg.Admin, err))
+		}
+		// Bind to localhost by default
+		if host == "" {
+			host = "localhost"
+		}
+		addr := net.JoinHostPort(host, p)
+
+		go func() {
+			err := http.ListenAndServe(addr, createAdminHandler(cfg.AdminToken))
+			if err != nil {
+				log.Errorln(fmt.Errorf("admin: %w", err))
+			}
+		}()
+
+		log.Infof("Admin on %s\n", addr)
+	}
+
 	// Mode-related options
 	switch mode {
 	case "faketcp":
@@ -493,111 +1083,690 @@ type IPName struct {
 		if isKCP {
 			log.Infoln("Enable KCP")
 		}
+
+		// Fingerprint
+		err = pcap.SetFingerprint(cfg.Fingerprint)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set fingerprint: %w", err))
+		}
+		if cfg.Fingerprint != pcap.FingerprintNone {
+			log.Infof("Mimic TCP fingerprint of %s\n", cfg.Fingerprint)
+		}
+
+		// Window scale
+		err = pcap.SetWindowScale(cfg.WindowScale)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set window scale: %w", err))
+		}
+		if cfg.WindowScale >= 0 {
+			log.Infof("Announce TCP window scale %d\n", cfg.WindowScale)
+		}
+
+		// Timestamps
+		pcap.SetTimestamps(cfg.Timestamps)
+		if cfg.Timestamps {
+			log.Infoln("Enable TCP timestamps option")
+		}
+
+		// ECN
+		pcap.SetECN(cfg.ECN)
+		if cfg.ECN {
+			log.Infoln("Forward ECN between embedded packets and FakeTCP")
+		}
+
+		// IPv4 identification
+		err = pcap.SetIPId(cfg.IPId)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set ip id: %w", err))
+		}
+		if cfg.IPId != pcap.IPIdCounter {
+			log.Infof("Scrub IPv4 identification to %s\n", cfg.IPId)
+		}
+
+		// Replay protection
+		err = pcap.SetReplayWindow(cfg.ReplayWindow)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set replay window: %w", err))
+		}
+		if cfg.ReplayWindow > 0 {
+			log.Infof("Enable replay protection with window of %d packets\n", cfg.ReplayWindow)
+		}
+
+		// Padding
+		err = pcap.SetPadding(cfg.Padding)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set padding: %w", err))
+		}
+		if cfg.Padding != "" {
+			log.Infof("Pad packets by %s\n", cfg.Padding)
+		}
+
+		// SYN flood mitigation
+		err = pcap.SetHandshakeRate(cfg.HandshakeRate)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set handshake rate: %w", err))
+		}
+		if cfg.HandshakeRate > 0 {
+			log.Infof("Limit handshakes to %d per second\n", cfg.HandshakeRate)
+		}
+		err = pcap.SetSYNCookies(cfg.SYNCookies)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set syn cookies: %w", err))
+		}
+		if cfg.SYNCookies {
+			log.Infoln("Answer handshakes with SYN cookies")
+		}
+		err = pcap.SetMaxClients(cfg.MaxClients)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set max clients: %w", err))
+		}
+		if cfg.MaxClients > 0 {
+			log.Infof("Limit clients to %d per listener\n", cfg.MaxClients)
+		}
+		pcap.SetRSTProbes(cfg.RSTProbes)
+		if cfg.RSTProbes {
+			log.Infoln("Reset clients not speaking the carrier")
+		}
+		resumeConns = cfg.Resume
+		pcap.SetResume(resumeConns)
+		if resumeConns {
+			log.Infoln("Resume established connections of unknown clients")
+		}
+
+		// Keepalive
+		keepAlive = time.Duration(cfg.KeepAlive) * time.Second
+		if keepAlive > 0 {
+			log.Infof("Send keepalive probes every %d seconds\n", cfg.KeepAlive)
+		}
 	case "tcp":
 		break
 	default:
 		log.Fatalln(fmt.Errorf("mode %s not support", mode))
 	}
 
-	// Fragment
-	fragment = cfg.Fragment
-	log.Infof("Set fragment to %d Bytes\n", fragment)
-
-	// Port
-	port = uint16(cfg.Port)
+	// Dump dropped packets
+	log.SetDump(cfg.DumpDrops)
+	if cfg.DumpDrops > 0 {
+		log.Infof("Dump first %d Bytes of dropped packets\n", cfg.DumpDrops)
+	}
 
-	log.Infof("Proxy from :%d\n", cfg.Port)
+	// Batch
+	batchDelay = time.Duration(cfg.BatchDelay) * time.Millisecond
+	batchSize = cfg.BatchSize
+	if batchDelay > 0 {
+		log.Infof("Coalesce packets into batches of %d Bytes in %d ms\n", batchSize, cfg.BatchDelay)
+	}
 
-	// Wait signals
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		<-sig
-		closeAll()
-		os.Exit(0)
-	}()
+	// Pin thread
+	pinThread = cfg.PinThread
+	if pinThread {
+		log.Infoln("Pin listen handles to threads")
+	}
 
-	// Open pcap
-	err = open()
+	// Egress
+	err = pcap.SetEgress(cfg.Egress)
 	if err != nil {
-		log.Fatalln(fmt.Errorf("open pcap: %w", err))
+		log.Fatalln(fmt.Errorf("set egress: %w", err))
 	}
-}
-
-func open() error {
-	var err error
-
-	// Verify
-	if port <= 0 || port > 65535 {
-		return fmt.Errorf("port %d out of range", port)
+	if cfg.Egress != pcap.EgressPcap {
+		log.Infof("Write packets through %s\n", cfg.Egress)
 	}
-	if len(listenDevs) <= 0 {
-		return errors.New("missing listen device")
+
+	// Lazy decode
+	pcap.SetLazyDecode(cfg.LazyDecode)
+	if cfg.LazyDecode {
+		log.Infoln("Decode captured packets lazily")
 	}
-	if upDev == nil {
-		return errors.New("missing upstream device")
+
+	// Max latency
+	maxLatency = time.Duration(cfg.MaxLatency) * time.Millisecond
+	if maxLatency > 0 {
+		log.Infof("Drop packets in the system for more than %d ms\n", cfg.MaxLatency)
 	}
-	if gatewayDev == nil {
-		return errors.New("missing gateway")
+
+	// Split upstream
+	splitUpstream = cfg.SplitUpstream
+	if splitUpstream {
+		log.Infoln("Write upstream through a separate handle")
 	}
 
-	if len(listenDevs) == 1 {
-		log.Infof("Listen on %s\n", listenDevs[0].String())
-	} else {
-		log.Infoln("Listen on:")
-		for _, dev := range listenDevs {
-			log.Infof("  %s\n", dev.String())
-		}
+	// VLAN
+	if cfg.VLAN < 0 || cfg.VLAN > 4094 {
+		log.Fatalln(fmt.Errorf("vlan %d out of range", cfg.VLAN))
 	}
-	if !gatewayDev.IsLoop() {
-		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
-	} else {
-		log.Infof("Route upstream in %s\n", upDev)
+	vlan = uint16(cfg.VLAN)
+	if vlan > 0 {
+		log.Infof("Tag frames routed upstream with VLAN %d\n", vlan)
 	}
 
-	for _, dev := range listenDevs {
-		var (
-			err      error
-			listener net.Listener
-		)
+	// Upstream MTU
+	if cfg.UpMTU != 0 {
+		upDev.SetMTU(cfg.UpMTU)
+		log.Infof("Set MTU of upstream device %s to %d Bytes\n", upDev.Alias(), cfg.UpMTU)
+	}
 
-		switch mode {
-		case "faketcp":
-			if dev.IsLoop() {
-				if isKCP {
-					listener, err = pcap.ListenFakeTCPWithKCP(dev, dev, port, crypt, mtu, kcpConfig)
-				} else {
-					listener, err = pcap.ListenFakeTCP(dev, dev, port, crypt, mtu)
-				}
-			} else {
-				if isKCP {
-					listener, err = pcap.ListenFakeTCPWithKCP(dev, gatewayDev, port, crypt, mtu, kcpConfig)
-				} else {
-					listener, err = pcap.ListenFakeTCP(dev, gatewayDev, port, crypt, mtu)
-				}
-			}
-		case "tcp":
-			listener, err = pcap.ListenTCP(dev, port, crypt)
-		default:
-			err = fmt.Errorf("mode %s not support", mode)
+	// Fragment
+	fragment = cfg.Fragment
+	if fragment == 0 {
+		fragment = upDev.MTU()
+		if fragment == 0 {
+			log.Fatalln(fmt.Errorf("cannot determine mtu of upstream device %s", upDev.Alias()))
 		}
-		if err != nil {
-			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+		if fragment < 576 || fragment > pcap.MaxMTU {
+			log.Fatalln(fmt.Errorf("mtu %d of upstream device %s out of range", fragment, upDev.Alias()))
 		}
+	}
+	log.Infof("Set fragment to %d Bytes\n", fragment)
 
-		listeners = append(listeners, listener)
+	// TTL
+	decrementTTL = cfg.DecrementTTL
+	if !decrementTTL {
+		log.Infoln("Disable TTL decrement")
 	}
 
-	// Handles for routing upstream
-	upConn, err = pcap.CreateRawConn(upDev, gatewayDev, fmt.Sprintf("ip && (((tcp || udp) && not dst port %d) || icmp || (ip[6:2] & 0x1fff) != 0)", port))
-	if err != nil {
-		return fmt.Errorf("open upstream device %s: %w", upDev.Alias(), err)
+	// Expected flows
+	expectedFlows = cfg.ExpectedFlows
+	if expectedFlows > 0 {
+		log.Infof("Preallocate for %d flows\n", expectedFlows)
 	}
 
+	// Pool
+	if cfg.Pool != "" {
+		pool, err = addr.ParsePool(cfg.Pool)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse pool %s: %w", cfg.Pool, err))
+		}
+		log.Infof("Assign addresses in %s to clients\n", pool.Network())
+	}
+
+	// Client subnets
+	if len(cfg.ClientSubnets) > 0 {
+		subnets := make([]*net.IPNet, 0)
+		for _, s := range cfg.ClientSubnets {
+			_, subnet, err := net.ParseCIDR(s)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("parse client subnet %s: %w", s, err))
+			}
+			if subnet.IP.To4() == nil {
+				log.Fatalln(fmt.Errorf("client subnet %s in ipv6 not support", s))
+			}
+			subnets = append(subnets, subnet)
+		}
+		pcap.SetClientSubnets(subnets)
+
+		log.Infof("Accept clients from %s\n", strings.Join(cfg.ClientSubnets, ", "))
+	}
+
+	// Policy
+	pol, err := parsePolicy(cfg)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse policy: %w", err))
+	}
+	policies.Store(pol)
+	logPolicy(cfg)
+
+	// Priority
+	for _, s := range cfg.Priority {
+		if strings.HasPrefix(strings.ToLower(s), "dscp:") {
+			dscp, err := strconv.ParseUint(s[len("dscp:"):], 10, 6)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("parse priority %s: %w", s, err))
+			}
+			if prioDSCPs == nil {
+				prioDSCPs = make(map[uint8]bool)
+			}
+			prioDSCPs[uint8(dscp)] = true
+			continue
+		}
+
+		t, r, err := parsePortRange(s)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse priority %s: %w", s, err))
+		}
+		if prioPorts == nil {
+			prioPorts = make(map[gopacket.LayerType][]*portRange)
+		}
+		prioPorts[t] = append(prioPorts[t], r)
+	}
+	if len(cfg.Priority) > 0 {
+		log.Infof("Forward packets to %s with priority\n", strings.Join(cfg.Priority, ", "))
+	}
+
+	// PROXY protocol
+	for _, s := range cfg.ProxyProtocol {
+		if proxyDsts == nil {
+			proxyDsts = make(map[string]bool)
+		}
+
+		ip := net.ParseIP(s)
+		if ip != nil {
+			proxyDsts[ip.String()] = true
+			continue
+		}
+
+		dst, err := addr.ParseTCPAddr(s)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse proxy protocol destination %s: %w", s, err))
+		}
+		proxyDsts[dst.String()] = true
+	}
+	if len(cfg.ProxyProtocol) > 0 {
+		log.Infof("Send PROXY protocol headers to %s\n", strings.Join(cfg.ProxyProtocol, ", "))
+	}
+
+	// Preserve UDP port
+	preserveUDP = cfg.PreserveUDP
+	if preserveUDP {
+		log.Infoln("Preserve source ports of UDP packets if possible")
+	}
+
+	// Hash ports
+	hashPorts = cfg.HashPorts
+	if hashPorts {
+		log.Infoln("Distribute ports and IDs by hashes of flows")
+	}
+	if cfg.HashSeed != "" {
+		hashSeed = []byte(cfg.HashSeed)
+		if hashPorts {
+			log.Infoln("Hash flows with a secret seed")
+		}
+	} else if hashPorts {
+		hashSeed, err = newHashSeed()
+		if err != nil {
+			log.Fatalln(fmt.Errorf("generate hash seed: %w", err))
+		}
+	}
+
+	// Answer ping
+	answerPing = cfg.AnswerPing
+	if answerPing {
+		log.Infoln("Answer ICMP echo requests to listen devices")
+	}
+
+	// Max memory
+	maxMemory = cfg.MaxMemory
+	if maxMemory > 0 {
+		log.Infof("Bound memory of NAT and fragments by %d Bytes\n", maxMemory)
+	}
+
+	// Housekeeping
+	housekeeping = time.Duration(cfg.Housekeeping) * time.Millisecond
+
+	// Flow export
+	if cfg.FlowExport != "" {
+		flowExporter, err = stat.NewFlowExporter(cfg.FlowExport)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("flow export: %w", err))
+		}
+		flowRecords = make(map[quintuple]*stat.FlowRecord)
+
+		log.Infof("Export flows to %s\n", cfg.FlowExport)
+	}
+
+	// Verify checksums
+	pcap.SetVerifyChecksums(cfg.Checksums)
+	if cfg.Checksums {
+		log.Infoln("Verify checksums of received packets")
+	}
+
+	// Client limits
+	clientFlows = make(map[string]int)
+	clientQueues = make(map[net.Conn]*int64)
+
+	// Egress
+	setEgress(cfg.EgressRate, cfg.EgressBurst)
+
+	// NAT timeout
+	natConfig = &cfg.NATConfig
+
+	// State
+	stateFile = cfg.State
+	if stateFile != "" {
+		log.Infof("Save and restore NAT state in %s\n", stateFile)
+	}
+
+	// Gateways
+	if len(cfg.Gateways) > 0 && gatewayDev == nil {
+		log.Fatalln(errors.New("gateways need a gateway device"))
+	}
+	for _, s := range cfg.Gateways {
+		gw, err := parseWeightedGateway(s)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse gateway %s: %w", s, err))
+		}
+		if !upDev.IPAddr().Contains(gw.ip) {
+			log.Fatalln(fmt.Errorf("gateway %s not in the domain of upstream device %s", gw.ip, upDev.Alias()))
+		}
+		gateways = append(gateways, gw)
+		totalWeight = totalWeight + gw.weight
+	}
+	if len(cfg.Gateways) > 0 {
+		log.Infof("Distribute flows across gateways %s\n", strings.Join(cfg.Gateways, ", "))
+	}
+	if len(cfg.SNIGateways) > 0 && gatewayDev == nil {
+		log.Fatalln(errors.New("sni gateways need a gateway device"))
+	}
+	for _, s := range cfg.SNIGateways {
+		gw, err := parseNamedGateway(s)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse sni gateway %s: %w", s, err))
+		}
+		if !upDev.IPAddr().Contains(gw.ip) {
+			log.Fatalln(fmt.Errorf("gateway %s not in the domain of upstream device %s", gw.ip, upDev.Alias()))
+		}
+		sniGateways = append(sniGateways, gw)
+	}
+	if len(cfg.SNIGateways) > 0 {
+		log.Infof("Route TLS flows by server names through gateways %s\n", strings.Join(cfg.SNIGateways, ", "))
+	}
+
+	// Client keys
+	if len(cfg.ClientKeys) > 0 {
+		clientKeys = make(map[string]string)
+		names := make([]string, 0, len(cfg.ClientKeys))
+		for _, s := range cfg.ClientKeys {
+			name, key, err := parseClientKey(s)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("parse client key %s: %w", s, err))
+			}
+			clientKeys[string(key)] = name
+			names = append(names, name)
+		}
+		log.Infof("Allow clients %s\n", strings.Join(names, ", "))
+	}
+
+	// Gratuitous ARP
+	gratuitousARP = time.Duration(cfg.GratuitousARP) * time.Second
+	if gratuitousARP > 0 {
+		log.Infof("Announce upstream address %s every %d seconds\n", upDev.IPAddr().IP, cfg.GratuitousARP)
+	}
+
+	// Log unmatched
+	logUnmatched = cfg.LogUnmatched
+	if logUnmatched {
+		log.Infoln("Log upstream packets not matching any flow")
+	}
+	logNAT = cfg.LogNAT
+	if logNAT {
+		log.Infoln("Log allocation and release of flows in NAT")
+	}
+
+	// Log format
+	switch cfg.LogFormat {
+	case logFormatText:
+	case logFormatJSON:
+		if flowRecords == nil {
+			flowRecords = make(map[quintuple]*stat.FlowRecord)
+		}
+
+		log.Infoln("Log events and summaries of flows in JSON")
+	default:
+		log.Fatalln(fmt.Errorf("log format %s not support", cfg.LogFormat))
+	}
+	logFormat = cfg.LogFormat
+
+	// Unsupported protocols
+	switch cfg.Unsupported {
+	case unsupportedLog:
+	case unsupportedDrop:
+		log.Infoln("Drop packets of unsupported protocols silently")
+	default:
+		log.Fatalln(fmt.Errorf("handling %s of unsupported protocols not support", cfg.Unsupported))
+	}
+	unsupported = cfg.Unsupported
+
+	// IP options
+	switch cfg.IPOptions {
+	case ipOptionsStrip:
+	case ipOptionsDrop:
+		log.Infoln("Drop packets with IP options")
+	case ipOptionsPreserve:
+		log.Infoln("Preserve IP options")
+	default:
+		log.Fatalln(fmt.Errorf("handling %s of ip options not support", cfg.IPOptions))
+	}
+	ipOptions = cfg.IPOptions
+	dropSrcRoute = cfg.DropSrcRoute
+	if dropSrcRoute {
+		log.Infoln("Drop packets with source routing options")
+	}
+
+	// Multicast and broadcast
+	switch cfg.Multicast {
+	case multicastDrop:
+	case multicastForward:
+		log.Infoln("Forward packets to multicast or broadcast addresses without NAT")
+	default:
+		log.Fatalln(fmt.Errorf("handling %s of multicast not support", cfg.Multicast))
+	}
+	multicast = cfg.Multicast
+
+	// Kill switch
+	killSwitch = time.Duration(cfg.KillSwitch) * time.Second
+	if killSwitch > 0 {
+		log.Infof("Drop all traffic while the tunnel is unhealthy or handshakes to the upstream are unanswered in %d seconds\n", cfg.KillSwitch)
+	}
+
+	// Port
+	port = uint16(cfg.Port)
+
+	log.Infof("Proxy from :%d\n", cfg.Port)
+
+	// Reload policy
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := reloadPolicy(*argConfig)
+			if err != nil {
+				log.Errorln(fmt.Errorf("reload policy: %w", err))
+			}
+		}
+	}()
+
+	// Wait signals
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	// Open pcap
+	err = open(ctx)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("open pcap: %w", err))
+	}
+
+	exportFlows(clock.Now(), true)
+	if stateFile != "" {
+		err := saveState(stateFile)
+		if err != nil {
+			log.Errorln(fmt.Errorf("save state: %w", err))
+		}
+	}
+	flushFlows()
+}
+
+// open opens handles and handles packets until the context is cancelled or the upstream is closed unexpectedly. All
+// handles are closed and all goroutines handling packets have exited when it returns, and packets left in queues are
+// discarded.
+func open(ctx context.Context) error {
+	var err error
+
+	// Verify
+	if port <= 0 || port > 65535 {
+		return fmt.Errorf("port %d out of range", port)
+	}
+	if len(listenDevs) <= 0 {
+		return fmt.Errorf("listen device: %w", pcap.ErrMissingDevice)
+	}
+	if upDev == nil {
+		return fmt.Errorf("upstream device: %w", pcap.ErrMissingDevice)
+	}
+
+	if len(listenDevs) == 1 {
+		log.Infof("Listen on %s\n", listenDevs[0].String())
+	} else {
+		log.Infoln("Listen on:")
+		for _, dev := range listenDevs {
+			log.Infof("  %s\n", dev.String())
+		}
+	}
+	if gatewayDev == nil {
+		log.Infof("Route upstream from %s directly\n", upDev)
+	} else if !gatewayDev.IsLoop() {
+		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
+	} else {
+		log.Infof("Route upstream in %s\n", upDev)
+	}
+
+	for _, dev := range listenDevs {
+		var (
+			err      error
+			listener net.Listener
+		)
+
+		switch mode {
+		case "faketcp":
+			if dev.IsLoop() {
+				if isKCP {
+					listener, err = pcap.ListenFakeTCPWithKCP(dev, dev, port, crypt, mtu, kcpConfig)
+				} else {
+					listener, err = pcap.ListenFakeTCP(dev, dev, port, crypt, mtu)
+				}
+			} else {
+				if isKCP {
+					listener, err = pcap.ListenFakeTCPWithKCP(dev, gatewayDev, port, crypt, mtu, kcpConfig)
+				} else {
+					listener, err = pcap.ListenFakeTCP(dev, gatewayDev, port, crypt, mtu)
+				}
+			}
+		case "tcp":
+			listener, err = pcap.ListenTCP(dev, port, crypt)
+		default:
+			err = fmt.Errorf("mode %s not support", mode)
+		}
+		if err != nil {
+			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+		}
+
+		listeners = append(listeners, listener)
+	}
+
+	// Handles for answering ping
+	if answerPing {
+		for _, dev := range listenDevs {
+			conn, err := pcap.CreateRawConn(dev, dev, pcap.EchoFilter)
+			if err != nil {
+				return fmt.Errorf("open echo device %s: %w", dev.Alias(), err)
+			}
+
+			echoConns = append(echoConns, conn)
+		}
+	}
+
+	// Preallocate NAT
+	patMap = make(map[natKey]uint16, expectedFlows)
+	nat = make(map[pcap.NATGuide]*natIndicator, expectedFlows)
+	sniFlows = make(map[pcap.NATGuide]net.IP)
+
+	// Restore NAT state
+	if stateFile != "" {
+		err := restoreState(stateFile)
+		if err != nil {
+			log.Errorln(fmt.Errorf("restore state: %w", err))
+		}
+	}
+
+	// Handles for routing upstream
+	others := "icmp || (ip[6:2] & 0x1fff) != 0"
+	if tf := pcap.TransportFilter(); tf != "" {
+		others = others + " || " + tf
+	}
+	upFilter = fmt.Sprintf("(ip && (((tcp || udp) && not dst port %d) || %s)) || arp[6:2] = 2 || arp[14:4] = arp[24:4]", port, others)
+	if vlan > 0 {
+		upFilter = fmt.Sprintf("%s || (vlan %d && (%s))", upFilter, vlan, upFilter)
+	}
+	conn, err := openUpstream(upDev, gatewayDev)
+	if err != nil {
+		return fmt.Errorf("open upstream device %s: %w", upDev.Alias(), err)
+	}
+	upConn.Store(conn)
+	storeGatewayMAC(gatewayDev)
+
+	// Announce the upstream address in advance
+	announceAddr(clock.Now())
+
+	return serve(ctx)
+}
+
+// serve handles packets from clients and the upstream with handles opened, until the context is cancelled or the
+// upstream is closed unexpectedly. All handles are closed and goroutines are waited for before it returns.
+func serve(ctx context.Context) error {
+	// Close on cancellation, or the upstream is closed unexpectedly
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		<-ctx.Done()
+		closeAll()
+	}()
+
+	// Housekeeping
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		housekeep(ctx, housekeeping)
+	}()
+
+	// Egress writer
+	handlers.Add(1)
+	go func() {
+		defer handlers.Done()
+		writeEgress(ctx)
+	}()
+
 	// Start handling
+	for _, conn := range echoConns {
+		conn := conn
+		handlers.Add(1)
+		go func() {
+			defer handlers.Done()
+			for {
+				packet, err := conn.ReadPacket()
+				if err != nil {
+					if isClosed {
+						return
+					}
+					log.Errorln(fmt.Errorf("read echo in device %s: %w", conn.LocalDev().Alias(), err))
+					continue
+				}
+
+				err = recoverHandle(func() error {
+					return handleEcho(packet, conn)
+				})
+				if err != nil {
+					log.Errorln(fmt.Errorf("handle echo in device %s: %w", conn.LocalDev().Alias(), err))
+					log.Verboseln(packet)
+					continue
+				}
+			}
+		}()
+	}
 	for i := 0; i < len(listeners); i++ {
 		listener := listeners[i]
+		cpu := i % runtime.NumCPU()
+		pool := pcap.NewBufferPool()
+		handlers.Add(1)
 		go func() {
+			defer handlers.Done()
+			if pinThread {
+				pin(cpu)
+			}
+
 			for {
 				conn, err := listener.Accept()
 				if err != nil {
@@ -623,77 +1792,598 @@ func open() error {
 				default:
 					break
 				}
+				if batchDelay > 0 {
+					conn = pcap.NewCoalescedConn(conn, batchDelay, batchSize)
+				}
 
 				log.Infof("Connect from client %s\n", conn.RemoteAddr().String())
 
+				if !addClientConn(conn) {
+					conn.Close()
+					return
+				}
+
+				handlers.Add(1)
 				go func() {
-					b := make([]byte, pcap.IPv4MaxSize)
-					for {
-						n, err := conn.Read(b)
-						if err != nil {
-							if isClosed {
-								return
-							}
-							if errors.Is(err, io.EOF) {
-								log.Infof("Disconnect from client %s\n", conn.RemoteAddr())
-								return
-							}
-							log.Errorln(fmt.Errorf("read listen: %w", err))
-							continue
-						}
+					defer handlers.Done()
+					defer removeClientConn(conn)
 
-						newB := make([]byte, n)
-						copy(newB, b[:n])
-						c <- pcap.ConnBytes{
-							Bytes: newB,
-							Conn:  conn,
-						}
-					}
+					readClient(ctx, conn, cpu, pool)
 				}()
 			}
 		}()
 	}
 
+	// Packets are handled in a CPU next to ones of listeners
+	handlers.Add(1)
 	go func() {
-		for cab := range c {
-			err := handleListen(cab.Bytes, cab.Conn)
-			if err != nil {
-				log.Errorln(fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
-				log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
-				continue
-			}
-		}
+		defer handlers.Done()
+		loopListen(ctx, len(listeners)%runtime.NumCPU())
+	}()
+
+	err := loopUpstream()
+
+	// Wait for goroutines
+	cancel()
+	exited := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(exited)
 	}()
+	select {
+	case <-exited:
+	case <-clock.After(shutdownTimeout):
+		log.Errorln(errors.New("wait for goroutines: timeout"))
+	}
+	n := drainQueues()
+	if n > 0 {
+		log.Verbosef("Discard %d packets left in queues\n", n)
+	}
+
+	return err
+}
+
+// readClient reads packets from the client and queues them for handling until the client is disconnected or the
+// context is cancelled. Packets are copied to buffers from the pool of the listen handle, and the goroutine is pinned to
+// the CPU of the listen handle if pinning is enabled.
+func readClient(ctx context.Context, conn net.Conn, cpu int, pool *pcap.BufferPool) {
+	// The thread is not unlocked, so it exits with the goroutine instead of returning to the scheduler with its affinity
+	if pinThread {
+		pin(cpu)
+	}
 
+	b := make([]byte, pcap.IPv4MaxSize)
 	for {
-		packet, err := upConn.ReadPacket()
+		n, err := conn.Read(b)
+		if err != nil {
+			if isClosed {
+				return
+			}
+			if errors.Is(err, io.EOF) {
+				// Flows of the client are reclaimed by the handler after its queued packets, which would distribute
+				// flows again otherwise
+				select {
+				case c <- pcap.ConnBytes{Conn: conn, Time: clock.Now()}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			log.Errorln(fmt.Errorf("read listen: %w", err))
+			continue
+		}
+
+		// Limit queued packets of the client
+		if !admitQueue(conn, n, policies.Load().(*policy).maxQueued) {
+			log.Verbosef("Drop a packet from client %s for queue (%d Bytes)\n", conn.RemoteAddr(), n)
+			log.Dump("queue", b[:n])
+			continue
+		}
+
+		newB := pool.Get(n)
+		copy(newB, b[:n])
+		cab := pcap.ConnBytes{
+			Bytes: newB,
+			Conn:  conn,
+			Time:  clock.Now(),
+			Pool:  pool,
+		}
+		queue := c
+		if isPriority(newB) {
+			queue = prioQueue
+		}
+		select {
+		case queue <- cab:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// loopListen handles packets queued from clients until the context is cancelled. The goroutine is pinned to the CPU
+// if pinning is enabled.
+func loopListen(ctx context.Context, cpu int) {
+	if pinThread {
+		pin(cpu)
+	}
+
+	for {
+		// Packets with priority are always handled ahead of others
+		var (
+			cab    pcap.ConnBytes
+			isPrio bool
+		)
+		select {
+		case cab = <-prioQueue:
+			isPrio = true
+		default:
+			select {
+			case cab = <-prioQueue:
+				isPrio = true
+			case cab = <-c:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// Disconnection
+		if cab.Bytes == nil {
+			disconnect(cab.Conn)
+			continue
+		}
+
+		// Drop packets queued for too long, which are worse delivered late than dropped
+		if maxLatency > 0 && clock.Now().Sub(cab.Time) > maxLatency {
+			releaseQueue(cab.Conn, len(cab.Bytes))
+			atomic.AddUint64(&lateDrops, 1)
+			if isPrio {
+				atomic.AddUint64(&prioLate, 1)
+			}
+			log.Verbosef("Drop a packet from client %s for latency (%d Bytes)\n", cab.Conn.RemoteAddr(), len(cab.Bytes))
+			log.Dump("latency", cab.Bytes)
+			putBytes(cab)
+			continue
+		}
+
+		err := recoverHandle(func() error {
+			return handleListen(cab.Bytes, cab.Conn)
+		})
+		releaseQueue(cab.Conn, len(cab.Bytes))
+		if err != nil {
+			log.Errorln(fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
+			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
+			log.Dump("error", cab.Bytes)
+		}
+		putBytes(cab)
+	}
+}
+
+// putBytes returns the bytes handled to their pool.
+func putBytes(cab pcap.ConnBytes) {
+	if cab.Pool != nil {
+		cab.Pool.Put(cab.Bytes)
+	}
+}
+
+// loopUpstream handles packets from the upstream until it is closed.
+func loopUpstream() error {
+	atomic.StoreInt32(&upLooping, 1)
+	defer atomic.StoreInt32(&upLooping, 0)
+	for {
+		conn := upstream()
+		packet, err := conn.ReadPacket()
 		if err != nil {
 			if isClosed {
 				return nil
 			}
-			log.Errorln(fmt.Errorf("read upstream in device %s: %w", upConn.LocalDev().Alias(), err))
+			// The handle is closed after migrating to another upstream device
+			if conn != upstream() {
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				// Tear down listeners for the upstream will never recover
+				return fmt.Errorf("upstream device %s closed unexpectedly: %w", conn.LocalDev().Alias(), err)
+			}
+			log.Errorln(fmt.Errorf("read upstream in device %s: %w", conn.LocalDev().Alias(), err))
 			continue
 		}
 
-		err = handleUpstream(packet)
+		err = recoverHandle(func() error {
+			return handleUpstream(packet)
+		})
 		if err != nil {
-			log.Errorln(fmt.Errorf("handle upstream in device %s: %w", upConn.LocalDev().Alias(), err))
+			log.Errorln(fmt.Errorf("handle upstream in device %s: %w", conn.LocalDev().Alias(), err))
 			log.Verboseln(packet)
+			log.Dump("error", packet.Data())
 			continue
 		}
 	}
 }
 
+// upstream returns the handle for routing upstream, which is replaced when migrating to another device.
+func upstream() *pcap.RawConn {
+	conn, _ := upConn.Load().(*pcap.RawConn)
+
+	return conn
+}
+
+// openUpstream opens a handle for routing upstream in the device.
+func openUpstream(dev, gwDev *pcap.Device) (*pcap.RawConn, error) {
+	var (
+		err  error
+		conn *pcap.RawConn
+	)
+
+	if splitUpstream {
+		conn, err = pcap.CreateSplitRawConn(dev, gwDev, upFilter)
+	} else {
+		conn, err = pcap.CreateRawConn(dev, gwDev, upFilter)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.SetVLAN(vlan)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("set vlan: %w", err)
+	}
+
+	return conn, nil
+}
+
+// migrate switches upstream to another device, and returns the count of flows dropped. New flows are refused while
+// migrating. Flows are migrated if the address of the device is unchanged, otherwise they are drained until they end or
+// the timeout elapses, since NAT is bound to the address, and remaining ones are dropped.
+func migrate(name string, timeout time.Duration) (int, error) {
+	migrateLock.Lock()
+	defer migrateLock.Unlock()
+
+	var gateway net.IP
+	if gatewayDev != nil && !gatewayDev.IsLoop() {
+		gateway = gatewayDev.IPAddr().IP
+	}
+	dev, gwDev, err := pcap.FindUpstreamDevAndGatewayDev(name, gateway)
+	if err != nil {
+		return 0, fmt.Errorf("find upstream device and gateway device: %w", err)
+	}
+	if dev == nil {
+		return 0, errors.New("cannot determine upstream device")
+	}
+	if dev.IPAddr() == nil || dev.IPAddr().IP.To4() == nil {
+		return 0, &requestError{Err: fmt.Errorf("missing ipv4 address of device %s", dev.Alias())}
+	}
+
+	return switchUpstream(dev, gwDev, timeout, openUpstream)
+}
+
+// switchUpstream switches upstream to the device and the gateway device opened by open, and returns the count of flows
+// dropped. It must be called while migrating.
+func switchUpstream(dev, gwDev *pcap.Device, timeout time.Duration, open func(dev, gwDev *pcap.Device) (*pcap.RawConn, error)) (int, error) {
+	if !isPaused() {
+		pause()
+		defer resume()
+	}
+
+	isSameIP := dev.IPAddr().IP.Equal(upDev.IPAddr().IP)
+	if !isSameIP {
+		log.Infof("Drain flows before migrating upstream to device %s\n", dev.Alias())
+
+		deadline := clock.Now().Add(timeout)
+		for aliveFlows(clock.Now()) > 0 && clock.Now().Before(deadline) {
+			<-clock.After(100 * time.Millisecond)
+		}
+	}
+
+	conn, err := open(dev, gwDev)
+	if err != nil {
+		return 0, fmt.Errorf("open upstream device %s: %w", dev.Alias(), err)
+	}
+
+	var dropped int
+	if !isSameIP {
+		dropped = dropFlows("Release migrated")
+	}
+
+	// Devices are only accessed while migrating once started, and others load the handle instead
+	old := upstream()
+	upDev = dev
+	gatewayDev = gwDev
+	storeGatewayMAC(gwDev)
+	upConn.Store(conn)
+	go func() {
+		time.Sleep(closeGrace)
+		old.Close()
+	}()
+
+	log.Infof("Migrate upstream from device %s to %s\n", old.LocalDev().Alias(), dev.Alias())
+	if dropped > 0 {
+		log.Infof("Drop %d flows not drained\n", dropped)
+	}
+	announceAddr(clock.Now())
+
+	return dropped, nil
+}
+
+// aliveFlows returns the count of flows which are not idle.
+func aliveFlows(now time.Time) int {
+	updateFlows(now)
+
+	usageLock.RLock()
+	defer usageLock.RUnlock()
+
+	var n int
+	for _, count := range clientFlows {
+		n = n + count
+	}
+
+	return n
+}
+
+// dropFlows removes all flows from NAT with the event logged, and returns the count of them.
+func dropFlows(event string) int {
+	natLock.Lock()
+	defer natLock.Unlock()
+
+	n := len(patMap)
+	for q, value := range patMap {
+		freeValue(q.src.Protocol, value)
+		logNATEvent(event, q, value)
+	}
+	patMap = make(map[natKey]uint16, expectedFlows)
+	nat = make(map[pcap.NATGuide]*natIndicator, expectedFlows)
+
+	return n
+}
+
+// closeAll closes all handles and connections of clients once.
 func closeAll() {
-	isClosed = true
-	for _, handle := range listeners {
-		if handle != nil {
-			handle.Close()
+	closeOnce.Do(func() {
+		connLock.Lock()
+		isClosed = true
+		for conn := range clientConns {
+			conn.Close()
+		}
+		connLock.Unlock()
+
+		for _, handle := range listeners {
+			if handle != nil {
+				handle.Close()
+			}
+		}
+		for _, conn := range echoConns {
+			conn.Close()
+		}
+		if conn := upstream(); conn != nil {
+			conn.Close()
+		}
+	})
+}
+
+// addClientConn records a connection of a client for closing, and reports false if all handles are closed.
+func addClientConn(conn net.Conn) bool {
+	connLock.Lock()
+	defer connLock.Unlock()
+
+	if isClosed {
+		return false
+	}
+	if clientConns == nil {
+		clientConns = make(map[net.Conn]bool)
+	}
+	clientConns[conn] = true
+
+	return true
+}
+
+func removeClientConn(conn net.Conn) {
+	connLock.Lock()
+	delete(clientConns, conn)
+	connLock.Unlock()
+}
+
+// drainQueues discards packets left in queues, and returns the count of them.
+func drainQueues() int {
+	n := 0
+	for {
+		select {
+		case cab := <-prioQueue:
+			releaseQueue(cab.Conn, len(cab.Bytes))
+		case cab := <-c:
+			releaseQueue(cab.Conn, len(cab.Bytes))
+		case <-egressQueue:
+		default:
+			return n
+		}
+		n++
+	}
+}
+
+// disconnect reclaims flows of a disconnected client with its state.
+func disconnect(conn net.Conn) {
+	n := releaseFlows(conn)
+	if n > 0 {
+		log.Verbosef("Release %d flows of client %s\n", n, conn.RemoteAddr())
+	}
+
+	helloLock.Lock()
+	delete(hellos, conn)
+	delete(clientIDs, conn)
+	ip, ok := clientAddrs[conn]
+	if ok {
+		delete(clientAddrs, conn)
+		pool.Release(ip)
+	}
+	helloLock.Unlock()
+
+	usageLock.Lock()
+	delete(clientQueues, conn)
+	usageLock.Unlock()
+
+	log.Infof("Disconnect from client %s\n", conn.RemoteAddr())
+}
+
+// flushFlows removes all flows from NAT and their states of translation, so nothing is left after shutdown.
+func flushFlows() {
+	n := dropFlows("Release flushed")
+	if n > 0 {
+		log.Verbosef("Flush %d flows\n", n)
+	}
+
+	proxyLock.Lock()
+	proxyFlows = make(map[string]*proxyFlow)
+	proxyLock.Unlock()
+
+	sniLock.Lock()
+	sniFlows = make(map[pcap.NATGuide]net.IP)
+	sniLock.Unlock()
+
+	usageLock.Lock()
+	clientFlows = make(map[string]int)
+	usageLock.Unlock()
+}
+
+func handleEcho(packet gopacket.Packet, conn *pcap.RawConn) error {
+	indicator, err := pcap.ParsePacket(packet)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	ok, err := pcap.WriteEchoReply(conn, indicator)
+	if err != nil {
+		return fmt.Errorf("write echo reply: %w", err)
+	}
+	if ok {
+		log.Verbosef("Reply an ICMPv4 echo request: %s <- %s\n", indicator.DstIP(), indicator.SrcIP())
+	}
+
+	return nil
+}
+
+func handleHello(contents []byte, conn net.Conn) error {
+	// Parse hello
+	hello, err := pcap.ParseHello(contents)
+	if err != nil {
+		return fmt.Errorf("parse hello: %w", err)
+	}
+	if hello.IsServer {
+		return errors.New("unexpected server hello")
+	}
+
+	// Verify
+	err = hello.Verify(mode, isKCP)
+	if err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+
+	// Authenticate
+	var id string
+	if len(clientKeys) > 0 {
+		err = hello.VerifySignature()
+		if err != nil {
+			return fmt.Errorf("authenticate: %w", err)
+		}
+		var ok bool
+		id, ok = clientKeys[string(hello.Key)]
+		if !ok {
+			return fmt.Errorf("key %s not allowed", base64.StdEncoding.EncodeToString(hello.Key))
+		}
+	}
+
+	// Negotiate version, which is resolved once and applied to all following payloads of the client
+	hello.Version = pcap.NegotiateVersion(hello.Version)
+
+	// Assign address
+	var (
+		ip         net.IP
+		isAssigned bool
+	)
+	if pool != nil {
+		helloLock.RLock()
+		ip, isAssigned = clientAddrs[conn]
+		helloLock.RUnlock()
+		if !isAssigned {
+			ip, err = pool.Allocate()
+			if err != nil {
+				return fmt.Errorf("allocate: %w", err)
+			}
+		}
+	}
+
+	// Reply
+	serverHello := pcap.NewServerHello(mode, mtu, isKCP)
+	serverHello.Version = hello.Version
+	serverHello.Addr = ip
+	data, err := serverHello.Serialize()
+	if err != nil {
+		if ip != nil && !isAssigned {
+			pool.Release(ip)
+		}
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	_, err = conn.Write(data)
+	if err != nil {
+		if ip != nil && !isAssigned {
+			pool.Release(ip)
+		}
+		return fmt.Errorf("write: %w", err)
+	}
+
+	helloLock.Lock()
+	hellos[conn] = hello
+	if ip != nil {
+		clientAddrs[conn] = ip
+	}
+	if id != "" {
+		clientIDs[conn] = id
+	}
+	helloLock.Unlock()
+
+	// Batch
+	if coalescedConn, ok := conn.(*pcap.CoalescedConn); ok {
+		err = coalescedConn.SetVersion(hello.Version)
+		if err != nil {
+			return fmt.Errorf("set version: %w", err)
 		}
 	}
-	if upConn != nil {
-		upConn.Close()
+
+	if id != "" {
+		log.Infof("Authenticate client %s as %s\n", conn.RemoteAddr(), id)
+	}
+	if ip != nil && !isAssigned {
+		log.Infof("Assign %s to client %s\n", ip, conn.RemoteAddr())
+	}
+
+	log.Verbosef("Receive hello from client %s (version %d, MTU %d)\n", conn.RemoteAddr(), hello.Version, hello.MTU)
+
+	return nil
+}
+
+// resumeHello returns a hello assumed for a client resumed without a hello, like one connected before the server
+// restarts. Batches are accepted from the client, but not sent to it since its version is unknown.
+func resumeHello(conn net.Conn) (*pcap.Hello, error) {
+	if !resumeConns {
+		return nil, errors.New("missing hello")
+	}
+	if len(clientKeys) > 0 {
+		return nil, errors.New("missing hello for authentication")
+	}
+
+	hello := pcap.NewClientHello(mode, mtu, isKCP)
+
+	helloLock.Lock()
+	defer helloLock.Unlock()
+
+	// The hello may be received concurrently
+	h, ok := hellos[conn]
+	if ok {
+		return h, nil
 	}
+	hellos[conn] = hello
+
+	log.Infof("Resume client %s without hello\n", conn.RemoteAddr())
+
+	return hello, nil
 }
 
 func handleListen(contents []byte, conn net.Conn) error {
@@ -709,577 +2399,2848 @@ func handleListen(contents []byte, conn net.Conn) error {
 		fragments         [][]byte
 	)
 
+	// Upstream, loaded once so that the packet is routed through a consistent upstream across migrating
+	up := upstream()
+
 	// Empty payload
 	if len(contents) <= 0 {
 		// return errors.New("empty payload")
 		return nil
 	}
 
+	// Hello
+	if pcap.IsHello(contents) {
+		err := handleHello(contents, conn)
+		if err != nil {
+			return fmt.Errorf("handle hello: %w", err)
+		}
+		return nil
+	}
+	helloLock.RLock()
+	hello, ok := hellos[conn]
+	helloLock.RUnlock()
+	if !ok {
+		hello, err = resumeHello(conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Batch
+	if hello.Version >= pcap.BatchVersion && pcap.IsBatch(contents) {
+		records, err := pcap.ParseBatch(contents)
+		if err != nil {
+			return fmt.Errorf("parse batch: %w", err)
+		}
+
+		// A record failed is dropped alone, and does not drop records following it
+		for i, record := range records {
+			err := handleListen(record, conn)
+			if err != nil {
+				log.Errorln(fmt.Errorf("handle record %d in batch: %w", i, err))
+				log.Dump("error", record)
+				continue
+			}
+		}
+		return nil
+	}
+
 	// Parse embedded packet
 	embIndicator, err = pcap.ParseEmbPacket(contents)
 	if err != nil {
+		// Packets of unsupported protocols are still counted in parse failures
+		var parseErr *pcap.ParseError
+		if unsupported == unsupportedDrop && errors.As(err, &parseErr) && isUnsupported(parseErr) {
+			log.Dump("unsupported", contents)
+			return nil
+		}
 		return fmt.Errorf("parse embedded packet: %w", err)
 	}
 
+	// Drop all packets while the kill switch is engaged
+	if isKilled() {
+		atomic.AddUint64(&killDrops, 1)
+		log.Verbosef("Drop an outbound packet for kill switch: %s -> %s\n", embIndicator.SrcIP(), embIndicator.DstIP())
+		return nil
+	}
+
+	// Drop packets which are neither fragments nor have a transport layer, since they cannot be translated
+	if !embIndicator.IsFrag() && embIndicator.TransportLayer() == nil {
+		log.Verbosef("Drop an outbound packet for missing transport layer: %s -> %s\n", embIndicator.SrcIP(), embIndicator.DstIP())
+		log.Dump("missing transport layer", contents)
+		return nil
+	}
+
+	// Drop packets whose TTL will be exceeded instead of forwarding them with TTL 0
+	if _, ok := routeTTL(embIndicator.TTL()); !ok {
+		log.Verbosef("Drop an outbound packet for TTL %d exceeded: %s -> %s\n", embIndicator.TTL(), embIndicator.SrcIP(), embIndicator.DstIP())
+		log.Dump("ttl exceeded", contents)
+		return nil
+	}
+
+	// Drop packets which are too large but must not be fragmented, TCP segments will be split into smaller ones instead
+	if embIndicator.DontFragment() && embIndicator.MTU() > fragment && embIndicator.TransportProtocol() != layers.LayerTypeTCP {
+		log.Verbosef("Drop an outbound %s packet for don't fragment: %s -> %s (%d Bytes)\n",
+			embIndicator.TransportProtocol(), embIndicator.SrcIP(), embIndicator.DstIP(), embIndicator.MTU())
+		log.Dump("don't fragment", contents)
+		return nil
+	}
+
+	// Drop packets with IP options by policy, source routing can be dropped independently
+	if dropSrcRoute && embIndicator.HasSourceRoute() {
+		log.Verbosef("Drop an outbound packet for source routing: %s -> %s\n", embIndicator.SrcIP(), embIndicator.DstIP())
+		log.Dump("source route", contents)
+		return nil
+	}
+	if ipOptions == ipOptionsDrop && embIndicator.HasIPOptions() {
+		log.Verbosef("Drop an outbound packet for ip options: %s -> %s\n", embIndicator.SrcIP(), embIndicator.DstIP())
+		log.Dump("ip options", contents)
+		return nil
+	}
+
+	// Policy, loaded once so that the packet sees a consistent policy across reloading
+	pol := policies.Load().(*policy)
+
+	// Payload limits, fragments are not limited since their payloads are incomplete
+	if !embIndicator.IsFrag() && embIndicator.TransportLayer() != nil {
+		limit, ok := pol.payloadLimits[embIndicator.TransportLayer().LayerType()]
+		if ok {
+			size := len(embIndicator.Payload())
+			if size < limit.min || size > limit.max {
+				atomic.AddUint64(&limitDrops, 1)
+				log.Verbosef("Drop an outbound %s packet: %s -> %s (%d Bytes)\n",
+					embIndicator.TransportProtocol(), embIndicator.Src().String(), embIndicator.Dst().String(), size)
+				log.Dump("payload limit", contents)
+				return nil
+			}
+		}
+	}
+
+	// Allowed ports, checked before creating NAT
+	if !embIndicator.IsFrag() && !isPortAllowed(pol.allowPorts, embIndicator) {
+		atomic.AddUint64(&portDrops, 1)
+		log.Verbosef("Drop an outbound %s packet to a denied port: %s -> %s\n",
+			embIndicator.TransportProtocol(), embIndicator.Src().String(), embIndicator.Dst().String())
+		log.Dump("denied port", contents)
+		return nil
+	}
+
+	// Multicast and broadcast, which cannot be replied through NAT
+	if isGroup(embIndicator.DstIP()) {
+		if multicast == multicastDrop || embIndicator.IsFrag() {
+			log.Verbosef("Drop an outbound %s packet to multicast or broadcast: %s -> %s\n",
+				embIndicator.TransportProtocol(), embIndicator.SrcIP(), embIndicator.DstIP())
+			log.Dump("multicast", contents)
+			return nil
+		}
+
+		return forwardGroup(embIndicator, conn)
+	}
+
 	// Distribute port/Id by source and client address and protocol
 	if !embIndicator.IsFrag() {
 		var ok bool
 
-		q := quintuple{
-			src:      embIndicator.NATSrc().String(),
-			dst:      conn.RemoteAddr().String(),
-			protocol: embIndicator.NATProtocol(),
-		}
-		upValue, ok = patMap[q]
-		if !ok {
-			// if ICMPv4 error is not in NAT, drop it
-			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
-				return errors.New("missing nat")
-			}
+		q := natKey{
+			src:    natGuideOf(embIndicator.NATSrc(), embIndicator.NATProtocol()),
+			client: clientName(conn),
+		}
+		natLock.Lock()
+		upValue, ok = patMap[q]
+		if ok && !isOwned(q, upValue) {
+			// The port or Id was recycled to another flow, which may be of another client
+			log.Verbosef("Redistribute for recycled %s port or ID %d: %s\n", q.src.Protocol, upValue, q.src)
+			logNATEvent("Release recycled", q, upValue)
+			delete(patMap, q)
+			ok = false
+		}
+		if !ok {
+			// if ICMPv4 error is not in NAT, drop it
+			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
+				natLock.Unlock()
+				return errors.New("missing nat")
+			}
+
+			// Refuse new flows while paused
+			if isPaused() {
+				natLock.Unlock()
+				log.Verbosef("Refuse an outbound %s packet for paused: %s -> %s\n",
+					embIndicator.TransportProtocol(), embIndicator.Src().String(), embIndicator.Dst().String())
+				return nil
+			}
+
+			// Shed new flows over the memory budget
+			if maxMemory > 0 && atomic.LoadInt64(&memoryUsage) >= int64(maxMemory) {
+				natLock.Unlock()
+				log.Verbosef("Refuse an outbound %s packet for memory: %s -> %s\n",
+					embIndicator.TransportProtocol(), embIndicator.Src().String(), embIndicator.Dst().String())
+				return nil
+			}
+
+			t := embIndicator.NATProtocol()
+			upValue, ok, err = allocFlow(q, fmt.Sprintf("%s-%s-%s", embIndicator.NATSrc(), embIndicator.NATDst(), t), pol.maxFlows)
+			if err != nil {
+				natLock.Unlock()
+				return fmt.Errorf("distribute: %w", err)
+			}
+			if !ok {
+				natLock.Unlock()
+				log.Verbosef("Refuse an outbound %s packet for flows of client %s: %s -> %s\n",
+					embIndicator.TransportProtocol(), q.client, embIndicator.Src().String(), embIndicator.Dst().String())
+				return nil
+			}
+			if embIndicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+				tcpStates[convertFromPort(upValue)] = tcpEstablished
+
+				// A recycled port is inspected again for the new flow
+				if len(sniGateways) > 0 {
+					sniLock.Lock()
+					delete(sniFlows, natGuide(layers.LayerTypeTCP, up.LocalDev().IPAddr().IP, upValue))
+					sniLock.Unlock()
+				}
+			}
+		}
+		natLock.Unlock()
+	}
+
+	// Create new transport layer
+	if embIndicator.TransportLayer() != nil {
+		switch t := embIndicator.TransportLayer().LayerType(); t {
+		case layers.LayerTypeICMPv4:
+			if embIndicator.ICMPv4Indicator().IsQuery() {
+				temp := *embIndicator.ICMPv4Indicator().ICMPv4Layer()
+				newTransportLayer = &temp
+
+				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
+
+				newICMPv4Layer.Id = upValue
+			} else {
+				newTransportLayer = embIndicator.ICMPv4Indicator().NewPureICMPv4Layer()
+
+				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
+
+				temp := *embIndicator.ICMPv4Indicator().EmbIPv4Layer()
+				newEmbIPv4Layer := &temp
+
+				newEmbIPv4Layer.DstIP = up.LocalDev().IPAddr().IP
+
+				var (
+					err                  error
+					newEmbTransportLayer gopacket.Layer
+				)
+
+				embTransportLayerType := embIndicator.ICMPv4Indicator().EmbTransportLayer().LayerType()
+				switch embTransportLayerType {
+				case layers.LayerTypeTCP:
+					temp := *embIndicator.ICMPv4Indicator().EmbTCPLayer()
+					newEmbTransportLayer = &temp
+
+					newEmbTCPLayer := newEmbTransportLayer.(*layers.TCP)
+
+					newEmbTCPLayer.DstPort = layers.TCPPort(upValue)
+
+					err = newEmbTCPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
+				case layers.LayerTypeUDP:
+					temp := *embIndicator.ICMPv4Indicator().EmbUDPLayer()
+					newEmbTransportLayer = &temp
+
+					newEmbUDPLayer := newEmbTransportLayer.(*layers.UDP)
+
+					newEmbUDPLayer.DstPort = layers.UDPPort(upValue)
+
+					err = newEmbUDPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
+				case layers.LayerTypeICMPv4:
+					temp := *embIndicator.ICMPv4Indicator().EmbICMPv4Layer()
+					newEmbTransportLayer = &temp
+
+					if embIndicator.ICMPv4Indicator().IsEmbQuery() {
+						newEmbICMPv4Layer := newEmbTransportLayer.(*layers.ICMPv4)
+
+						newEmbICMPv4Layer.Id = upValue
+					}
+				default:
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("transport layer type %s not support", embTransportLayerType))
+				}
+				if err != nil {
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+				}
+
+				payload, err := pcap.Serialize(newEmbIPv4Layer, newEmbTransportLayer.(gopacket.SerializableLayer))
+				if err != nil {
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("serialize: %w", err))
+				}
+
+				newICMPv4Layer.Payload = payload
+			}
+		default:
+			handler := pcap.FindTransport(t)
+			if handler == nil {
+				return fmt.Errorf("transport layer type %s not support", t)
+			}
+
+			newTransportLayer, err = handler.Rewrite(embIndicator.TransportLayer(), upValue, embIndicator.DstPort())
+			if err != nil {
+				return fmt.Errorf("create transport layer: %w", err)
+			}
+		}
+	}
+
+	// PROXY protocol
+	payload := embIndicator.Payload()
+	if !embIndicator.IsFrag() && newTransportLayer != nil && newTransportLayer.LayerType() == layers.LayerTypeTCP {
+		dst := embIndicator.Dst().(*net.TCPAddr)
+		if proxyDsts[dst.IP.String()] || proxyDsts[dst.String()] {
+			payload, err = injectProxyHeader(newTransportLayer.(*layers.TCP), embIndicator.Src().(*net.TCPAddr), dst, payload)
+			if err != nil {
+				return fmt.Errorf("inject proxy protocol header: %w", err)
+			}
+		}
+	}
+
+	// Create new network layer
+	switch t := embIndicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		ipv4Layer := embIndicator.NetworkLayer().(*layers.IPv4)
+		temp := *ipv4Layer
+		newNetworkLayer = &temp
+
+		newIPv4Layer := newNetworkLayer.(*layers.IPv4)
+
+		newIPv4Layer.SrcIP = up.LocalDev().IPAddr().IP
+		if ipOptions == ipOptionsStrip {
+			newIPv4Layer.Options = nil
+			newIPv4Layer.Padding = nil
+		}
+		newIPv4Layer.TTL, _ = routeTTL(newIPv4Layer.TTL)
+		upIP = newIPv4Layer.SrcIP
+	default:
+		return fmt.Errorf("network layer type %s not support", t)
+	}
+
+	// Set network layer for transport layer
+	if newTransportLayer != nil {
+		switch t := newTransportLayer.LayerType(); t {
+		case layers.LayerTypeICMPv4:
+			break
+		default:
+			handler := pcap.FindTransport(t)
+			if handler == nil {
+				return fmt.Errorf("transport layer type %s not support", t)
+			}
+
+			err = handler.SetNetworkLayerForChecksum(newTransportLayer, newNetworkLayer)
+		}
+		if err != nil {
+			return fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	}
+
+	// Decide Loopback or Ethernet, raw connections have no link layer
+	if up.IsRaw() {
+		newLinkLayerType = gopacket.LayerTypeZero
+	} else if up.IsLoop() {
+		newLinkLayerType = layers.LayerTypeLoopback
+	} else {
+		newLinkLayerType = layers.LayerTypeEthernet
+	}
+
+	// Create new link layer
+	switch newLinkLayerType {
+	case gopacket.LayerTypeZero:
+		break
+	case layers.LayerTypeLoopback:
+		newLinkLayer, err = pcap.CreateLoopbackLayer(newNetworkLayer)
+	case layers.LayerTypeEthernet:
+		dstIP := newNetworkLayer.(*layers.IPv4).DstIP
+		gateway := selectGateway(embIndicator.SrcIP(), dstIP)
+		if len(sniGateways) > 0 && embIndicator.TransportLayer() != nil && embIndicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+			gw := selectSNIGateway(embIndicator, natGuide(layers.LayerTypeTCP, upIP, upValue))
+			if gw != nil {
+				gateway = gw
+			}
+		}
+		hardwareAddr := resolve(dstIP, gateway)
+		if hardwareAddr == nil {
+			return fmt.Errorf("cannot resolve hardware address of %s", dstIP)
+		}
+
+		newLinkLayer, err = pcap.CreateEthernetLayer(up.LocalDev().HardwareAddr(), hardwareAddr, newNetworkLayer)
+	default:
+		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
+	}
+	if err != nil {
+		return fmt.Errorf("create link layer: %w", err)
+	}
+
+	// Fragment
+	fragments, err = pcap.CreateFragmentPackets(newLinkLayer, newNetworkLayer, newTransportLayer, payload, fragment)
+	if err != nil {
+		return fmt.Errorf("fragment: %w", err)
+	}
+
+	// Shape
+	isQueued, ok := shapeEgress(up, fragments)
+	if !ok {
+		log.Verbosef("Drop an outbound %s packet for egress rate: %s -> %s\n",
+			embIndicator.TransportProtocol(), embIndicator.Src().String(), embIndicator.Dst().String())
+		return nil
+	}
+
+	// Write packet data, or leave it to the egress writer if delayed
+	if isQueued {
+		log.Verbosef("Delay an inbound %s packet for egress rate: %s -> %s -> %s (%d Bytes)\n",
+			embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
+	} else {
+		for i, fragment := range fragments {
+			_, err = up.Write(fragment)
+			if err != nil {
+				return fmt.Errorf("write: %w", err)
+			}
+
+			if i == len(fragment)-1 {
+				log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n",
+					embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
+			} else {
+				log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (...)\n",
+					embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
+			}
+		}
+	}
+
+	// Kill switch, by handshakes which are always answered by the upstream unless it is unreachable
+	if killSwitch > 0 && embIndicator.TransportLayer() != nil {
+		if layer := embIndicator.TCPLayer(); layer != nil && layer.SYN && !layer.ACK {
+			atomic.CompareAndSwapInt64(&synPending, 0, clock.Now().UnixNano())
+			atomic.AddInt32(&synUnacked, 1)
+		}
+	}
+
+	// NAT
+	if embIndicator.TransportLayer() != nil {
+		// Record the source and the source device of the packet
+		var (
+			guide  pcap.NATGuide
+			addNAT bool
+		)
+
+		switch t := embIndicator.TransportLayer().LayerType(); t {
+		case layers.LayerTypeICMPv4:
+			if embIndicator.ICMPv4Indicator().IsQuery() {
+				guide = natGuide(t, upIP, upValue)
+				addNAT = true
+			}
+		default:
+			if pcap.FindTransport(t) == nil {
+				return fmt.Errorf("transport layer type %s not support", t)
+			}
+
+			guide = natGuide(t, upIP, upValue)
+			addNAT = true
+		}
+		if addNAT {
+			ni := &natIndicator{
+				src:    conn.RemoteAddr(),
+				embSrc: embIndicator.NATSrc(),
+				conn:   conn,
+			}
+			natLock.Lock()
+			nat[guide] = ni
+			natLock.Unlock()
+		}
+
+		// Keep alive
+		protocol := embIndicator.NATProtocol()
+		natLock.Lock()
+		switch protocol {
+		case layers.LayerTypeTCP:
+			tcpPortPool[convertFromPort(upValue)] = clock.Now()
+			if embIndicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+				updateTCPState(convertFromPort(upValue), embIndicator.TCPLayer())
+			}
+		case layers.LayerTypeUDP:
+			udpPortPool[upValue] = clock.Now()
+		case layers.LayerTypeICMPv4:
+			icmpv4IdPool[upValue] = clock.Now()
+		default:
+			pool, ok := portPools[protocol]
+			if !ok {
+				natLock.Unlock()
+				return fmt.Errorf("transport layer type %s not support", protocol)
+			}
+
+			pool[convertFromPort(upValue)] = clock.Now()
+		}
+		natLock.Unlock()
+	}
+
+	// Statistics
+	if monitor != nil {
+		monitor.Add(clientName(conn), stat.DirectionOut, uint(embIndicator.Size()))
+	}
+
+	// Flow export
+	if flowRecords != nil && !embIndicator.IsFrag() && isFlow(embIndicator) {
+		t := embIndicator.NATProtocol()
+		recordFlow(embIndicator.NATSrc(), embIndicator.NATDst(), translateAddr(t, upIP, upValue), embIndicator.NATDst(), t, embIndicator.Size())
+	}
+
+	return nil
+}
+
+// forwardGroup forwards a packet from a client to a multicast or broadcast address without NAT. Only the source address
+// is translated, and no reply is expected.
+func forwardGroup(embIndicator *pcap.PacketIndicator, conn net.Conn) error {
+	var (
+		err               error
+		newTransportLayer gopacket.Layer
+		newLinkLayer      gopacket.Layer
+	)
+
+	up := upstream()
+
+	// Create new network layer
+	temp := *embIndicator.IPv4Layer()
+	newIPv4Layer := &temp
+
+	newIPv4Layer.SrcIP = up.LocalDev().IPAddr().IP
+	if ipOptions == ipOptionsStrip {
+		newIPv4Layer.Options = nil
+		newIPv4Layer.Padding = nil
+	}
+	newIPv4Layer.TTL, _ = routeTTL(newIPv4Layer.TTL)
+
+	// Create new transport layer with ports as is
+	switch t := embIndicator.TransportLayer().LayerType(); t {
+	case layers.LayerTypeICMPv4:
+		temp := *embIndicator.ICMPv4Indicator().ICMPv4Layer()
+		newTransportLayer = &temp
+	default:
+		handler := pcap.FindTransport(t)
+		if handler == nil {
+			return fmt.Errorf("transport layer type %s not support", t)
+		}
+
+		newTransportLayer, err = handler.Rewrite(embIndicator.TransportLayer(), embIndicator.SrcPort(), embIndicator.DstPort())
+		if err != nil {
+			return fmt.Errorf("create transport layer: %w", err)
+		}
+		err = handler.SetNetworkLayerForChecksum(newTransportLayer, newIPv4Layer)
+		if err != nil {
+			return fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	}
+
+	// Create new link layer, raw connections have no link layer
+	if !up.IsRaw() {
+		if up.IsLoop() {
+			newLinkLayer, err = pcap.CreateLoopbackLayer(newIPv4Layer)
+		} else {
+			newLinkLayer, err = pcap.CreateEthernetLayer(up.LocalDev().HardwareAddr(), groupHardwareAddr(newIPv4Layer.DstIP), newIPv4Layer)
+		}
+		if err != nil {
+			return fmt.Errorf("create link layer: %w", err)
+		}
+	}
+
+	// Fragment
+	fragments, err := pcap.CreateFragmentPackets(newLinkLayer, newIPv4Layer, newTransportLayer, embIndicator.Payload(), fragment)
+	if err != nil {
+		return fmt.Errorf("fragment: %w", err)
+	}
+
+	// Shape
+	isQueued, ok := shapeEgress(up, fragments)
+	if !ok {
+		log.Verbosef("Drop an outbound %s packet to multicast or broadcast for egress rate: %s -> %s\n",
+			embIndicator.TransportProtocol(), embIndicator.Src().String(), embIndicator.Dst().String())
+		return nil
+	}
+
+	// Write packet data, or leave it to the egress writer if delayed
+	if !isQueued {
+		for _, fragment := range fragments {
+			_, err = up.Write(fragment)
+			if err != nil {
+				return fmt.Errorf("write: %w", err)
+			}
+		}
+	}
+
+	log.Verbosef("Forward an inbound %s packet to multicast or broadcast: %s -> %s -> %s (%d Bytes)\n",
+		embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
+
+	// Statistics
+	if monitor != nil {
+		monitor.Add(clientName(conn), stat.DirectionOut, uint(embIndicator.Size()))
+	}
+
+	return nil
+}
+
+// isGroup reports whether the address is a multicast address, the limited broadcast address or the broadcast address of
+// the upstream device.
+func isGroup(ip net.IP) bool {
+	if ip.IsMulticast() || ip.Equal(net.IPv4bcast) {
+		return true
+	}
+
+	ipNet := upstream().LocalDev().IPAddr()
+	if ipNet == nil || !ipNet.Contains(ip) {
+		return false
+	}
+	ip4 := ip.To4()
+	mask := ipNet.Mask
+	if ip4 == nil || len(mask) != net.IPv4len || net.IP(mask).Equal(net.IPv4bcast) {
+		return false
+	}
+	for i := 0; i < net.IPv4len; i++ {
+		if ip4[i]|mask[i] != 0xff {
+			return false
+		}
+	}
+
+	return true
+}
+
+// groupHardwareAddr returns the hardware address of a multicast or broadcast address in Ethernet.
+func groupHardwareAddr(ip net.IP) net.HardwareAddr {
+	ip4 := ip.To4()
+	if ip4 != nil && ip4.IsMulticast() {
+		return net.HardwareAddr{0x01, 0x00, 0x5e, ip4[1] & 0x7f, ip4[2], ip4[3]}
+	}
+
+	return layers.EthernetBroadcast
+}
+
+func handleUpstream(packet gopacket.Packet) error {
+	var (
+		err       error
+		indicator *pcap.PacketIndicator
+		frags     []*pcap.PacketIndicator
+		ni        *natIndicator
+		data      []byte
+	)
+
+	// Parse packet
+	indicator, err = pcap.ParsePacket(packet)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	// ARP, and gratuitous ARP of the gateway which announces its failover
+	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
+		arpLayer := indicator.ARPLayer()
+		isGratuitous := net.IP(arpLayer.SourceProtAddress).Equal(arpLayer.DstProtAddress) && isGateway(arpLayer.SourceProtAddress)
+		if !isGratuitous && (arpLayer.Operation != layers.ARPReply || !upstream().LocalDev().IPAddr().IP.Equal(arpLayer.DstProtAddress)) {
+			return nil
+		}
+
+		arpCache.Add(arpLayer.SourceProtAddress, arpLayer.SourceHwAddress)
+		if isGateway(arpLayer.SourceProtAddress) {
+			updateGatewayMAC(arpLayer.SourceHwAddress)
+		}
+
+		log.Verbosef("Resolve %s [%s]\n", net.IP(arpLayer.SourceProtAddress), net.HardwareAddr(arpLayer.SourceHwAddress))
+
+		return nil
+	}
+
+	// Kill switch
+	resetHandshakes()
+	if isKilled() {
+		atomic.AddUint64(&killDrops, 1)
+		log.Verbosef("Drop an inbound packet for kill switch: %s -> %s\n", indicator.SrcIP(), indicator.DstIP())
+		return nil
+	}
+
+	// Handle fragments
+	if atomic.LoadInt32(&overBudget) != 0 {
+		defrag.Discard()
+	}
+	indicator, frags, err = defrag.AppendOriginal(indicator)
+	atomic.StoreInt64(&fragsSize, int64(defrag.Size()))
+	if err != nil {
+		return fmt.Errorf("defrag: %w", err)
+	}
+	if indicator == nil {
+		return nil
+	}
+
+	// Drop packets whose TTL will be exceeded instead of forwarding them with TTL 0
+	if _, ok := routeTTL(indicator.TTL()); !ok {
+		log.Verbosef("Drop an inbound packet for TTL %d exceeded: %s <- %s\n", indicator.TTL(), indicator.DstIP(), indicator.SrcIP())
+		log.Dump("ttl exceeded", packet.Data())
+		return nil
+	}
+
+	// NAT
+	guide := natGuideOf(indicator.NATDst(), indicator.TransportLayer().LayerType())
+	natLock.RLock()
+	ni, ok := nat[guide]
+	natLock.RUnlock()
+	if !ok {
+		n := atomic.AddUint64(&unmatched, 1)
+
+		// Log at most once in an interval
+		if logUnmatched {
+			now := clock.Now().UnixNano()
+			last := atomic.LoadInt64(&lastLogged)
+			if now-last >= int64(logUnmatchedInterval) && atomic.CompareAndSwapInt64(&lastLogged, last, now) {
+				log.Infof("Receive an unmatched inbound %s packet: %s -> %s (%d in total)\n",
+					indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), n)
+			}
+		}
+
+		return nil
+	}
+
+	// Sources are stored in NAT as addresses with IPs and never parsed again, but a packet must not be built without a
+	// valid destination in any case
+	if ip := ni.embSrcIP(); ip.To4() == nil {
+		return fmt.Errorf("invalid source %s in nat", ni.embSrc)
+	}
+
+	// Keep alive
+	protocol := indicator.NATProtocol()
+	natLock.Lock()
+	switch protocol {
+	case layers.LayerTypeTCP:
+		tcpPortPool[convertFromPort(indicator.DstPort())] = clock.Now()
+		if indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+			updateTCPState(convertFromPort(indicator.DstPort()), indicator.TCPLayer())
+		}
+	case layers.LayerTypeUDP:
+		udpPortPool[indicator.DstPort()] = clock.Now()
+	case layers.LayerTypeICMPv4:
+		icmpv4IdPool[indicator.ICMPv4Indicator().Id()] = clock.Now()
+	default:
+		pool, ok := portPools[protocol]
+		if !ok {
+			natLock.Unlock()
+			return fmt.Errorf("transport layer type %s not support", protocol)
+		}
+
+		pool[convertFromPort(indicator.DstPort())] = clock.Now()
+	}
+	natLock.Unlock()
+
+	for _, frag := range frags {
+		var (
+			embTransportLayer gopacket.Layer
+			embNetworkLayer   gopacket.NetworkLayer
+		)
+
+		// Create embedded transport layer
+		if frag.TransportLayer() != nil {
+			switch t := frag.TransportLayer().LayerType(); t {
+			case layers.LayerTypeICMPv4:
+				if frag.ICMPv4Indicator().IsQuery() {
+					embICMPv4Layer := frag.ICMPv4Indicator().ICMPv4Layer()
+					temp := *embICMPv4Layer
+					embTransportLayer = &temp
+
+					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
+
+					newEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
+				} else {
+					embTransportLayer = frag.ICMPv4Indicator().NewPureICMPv4Layer()
+
+					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
+
+					temp := *frag.ICMPv4Indicator().EmbIPv4Layer()
+					newEmbEmbIPv4Layer := &temp
+
+					newEmbEmbIPv4Layer.SrcIP = ni.embSrcIP()
+
+					var (
+						err                     error
+						newEmbEmbTransportLayer gopacket.Layer
+					)
+
+					switch t := frag.ICMPv4Indicator().EmbTransportLayer().LayerType(); t {
+					case layers.LayerTypeTCP:
+						temp := *frag.ICMPv4Indicator().EmbTCPLayer()
+						newEmbEmbTransportLayer = &temp
+
+						newEmbEmbTCPLayer := newEmbEmbTransportLayer.(*layers.TCP)
+
+						newEmbEmbTCPLayer.SrcPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+
+						err = newEmbEmbTCPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
+					case layers.LayerTypeUDP:
+						temp := *frag.ICMPv4Indicator().EmbUDPLayer()
+						newEmbEmbTransportLayer = &temp
+
+						newEmbEmbUDPLayer := newEmbEmbTransportLayer.(*layers.UDP)
+
+						newEmbEmbUDPLayer.SrcPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
+
+						err = newEmbEmbUDPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
+					case layers.LayerTypeICMPv4:
+						temp := *frag.ICMPv4Indicator().EmbICMPv4Layer()
+						newEmbEmbTransportLayer = &temp
+
+						if frag.ICMPv4Indicator().IsEmbQuery() {
+							newEmbEmbICMPv4Layer := newEmbEmbTransportLayer.(*layers.ICMPv4)
+
+							newEmbEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
+						}
+					default:
+						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("transport layer type %s not support", t))
+					}
+					if err != nil {
+						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+					}
+
+					payload, err := pcap.Serialize(newEmbEmbIPv4Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer))
+					if err != nil {
+						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
+					}
+
+					newEmbICMPv4Layer.Payload = payload
+				}
+			default:
+				handler := pcap.FindTransport(t)
+				if handler == nil {
+					return fmt.Errorf("embedded transport layer type %s not support", t)
+				}
+
+				embTransportLayer, err = handler.Rewrite(frag.TransportLayer(), frag.SrcPort(), natPort(ni.embSrc))
+				if err != nil {
+					return fmt.Errorf("create embedded transport layer: %w", err)
+				}
+
+				// PROXY protocol
+				if t == layers.LayerTypeTCP && proxyDsts != nil {
+					restoreProxyAck(embTransportLayer.(*layers.TCP), frag.Src().(*net.TCPAddr))
+				}
+			}
+		}
+
+		// Create embedded network layer
+		switch t := frag.NetworkLayer().LayerType(); t {
+		case layers.LayerTypeIPv4:
+			embIPv4Layer := frag.IPv4Layer()
+			temp := *embIPv4Layer
+			embNetworkLayer = &temp
+
+			newEmbIPv4Layer := embNetworkLayer.(*layers.IPv4)
+
+			newEmbIPv4Layer.DstIP = ni.embSrcIP()
+			newEmbIPv4Layer.TTL, _ = routeTTL(newEmbIPv4Layer.TTL)
+		default:
+			return fmt.Errorf("embedded network layer type %s not support", t)
+		}
+
+		// Set network layer for transport layer
+		if embTransportLayer != nil {
+			switch t := embTransportLayer.LayerType(); t {
+			case layers.LayerTypeICMPv4:
+				break
+			default:
+				handler := pcap.FindTransport(t)
+				if handler == nil {
+					return fmt.Errorf("embedded transport layer type %s not support", t)
+				}
+
+				err = handler.SetNetworkLayerForChecksum(embTransportLayer, embNetworkLayer)
+			}
+			if err != nil {
+				return fmt.Errorf("set embedded network layer for checksum: %w", err)
+			}
+		}
+
+		// Serialize layers
+		if embTransportLayer == nil {
+			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
+				gopacket.Payload(frag.Payload()))
+		} else {
+			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
+				embTransportLayer.(gopacket.SerializableLayer),
+				gopacket.Payload(frag.Payload()))
+		}
+		if err != nil {
+			return fmt.Errorf("serialize: %w", err)
+		}
+
+		// Write packet data
+		_, err = ni.conn.Write(data)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+
+		// Statistics
+		size := frag.MTU()
+		if monitor != nil {
+			monitor.Add(clientName(ni.conn), stat.DirectionIn, uint(size))
+		}
+		if flowRecords != nil && isFlow(indicator) {
+			recordFlow(indicator.NATSrc(), indicator.NATDst(), indicator.NATSrc(), ni.embSrc, protocol, size)
+		}
+
+		log.Verbosef("Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
+			frag.TransportProtocol(), ni.embSrc.String(), ni.src.String(), frag.Src(), size)
+	}
+
+	// Record DNS
+	if monitor != nil {
+		if indicator.DNSIndicator() != nil {
+			if indicator.DNSIndicator().IsResponse() {
+				name, ips := indicator.DNSIndicator().Answers()
+				if name != "" && len(ips) > 0 {
+					dnsLock.Lock()
+					for _, ip := range ips {
+						dns[ip.String()] = name
+						log.Verbosef("Record DNS record %s = %s\n", name, ip)
+					}
+					dnsLock.Unlock()
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// stats returns a snapshot of statistics of the server.
+func stats() *serverStats {
+	return &serverStats{
+		Name:    name,
+		Version: versionInfo,
+		Time:    int(clock.Now().Sub(startTime).Seconds()),
+		Monitor: monitor,
+		Replays: pcap.Replays(),
+		Parses:  pcap.ParseFailures(),
+		Drops:   atomic.LoadUint64(&limitDrops),
+		Paused:  isPaused(),
+		Memory:  atomic.LoadInt64(&memoryUsage),
+		Rejects: pcap.HandshakeDrops(),
+		Unmatch: atomic.LoadUint64(&unmatched),
+		Denied:  atomic.LoadUint64(&portDrops),
+		Probes:  pcap.Probes(),
+		Late:    atomic.LoadUint64(&lateDrops),
+		Queues:  queues(),
+		Killed:  isKilled(),
+		Kills:   atomic.LoadUint64(&killDrops),
+		Shaped:  atomic.LoadUint64(&shaped),
+		Excess:  atomic.LoadUint64(&shapeDrops),
+	}
+}
+
+// pause stops forwarding new flows, while existing flows are still forwarded.
+func pause() {
+	if atomic.CompareAndSwapInt32(&paused, 0, 1) {
+		log.Infoln("Pause forwarding new flows")
+	}
+}
+
+// resume restarts forwarding new flows.
+func resume() {
+	if atomic.CompareAndSwapInt32(&paused, 1, 0) {
+		log.Infoln("Resume forwarding new flows")
+	}
+}
+
+// healthy returns if handles are open and the upstream loop is running, or the reason if not.
+func healthy() (bool, string) {
+	if isClosed {
+		return false, "closed"
+	}
+	if len(listeners) <= 0 {
+		return false, "no listener"
+	}
+	for i, listener := range listeners {
+		if listener == nil {
+			return false, fmt.Sprintf("listener %d not open", i)
+		}
+	}
+	if upstream() == nil {
+		return false, "upstream not open"
+	}
+	if atomic.LoadInt32(&upLooping) == 0 {
+		return false, "upstream loop not running"
+	}
+
+	return true, ""
+}
+
+func isPaused() bool {
+	return atomic.LoadInt32(&paused) != 0
+}
+
+// checkKillSwitch engages the kill switch if the tunnel is unhealthy or the upstream has not answered TCP handshakes
+// sent to it in time, and releases it once the tunnel recovers. The upstream is retried after the same time while
+// engaged, since nothing is sent to it meanwhile.
+func checkKillSwitch(now time.Time) {
+	if killSwitch <= 0 {
+		return
+	}
+
+	if isKilled() && now.Sub(killedAt) >= killSwitch {
+		resetHandshakes()
+	}
+
+	ok, reason := healthy()
+	if ok {
+		pending := atomic.LoadInt64(&synPending)
+		if pending != 0 && atomic.LoadInt32(&synUnacked) >= killHandshakes && now.Sub(time.Unix(0, pending)) >= killSwitch {
+			ok, reason = false, "handshakes unanswered"
+		}
+	}
+
+	if !ok {
+		if atomic.CompareAndSwapInt32(&killed, 0, 1) {
+			killedAt = now
+			log.Errorf("Engage kill switch for %s\n", reason)
+		}
+		return
+	}
+	if atomic.CompareAndSwapInt32(&killed, 1, 0) {
+		log.Infoln("Release kill switch")
+	}
+}
+
+// resetHandshakes forgets TCP handshakes sent to the upstream once it answers.
+func resetHandshakes() {
+	atomic.StoreInt64(&synPending, 0)
+	atomic.StoreInt32(&synUnacked, 0)
+}
+
+func isKilled() bool {
+	return atomic.LoadInt32(&killed) != 0
+}
+
+// shapeEgress takes tokens of the egress rate for fragments of a packet to the upstream. If the tokens are owed, the
+// packet is queued for the egress writer until they are refilled, so the handler never waits, and it reports true. It
+// reports false if the owed tokens would exceed the burst or the queue is full, so the packet should be dropped.
+func shapeEgress(conn *pcap.RawConn, fragments [][]byte) (bool, bool) {
+	egressLock.Lock()
+	defer egressLock.Unlock()
+
+	if egressRate <= 0 {
+		return false, true
+	}
+
+	// Refill tokens
+	now := clock.Now()
+	egressToken = math.Min(egressToken+now.Sub(egressLast).Seconds()*float64(egressRate), float64(egressBurst))
+	egressLast = now
+
+	size := float64(sizeOf(fragments))
+	if egressToken-size < -float64(egressBurst) {
+		atomic.AddUint64(&shapeDrops, 1)
+		return false, false
+	}
+
+	// Packets are queued after any queued one, so they are written in order
+	if egressToken-size >= 0 && egressQueued <= 0 {
+		egressToken = egressToken - size
+		return false, true
+	}
+
+	wait := time.Duration((size - egressToken) / float64(egressRate) * float64(time.Second))
+	select {
+	case egressQueue <- &egressPacket{conn: conn, fragments: fragments, due: now.Add(wait)}:
+	default:
+		atomic.AddUint64(&shapeDrops, 1)
+		return false, false
+	}
+	egressToken = egressToken - size
+	egressQueued++
+	atomic.AddUint64(&shaped, 1)
+
+	return true, true
+}
+
+// writeEgress writes packets delayed by the egress rate to the upstream once they are due, until the context is
+// cancelled.
+func writeEgress(ctx context.Context) {
+	for {
+		var p *egressPacket
+		select {
+		case p = <-egressQueue:
+		case <-ctx.Done():
+			return
+		}
+
+		if wait := p.due.Sub(clock.Now()); wait > 0 {
+			timer := clock.NewTimer(wait)
+			select {
+			case <-timer.C():
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		for _, fragment := range p.fragments {
+			_, err := p.conn.Write(fragment)
+			if err != nil {
+				log.Errorln(fmt.Errorf("write egress: %w", err))
+				break
+			}
+		}
+
+		egressLock.Lock()
+		egressQueued--
+		egressLock.Unlock()
+	}
+}
+
+// setEgress sets the egress rate and burst, and refills the bucket. A burst of 0 means the size of traffic in one
+// second of the rate.
+func setEgress(rate, burst int) {
+	if burst <= 0 {
+		burst = rate
+		if burst < fragment {
+			burst = fragment
+		}
+	}
+
+	egressLock.Lock()
+	egressRate = rate
+	egressBurst = burst
+	egressToken = float64(burst)
+	egressLast = clock.Now()
+	egressLock.Unlock()
+
+	if rate > 0 {
+		log.Infof("Shape traffic to the upstream to %d Bytes per second with a burst of %d Bytes\n", rate, burst)
+	}
+}
+
+// parsePolicy returns policies of packets from clients in the configuration.
+func parsePolicy(cfg *config.Config) (*policy, error) {
+	if cfg.ClientFlows < 0 {
+		return nil, fmt.Errorf("client flows %d out of range", cfg.ClientFlows)
+	}
+	if cfg.ClientBytes < 0 {
+		return nil, fmt.Errorf("client bytes %d out of range", cfg.ClientBytes)
+	}
+
+	pol := &policy{
+		payloadLimits: make(map[gopacket.LayerType]*payloadLimit),
+		allowPorts:    make(map[gopacket.LayerType][]*portRange),
+		maxFlows:      cfg.ClientFlows,
+		maxQueued:     cfg.ClientBytes,
+	}
+
+	// Payload limits
+	for _, s := range cfg.PayloadLimits {
+		t, limit, err := parsePayloadLimit(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse payload limit %s: %w", s, err)
+		}
+		pol.payloadLimits[t] = limit
+	}
+
+	// Allowed ports
+	for _, s := range cfg.AllowPorts {
+		t, r, err := parsePortRange(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse allowed port %s: %w", s, err)
+		}
+		pol.allowPorts[t] = append(pol.allowPorts[t], r)
+	}
+
+	return pol, nil
+}
+
+// logPolicy logs policies of packets from clients in the configuration.
+func logPolicy(cfg *config.Config) {
+	pol := policies.Load().(*policy)
+	for t, limit := range pol.payloadLimits {
+		log.Infof("Limit payload size of %s packets to %d - %d Bytes\n", t, limit.min, limit.max)
+	}
+	if len(pol.allowPorts) > 0 {
+		log.Infof("Allow destination ports %s\n", strings.Join(cfg.AllowPorts, ", "))
+	}
+	if pol.maxFlows > 0 {
+		log.Infof("Limit flows of each client by %d\n", pol.maxFlows)
+	}
+	if pol.maxQueued > 0 {
+		log.Infof("Limit queued packets of each client by %d Bytes\n", pol.maxQueued)
+	}
+}
+
+// reloadPolicy reloads policies of packets from clients and the egress rate from the configuration file without
+// restart. Handles and NAT are kept, and other options in the file are ignored. Nothing is applied if any policy is
+// invalid.
+func reloadPolicy(path string) error {
+	if path == "" {
+		return errors.New("missing configuration file")
+	}
+
+	newCfg, err := config.ParseFile(path)
+	if err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	pol, err := parsePolicy(newCfg)
+	if err != nil {
+		return err
+	}
+	if newCfg.EgressRate < 0 {
+		return fmt.Errorf("egress rate %d out of range", newCfg.EgressRate)
+	}
+	if newCfg.EgressBurst < 0 || (newCfg.EgressBurst > 0 && newCfg.EgressBurst < fragment) {
+		return fmt.Errorf("egress burst %d out of range", newCfg.EgressBurst)
+	}
+
+	log.Infof("Reload policy from %s\n", path)
+
+	policies.Store(pol)
+	logPolicy(newCfg)
+	setEgress(newCfg.EgressRate, newCfg.EgressBurst)
+
+	return nil
+}
+
+// sizeOf returns the total size of packets.
+func sizeOf(packets [][]byte) int {
+	size := 0
+	for _, packet := range packets {
+		size = size + len(packet)
+	}
+
+	return size
+}
+
+// createAdminHandler returns a handler of admin API which requires the bearer token.
+func createAdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+
+	handle := func(pattern, method string, f func(req *http.Request) (interface{}, error)) {
+		mux.HandleFunc(pattern, func(w http.ResponseWriter, req *http.Request) {
+			if !isAuthorized(req, token) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if req.Method != method {
+				w.Header().Set("Allow", method)
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+
+			v, err := f(req)
+			if err != nil {
+				log.Errorln(fmt.Errorf("admin: %w", err))
+				var reqErr *requestError
+				if errors.As(err, &reqErr) {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if v == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			b, err := json.Marshal(v)
+			if err != nil {
+				log.Errorln(fmt.Errorf("admin: %w", err))
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+
+			_, err = w.Write(b)
+			if err != nil {
+				log.Errorln(fmt.Errorf("admin: %w", err))
+			}
+		})
+	}
+
+	handle("/connections", http.MethodGet, func(req *http.Request) (interface{}, error) {
+		return connections(), nil
+	})
+	handle("/stats", http.MethodGet, func(req *http.Request) (interface{}, error) {
+		return stats(), nil
+	})
+	handle("/evict", http.MethodPost, func(req *http.Request) (interface{}, error) {
+		evicted := evictIdle(clock.Now())
+		log.Infof("Evict %d idle flows by admin\n", evicted)
+
+		return &struct {
+			Evicted int `json:"evicted"`
+		}{Evicted: evicted}, nil
+	})
+	handle("/pause", http.MethodPost, func(req *http.Request) (interface{}, error) {
+		pause()
+		return nil, nil
+	})
+	handle("/resume", http.MethodPost, func(req *http.Request) (interface{}, error) {
+		resume()
+		return nil, nil
+	})
+	handle("/reload", http.MethodPost, func(req *http.Request) (interface{}, error) {
+		err := reloadPolicy(*argConfig)
+		if err != nil {
+			return nil, fmt.Errorf("reload policy: %w", err)
+		}
+
+		return nil, nil
+	})
+	handle("/migrate", http.MethodPost, func(req *http.Request) (interface{}, error) {
+		name := req.URL.Query().Get("device")
+		if name == "" {
+			return nil, &requestError{Err: errors.New("missing device")}
+		}
+		timeout := defaultDrain
+		if s := req.URL.Query().Get("timeout"); s != "" {
+			seconds, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, &requestError{Err: fmt.Errorf("parse timeout %s: %w", s, err)}
+			}
+			if seconds < 0 {
+				return nil, &requestError{Err: fmt.Errorf("timeout %d out of range", seconds)}
+			}
+			timeout = time.Duration(seconds) * time.Second
+		}
+
+		dropped, err := migrate(name, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: %w", err)
+		}
+
+		return &struct {
+			Device  string `json:"device"`
+			Dropped int    `json:"dropped"`
+		}{Device: upstream().LocalDev().Alias(), Dropped: dropped}, nil
+	})
+
+	return mux
+}
+
+func isAuthorized(req *http.Request, token string) bool {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+func proxyFlowKey(port uint16, dst *net.TCPAddr) string {
+	return fmt.Sprintf("%d-%s", port, dst)
+}
+
+// injectProxyHeader prepends a PROXY protocol header to the first data segment of a TCP connection, which may be the
+// SYN in TCP Fast Open, and shifts the sequence numbers of the following segments by the size of the header. The TCP
+// layer should be with the distributed port.
+func injectProxyHeader(layer *layers.TCP, src, dst *net.TCPAddr, payload []byte) ([]byte, error) {
+	key := proxyFlowKey(uint16(layer.SrcPort), dst)
+
+	// New connection
+	if layer.SYN && !layer.ACK {
+		flow := &proxyFlow{seq: layer.Seq + 1}
+
+		// Data in SYN of TCP Fast Open, which will be retransmitted after the handshake if it is not accepted
+		if len(payload) > 0 {
+			header, err := pcap.CreateProxyProtocolHeader(src, dst)
+			if err != nil {
+				return nil, fmt.Errorf("create proxy protocol header: %w", err)
+			}
+
+			flow.offset = uint32(len(header))
+			flow.isInjected = true
+			payload = append(header, payload...)
+
+			log.Verbosef("Send PROXY protocol header in TCP Fast Open: %s -> %s\n", src, dst)
+		}
+
+		proxyLock.Lock()
+		proxyFlows[key] = flow
+		proxyLock.Unlock()
+
+		return payload, nil
+	}
+
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
+
+	flow, ok := proxyFlows[key]
+	if !ok {
+		// The connection was established before
+		return payload, nil
+	}
+
+	// First data segment, or its retransmission
+	if layer.Seq == flow.seq && len(payload) > 0 {
+		header, err := pcap.CreateProxyProtocolHeader(src, dst)
+		if err != nil {
+			return nil, fmt.Errorf("create proxy protocol header: %w", err)
+		}
+
+		if !flow.isInjected {
+			flow.offset = uint32(len(header))
+			flow.isInjected = true
+
+			log.Verbosef("Send PROXY protocol header: %s -> %s\n", src, dst)
+		}
+
+		return append(header, payload...), nil
+	}
+
+	// Following segments
+	if flow.isInjected && int32(layer.Seq-flow.seq) >= 0 {
+		layer.Seq = layer.Seq + flow.offset
+	}
+
+	return payload, nil
+}
+
+// restoreProxyAck shifts the acknowledgement and SACK blocks of a TCP segment from the destination back by the size of
+// the injected PROXY protocol header. The TCP layer should be with the distributed port.
+func restoreProxyAck(layer *layers.TCP, dst *net.TCPAddr) {
+	key := proxyFlowKey(uint16(layer.DstPort), dst)
+
+	proxyLock.RLock()
+	flow, ok := proxyFlows[key]
+	proxyLock.RUnlock()
+	if !ok || !flow.isInjected {
+		return
+	}
+
+	restore := func(n uint32) uint32 {
+		diff := int32(n - flow.seq)
+		if diff <= 0 {
+			return n
+		}
+		// Acknowledge part of the header
+		if uint32(diff) <= flow.offset {
+			return flow.seq
+		}
+		return n - flow.offset
+	}
+
+	if layer.ACK {
+		layer.Ack = restore(layer.Ack)
+	}
+
+	for i, option := range layer.Options {
+		if option.OptionType != layers.TCPOptionKindSACK {
+			continue
+		}
+
+		data := make([]byte, len(option.OptionData))
+		copy(data, option.OptionData)
+		for j := 0; j+8 <= len(data); j = j + 8 {
+			binary.BigEndian.PutUint32(data[j:], restore(binary.BigEndian.Uint32(data[j:])))
+			binary.BigEndian.PutUint32(data[j+4:], restore(binary.BigEndian.Uint32(data[j+4:])))
+		}
+		layer.Options[i].OptionData = data
+	}
+}
+
+// resolve returns the hardware address of the next hop to the destination IP. If the destination is on-link and its
+// hardware address is unknown, an ARP request will be sent, and the gateway will be used until the ARP is replied. If
+// there is no gateway, all destinations are regarded as on-link, and nil will be returned until the ARP is replied. If
+// a gateway is selected, off-link destinations will be routed through it instead of the default gateway.
+func resolve(ip, gateway net.IP) net.HardwareAddr {
+	var (
+		gatewayHardwareAddr net.HardwareAddr
+		up                  = upstream()
+	)
+
+	local := up.LocalDev().IPAddr()
+	if up.RemoteDev() != nil {
+		gatewayHardwareAddr = gatewayMAC.Load().(net.HardwareAddr)
+
+		// Gateway itself, or off-link through the default gateway. The default gateway is resolved again once its
+		// ARP expires, so that its failover is followed
+		if isGateway(ip) || ((local == nil || !local.Contains(ip)) && gateway == nil) {
+			if local != nil && arpCache.Get(up.RemoteDev().IPAddr().IP) == nil {
+				requestARP(local.IP, up.RemoteDev().IPAddr().IP)
+			}
+			return gatewayHardwareAddr
+		}
+
+		// Off-link
+		if local == nil || !local.Contains(ip) {
+			ip = gateway
+		}
+	}
+	if local == nil {
+		return nil
+	}
+
+	hardwareAddr := arpCache.Get(ip)
+	if hardwareAddr != nil {
+		return hardwareAddr
+	}
+
+	requestARP(local.IP, ip)
+
+	return gatewayHardwareAddr
+}
+
+// requestARP sends an ARP request of the IP, if it is not requested recently.
+func requestARP(srcIP, ip net.IP) {
+	if !arpCache.ShouldRequest(ip) {
+		return
+	}
+
+	up := upstream()
+	data, err := pcap.CreateARPRequest(up.LocalDev().HardwareAddr(), srcIP, ip)
+	if err != nil {
+		log.Errorln(fmt.Errorf("create arp request: %w", err))
+		return
+	}
+
+	_, err = up.Write(data)
+	if err != nil {
+		log.Errorln(fmt.Errorf("write arp request: %w", err))
+		return
+	}
+
+	log.Verbosef("Request ARP of %s\n", ip)
+}
+
+// isGateway reports whether the IP is the default gateway of the upstream.
+func isGateway(ip net.IP) bool {
+	up := upstream()
+
+	return up.RemoteDev() != nil && up.RemoteDev().IPAddr().IP.Equal(ip)
+}
+
+// storeGatewayMAC resets the hardware address of the default gateway to the one of the gateway device.
+func storeGatewayMAC(dev *pcap.Device) {
+	var hardwareAddr net.HardwareAddr
+	if dev != nil {
+		hardwareAddr = dev.HardwareAddr()
+	}
+
+	gatewayMAC.Store(hardwareAddr)
+}
+
+// updateGatewayMAC updates the hardware address of the default gateway resolved by ARP, which changes when the gateway
+// fails over to another router.
+func updateGatewayMAC(hardwareAddr net.HardwareAddr) {
+	old := gatewayMAC.Load().(net.HardwareAddr)
+	if bytes.Equal(old, hardwareAddr) {
+		return
+	}
+
+	temp := make(net.HardwareAddr, len(hardwareAddr))
+	copy(temp, hardwareAddr)
+	gatewayMAC.Store(temp)
+
+	log.Infof("Gateway %s changes hardware address from %s to %s\n", upstream().RemoteDev().IPAddr().IP, old, temp)
+}
+
+// clientName returns the name of the client, which is the identity of the client authenticated by its key if it
+// exists, the address assigned to the client if it exists, or the remote address of the connection.
+func clientName(conn net.Conn) string {
+	helloLock.RLock()
+	id, isAuthenticated := clientIDs[conn]
+	ip, ok := clientAddrs[conn]
+	helloLock.RUnlock()
+	if isAuthenticated {
+		return id
+	}
+	if ok {
+		return ip.String()
+	}
+
+	return conn.RemoteAddr().String()
+}
+
+// dist distributes a port or Id in sequence from the pool. NAT must be locked by the caller, as with distHashed and
+// distPreserved.
+func dist(t gopacket.LayerType) (uint16, error) {
+	now := clock.Now()
+
+	switch t {
+	case layers.LayerTypeTCP:
+		for i := 0; i < 16384; i++ {
+			s := nextTCPPort % 16384
+
+			// Point to next port
+			nextTCPPort++
+
+			// Check if the port is alive
+			last := tcpPortPool[s]
+			if now.Sub(last) > idleTimeout(t, s) {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
+				}
+				return 49152 + s, nil
+			}
+		}
+	case layers.LayerTypeUDP:
+		for i := 0; i < 16384; i++ {
+			s := nextUDPPort % 16384
+
+			// Point to next port
+			nextUDPPort++
+
+			// Check if the port is alive
+			last := udpPortPool[49152+s]
+			if now.Sub(last) > idleTimeout(t, s) {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
+				}
+				return 49152 + s, nil
+			}
+		}
+	case layers.LayerTypeICMPv4:
+		for i := 0; i < 65536; i++ {
+			s := nextICMPv4Id
+
+			// Point to next Id
+			nextICMPv4Id++
+
+			// Check if the Id is alive
+			last := icmpv4IdPool[s]
+			if now.Sub(last) > idleTimeout(t, s) {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s ID %d\n", t, s)
+				}
+				return s, nil
+			}
+		}
+	default:
+		pool, ok := portPools[t]
+		if !ok {
+			return 0, fmt.Errorf("transport layer type %s not support", t)
+		}
+
+		for i := 0; i < 16384; i++ {
+			s := nextPorts[t] % 16384
+
+			// Point to next port
+			nextPorts[t]++
+
+			// Check if the port is alive
+			last := pool[s]
+			if now.Sub(last) > idleTimeout(t, s) {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
+				}
+				return 49152 + s, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("%s pool empty", t)
+}
+
+// distHashed distributes a port or Id by the hash of the key of a flow. If the port or Id is alive, the following ones
+// will be probed linearly, so a flow is distributed the same port or Id across runs unless it collides with another.
+func distHashed(t gopacket.LayerType, key string) (uint16, error) {
+	var (
+		size int
+		base uint16
+		pool []time.Time
+	)
+
+	switch t {
+	case layers.LayerTypeTCP:
+		size, base, pool = 16384, 49152, tcpPortPool
+	case layers.LayerTypeUDP:
+		size, base, pool = 16384, 49152, udpPortPool[49152:]
+	case layers.LayerTypeICMPv4:
+		size, base, pool = 65536, 0, icmpv4IdPool
+	default:
+		var ok bool
+
+		size, base = 16384, 49152
+		pool, ok = portPools[t]
+		if !ok {
+			return 0, fmt.Errorf("transport layer type %s not support", t)
+		}
+	}
+
+	start := int(hashFlow(key) % uint32(size))
+
+	now := clock.Now()
+	for i := 0; i < size && i < maxHashProbes; i++ {
+		s := uint16((start + i) % size)
+
+		// Check if the port or Id is alive
+		last := pool[s]
+		if now.Sub(last) > idleTimeout(t, s) {
+			if !last.IsZero() && t == layers.LayerTypeICMPv4 {
+				log.Verbosef("Recycle %s ID %d\n", t, s)
+			} else if !last.IsZero() {
+				log.Verbosef("Recycle %s port %d\n", t, base+s)
+			}
+			return base + s, nil
+		}
+	}
+
+	// Flows crafted to be hashed to the same range would make every distribution probe the whole range, so the port
+	// or Id is distributed in sequence instead
+	log.Verbosef("Distribute %s port or ID in sequence for too many probes: %s\n", t, key)
+
+	return dist(t)
+}
+
+// newHashSeed returns a random seed of hashes of flows, which is used if no seed is set. Flows are hashed to different
+// values after restarting with a random seed.
+func newHashSeed() ([]byte, error) {
+	seed := make([]byte, sha256.Size)
+	_, err := rand.Read(seed)
+	if err != nil {
+		return nil, err
+	}
+
+	return seed, nil
+}
+
+// hashFlow hashes the key of a flow. The hash is keyed by the hash seed, which is random in every process unless it is
+// set, so flows cannot be crafted to be hashed to the same value without knowing the seed.
+func hashFlow(key string) uint32 {
+	if hashSeed != nil {
+		mac := hmac.New(sha256.New, hashSeed)
+		mac.Write([]byte(key))
+
+		return binary.BigEndian.Uint32(mac.Sum(nil))
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	return h.Sum32()
+}
+
+// allocFlow distributes a port or Id to a new flow of a client unless the client has reached the limit of flows, and
+// returns false if so. Ports are hashed by the key if hashing is enabled. NAT must be locked by the caller.
+func allocFlow(q natKey, key string, maxFlows int) (uint16, bool, error) {
+	var (
+		err   error
+		value uint16
+	)
+
+	// Limit flows of the client
+	if maxFlows > 0 && countFlows(q.client) >= maxFlows {
+		return 0, false, nil
+	}
+
+	if t := q.src.Protocol; t == layers.LayerTypeUDP && preserveUDP {
+		value, err = distPreserved(t, q.src.Value)
+	} else if hashPorts {
+		value, err = distHashed(t, key)
+	} else {
+		value, err = dist(t)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Keep the port or Id alive since now, or housekeeping may evict the flow before its first packet is sent
+	keepValue(q.src.Protocol, value)
+
+	patMap[q] = value
+	logNATEvent("Allocate", q, value)
+
+	usageLock.Lock()
+	clientFlows[q.client]++
+	usageLock.Unlock()
+
+	return value, true, nil
+}
+
+// distPreserved returns the given source port if it is free, or distributes a port from the pool otherwise. UDP ports
+// are kept alive in the whole range, while only ones from 49152 to 65535 are distributed.
+func distPreserved(t gopacket.LayerType, srcPort uint16) (uint16, error) {
+	var last time.Time
+
+	switch t {
+	case layers.LayerTypeUDP:
+		last = udpPortPool[srcPort]
+	default:
+		return 0, fmt.Errorf("transport layer type %s not support", t)
+	}
+
+	// The listen port cannot be preserved, whose packets are never captured from the upstream
+	if srcPort != port && clock.Now().Sub(last) > idleTimeout(t, srcPort) {
+		return srcPort, nil
+	}
+
+	log.Verbosef("Cannot preserve %s port %d\n", t, srcPort)
+
+	return dist(t)
+}
+
+// housekeep runs periodic maintenance in every interval until the context is cancelled.
+func housekeep(ctx context.Context, interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			tick(clock.Now())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// tick runs periodic maintenance once at the given time.
+func tick(now time.Time) {
+	checkMemory(now)
+	updateFlows(now)
+	exportFlows(now, false)
+	probeClients(now)
+	announceAddr(now)
+	checkKillSwitch(now)
+	expireSNI()
+}
+
+// probeClients sends keepalive probes to clients in FakeTCP periodically.
+func probeClients(now time.Time) {
+	if keepAlive <= 0 || now.Sub(lastProbe) < keepAlive {
+		return
+	}
+	lastProbe = now
+
+	helloLock.RLock()
+	conns := make([]net.Conn, 0, len(hellos))
+	for conn := range hellos {
+		conns = append(conns, conn)
+	}
+	helloLock.RUnlock()
+
+	for _, conn := range conns {
+		if coalescedConn, ok := conn.(*pcap.CoalescedConn); ok {
+			conn = coalescedConn.Conn
+		}
+		fakeTCPConn, ok := conn.(*pcap.FakeTCPConn)
+		if !ok {
+			continue
+		}
+
+		err := fakeTCPConn.KeepAlive()
+		if err != nil {
+			log.Errorln(fmt.Errorf("keepalive %s: %w", conn.RemoteAddr(), err))
+		}
+	}
+}
+
+// announceAddr sends gratuitous ARP requests of the upstream address periodically, so that the gateway and switches
+// learn it before replies arrive, which matters if it is an additional address of the upstream device.
+func announceAddr(now time.Time) {
+	if gratuitousARP <= 0 || now.Sub(lastAnnounce) < gratuitousARP {
+		return
+	}
+	lastAnnounce = now
+
+	// Only Ethernet devices resolve addresses by ARP
+	up := upstream()
+	if up.IsRaw() || up.IsLoop() {
+		return
+	}
+
+	ip := up.LocalDev().IPAddr().IP
+	data, err := pcap.CreateGratuitousARP(up.LocalDev().HardwareAddr(), ip)
+	if err != nil {
+		log.Errorln(fmt.Errorf("create gratuitous arp: %w", err))
+		return
+	}
+
+	_, err = up.Write(data)
+	if err != nil {
+		log.Errorln(fmt.Errorf("write gratuitous arp: %w", err))
+		return
+	}
+
+	log.Verbosef("Announce ARP of %s\n", ip)
+}
+
+// clientQueue returns the size of queued packets of a client.
+func clientQueue(conn net.Conn) *int64 {
+	usageLock.RLock()
+	queued, ok := clientQueues[conn]
+	usageLock.RUnlock()
+	if ok {
+		return queued
+	}
+
+	usageLock.Lock()
+	defer usageLock.Unlock()
+
+	queued, ok = clientQueues[conn]
+	if !ok {
+		queued = new(int64)
+		clientQueues[conn] = queued
+	}
+
+	return queued
+}
+
+// admitQueue queues the size of a packet of a client, and returns false if the client would exceed the limit of queued
+// packets.
+func admitQueue(conn net.Conn, n int, maxQueued int) bool {
+	queued := clientQueue(conn)
+	if maxQueued > 0 && atomic.LoadInt64(queued)+int64(n) > int64(maxQueued) {
+		return false
+	}
+	atomic.AddInt64(queued, int64(n))
+
+	return true
+}
+
+// releaseQueue releases the size of a handled packet from queued packets of a client.
+func releaseQueue(conn net.Conn, n int) {
+	usageLock.RLock()
+	queued, ok := clientQueues[conn]
+	usageLock.RUnlock()
+	if ok {
+		atomic.AddInt64(queued, -int64(n))
+	}
+}
+
+func countFlows(client string) int {
+	usageLock.RLock()
+	defer usageLock.RUnlock()
+
+	return clientFlows[client]
+}
+
+// updateFlows counts alive flows of each client. Flows created between updates are counted when they are created.
+func updateFlows(now time.Time) {
+	counts := make(map[string]int)
+
+	natLock.RLock()
+	for q, value := range patMap {
+		var (
+			last time.Time
+			s    uint16
+		)
+
+		switch q.src.Protocol {
+		case layers.LayerTypeTCP:
+			s = convertFromPort(value)
+			last = tcpPortPool[s]
+		case layers.LayerTypeUDP:
+			s = value
+			last = udpPortPool[s]
+		case layers.LayerTypeICMPv4:
+			s = value
+			last = icmpv4IdPool[s]
+		default:
+			pool, ok := portPools[q.src.Protocol]
+			if !ok {
+				continue
+			}
+
+			s = convertFromPort(value)
+			last = pool[s]
+		}
+
+		if now.Sub(last) <= idleTimeout(q.src.Protocol, s) {
+			counts[q.client]++
+		}
+	}
+	natLock.RUnlock()
+
+	usageLock.Lock()
+	clientFlows = counts
+	usageLock.Unlock()
+}
+
+// isFlow returns if a packet belongs to a flow which can be exported, which is in TCP, UDP or ICMPv4 query.
+func isFlow(indicator *pcap.PacketIndicator) bool {
+	switch indicator.TransportLayer().LayerType() {
+	case layers.LayerTypeTCP, layers.LayerTypeUDP:
+		return true
+	case layers.LayerTypeICMPv4:
+		return indicator.ICMPv4Indicator().IsQuery()
+	default:
+		return false
+	}
+}
+
+// translateAddr returns the address distributed to a flow in the upstream.
+func translateAddr(t gopacket.LayerType, ip net.IP, value uint16) net.Addr {
+	switch t {
+	case layers.LayerTypeTCP:
+		return &net.TCPAddr{IP: ip, Port: int(value)}
+	case layers.LayerTypeUDP:
+		return &net.UDPAddr{IP: ip, Port: int(value)}
+	default:
+		return &addr.ICMPQueryAddr{IP: ip, Id: value}
+	}
+}
+
+func splitAddr(a net.Addr) (net.IP, uint16) {
+	switch a := a.(type) {
+	case *net.TCPAddr:
+		return a.IP, uint16(a.Port)
+	case *net.UDPAddr:
+		return a.IP, uint16(a.Port)
+	case *addr.ICMPQueryAddr:
+		return a.IP, 0
+	default:
+		panic(fmt.Errorf("type %T not support", a))
+	}
+}
+
+// recordFlow counts a packet of an unidirectional flow for exporting. The flow is identified by its addresses before
+// translation, and also recorded with its addresses after translation.
+func recordFlow(src, dst, postSrc, postDst net.Addr, t gopacket.LayerType, size int) {
+	q := quintuple{
+		src:      src.String(),
+		dst:      dst.String(),
+		protocol: t,
+	}
+
+	flowLock.Lock()
+	defer flowLock.Unlock()
+
+	record, ok := flowRecords[q]
+	if !ok {
+		record = &stat.FlowRecord{}
+		record.SrcIP, record.SrcPort = splitAddr(src)
+		record.DstIP, record.DstPort = splitAddr(dst)
+		record.PostSrcIP, record.PostSrcPort = splitAddr(postSrc)
+		record.PostDstIP, record.PostDstPort = splitAddr(postDst)
+		switch t {
+		case layers.LayerTypeTCP:
+			record.Protocol = uint8(layers.IPProtocolTCP)
+		case layers.LayerTypeUDP:
+			record.Protocol = uint8(layers.IPProtocolUDP)
+		case layers.LayerTypeICMPv4:
+			record.Protocol = uint8(layers.IPProtocolICMPv4)
+		}
+
+		flowRecords[q] = record
+	}
+	record.Add(size, clock.Now())
+}
+
+// exportFlows exports records of flows which are idle longer than their NAT timeout, or active longer than the active
+// timeout, and logs their summaries in JSON if it is enabled. All records will be exported if all is set.
+func exportFlows(now time.Time, all bool) {
+	if flowRecords == nil {
+		return
+	}
+
+	records := make([]*stat.FlowRecord, 0)
+
+	flowLock.Lock()
+	for q, record := range flowRecords {
+		var timeout int
+		switch q.protocol {
+		case layers.LayerTypeTCP:
+			timeout = natConfig.TCPEstablished
+		case layers.LayerTypeUDP:
+			timeout = natConfig.UDP
+		default:
+			timeout = natConfig.ICMP
+		}
+
+		if all || now.Sub(record.End) > time.Duration(timeout)*time.Second {
+			if record.Packets > 0 {
+				records = append(records, record)
+			}
+			delete(flowRecords, q)
+		} else if record.Packets > 0 && now.Sub(record.Start) > flowActiveTimeout {
+			temp := *record
+			records = append(records, &temp)
+
+			record.Bytes = 0
+			record.Packets = 0
+			record.Start = time.Time{}
+		}
+	}
+	flowLock.Unlock()
+
+	if len(records) <= 0 {
+		return
+	}
+
+	if logFormat == logFormatJSON {
+		for _, record := range records {
+			logFlowSummary(now, record)
+		}
+	}
+
+	if flowExporter == nil {
+		return
+	}
+
+	err := flowExporter.Export(records)
+	if err != nil {
+		log.Errorln(fmt.Errorf("export flows: %w", err))
+		return
+	}
+
+	log.Verbosef("Export %d flows\n", len(records))
+}
+
+// checkMemory estimates the memory used by NAT and fragments, and evicts idle flows early if it approaches the budget.
+func checkMemory(now time.Time) {
+	usage := estimateMemory()
+	if maxMemory > 0 && usage >= int64(maxMemory)*9/10 {
+		atomic.StoreInt32(&overBudget, 1)
+
+		evicted := evictIdle(now)
+		if evicted > 0 {
+			log.Verbosef("Evict %d idle flows for memory\n", evicted)
+		}
+		usage = estimateMemory()
+		if usage >= int64(maxMemory) {
+			log.Verbosef("Memory %d Bytes over budget %d Bytes\n", usage, maxMemory)
+		}
+	} else {
+		atomic.StoreInt32(&overBudget, 0)
+	}
+
+	atomic.StoreInt64(&memoryUsage, usage)
+}
+
+func estimateMemory() int64 {
+	natLock.RLock()
+	flows := len(patMap) + len(nat)
+	natLock.RUnlock()
+
+	return int64(flows*flowMemory) + atomic.LoadInt64(&fragsSize)
+}
+
+// isUnsupported reports whether a parse error is caused by an unsupported protocol.
+func isUnsupported(err *pcap.ParseError) bool {
+	return err.Reason == pcap.ParseReasonUnsupportedNetwork || err.Reason == pcap.ParseReasonUnsupportedTransport
+}
+
+// natGuide returns the guide of NAT of the port or Id distributed in the protocol.
+func natGuide(protocol gopacket.LayerType, upIP net.IP, value uint16) pcap.NATGuide {
+	return pcap.NewNATGuide(upIP, value, protocol)
+}
+
+// natGuideOf returns the guide of NAT of the address in the protocol.
+func natGuideOf(a net.Addr, protocol gopacket.LayerType) pcap.NATGuide {
+	switch t := a.(type) {
+	case *net.IPAddr:
+		return pcap.NewNATGuide(t.IP, 0, protocol)
+	case *net.TCPAddr:
+		return pcap.NewNATGuide(t.IP, uint16(t.Port), protocol)
+	case *net.UDPAddr:
+		return pcap.NewNATGuide(t.IP, uint16(t.Port), protocol)
+	case *addr.ICMPQueryAddr:
+		return pcap.NewNATGuide(t.IP, t.Id, protocol)
+	case *addr.PortAddr:
+		return pcap.NewNATGuide(t.IP, t.Port, protocol)
+	default:
+		panic(fmt.Errorf("type %T not support", t))
+	}
+}
+
+// parseNATGuide parses a guide of NAT in the protocol formatted by its String method.
+func parseNATGuide(s string, protocol gopacket.LayerType) (pcap.NATGuide, error) {
+	sep := strings.LastIndex(s, ":")
+	if protocol == layers.LayerTypeICMPv4 {
+		sep = strings.LastIndex(s, "@")
+	}
+	if sep < 0 {
+		return pcap.NATGuide{}, errors.New("invalid address")
+	}
+
+	ip := net.ParseIP(s[:sep])
+	if ip == nil || ip.To4() == nil {
+		return pcap.NATGuide{}, fmt.Errorf("invalid ip %s", s[:sep])
+	}
+	value, err := strconv.ParseUint(s[sep+1:], 10, 16)
+	if err != nil {
+		return pcap.NATGuide{}, fmt.Errorf("parse port or id %s: %w", s[sep+1:], err)
+	}
 
-			upValue, err = dist(embIndicator.TransportLayer().LayerType())
-			if err != nil {
-				return fmt.Errorf("distribute: %w", err)
-			}
+	return pcap.NewNATGuide(ip, uint16(value), protocol), nil
+}
 
-			patMap[q] = upValue
-		}
+// isOwned reports whether the port or Id distributed to a flow is still owned by it. The port or Id of an idle flow
+// may be recycled and distributed to another flow, which owns the NAT since then, and replies must not be routed to
+// the former one when it is active again. NAT must be locked by the caller.
+func isOwned(q natKey, value uint16) bool {
+	ni, ok := nat[natGuide(q.src.Protocol, upstream().LocalDev().IPAddr().IP, value)]
+	if !ok {
+		return true
 	}
 
-	// Create new transport layer
-	if embIndicator.TransportLayer() != nil {
-		switch t := embIndicator.TransportLayer().LayerType(); t {
-		case layers.LayerTypeTCP:
-			tcpLayer := embIndicator.TCPLayer()
-			temp := *tcpLayer
-			newTransportLayer = &temp
+	return natGuideOf(ni.embSrc, q.src.Protocol) == q.src && clientName(ni.conn) == q.client
+}
 
-			newTCPLayer := newTransportLayer.(*layers.TCP)
+// evictIdle removes flows which are idle for a while from NAT before they expire, and returns the count of them.
+func evictIdle(now time.Time) int {
+	var (
+		evicted int
+		upIP    = upstream().LocalDev().IPAddr().IP
+	)
 
-			newTCPLayer.SrcPort = layers.TCPPort(upValue)
-		case layers.LayerTypeUDP:
-			udpLayer := embIndicator.UDPLayer()
-			temp := *udpLayer
-			newTransportLayer = &temp
+	natLock.Lock()
+	defer natLock.Unlock()
 
-			newUDPLayer := newTransportLayer.(*layers.UDP)
+	for q, value := range patMap {
+		var last *time.Time
 
-			newUDPLayer.SrcPort = layers.UDPPort(upValue)
+		switch q.src.Protocol {
+		case layers.LayerTypeTCP:
+			last = &tcpPortPool[convertFromPort(value)]
+		case layers.LayerTypeUDP:
+			last = &udpPortPool[value]
 		case layers.LayerTypeICMPv4:
-			if embIndicator.ICMPv4Indicator().IsQuery() {
-				temp := *embIndicator.ICMPv4Indicator().ICMPv4Layer()
-				newTransportLayer = &temp
-
-				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
+			last = &icmpv4IdPool[value]
+		default:
+			pool, ok := portPools[q.src.Protocol]
+			if !ok {
+				continue
+			}
 
-				newICMPv4Layer.Id = upValue
-			} else {
-				newTransportLayer = embIndicator.ICMPv4Indicator().NewPureICMPv4Layer()
+			last = &pool[convertFromPort(value)]
+		}
+		guide := natGuide(q.src.Protocol, upIP, value)
 
-				newICMPv4Layer := newTransportLayer.(*layers.ICMPv4)
+		if now.Sub(*last) <= keepIdle {
+			continue
+		}
 
-				temp := *embIndicator.ICMPv4Indicator().EmbIPv4Layer()
-				newEmbIPv4Layer := &temp
+		delete(patMap, q)
+		delete(nat, guide)
+		*last = time.Time{}
+		evicted++
+		logNATEvent("Release idle", q, value)
+	}
 
-				newEmbIPv4Layer.DstIP = upConn.LocalDev().IPAddr().IP
+	return evicted
+}
 
-				var (
-					err                  error
-					newEmbTransportLayer gopacket.Layer
-				)
+// releaseFlows removes flows of a client from NAT, and returns the count of them.
+func releaseFlows(conn net.Conn) int {
+	var (
+		released int
+		client   = clientName(conn)
+		upIP     = upstream().LocalDev().IPAddr().IP
+	)
 
-				embTransportLayerType := embIndicator.ICMPv4Indicator().EmbTransportLayer().LayerType()
-				switch embTransportLayerType {
-				case layers.LayerTypeTCP:
-					temp := *embIndicator.ICMPv4Indicator().EmbTCPLayer()
-					newEmbTransportLayer = &temp
+	natLock.Lock()
+	defer natLock.Unlock()
 
-					newEmbTCPLayer := newEmbTransportLayer.(*layers.TCP)
+	for q, value := range patMap {
+		if q.client != client {
+			continue
+		}
+		delete(patMap, q)
 
-					newEmbTCPLayer.DstPort = layers.TCPPort(upValue)
+		// The port may have been recycled by another flow
+		guide := natGuide(q.src.Protocol, upIP, value)
+		ni, ok := nat[guide]
+		if !ok || ni.conn != conn {
+			continue
+		}
+		delete(nat, guide)
+		freeValue(q.src.Protocol, value)
+		released++
+		logNATEvent("Release disconnected", q, value)
+	}
 
-					err = newEmbTCPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
-				case layers.LayerTypeUDP:
-					temp := *embIndicator.ICMPv4Indicator().EmbUDPLayer()
-					newEmbTransportLayer = &temp
+	return released
+}
 
-					newEmbUDPLayer := newEmbTransportLayer.(*layers.UDP)
+// logNATEvent logs an event in the lifecycle of a flow in NAT with the port or Id distributed to it, if it is enabled.
+func logNATEvent(event string, q natKey, value uint16) {
+	if !logNAT {
+		return
+	}
 
-					newEmbUDPLayer.DstPort = layers.UDPPort(upValue)
+	if logFormat == logFormatJSON {
+		b, err := json.Marshal(&flowEvent{
+			Time:     clock.Now().Format(time.RFC3339Nano),
+			Event:    strings.ToLower(strings.ReplaceAll(event, " ", "-")),
+			Protocol: q.src.Protocol.String(),
+			Src:      q.src.String(),
+			Client:   q.client,
+			NAT:      natGuide(q.src.Protocol, upstream().LocalDev().IPAddr().IP, value).String(),
+		})
+		if err != nil {
+			log.Errorln(fmt.Errorf("log flow event: %w", err))
+			return
+		}
 
-					err = newEmbUDPLayer.SetNetworkLayerForChecksum(newEmbIPv4Layer)
-				case layers.LayerTypeICMPv4:
-					temp := *embIndicator.ICMPv4Indicator().EmbICMPv4Layer()
-					newEmbTransportLayer = &temp
+		log.Infoln(string(b))
+		return
+	}
 
-					if embIndicator.ICMPv4Indicator().IsEmbQuery() {
-						newEmbICMPv4Layer := newEmbTransportLayer.(*layers.ICMPv4)
+	log.Infof("%s %s flow in NAT: %s (client %s) <-> %s\n",
+		event, q.src.Protocol, q.src, q.client, natGuide(q.src.Protocol, upstream().LocalDev().IPAddr().IP, value))
+}
 
-						newEmbICMPv4Layer.Id = upValue
-					}
-				default:
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("transport layer type %s not support", embTransportLayerType))
-				}
-				if err != nil {
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
-				}
+// logFlowSummary logs a summary of an unidirectional flow in JSON.
+func logFlowSummary(now time.Time, record *stat.FlowRecord) {
+	b, err := json.Marshal(&flowSummary{
+		Time:     now.Format(time.RFC3339Nano),
+		Event:    "summary",
+		Protocol: layers.IPProtocol(record.Protocol).String(),
+		Src:      net.JoinHostPort(record.SrcIP.String(), strconv.Itoa(int(record.SrcPort))),
+		Dst:      net.JoinHostPort(record.DstIP.String(), strconv.Itoa(int(record.DstPort))),
+		PostSrc:  net.JoinHostPort(record.PostSrcIP.String(), strconv.Itoa(int(record.PostSrcPort))),
+		PostDst:  net.JoinHostPort(record.PostDstIP.String(), strconv.Itoa(int(record.PostDstPort))),
+		Bytes:    record.Bytes,
+		Packets:  record.Packets,
+		Start:    record.Start.Format(time.RFC3339Nano),
+		End:      record.End.Format(time.RFC3339Nano),
+		Duration: record.End.Sub(record.Start).Seconds(),
+	})
+	if err != nil {
+		log.Errorln(fmt.Errorf("log flow summary: %w", err))
+		return
+	}
 
-				payload, err := pcap.Serialize(newEmbIPv4Layer, newEmbTransportLayer.(gopacket.SerializableLayer))
-				if err != nil {
-					return fmt.Errorf("create transport layer: %w", fmt.Errorf("serialize: %w", err))
-				}
+	log.Infoln(string(b))
+}
 
-				newICMPv4Layer.Payload = payload
-			}
-		default:
-			return fmt.Errorf("transport layer type %s not support", t)
+// freeValue frees a port or an Id in the pool, so that it can be distributed again immediately.
+func freeValue(protocol gopacket.LayerType, value uint16) {
+	switch protocol {
+	case layers.LayerTypeTCP:
+		tcpPortPool[convertFromPort(value)] = time.Time{}
+	case layers.LayerTypeUDP:
+		udpPortPool[value] = time.Time{}
+	case layers.LayerTypeICMPv4:
+		icmpv4IdPool[value] = time.Time{}
+	default:
+		pool, ok := portPools[protocol]
+		if ok {
+			pool[convertFromPort(value)] = time.Time{}
 		}
 	}
+}
 
-	// Create new network layer
-	switch t := embIndicator.NetworkLayer().LayerType(); t {
-	case layers.LayerTypeIPv4:
-		ipv4Layer := embIndicator.NetworkLayer().(*layers.IPv4)
-		temp := *ipv4Layer
-		newNetworkLayer = &temp
+// routeTTL returns the TTL of a packet after being routed, and reports false if the TTL will be exceeded, so the packet
+// should be dropped instead of forwarded with TTL 0. The TTL is preserved as is if TTL is not decremented.
+func routeTTL(ttl uint8) (uint8, bool) {
+	if !decrementTTL {
+		return ttl, true
+	}
+	if ttl <= 1 {
+		return 0, false
+	}
 
-		newIPv4Layer := newNetworkLayer.(*layers.IPv4)
+	return ttl - 1, true
+}
 
-		newIPv4Layer.SrcIP = upConn.LocalDev().IPAddr().IP
-		upIP = newIPv4Layer.SrcIP
+// keepValue marks a port or an Id in the pool alive at the time.
+func keepValue(protocol gopacket.LayerType, value uint16) {
+	now := clock.Now()
+
+	switch protocol {
+	case layers.LayerTypeTCP:
+		tcpPortPool[convertFromPort(value)] = now
+	case layers.LayerTypeUDP:
+		udpPortPool[value] = now
+	case layers.LayerTypeICMPv4:
+		icmpv4IdPool[value] = now
 	default:
-		return fmt.Errorf("network layer type %s not support", t)
+		pool, ok := portPools[protocol]
+		if ok {
+			pool[convertFromPort(value)] = now
+		}
 	}
+}
 
-	// Set network layer for transport layer
-	if newTransportLayer != nil {
-		switch t := newTransportLayer.LayerType(); t {
-		case layers.LayerTypeTCP:
-			tcpLayer := newTransportLayer.(*layers.TCP)
+// updateTCPState updates the state of a TCP port in the pool by a segment.
+func updateTCPState(s uint16, layer *layers.TCP) {
+	switch {
+	case layer.RST || layer.FIN:
+		tcpStates[s] = tcpClosing
+	case layer.SYN:
+		tcpStates[s] = tcpSYNSent
+	case tcpStates[s] == tcpSYNSent && layer.ACK:
+		tcpStates[s] = tcpEstablished
+	}
+}
 
-			err = tcpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
-		case layers.LayerTypeUDP:
-			udpLayer := newTransportLayer.(*layers.UDP)
+// idleTimeout returns the idle timeout of a port or Id in the pool.
+func idleTimeout(t gopacket.LayerType, s uint16) time.Duration {
+	var timeout int
 
-			err = udpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
-		case layers.LayerTypeICMPv4:
-			break
+	switch t {
+	case layers.LayerTypeTCP:
+		switch tcpStates[s] {
+		case tcpSYNSent:
+			timeout = natConfig.TCPSYN
+		case tcpClosing:
+			timeout = natConfig.TCPClosing
 		default:
-			return fmt.Errorf("transport layer type %s not support", t)
-		}
-		if err != nil {
-			return fmt.Errorf("set network layer for checksum: %w", err)
+			timeout = natConfig.TCPEstablished
 		}
+	case layers.LayerTypeICMPv4:
+		timeout = natConfig.ICMP
+	default:
+		// Other transports are connectionless as UDP from the view of NAT
+		timeout = natConfig.UDP
 	}
 
-	// Decide Loopback or Ethernet
-	if upConn.IsLoop() {
-		newLinkLayerType = layers.LayerTypeLoopback
-	} else {
-		newLinkLayerType = layers.LayerTypeEthernet
-	}
+	return time.Duration(timeout) * time.Second
+}
 
-	// Create new link layer
-	switch newLinkLayerType {
-	case layers.LayerTypeLoopback:
-		newLinkLayer, err = pcap.CreateLoopbackLayer(newNetworkLayer)
-	case layers.LayerTypeEthernet:
-		newLinkLayer, err = pcap.CreateEthernetLayer(upConn.LocalDev().HardwareAddr(), upConn.RemoteDev().HardwareAddr(), newNetworkLayer)
+// natPort returns the port of an address used in NAT.
+func natPort(a net.Addr) uint16 {
+	switch t := a.(type) {
+	case *net.TCPAddr:
+		return uint16(t.Port)
+	case *net.UDPAddr:
+		return uint16(t.Port)
+	case *addr.PortAddr:
+		return t.Port
 	default:
-		return fmt.Errorf("link layer type %s not support", newLinkLayerType)
-	}
-	if err != nil {
-		return fmt.Errorf("create link layer: %w", err)
+		panic(fmt.Errorf("type %T not support", t))
 	}
+}
 
-	// Fragment
-	fragments, err = pcap.CreateFragmentPackets(newLinkLayer, newNetworkLayer, newTransportLayer, embIndicator.Payload(), fragment)
-	if err != nil {
-		return fmt.Errorf("fragment: %w", err)
-	}
+func convertFromPort(port uint16) uint16 {
+	return port - 49152
+}
 
-	// Write packet data
-	for i, fragment := range fragments {
-		_, err = upConn.Write(fragment)
-		if err != nil {
-			return fmt.Errorf("write: %w", err)
+// recoverHandle calls the handler and converts a panic in it into an error, so a malformed packet will not crash the
+// process.
+func recoverHandle(handle func() error) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			log.Verboseln(string(debug.Stack()))
 		}
+	}()
 
-		if i == len(fragment)-1 {
-			log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n",
-				embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
-		} else {
-			log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (...)\n",
-				embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String())
-		}
+	return handle()
+}
+
+func pin(cpu int) {
+	runtime.LockOSThread()
+
+	err := exec.SetAffinity(cpu)
+	if err != nil {
+		log.Errorln(fmt.Errorf("set affinity to cpu %d: %w", cpu, err))
 	}
+}
 
-	// NAT
-	if embIndicator.TransportLayer() != nil {
-		// Record the source and the source device of the packet
-		var (
-			guide  pcap.NATGuide
-			addNAT bool
-		)
+func parsePayloadLimit(s string) (gopacket.LayerType, *payloadLimit, error) {
+	var t gopacket.LayerType
 
-		switch t := embIndicator.TransportLayer().LayerType(); t {
-		case layers.LayerTypeTCP:
-			a := net.TCPAddr{
-				IP:   upIP,
-				Port: int(upValue),
-			}
-			guide = pcap.NATGuide{
-				Src:      a.String(),
-				Protocol: t,
-			}
-			addNAT = true
-		case layers.LayerTypeUDP:
-			a := net.UDPAddr{
-				IP:   upIP,
-				Port: int(upValue),
-			}
-			guide = pcap.NATGuide{
-				Src:      a.String(),
-				Protocol: t,
-			}
-			addNAT = true
-		case layers.LayerTypeICMPv4:
-			if embIndicator.ICMPv4Indicator().IsQuery() {
-				guide = pcap.NATGuide{
-					Src: addr.ICMPQueryAddr{
-						IP: upIP,
-						Id: upValue,
-					}.String(),
-					Protocol: t,
-				}
-				addNAT = true
-			}
-		default:
-			return fmt.Errorf("transport layer type %s not support", t)
-		}
-		if addNAT {
-			ni := &natIndicator{
-				src:    conn.RemoteAddr(),
-				embSrc: embIndicator.NATSrc(),
-				conn:   conn,
-			}
-			natLock.Lock()
-			nat[guide] = ni
-			natLock.Unlock()
-		}
+	strs := strings.Split(s, ":")
+	if len(strs) != 2 {
+		return gopacket.LayerTypeZero, nil, errors.New("invalid format")
+	}
 
-		// Keep alive
-		protocol := embIndicator.NATProtocol()
-		switch protocol {
-		case layers.LayerTypeTCP:
-			tcpPortPool[convertFromPort(upValue)] = time.Now()
-		case layers.LayerTypeUDP:
-			udpPortPool[convertFromPort(upValue)] = time.Now()
-		case layers.LayerTypeICMPv4:
-			icmpv4IdPool[upValue] = time.Now()
-		default:
-			return fmt.Errorf("transport layer type %s not support", protocol)
-		}
+	switch strings.ToLower(strs[0]) {
+	case "tcp":
+		t = layers.LayerTypeTCP
+	case "udp":
+		t = layers.LayerTypeUDP
+	case "icmp":
+		t = layers.LayerTypeICMPv4
+	default:
+		return gopacket.LayerTypeZero, nil, fmt.Errorf("protocol %s not support", strs[0])
 	}
 
-	// Statistics
-	if monitor != nil {
-		monitor.Add(conn.RemoteAddr().String(), stat.DirectionOut, uint(embIndicator.Size()))
+	sizes := strings.Split(strs[1], "-")
+	if len(sizes) != 2 {
+		return gopacket.LayerTypeZero, nil, errors.New("invalid range")
+	}
+	min, err := strconv.Atoi(sizes[0])
+	if err != nil {
+		return gopacket.LayerTypeZero, nil, fmt.Errorf("parse min %s: %w", sizes[0], err)
+	}
+	max, err := strconv.Atoi(sizes[1])
+	if err != nil {
+		return gopacket.LayerTypeZero, nil, fmt.Errorf("parse max %s: %w", sizes[1], err)
+	}
+	if min < 0 || max > pcap.IPv4MaxSize || min > max {
+		return gopacket.LayerTypeZero, nil, fmt.Errorf("range %d - %d out of range", min, max)
 	}
 
-	return nil
+	return t, &payloadLimit{min: min, max: max}, nil
 }
 
-func handleUpstream(packet gopacket.Packet) error {
-	var (
-		err       error
-		indicator *pcap.PacketIndicator
-		frags     []*pcap.PacketIndicator
-		ni        *natIndicator
-		data      []byte
-	)
+func parsePortRange(s string) (gopacket.LayerType, *portRange, error) {
+	var t gopacket.LayerType
 
-	// Parse packet
-	indicator, err = pcap.ParsePacket(packet)
-	if err != nil {
-		return fmt.Errorf("parse packet: %w", err)
+	strs := strings.Split(s, ":")
+	if len(strs) != 2 {
+		return gopacket.LayerTypeZero, nil, errors.New("invalid format")
 	}
 
-	// Handle fragments
-	indicator, frags, err = defrag.AppendOriginal(indicator)
+	switch strings.ToLower(strs[0]) {
+	case "tcp":
+		t = layers.LayerTypeTCP
+	case "udp":
+		t = layers.LayerTypeUDP
+	default:
+		return gopacket.LayerTypeZero, nil, fmt.Errorf("protocol %s not support", strs[0])
+	}
+
+	ports := strings.Split(strs[1], "-")
+	if len(ports) > 2 {
+		return gopacket.LayerTypeZero, nil, errors.New("invalid range")
+	}
+	min, err := strconv.ParseUint(ports[0], 10, 16)
 	if err != nil {
-		return fmt.Errorf("defrag: %w", err)
+		return gopacket.LayerTypeZero, nil, fmt.Errorf("parse min %s: %w", ports[0], err)
 	}
-	if indicator == nil {
-		return nil
+	max := min
+	if len(ports) == 2 {
+		max, err = strconv.ParseUint(ports[1], 10, 16)
+		if err != nil {
+			return gopacket.LayerTypeZero, nil, fmt.Errorf("parse max %s: %w", ports[1], err)
+		}
+	}
+	if min <= 0 || min > max {
+		return gopacket.LayerTypeZero, nil, fmt.Errorf("range %d - %d out of range", min, max)
 	}
 
-	// NAT
-	guide := pcap.NATGuide{
-		Src:      indicator.NATDst().String(),
-		Protocol: indicator.TransportLayer().LayerType(),
+	return t, &portRange{min: uint16(min), max: uint16(max)}, nil
+}
+
+// isPriority reports whether an embedded packet should be handled with priority by its DSCP or destination port. Only
+// the headers are inspected, so hellos, batches and non-first fragments are handled without priority.
+func isPriority(contents []byte) bool {
+	if len(prioDSCPs) <= 0 && len(prioPorts) <= 0 {
+		return false
 	}
-	natLock.RLock()
-	ni, ok := nat[guide]
-	natLock.RUnlock()
-	if !ok {
-		return nil
+	if len(contents) < 20 || contents[0]>>4 != 4 {
+		return false
 	}
 
-	// Keep alive
-	protocol := indicator.NATProtocol()
-	switch protocol {
-	case layers.LayerTypeTCP:
-		tcpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
-	case layers.LayerTypeUDP:
-		udpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
-	case layers.LayerTypeICMPv4:
-		icmpv4IdPool[indicator.ICMPv4Indicator().Id()] = time.Now()
-	default:
-		return fmt.Errorf("transport layer type %s not support", protocol)
+	if prioDSCPs[contents[1]>>2] {
+		return true
 	}
 
-	for _, frag := range frags {
-		var (
-			embTransportLayer gopacket.Layer
-			embNetworkLayer   gopacket.NetworkLayer
-		)
+	var t gopacket.LayerType
+	switch layers.IPProtocol(contents[9]) {
+	case layers.IPProtocolTCP:
+		t = layers.LayerTypeTCP
+	case layers.IPProtocolUDP:
+		t = layers.LayerTypeUDP
+	default:
+		return false
+	}
+	ihl := int(contents[0]&0x0f) * 4
+	if binary.BigEndian.Uint16(contents[6:])&0x1fff != 0 || len(contents) < ihl+4 {
+		return false
+	}
 
-		// Create embedded transport layer
-		if frag.TransportLayer() != nil {
-			switch t := frag.TransportLayer().LayerType(); t {
-			case layers.LayerTypeTCP:
-				embTCPLayer := frag.TCPLayer()
-				temp := *embTCPLayer
-				embTransportLayer = &temp
+	port := binary.BigEndian.Uint16(contents[ihl+2:])
+	for _, r := range prioPorts[t] {
+		if port >= r.min && port <= r.max {
+			return true
+		}
+	}
 
-				newEmbTCPLayer := embTransportLayer.(*layers.TCP)
+	return false
+}
 
-				newEmbTCPLayer.DstPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
-			case layers.LayerTypeUDP:
-				embUDPLayer := frag.UDPLayer()
-				temp := *embUDPLayer
-				embTransportLayer = &temp
+// queues returns a snapshot of statistics of queues of packets from clients.
+func queues() []queueStats {
+	late := atomic.LoadUint64(&lateDrops)
+	prio := atomic.LoadUint64(&prioLate)
 
-				newEmbUDPLayer := embTransportLayer.(*layers.UDP)
+	return []queueStats{
+		{Name: "priority", Depth: len(prioQueue), Late: prio},
+		{Name: "normal", Depth: len(c), Late: late - prio},
+	}
+}
 
-				newEmbUDPLayer.DstPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
-			case layers.LayerTypeICMPv4:
-				if frag.ICMPv4Indicator().IsQuery() {
-					embICMPv4Layer := frag.ICMPv4Indicator().ICMPv4Layer()
-					temp := *embICMPv4Layer
-					embTransportLayer = &temp
+// isPortAllowed reports whether the destination port of a packet is allowed. TCP and UDP packets are only allowed to
+// the ports in the ranges of their protocol if any range is specified, and other packets are always allowed.
+func isPortAllowed(allowPorts map[gopacket.LayerType][]*portRange, indicator *pcap.PacketIndicator) bool {
+	if len(allowPorts) <= 0 {
+		return true
+	}
 
-					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
+	t := indicator.TransportLayer().LayerType()
+	if t != layers.LayerTypeTCP && t != layers.LayerTypeUDP {
+		return true
+	}
 
-					newEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
-				} else {
-					embTransportLayer = frag.ICMPv4Indicator().NewPureICMPv4Layer()
+	port := indicator.DstPort()
+	for _, r := range allowPorts[t] {
+		if port >= r.min && port <= r.max {
+			return true
+		}
+	}
 
-					newEmbICMPv4Layer := embTransportLayer.(*layers.ICMPv4)
+	return false
+}
 
-					temp := *frag.ICMPv4Indicator().EmbIPv4Layer()
-					newEmbEmbIPv4Layer := &temp
+// exportState exports the NAT state of alive flows. Handles and connections of clients are not exported, so NAT of a
+// flow will be rebuilt with the same port or Id on its next outbound packet after clients reconnect.
+func exportState() ([]byte, error) {
+	state := natState{Version: stateVersion, Flows: connections()}
 
-					newEmbEmbIPv4Layer.SrcIP = ni.embSrcIP()
+	return json.Marshal(state)
+}
 
-					var (
-						err                     error
-						newEmbEmbTransportLayer gopacket.Layer
-					)
+// connections returns a snapshot of alive flows in NAT.
+func connections() []natStateFlow {
+	flows := make([]natStateFlow, 0)
+	now := clock.Now()
 
-					switch t := frag.ICMPv4Indicator().EmbTransportLayer().LayerType(); t {
-					case layers.LayerTypeTCP:
-						temp := *frag.ICMPv4Indicator().EmbTCPLayer()
-						newEmbEmbTransportLayer = &temp
+	natLock.RLock()
+	defer natLock.RUnlock()
 
-						newEmbEmbTCPLayer := newEmbEmbTransportLayer.(*layers.TCP)
+	for q, value := range patMap {
+		var (
+			s        uint16
+			last     time.Time
+			tcpState uint8
+		)
 
-						newEmbEmbTCPLayer.SrcPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+		switch q.src.Protocol {
+		case layers.LayerTypeTCP:
+			s = convertFromPort(value)
+			last = tcpPortPool[s]
+			tcpState = tcpStates[s]
+		case layers.LayerTypeUDP:
+			s = value
+			last = udpPortPool[s]
+		case layers.LayerTypeICMPv4:
+			s = value
+			last = icmpv4IdPool[s]
+		default:
+			continue
+		}
+		if now.Sub(last) > idleTimeout(q.src.Protocol, s) {
+			continue
+		}
 
-						err = newEmbEmbTCPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
-					case layers.LayerTypeUDP:
-						temp := *frag.ICMPv4Indicator().EmbUDPLayer()
-						newEmbEmbTransportLayer = &temp
+		flows = append(flows, natStateFlow{
+			Src:      q.src.String(),
+			Client:   q.client,
+			Protocol: q.src.Protocol.String(),
+			Value:    value,
+			LastSeen: last.UnixNano(),
+			TCPState: tcpState,
+		})
+	}
 
-						newEmbEmbUDPLayer := newEmbEmbTransportLayer.(*layers.UDP)
+	return flows
+}
 
-						newEmbEmbUDPLayer.SrcPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
+// importState imports the NAT state exported by exportState.
+func importState(data []byte) error {
+	var state natState
 
-						err = newEmbEmbUDPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv4Layer)
-					case layers.LayerTypeICMPv4:
-						temp := *frag.ICMPv4Indicator().EmbICMPv4Layer()
-						newEmbEmbTransportLayer = &temp
+	err := json.Unmarshal(data, &state)
+	if err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("version %d not support", state.Version)
+	}
 
-						if frag.ICMPv4Indicator().IsEmbQuery() {
-							newEmbEmbICMPv4Layer := newEmbEmbTransportLayer.(*layers.ICMPv4)
+	natLock.Lock()
+	defer natLock.Unlock()
 
-							newEmbEmbICMPv4Layer.Id = ni.embSrc.(*addr.ICMPQueryAddr).Id
-						}
-					default:
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("transport layer type %s not support", t))
-					}
-					if err != nil {
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
-					}
+	for _, flow := range state.Flows {
+		var t gopacket.LayerType
 
-					payload, err := pcap.Serialize(newEmbEmbIPv4Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer))
-					if err != nil {
-						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
-					}
+		last := time.Unix(0, flow.LastSeen)
 
-					newEmbICMPv4Layer.Payload = payload
-				}
-			default:
-				return fmt.Errorf("embedded transport layer type %s not support", t)
+		switch flow.Protocol {
+		case layers.LayerTypeTCP.String():
+			if flow.Value < 49152 {
+				return fmt.Errorf("tcp port %d out of range", flow.Value)
 			}
+			t = layers.LayerTypeTCP
+			tcpPortPool[convertFromPort(flow.Value)] = last
+			tcpStates[convertFromPort(flow.Value)] = flow.TCPState
+		case layers.LayerTypeUDP.String():
+			t = layers.LayerTypeUDP
+			udpPortPool[flow.Value] = last
+		case layers.LayerTypeICMPv4.String():
+			t = layers.LayerTypeICMPv4
+			icmpv4IdPool[flow.Value] = last
+		default:
+			return fmt.Errorf("protocol %s not support", flow.Protocol)
 		}
 
-		// Create embedded network layer
-		switch t := frag.NetworkLayer().LayerType(); t {
-		case layers.LayerTypeIPv4:
-			embIPv4Layer := frag.IPv4Layer()
-			temp := *embIPv4Layer
-			embNetworkLayer = &temp
+		src, err := parseNATGuide(flow.Src, t)
+		if err != nil {
+			return fmt.Errorf("parse source %s: %w", flow.Src, err)
+		}
 
-			newEmbIPv4Layer := embNetworkLayer.(*layers.IPv4)
+		patMap[natKey{src: src, client: flow.Client}] = flow.Value
+	}
 
-			newEmbIPv4Layer.DstIP = ni.embSrcIP()
-		default:
-			return fmt.Errorf("embedded network layer type %s not support", t)
-		}
+	return nil
+}
 
-		// Set network layer for transport layer
-		if embTransportLayer != nil {
-			switch t := embTransportLayer.LayerType(); t {
-			case layers.LayerTypeTCP:
-				embTCPLayer := embTransportLayer.(*layers.TCP)
+func saveState(file string) error {
+	data, err := exportState()
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	err = ioutil.WriteFile(file, data, 0600)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
 
-				err = embTCPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
-			case layers.LayerTypeUDP:
-				embUDPLayer := embTransportLayer.(*layers.UDP)
+	log.Infof("Save NAT state to %s\n", file)
 
-				err = embUDPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
-			case layers.LayerTypeICMPv4:
-				break
-			default:
-				return fmt.Errorf("embedded transport layer type %s not support", t)
-			}
-			if err != nil {
-				return fmt.Errorf("set embedded network layer for checksum: %w", err)
-			}
-		}
+	return nil
+}
 
-		// Serialize layers
-		if embTransportLayer == nil {
-			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(frag.Payload()))
-		} else {
-			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
-				embTransportLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(frag.Payload()))
-		}
-		if err != nil {
-			return fmt.Errorf("serialize: %w", err)
+func restoreState(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return fmt.Errorf("read: %w", err)
+	}
 
-		// Write packet data
-		_, err = ni.conn.Write(data)
+	err = importState(data)
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+
+	log.Infof("Restore NAT state from %s\n", file)
+
+	return nil
+}
+
+func parseWeightedGateway(s string) (*weightedGateway, error) {
+	weight := 1
+
+	strs := strings.Split(s, ":")
+	if len(strs) > 2 {
+		return nil, errors.New("invalid gateway")
+	}
+	ip := net.ParseIP(strs[0])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %s", strs[0])
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("ip %s in ipv6 not support", ip)
+	}
+	if len(strs) > 1 {
+		var err error
+		weight, err = strconv.Atoi(strs[1])
 		if err != nil {
-			return fmt.Errorf("write: %w", err)
+			return nil, fmt.Errorf("parse weight %s: %w", strs[1], err)
 		}
-
-		// Statistics
-		size := frag.MTU()
-		if monitor != nil {
-			monitor.Add(ni.conn.RemoteAddr().String(), stat.DirectionIn, uint(size))
+		if weight <= 0 || weight > 255 {
+			return nil, fmt.Errorf("weight %d out of range", weight)
 		}
+	}
 
-		log.Verbosef("Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
-			frag.TransportProtocol(), ni.embSrc.String(), ni.src.String(), frag.Src(), size)
+	return &weightedGateway{ip: ip, weight: weight}, nil
+}
+
+// selectGateway selects a gateway by weights for packets between the source and the destination. The selection is
+// hashed, so all packets of a flow including fragments are routed through the same gateway.
+func selectGateway(src, dst net.IP) net.IP {
+	if len(gateways) <= 0 {
+		return nil
 	}
 
-	// Record DNS
-	if monitor != nil {
-		if indicator.DNSIndicator() != nil {
-			if indicator.DNSIndicator().IsResponse() {
-				name, ips := indicator.DNSIndicator().Answers()
-				if name != "" && len(ips) > 0 {
-					dnsLock.Lock()
-					for _, ip := range ips {
-						dns[ip.String()] = name
-						log.Verbosef("Record DNS record %s = %s\n", name, ip)
-					}
-					dnsLock.Unlock()
-				}
-			}
+	h := fnv.New32a()
+	h.Write(src.To4())
+	h.Write(dst.To4())
+
+	n := int(h.Sum32() % uint32(totalWeight))
+	for _, gw := range gateways {
+		if n < gw.weight {
+			return gw.ip
 		}
+		n = n - gw.weight
 	}
 
 	return nil
 }
 
-func dist(t gopacket.LayerType) (uint16, error) {
-	now := time.Now()
+// parseClientKey parses a public key of a client in the form of name:key, where the key is encoded in base64.
+func parseClientKey(s string) (string, ed25519.PublicKey, error) {
+	strs := strings.Split(s, ":")
+	if len(strs) != 2 || strs[0] == "" {
+		return "", nil, errors.New("invalid client key")
+	}
+	key, err := base64.StdEncoding.DecodeString(strs[1])
+	if err != nil {
+		return "", nil, fmt.Errorf("decode: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return "", nil, fmt.Errorf("key size %d out of range", len(key))
+	}
 
-	switch t {
-	case layers.LayerTypeTCP:
-		for i := 0; i < 16384; i++ {
-			s := nextTCPPort % 16384
+	return strs[0], key, nil
+}
 
-			// Point to next port
-			nextTCPPort++
+func parseNamedGateway(s string) (*namedGateway, error) {
+	strs := strings.Split(s, "=")
+	if len(strs) != 2 || strs[0] == "" {
+		return nil, errors.New("invalid gateway")
+	}
+	ip := net.ParseIP(strs[1])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %s", strs[1])
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("ip %s in ipv6 not support", ip)
+	}
 
-			// Check if the port is alive
-			last := tcpPortPool[s]
-			if now.Sub(last) > keepAlive {
-				if !last.IsZero() {
-					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
-				}
-				return 49152 + s, nil
-			}
-		}
-	case layers.LayerTypeUDP:
-		for i := 0; i < 16384; i++ {
-			s := nextUDPPort % 16384
+	return &namedGateway{pattern: strings.ToLower(strs[0]), ip: ip}, nil
+}
 
-			// Point to next port
-			nextUDPPort++
+// selectSNIGateway selects a gateway for a TLS flow by the server name in its ClientHello. The selection is cached per
+// flow, so only the first segment with payload of the flow is inspected.
+func selectSNIGateway(indicator *pcap.PacketIndicator, guide pcap.NATGuide) net.IP {
+	sniLock.RLock()
+	gw, ok := sniFlows[guide]
+	sniLock.RUnlock()
+	if ok {
+		return gw
+	}
+	if len(indicator.Payload()) <= 0 {
+		return nil
+	}
 
-			// Check if the port is alive
-			last := udpPortPool[s]
-			if now.Sub(last) > keepAlive {
-				if !last.IsZero() {
-					log.Verbosef("Recycle %s port %d\n", t, 49152+s)
-				}
-				return 49152 + s, nil
+	name, err := pcap.ParseSNI(indicator.Payload())
+	if err == nil {
+		name = strings.ToLower(name)
+		for _, g := range sniGateways {
+			if g.pattern == name || (strings.HasPrefix(g.pattern, "*.") && strings.HasSuffix(name, g.pattern[1:])) {
+				gw = g.ip
+				break
 			}
 		}
-	case layers.LayerTypeICMPv4:
-		for i := 0; i < 65536; i++ {
-			s := nextICMPv4Id
-
-			// Point to next Id
-			nextICMPv4Id++
-
-			// Check if the Id is alive
-			last := icmpv4IdPool[s]
-			if now.Sub(last) > keepAlive {
-				if !last.IsZero() {
-					log.Verbosef("Recycle %s ID %d\n", t, s)
-				}
-				return s, nil
-			}
+		if gw != nil {
+			log.Verbosef("Route TLS flow of %s through gateway %s: %s -> %s\n", name, gw, indicator.Src(), indicator.Dst())
 		}
-	default:
-		return 0, fmt.Errorf("transport layer type %s not support", t)
 	}
 
-	return 0, fmt.Errorf("%s pool empty", t)
+	sniLock.Lock()
+	sniFlows[guide] = gw
+	sniLock.Unlock()
+
+	return gw
 }
 
-func convertFromPort(port uint16) uint16 {
-	return port - 49152
+// expireSNI removes gateways selected by server names of flows which are not in NAT anymore.
+func expireSNI() {
+	if len(sniGateways) <= 0 {
+		return
+	}
+
+	// NAT is locked before server names, as when a flow is distributed
+	natLock.RLock()
+	defer natLock.RUnlock()
+	sniLock.Lock()
+	defer sniLock.Unlock()
+
+	for guide := range sniFlows {
+		if _, ok := nat[guide]; !ok {
+			delete(sniFlows, guide)
+		}
+	}
 }
 
 func splitArg(s string) []string {
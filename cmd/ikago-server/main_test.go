@@ -0,0 +1,2445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/clock"
+	"github.com/zhxie/ikago/internal/config"
+	"github.com/zhxie/ikago/internal/pcap"
+	"github.com/zhxie/ikago/internal/stat"
+)
+
+func TestRouteTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		decrement bool
+		ttl       uint8
+		want      uint8
+		ok        bool
+	}{
+		{name: "decrement", decrement: true, ttl: 64, want: 63, ok: true},
+		{name: "decrement max", decrement: true, ttl: 255, want: 254, ok: true},
+		{name: "decrement to 1", decrement: true, ttl: 2, want: 1, ok: true},
+		{name: "exceeded", decrement: true, ttl: 1, want: 0, ok: false},
+		{name: "exceeded with 0", decrement: true, ttl: 0, want: 0, ok: false},
+		{name: "preserve", decrement: false, ttl: 64, want: 64, ok: true},
+		{name: "preserve max", decrement: false, ttl: 255, want: 255, ok: true},
+		{name: "preserve 1", decrement: false, ttl: 1, want: 1, ok: true},
+		{name: "preserve 0", decrement: false, ttl: 0, want: 0, ok: true},
+	}
+
+	defer func(decrement bool) {
+		decrementTTL = decrement
+	}(decrementTTL)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decrementTTL = tt.decrement
+
+			ttl, ok := routeTTL(tt.ttl)
+			if ttl != tt.want || ok != tt.ok {
+				t.Errorf("routeTTL(%d) = %d, %t, want %d, %t", tt.ttl, ttl, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+// resetFlows resets NAT and usage of clients, and returns a function restoring them.
+func resetFlows() func() {
+	oldPatMap, oldNAT, oldSNIFlows, oldFlowRecords := patMap, nat, sniFlows, flowRecords
+	oldClientFlows, oldClientQueues := clientFlows, clientQueues
+	oldTCPPortPool, oldTCPStates, oldNextTCPPort := tcpPortPool, tcpStates, nextTCPPort
+	oldUDPPortPool, oldNextUDPPort := udpPortPool, nextUDPPort
+	oldICMPv4IdPool, oldNextICMPv4Id, oldNATConfig := icmpv4IdPool, nextICMPv4Id, natConfig
+
+	patMap = make(map[natKey]uint16)
+	nat = make(map[pcap.NATGuide]*natIndicator)
+	sniFlows = make(map[pcap.NATGuide]net.IP)
+	flowRecords = nil
+	clientFlows = make(map[string]int)
+	clientQueues = make(map[net.Conn]*int64)
+	tcpPortPool = make([]time.Time, 16384)
+	tcpStates = make([]uint8, 16384)
+	nextTCPPort = 0
+	udpPortPool = make([]time.Time, 65536)
+	nextUDPPort = 0
+	icmpv4IdPool = make([]time.Time, 65536)
+	nextICMPv4Id = 0
+	natConfig = config.NewNATConfig()
+
+	return func() {
+		patMap, nat, sniFlows, flowRecords = oldPatMap, oldNAT, oldSNIFlows, oldFlowRecords
+		clientFlows, clientQueues = oldClientFlows, oldClientQueues
+		tcpPortPool, tcpStates, nextTCPPort = oldTCPPortPool, oldTCPStates, oldNextTCPPort
+		udpPortPool, nextUDPPort = oldUDPPortPool, oldNextUDPPort
+		icmpv4IdPool, nextICMPv4Id, natConfig = oldICMPv4IdPool, oldNextICMPv4Id, oldNATConfig
+	}
+}
+
+// resetClock replaces the clock with a fake one, and returns it and a function restoring the clock.
+func resetClock() (*clock.Fake, func()) {
+	fake := clock.NewFake(time.Unix(1600000000, 0))
+
+	return fake, clock.Set(fake)
+}
+
+// testHandle is a handle which reads queued packets until EOF, and records packets written to it unless they are
+// discarded.
+type testHandle struct {
+	lock     sync.Mutex
+	linkType layers.LinkType
+	discard  bool
+	n        int64
+	reads    [][]byte
+	writes   [][]byte
+}
+
+func (h *testHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if len(h.reads) <= 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+
+	d := h.reads[0]
+	h.reads = h.reads[1:]
+
+	return d, gopacket.CaptureInfo{Timestamp: clock.Now(), CaptureLength: len(d), Length: len(d)}, nil
+}
+
+func (h *testHandle) WritePacketData(data []byte) error {
+	atomic.AddInt64(&h.n, 1)
+	if h.discard {
+		return nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	b := make([]byte, len(data))
+	copy(b, data)
+	h.writes = append(h.writes, b)
+
+	return nil
+}
+
+func (h *testHandle) LinkType() layers.LinkType {
+	return h.linkType
+}
+
+func (h *testHandle) Close() {}
+
+// count returns the count of packets written to the handle.
+func (h *testHandle) count() int {
+	return int(atomic.LoadInt64(&h.n))
+}
+
+// written returns packets written to the handle and clears them.
+func (h *testHandle) written() [][]byte {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	writes := h.writes
+	h.writes = nil
+	atomic.StoreInt64(&h.n, 0)
+
+	return writes
+}
+
+var (
+	testUpIP       = net.IPv4(10, 0, 0, 1)
+	testUpMAC      = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	testGatewayIP  = net.IPv4(10, 0, 0, 254)
+	testGatewayMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 0xfe}
+)
+
+// resetUpstream replaces the upstream with an Ethernet handle to the gateway, and returns the handle and a function
+// restoring the upstream.
+func resetUpstream() (*testHandle, func()) {
+	oldConn, oldUpDev, oldGatewayDev := upstream(), upDev, gatewayDev
+
+	upDev = pcap.NewDevice("up0", "up0", []*net.IPNet{{IP: testUpIP, Mask: net.CIDRMask(24, 32)}}, testUpMAC, false)
+	gatewayDev = pcap.NewDevice("", "Gateway", []*net.IPNet{{IP: testGatewayIP, Mask: net.CIDRMask(32, 32)}}, testGatewayMAC, false)
+	handle := &testHandle{linkType: layers.LinkTypeEthernet}
+	upConn.Store(pcap.CreateRawConnWithHandle(upDev, gatewayDev, handle))
+	oldGatewayMAC := gatewayMAC.Load()
+	storeGatewayMAC(gatewayDev)
+	arpCache.Add(testGatewayIP, testGatewayMAC)
+
+	return handle, func() {
+		upConn.Store(oldConn)
+		upDev, gatewayDev = oldUpDev, oldGatewayDev
+		if oldGatewayMAC != nil {
+			gatewayMAC.Store(oldGatewayMAC)
+		}
+	}
+}
+
+// resetListen resets options of routing to their defaults with an empty policy, and returns a function restoring them.
+func resetListen() func() {
+	oldFragment, oldDecrementTTL, oldDropSrcRoute := fragment, decrementTTL, dropSrcRoute
+	oldIPOptions, oldMulticast, oldUnsupported := ipOptions, multicast, unsupported
+	oldPolicy := policies.Load()
+
+	fragment = pcap.MaxEthernetMTU
+	decrementTTL = true
+	dropSrcRoute = false
+	ipOptions = ipOptionsStrip
+	multicast = multicastDrop
+	unsupported = unsupportedLog
+	policies.Store(&policy{})
+
+	return func() {
+		fragment, decrementTTL, dropSrcRoute = oldFragment, oldDecrementTTL, oldDropSrcRoute
+		ipOptions, multicast, unsupported = oldIPOptions, oldMulticast, oldUnsupported
+		if oldPolicy != nil {
+			policies.Store(oldPolicy)
+		}
+	}
+}
+
+// resetRouting resets NAT, the upstream and options of routing, and returns the upstream handle and a function
+// restoring them.
+func resetRouting() (*testHandle, func()) {
+	restoreFlows := resetFlows()
+	handle, restoreUpstream := resetUpstream()
+	restoreListen := resetListen()
+
+	return handle, func() {
+		restoreListen()
+		restoreUpstream()
+		restoreFlows()
+	}
+}
+
+// testListenAddr is the address clients connect to.
+var testListenAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 254), Port: 443}
+
+// testConn is a connection of a client, which reads the packet in every read for the count of times, and records
+// packets written to it.
+type testConn struct {
+	lock   sync.Mutex
+	remote net.Addr
+	packet []byte
+	count  int
+	writes [][]byte
+}
+
+func (c *testConn) Read(b []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.count <= 0 {
+		return 0, io.EOF
+	}
+	c.count--
+
+	return copy(b, c.packet), nil
+}
+
+func (c *testConn) Write(b []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	c.writes = append(c.writes, data)
+
+	return len(b), nil
+}
+
+func (c *testConn) Close() error {
+	return nil
+}
+
+func (c *testConn) LocalAddr() net.Addr {
+	return testListenAddr
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *testConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *testConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *testConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// written returns packets written to the connection and clears them.
+func (c *testConn) written() [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	writes := c.writes
+	c.writes = nil
+
+	return writes
+}
+
+// addTestClient adds a client at the address which has said hello, and returns its connection and a function removing
+// it.
+func addTestClient(ip net.IP) (*testConn, func()) {
+	conn := &testConn{remote: &net.TCPAddr{IP: ip, Port: 49152}}
+
+	hello := pcap.NewClientHello("faketcp", pcap.MaxEthernetMTU, false)
+	hello.Version = pcap.NegotiateVersion(hello.Version)
+	helloLock.Lock()
+	hellos[conn] = hello
+	helloLock.Unlock()
+
+	return conn, func() {
+		helloLock.Lock()
+		delete(hellos, conn)
+		helloLock.Unlock()
+
+		usageLock.Lock()
+		delete(clientQueues, conn)
+		usageLock.Unlock()
+	}
+}
+
+// testDst is the destination of packets routed upstream in tests, which is off-link and routed through the gateway.
+var testDst = &net.UDPAddr{IP: net.IPv4(203, 0, 113, 1), Port: 10000}
+
+// routeOut handles the packet from the client, and returns the single packet written to the upstream.
+func routeOut(t *testing.T, handle *testHandle, conn net.Conn, data []byte) gopacket.Packet {
+	t.Helper()
+
+	err := handleListen(data, conn)
+	if err != nil {
+		t.Fatalf("handle listen: %v", err)
+	}
+
+	writes := handle.written()
+	if len(writes) != 1 {
+		t.Fatalf("writes to upstream = %d, want 1", len(writes))
+	}
+
+	return gopacket.NewPacket(writes[0], layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// routeIn handles the packet from the upstream, and returns the single packet written to the client.
+func routeIn(t *testing.T, conn *testConn, packet gopacket.Packet) gopacket.Packet {
+	t.Helper()
+
+	err := handleUpstream(packet)
+	if err != nil {
+		t.Fatalf("handle upstream: %v", err)
+	}
+
+	writes := conn.written()
+	if len(writes) != 1 {
+		t.Fatalf("writes to client = %d, want 1", len(writes))
+	}
+
+	return gopacket.NewPacket(writes[0], layers.LayerTypeIPv4, gopacket.Default)
+}
+
+// newUpPacket returns a packet received by the upstream from the gateway, which is of the transport layer with the
+// payload to the upstream address.
+func newUpPacket(tb testing.TB, src net.IP, ttl uint8, transportLayer gopacket.TransportLayer, payload []byte) gopacket.Packet {
+	networkLayer, err := pcap.CreateIPv4Layer(src, testUpIP, 0, ttl, transportLayer)
+	if err != nil {
+		tb.Fatalf("create network layer: %v", err)
+	}
+	linkLayer, err := pcap.CreateEthernetLayer(testGatewayMAC, testUpMAC, networkLayer)
+	if err != nil {
+		tb.Fatalf("create link layer: %v", err)
+	}
+
+	data, err := pcap.Serialize(linkLayer, networkLayer, transportLayer.(gopacket.SerializableLayer), gopacket.Payload(payload))
+	if err != nil {
+		tb.Fatalf("serialize: %v", err)
+	}
+
+	return gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+}
+
+// newEmbUDP returns an embedded UDP packet with the payload.
+func newEmbUDP(tb testing.TB, src, dst *net.UDPAddr, ttl uint8, payload []byte) []byte {
+	return newEmbPacket(tb, src.IP, dst.IP, ttl, pcap.CreateUDPLayer(uint16(src.Port), uint16(dst.Port)), payload)
+}
+
+// newEmbPacket returns an embedded packet which is of the transport layer with the payload.
+func newEmbPacket(tb testing.TB, srcIP, dstIP net.IP, ttl uint8, transportLayer gopacket.TransportLayer, payload []byte) []byte {
+	networkLayer, err := pcap.CreateIPv4Layer(srcIP, dstIP, 0, ttl, transportLayer)
+	if err != nil {
+		tb.Fatalf("create network layer: %v", err)
+	}
+
+	data, err := pcap.Serialize(networkLayer, transportLayer.(gopacket.SerializableLayer), gopacket.Payload(payload))
+	if err != nil {
+		tb.Fatalf("serialize: %v", err)
+	}
+
+	return data
+}
+
+func TestEvictIdle(t *testing.T) {
+	defer resetFlows()()
+	fake, restoreClock := resetClock()
+	defer restoreClock()
+	_, restoreUpstream := resetUpstream()
+	defer restoreUpstream()
+
+	// Flow a goes idle, while flow b is seen again later
+	open := func(port uint16) natKey {
+		natLock.Lock()
+		defer natLock.Unlock()
+
+		q := natKey{src: pcap.NewNATGuide(net.IPv4(192, 168, 1, 2), port, layers.LayerTypeUDP), client: "client"}
+		value, ok, err := allocFlow(q, q.src.String(), 0)
+		if err != nil || !ok {
+			t.Fatalf("alloc flow: %t, %v", ok, err)
+		}
+		patMap[q] = value
+		nat[natGuide(layers.LayerTypeUDP, testUpIP, value)] = &natIndicator{}
+		udpPortPool[value] = clock.Now()
+
+		return q
+	}
+	a := open(1024)
+	b := open(1025)
+
+	fake.Advance(keepIdle / 2)
+	udpPortPool[patMap[b]] = clock.Now()
+	fake.Advance(keepIdle/2 + time.Second)
+
+	if n := evictIdle(clock.Now()); n != 1 {
+		t.Fatalf("evicted = %d, want 1", n)
+	}
+	if _, ok := patMap[a]; ok {
+		t.Error("idle flow is not evicted")
+	}
+	if _, ok := patMap[b]; !ok {
+		t.Error("active flow is evicted")
+	}
+
+	fake.Advance(keepIdle)
+	if n := evictIdle(clock.Now()); n != 1 {
+		t.Fatalf("evicted = %d, want 1", n)
+	}
+	if len(patMap) != 0 || len(nat) != 0 {
+		t.Errorf("flows = %d, %d, want 0, 0", len(patMap), len(nat))
+	}
+}
+
+func TestExportFlows(t *testing.T) {
+	defer resetFlows()()
+	fake, restoreClock := resetClock()
+	defer restoreClock()
+
+	flowRecords = make(map[quintuple]*stat.FlowRecord)
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+	postSrc := &net.UDPAddr{IP: testUpIP, Port: 49152}
+	dstA := &net.UDPAddr{IP: net.IPv4(1, 1, 1, 1), Port: 10000}
+	dstB := &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 10000}
+	qA := quintuple{src: src.String(), dst: dstA.String(), protocol: layers.LayerTypeUDP}
+	qB := quintuple{src: src.String(), dst: dstB.String(), protocol: layers.LayerTypeUDP}
+
+	recordFlow(src, dstA, postSrc, dstA, layers.LayerTypeUDP, 100)
+	recordFlow(src, dstB, postSrc, dstB, layers.LayerTypeUDP, 100)
+
+	// Flow a is idle longer than the timeout of UDP
+	timeout := time.Duration(natConfig.UDP) * time.Second
+	fake.Advance(timeout / 2)
+	recordFlow(src, dstB, postSrc, dstB, layers.LayerTypeUDP, 100)
+	fake.Advance(timeout/2 + time.Second)
+
+	exportFlows(clock.Now(), false)
+	if _, ok := flowRecords[qA]; ok {
+		t.Error("idle flow is not exported")
+	}
+	record, ok := flowRecords[qB]
+	if !ok {
+		t.Fatal("active flow is exported")
+	}
+	if record.Packets != 2 {
+		t.Errorf("packets = %d, want 2", record.Packets)
+	}
+
+	// Flow b is active longer than the active timeout, and restarts its record
+	for clock.Since(record.Start) <= flowActiveTimeout {
+		fake.Advance(timeout / 2)
+		recordFlow(src, dstB, postSrc, dstB, layers.LayerTypeUDP, 100)
+	}
+
+	exportFlows(clock.Now(), false)
+	record, ok = flowRecords[qB]
+	if !ok {
+		t.Fatal("long-lived flow is removed")
+	}
+	if record.Packets != 0 || !record.Start.IsZero() {
+		t.Errorf("record = %d packets from %v, want restarted", record.Packets, record.Start)
+	}
+
+	exportFlows(clock.Now(), true)
+	if len(flowRecords) != 0 {
+		t.Errorf("records = %d, want 0", len(flowRecords))
+	}
+}
+
+// resetEgress resets the egress rate and its queue, and returns a function restoring them.
+func resetEgress() func() {
+	oldRate, oldBurst, oldToken, oldLast := egressRate, egressBurst, egressToken, egressLast
+	oldQueue, oldQueued := egressQueue, egressQueued
+	oldShaped, oldDrops := atomic.LoadUint64(&shaped), atomic.LoadUint64(&shapeDrops)
+
+	egressQueue = make(chan *egressPacket, 1000)
+	egressQueued = 0
+	atomic.StoreUint64(&shaped, 0)
+	atomic.StoreUint64(&shapeDrops, 0)
+
+	return func() {
+		egressRate, egressBurst, egressToken, egressLast = oldRate, oldBurst, oldToken, oldLast
+		egressQueue, egressQueued = oldQueue, oldQueued
+		atomic.StoreUint64(&shaped, oldShaped)
+		atomic.StoreUint64(&shapeDrops, oldDrops)
+	}
+}
+
+func TestShapeEgressRefill(t *testing.T) {
+	fake, restoreClock := resetClock()
+	defer restoreClock()
+	defer resetEgress()()
+
+	setEgress(1000, 1000)
+	fragments := [][]byte{make([]byte, 1000)}
+
+	// The burst is spent at once, and the next packet is queued until tokens are refilled
+	if queued, ok := shapeEgress(nil, fragments); queued || !ok {
+		t.Fatalf("shape = %t, %t, want false, true", queued, ok)
+	}
+	if queued, ok := shapeEgress(nil, fragments); !queued || !ok {
+		t.Fatalf("shape = %t, %t, want true, true", queued, ok)
+	}
+	p := <-egressQueue
+	if wait := p.due.Sub(clock.Now()); wait != time.Second {
+		t.Errorf("due in %v, want %v", wait, time.Second)
+	}
+	egressQueued--
+
+	// Tokens of one second are refilled, but the bucket was overdrawn by the queued packet
+	fake.Advance(2 * time.Second)
+	if queued, ok := shapeEgress(nil, fragments); queued || !ok {
+		t.Errorf("shape after refill = %t, %t, want false, true", queued, ok)
+	}
+}
+
+func TestShapeEgressRate(t *testing.T) {
+	const (
+		rate     = 10000
+		burst    = 2000
+		size     = 100
+		duration = 10 * time.Second
+		step     = 5 * time.Millisecond
+	)
+
+	fake, restoreClock := resetClock()
+	defer restoreClock()
+	defer resetEgress()()
+
+	setEgress(rate, burst)
+	start := clock.Now()
+	fragments := [][]byte{make([]byte, size)}
+
+	// Packets are offered at twice the rate, and the queue is drained like the egress writer once packets are due
+	var (
+		sent int
+		due  []time.Time
+	)
+	for clock.Since(start) < duration {
+		for i := 0; i < 2*rate*int(step)/int(time.Second)/size; i++ {
+			queued, ok := shapeEgress(nil, fragments)
+			if !ok {
+				continue
+			}
+			if !queued {
+				sent = sent + size
+				continue
+			}
+			due = append(due, (<-egressQueue).due)
+		}
+
+		fake.Advance(step)
+		for len(due) > 0 && !due[0].After(clock.Now()) {
+			due = due[1:]
+			sent = sent + size
+			egressLock.Lock()
+			egressQueued--
+			egressLock.Unlock()
+		}
+	}
+
+	// The burst is sent at once, and then the rate is sustained
+	got := float64(sent-burst) / duration.Seconds()
+	if got < rate*0.95 || got > rate*1.05 {
+		t.Errorf("rate = %.0f Bytes per second, want %d", got, rate)
+	}
+	if atomic.LoadUint64(&shapeDrops) == 0 {
+		t.Error("no drops of traffic over the rate")
+	}
+}
+
+func TestShapeEgressDrop(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue int
+		sizes []int
+	}{
+		// The second packet is queued, and the third one finds the queue full
+		{name: "queue full", queue: 1, sizes: []int{1000, 100, 100}},
+		// The second packet overdraws the bucket, and the third one would overdraw it more than the burst
+		{name: "burst exceeded", queue: 1000, sizes: []int{1000, 600, 600}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, restoreClock := resetClock()
+			defer restoreClock()
+			defer resetEgress()()
+
+			egressQueue = make(chan *egressPacket, tt.queue)
+			setEgress(1000, 1000)
+
+			want := []struct{ queued, ok bool }{{false, true}, {true, true}, {false, false}}
+			var token float64
+			for i, size := range tt.sizes {
+				token = egressToken
+
+				queued, ok := shapeEgress(nil, [][]byte{make([]byte, size)})
+				if queued != want[i].queued || ok != want[i].ok {
+					t.Fatalf("shape packet %d = %t, %t, want %t, %t", i, queued, ok, want[i].queued, want[i].ok)
+				}
+			}
+
+			// Dropped packets take no tokens
+			if egressToken != token {
+				t.Errorf("tokens after drop = %.0f, want %.0f", egressToken, token)
+			}
+			if drops := atomic.LoadUint64(&shapeDrops); drops != 1 {
+				t.Errorf("drops = %d, want 1", drops)
+			}
+			if len(egressQueue) != 1 || egressQueued != 1 {
+				t.Errorf("queued = %d, %d, want 1, 1", len(egressQueue), egressQueued)
+			}
+		})
+	}
+}
+
+func TestFlowFairness(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxFlows int
+		wantA    int
+		wantB    int
+	}{
+		{name: "unlimited", maxFlows: 0, wantA: 16384, wantB: 0},
+		{name: "limited", maxFlows: 100, wantA: 100, wantB: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer resetFlows()()
+
+			// Client a opens flows as many as the pool, and client b opens a few flows later
+			alloc := func(client string, ip net.IP, n int) int {
+				natLock.Lock()
+				defer natLock.Unlock()
+
+				var count int
+				for i := 0; i < n; i++ {
+					q := natKey{
+						src:    pcap.NewNATGuide(ip, uint16(1024+i), layers.LayerTypeUDP),
+						client: client,
+					}
+					_, ok, err := allocFlow(q, q.src.String(), tt.maxFlows)
+					if err == nil && ok {
+						count++
+					}
+				}
+
+				return count
+			}
+
+			a := alloc("a", net.IPv4(192, 168, 1, 2), 20000)
+			b := alloc("b", net.IPv4(192, 168, 1, 3), 10)
+			if a != tt.wantA || b != tt.wantB {
+				t.Errorf("flows = %d, %d, want %d, %d", a, b, tt.wantA, tt.wantB)
+			}
+		})
+	}
+}
+
+func TestQueueFairness(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxQueued int
+		wantA     int
+		wantB     int
+	}{
+		{name: "unlimited", maxQueued: 0, wantA: 100, wantB: 5},
+		{name: "limited", maxQueued: 10000, wantA: 10, wantB: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer resetFlows()()
+
+			connA, peerA := net.Pipe()
+			defer connA.Close()
+			defer peerA.Close()
+			connB, peerB := net.Pipe()
+			defer connB.Close()
+			defer peerB.Close()
+
+			// Client a floods packets which are not handled yet, and client b sends a few packets later
+			admit := func(conn net.Conn, n int) int {
+				var count int
+				for i := 0; i < n; i++ {
+					if admitQueue(conn, 1000, tt.maxQueued) {
+						count++
+					}
+				}
+
+				return count
+			}
+
+			a := admit(connA, 100)
+			b := admit(connB, 5)
+			if a != tt.wantA || b != tt.wantB {
+				t.Errorf("packets = %d, %d, want %d, %d", a, b, tt.wantA, tt.wantB)
+			}
+
+			// Handled packets release the queue of client a
+			releaseQueue(connA, 1000)
+			if !admitQueue(connA, 1000, tt.maxQueued) {
+				t.Error("admit after release: want true")
+			}
+		})
+	}
+}
+
+func TestHandleBatch(t *testing.T) {
+	handle, restore := resetRouting()
+	defer restore()
+	conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+	defer remove()
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+	records := [][]byte{
+		newEmbUDP(t, src, testDst, 64, []byte("first")),
+		// Truncated IPv4 header
+		{0x45, 0x00, 0x00},
+		newEmbUDP(t, src, testDst, 64, []byte("last")),
+	}
+	data, err := pcap.SerializeBatch(records)
+	if err != nil {
+		t.Fatalf("serialize batch: %v", err)
+	}
+
+	err = handleListen(data, conn)
+	if err != nil {
+		t.Fatalf("handle listen: %v", err)
+	}
+
+	// Records after the failed one are still routed
+	writes := handle.written()
+	if len(writes) != 2 {
+		t.Fatalf("writes = %d, want 2", len(writes))
+	}
+	for i, want := range []string{"first", "last"} {
+		packet := gopacket.NewPacket(writes[i], layers.LayerTypeEthernet, gopacket.Default)
+		if app := packet.ApplicationLayer(); app == nil || string(app.Payload()) != want {
+			t.Errorf("write %d payload = %v, want %q", i, app, want)
+		}
+	}
+}
+
+func TestHashCollisionFlood(t *testing.T) {
+	defer resetFlows()()
+	defer func(ports bool, seed []byte) {
+		hashPorts, hashSeed = ports, seed
+	}(hashPorts, hashSeed)
+
+	hashPorts = true
+	hashSeed = []byte("seed")
+
+	// An attacker knowing the seed crafts flows hashed to a narrow window of ports
+	const (
+		flows  = 4 * maxHashProbes
+		target = 1000
+	)
+	keys := make([]string, 0, flows)
+	for i := 0; len(keys) < flows; i++ {
+		key := fmt.Sprintf("192.168.1.2:%d-203.0.113.1:10000-UDP", i)
+		if s := int(hashFlow(key) % 16384); s >= target && s < target+maxHashProbes {
+			keys = append(keys, key)
+		}
+	}
+
+	natLock.Lock()
+	defer natLock.Unlock()
+
+	var sequenced int
+	for i, key := range keys {
+		start := 49152 + int(hashFlow(key)%16384)
+		next := 49152 + int(nextUDPPort%16384)
+
+		value, err := distHashed(layers.LayerTypeUDP, key)
+		if err != nil {
+			t.Fatalf("distribute flow %d: %v", i, err)
+		}
+		udpPortPool[value] = clock.Now()
+
+		// Ports are probed in a window of the max probes from the hash, or distributed in sequence
+		switch {
+		case int(value) >= start && int(value) < start+maxHashProbes:
+		case int(value) == next:
+			sequenced++
+		default:
+			t.Fatalf("flow %d distributed port %d out of probes from %d", i, value, start)
+		}
+	}
+	if sequenced < flows-2*maxHashProbes {
+		t.Errorf("sequenced = %d, want at least %d", sequenced, flows-2*maxHashProbes)
+	}
+}
+
+func TestHashSeed(t *testing.T) {
+	defer func(seed []byte) {
+		hashSeed = seed
+	}(hashSeed)
+
+	// Flows crafted to collide without a seed
+	hashSeed = nil
+	keys := make([]string, 0, 16)
+	for i := 0; len(keys) < cap(keys); i++ {
+		key := fmt.Sprintf("192.168.1.2:%d-203.0.113.1:10000-UDP", i)
+		if hashFlow(key)%16384 == 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	seed, err := newHashSeed()
+	if err != nil {
+		t.Fatalf("new hash seed: %v", err)
+	}
+	other, err := newHashSeed()
+	if err != nil {
+		t.Fatalf("new hash seed: %v", err)
+	}
+	if bytes.Equal(seed, other) {
+		t.Error("seeds are the same")
+	}
+
+	// Crafted flows are spread with a random seed
+	hashSeed = seed
+	starts := make(map[uint32]bool)
+	for _, key := range keys {
+		starts[hashFlow(key)%16384] = true
+	}
+	if len(starts) < len(keys)/2 {
+		t.Errorf("distinct hashes = %d of %d", len(starts), len(keys))
+	}
+}
+
+func TestHandleTTL(t *testing.T) {
+	tests := []struct {
+		name      string
+		decrement bool
+		wantOut   uint8
+		wantIn    uint8
+	}{
+		{name: "decrement", decrement: true, wantOut: 63, wantIn: 49},
+		{name: "preserve", decrement: false, wantOut: 64, wantIn: 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handle, restore := resetRouting()
+			defer restore()
+			conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+			defer remove()
+
+			decrementTTL = tt.decrement
+
+			src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+			out := routeOut(t, handle, conn, newEmbUDP(t, src, testDst, 64, []byte("request")))
+			outIPv4 := out.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if outIPv4.TTL != tt.wantOut {
+				t.Errorf("outbound ttl = %d, want %d", outIPv4.TTL, tt.wantOut)
+			}
+
+			upPort := out.Layer(layers.LayerTypeUDP).(*layers.UDP).SrcPort
+			reply := pcap.CreateUDPLayer(uint16(testDst.Port), uint16(upPort))
+			in := routeIn(t, conn, newUpPacket(t, testDst.IP, 50, reply, []byte("response")))
+			inIPv4 := in.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if inIPv4.TTL != tt.wantIn {
+				t.Errorf("inbound ttl = %d, want %d", inIPv4.TTL, tt.wantIn)
+			}
+			if !inIPv4.DstIP.Equal(src.IP) {
+				t.Errorf("inbound destination = %s, want %s", inIPv4.DstIP, src.IP)
+			}
+		})
+	}
+}
+
+// resetKillSwitch enables the kill switch with the timeout on a healthy tunnel, and returns a function restoring it.
+func resetKillSwitch(timeout time.Duration) func() {
+	oldKillSwitch, oldKilledAt, oldListeners := killSwitch, killedAt, listeners
+	oldKilled, oldPending, oldUnacked := atomic.LoadInt32(&killed), atomic.LoadInt64(&synPending), atomic.LoadInt32(&synUnacked)
+	oldLooping, oldDrops := atomic.LoadInt32(&upLooping), atomic.LoadUint64(&killDrops)
+
+	killSwitch = timeout
+	// Only the presence of listeners is checked for the health
+	listeners = []net.Listener{&net.TCPListener{}}
+	atomic.StoreInt32(&killed, 0)
+	atomic.StoreInt32(&upLooping, 1)
+	atomic.StoreUint64(&killDrops, 0)
+	resetHandshakes()
+
+	return func() {
+		killSwitch, killedAt, listeners = oldKillSwitch, oldKilledAt, oldListeners
+		atomic.StoreInt32(&killed, oldKilled)
+		atomic.StoreInt64(&synPending, oldPending)
+		atomic.StoreInt32(&synUnacked, oldUnacked)
+		atomic.StoreInt32(&upLooping, oldLooping)
+		atomic.StoreUint64(&killDrops, oldDrops)
+	}
+}
+
+func TestKillSwitch(t *testing.T) {
+	const timeout = 5 * time.Second
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+
+	// assertDropped asserts packets are dropped in both directions while the kill switch is engaged
+	assertDropped := func(t *testing.T, handle *testHandle, conn *testConn, upPort layers.UDPPort) {
+		t.Helper()
+
+		if !isKilled() {
+			t.Fatal("kill switch not engaged")
+		}
+
+		err := handleListen(newEmbUDP(t, src, testDst, 64, []byte("request")), conn)
+		if err != nil {
+			t.Fatalf("handle listen: %v", err)
+		}
+		if n := len(handle.written()); n != 0 {
+			t.Errorf("writes to upstream = %d, want 0", n)
+		}
+
+		err = handleUpstream(newUpPacket(t, testDst.IP, 64, pcap.CreateUDPLayer(uint16(testDst.Port), uint16(upPort)), []byte("response")))
+		if err != nil {
+			t.Fatalf("handle upstream: %v", err)
+		}
+		if n := len(conn.written()); n != 0 {
+			t.Errorf("writes to client = %d, want 0", n)
+		}
+
+		if drops := atomic.LoadUint64(&killDrops); drops != 2 {
+			t.Errorf("drops = %d, want 2", drops)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		engage func(t *testing.T, fake *clock.Fake, handle *testHandle, conn *testConn)
+	}{
+		{
+			name: "upstream loop stopped",
+			engage: func(t *testing.T, fake *clock.Fake, handle *testHandle, conn *testConn) {
+				atomic.StoreInt32(&upLooping, 0)
+				checkKillSwitch(clock.Now())
+			},
+		},
+		{
+			name: "handshakes unanswered",
+			engage: func(t *testing.T, fake *clock.Fake, handle *testHandle, conn *testConn) {
+				for i := 0; i < killHandshakes; i++ {
+					syn := pcap.CreateTCPLayer(uint16(2048+i), 443, 0, 0)
+					pcap.FlagTCPLayer(syn, true, false, false)
+					routeOut(t, handle, conn, newEmbPacket(t, src.IP, testDst.IP, 64, syn, nil))
+				}
+
+				// Handshakes are given the timeout to be answered
+				fake.Advance(timeout - time.Second)
+				checkKillSwitch(clock.Now())
+				if isKilled() {
+					t.Fatal("kill switch engaged before the timeout")
+				}
+
+				fake.Advance(time.Second)
+				checkKillSwitch(clock.Now())
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handle, restore := resetRouting()
+			defer restore()
+			fake, restoreClock := resetClock()
+			defer restoreClock()
+			defer resetKillSwitch(timeout)()
+			conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+			defer remove()
+
+			// A flow is open before the kill switch is engaged
+			out := routeOut(t, handle, conn, newEmbUDP(t, src, testDst, 64, []byte("request")))
+			upPort := out.Layer(layers.LayerTypeUDP).(*layers.UDP).SrcPort
+			routeIn(t, conn, newUpPacket(t, testDst.IP, 64, pcap.CreateUDPLayer(uint16(testDst.Port), uint16(upPort)), []byte("response")))
+
+			tt.engage(t, fake, handle, conn)
+			assertDropped(t, handle, conn, upPort)
+
+			// The kill switch is released once the tunnel recovers and the upstream is retried after the timeout
+			atomic.StoreInt32(&upLooping, 1)
+			fake.Advance(timeout)
+			checkKillSwitch(clock.Now())
+			if isKilled() {
+				t.Fatal("kill switch not released")
+			}
+			routeOut(t, handle, conn, newEmbUDP(t, src, testDst, 64, []byte("request")))
+		})
+	}
+}
+
+func TestReloadPolicy(t *testing.T) {
+	handle, restore := resetRouting()
+	defer restore()
+	defer resetEgress()()
+	defer func(drops uint64) {
+		atomic.StoreUint64(&portDrops, drops)
+	}(atomic.LoadUint64(&portDrops))
+	conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+	defer remove()
+
+	dir, err := ioutil.TempDir("", "ikago")
+	if err != nil {
+		t.Fatalf("create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+
+	reload := func(contents string) error {
+		err := ioutil.WriteFile(path, []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+
+		return reloadPolicy(path)
+	}
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+	kept := &net.UDPAddr{IP: testDst.IP, Port: 10000}
+	denied := &net.UDPAddr{IP: testDst.IP, Port: 10050}
+
+	err = reload(`{"allow-ports": ["udp:10000-10100"]}`)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	out := routeOut(t, handle, conn, newEmbUDP(t, src, kept, 64, []byte("kept")))
+	upPort := out.Layer(layers.LayerTypeUDP).(*layers.UDP).SrcPort
+	routeOut(t, handle, conn, newEmbUDP(t, src, denied, 64, []byte("denied")))
+
+	// Narrowed ports drop newly denied destinations, while flows to allowed ones still forward both ways
+	err = reload(`{"allow-ports": ["udp:10000"]}`)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	atomic.StoreUint64(&portDrops, 0)
+
+	err = handleListen(newEmbUDP(t, src, denied, 64, []byte("denied")), conn)
+	if err != nil {
+		t.Fatalf("handle listen: %v", err)
+	}
+	if n := len(handle.written()); n != 0 {
+		t.Errorf("writes to denied port = %d, want 0", n)
+	}
+	if drops := atomic.LoadUint64(&portDrops); drops != 1 {
+		t.Errorf("drops = %d, want 1", drops)
+	}
+
+	routeOut(t, handle, conn, newEmbUDP(t, src, kept, 64, []byte("kept")))
+	routeIn(t, conn, newUpPacket(t, kept.IP, 64, pcap.CreateUDPLayer(uint16(kept.Port), uint16(upPort)), []byte("response")))
+
+	// Invalid files leave policies untouched
+	pol := policies.Load()
+	invalids := []string{
+		`{"allow-ports": ["udp:0"]}`,
+		`{"allow-ports": ["icmp:1"]}`,
+		`{"payload-limits": ["udp:100-10"]}`,
+		`{"allow-ports": [`,
+	}
+	for _, contents := range invalids {
+		err = reload(contents)
+		if err == nil {
+			t.Errorf("reload %s: want error", contents)
+		}
+		if policies.Load() != pol {
+			t.Errorf("reload %s: policies changed", contents)
+		}
+	}
+	err = reloadPolicy(filepath.Join(dir, "missing.json"))
+	if err == nil {
+		t.Error("reload missing file: want error")
+	}
+	if policies.Load() != pol {
+		t.Error("reload missing file: policies changed")
+	}
+
+	routeOut(t, handle, conn, newEmbUDP(t, src, kept, 64, []byte("kept")))
+}
+
+func TestHandleNoTransport(t *testing.T) {
+	src := net.IPv4(192, 168, 1, 2)
+	newEmbIP := func(t *testing.T, protocol layers.IPProtocol, offset uint16) []byte {
+		ipv4Layer := &layers.IPv4{
+			Version:    4,
+			IHL:        5,
+			TTL:        64,
+			Id:         1,
+			Protocol:   protocol,
+			FragOffset: offset,
+			SrcIP:      src,
+			DstIP:      testDst.IP,
+		}
+		data, err := pcap.Serialize(ipv4Layer, gopacket.Payload("opaque payload"))
+		if err != nil {
+			t.Fatalf("serialize: %v", err)
+		}
+
+		return data
+	}
+
+	tests := []struct {
+		name        string
+		protocol    layers.IPProtocol
+		offset      uint16
+		unsupported string
+		isErr       bool
+		writes      int
+	}{
+		{name: "no next header", protocol: layers.IPProtocolNoNextHeader, unsupported: unsupportedLog, isErr: true},
+		{name: "no next header dropped", protocol: layers.IPProtocolNoNextHeader, unsupported: unsupportedDrop},
+		{name: "unknown protocol", protocol: 253, unsupported: unsupportedLog, isErr: true},
+		// Fragments other than the first one carry no transport layer, but are still forwarded
+		{name: "non-first fragment", protocol: layers.IPProtocolUDP, offset: 1, unsupported: unsupportedLog, writes: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handle, restore := resetRouting()
+			defer restore()
+			conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+			defer remove()
+
+			unsupported = tt.unsupported
+
+			err := handleListen(newEmbIP(t, tt.protocol, tt.offset), conn)
+			if isErr := err != nil; isErr != tt.isErr {
+				t.Errorf("handle listen = %v, want error %t", err, tt.isErr)
+			}
+			writes := handle.written()
+			if len(writes) != tt.writes {
+				t.Fatalf("writes to upstream = %d, want %d", len(writes), tt.writes)
+			}
+			for _, data := range writes {
+				packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+				ipv4Layer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+				if ipv4Layer.FragOffset != tt.offset || !ipv4Layer.DstIP.Equal(testDst.IP) {
+					t.Errorf("written fragment at %d to %s, want at %d to %s", ipv4Layer.FragOffset, ipv4Layer.DstIP, tt.offset, testDst.IP)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleSameTupleClients(t *testing.T) {
+	handle, restore := resetRouting()
+	defer restore()
+	connA, removeA := addTestClient(net.IPv4(192, 0, 2, 1))
+	defer removeA()
+	connB, removeB := addTestClient(net.IPv4(192, 0, 2, 2))
+	defer removeB()
+
+	// Both clients send from the same inner source to the same destination
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+	outA := routeOut(t, handle, connA, newEmbUDP(t, src, testDst, 64, []byte("a")))
+	outB := routeOut(t, handle, connB, newEmbUDP(t, src, testDst, 64, []byte("b")))
+	portA := outA.Layer(layers.LayerTypeUDP).(*layers.UDP).SrcPort
+	portB := outB.Layer(layers.LayerTypeUDP).(*layers.UDP).SrcPort
+	if portA == portB {
+		t.Fatalf("both clients are distributed to port %d", portA)
+	}
+
+	natLock.RLock()
+	guide := pcap.NewNATGuide(src.IP, uint16(src.Port), layers.LayerTypeUDP)
+	qA := natKey{src: guide, client: clientName(connA)}
+	qB := natKey{src: guide, client: clientName(connB)}
+	if !isOwned(qA, uint16(portA)) || isOwned(qA, uint16(portB)) {
+		t.Errorf("port %d owned by client a = %t, port %d = %t, want true, false", portA, isOwned(qA, uint16(portA)), portB, isOwned(qA, uint16(portB)))
+	}
+	if !isOwned(qB, uint16(portB)) || isOwned(qB, uint16(portA)) {
+		t.Errorf("port %d owned by client b = %t, port %d = %t, want true, false", portB, isOwned(qB, uint16(portB)), portA, isOwned(qB, uint16(portA)))
+	}
+	natLock.RUnlock()
+
+	// Replies to each distributed port route to the client which owns it only
+	tests := []struct {
+		port  layers.UDPPort
+		conn  *testConn
+		other *testConn
+	}{
+		{port: portA, conn: connA, other: connB},
+		{port: portB, conn: connB, other: connA},
+	}
+	for _, tt := range tests {
+		payload := []byte(tt.port.String())
+		in := routeIn(t, tt.conn, newUpPacket(t, testDst.IP, 64, pcap.CreateUDPLayer(uint16(testDst.Port), uint16(tt.port)), payload))
+		if n := len(tt.other.written()); n != 0 {
+			t.Errorf("reply to port %d: writes to other client = %d, want 0", tt.port, n)
+		}
+
+		udpLayer := in.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if int(udpLayer.DstPort) != src.Port || !bytes.Equal(udpLayer.Payload, payload) {
+			t.Errorf("reply to port %d = %d, %q, want %d, %q", tt.port, udpLayer.DstPort, udpLayer.Payload, src.Port, payload)
+		}
+	}
+}
+
+func TestHandleIPOptions(t *testing.T) {
+	routerAlert := layers.IPv4Option{OptionType: 148, OptionLength: 4, OptionData: []byte{0, 0}}
+	looseSrcRoute := layers.IPv4Option{OptionType: 131, OptionLength: 7, OptionData: []byte{4, 10, 0, 0, 254}}
+
+	tests := []struct {
+		name         string
+		options      []layers.IPv4Option
+		ipOptions    string
+		dropSrcRoute bool
+		isForwarded  bool
+		isPreserved  bool
+	}{
+		{name: "none", ipOptions: ipOptionsDrop, isForwarded: true},
+		{name: "strip", options: []layers.IPv4Option{routerAlert}, ipOptions: ipOptionsStrip, isForwarded: true},
+		{name: "drop", options: []layers.IPv4Option{routerAlert}, ipOptions: ipOptionsDrop},
+		{name: "preserve", options: []layers.IPv4Option{routerAlert}, ipOptions: ipOptionsPreserve, isForwarded: true, isPreserved: true},
+		{name: "preserve source route", options: []layers.IPv4Option{looseSrcRoute}, ipOptions: ipOptionsPreserve, isForwarded: true, isPreserved: true},
+		{name: "drop source route", options: []layers.IPv4Option{looseSrcRoute}, ipOptions: ipOptionsPreserve, dropSrcRoute: true},
+		{name: "drop source route before strip", options: []layers.IPv4Option{routerAlert, looseSrcRoute}, ipOptions: ipOptionsStrip, dropSrcRoute: true},
+		{name: "preserve without source route", options: []layers.IPv4Option{routerAlert}, ipOptions: ipOptionsPreserve, dropSrcRoute: true, isForwarded: true, isPreserved: true},
+	}
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handle, restore := resetRouting()
+			defer restore()
+			conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+			defer remove()
+
+			ipOptions = tt.ipOptions
+			dropSrcRoute = tt.dropSrcRoute
+
+			transportLayer := pcap.CreateUDPLayer(uint16(src.Port), uint16(testDst.Port))
+			networkLayer, err := pcap.CreateIPv4Layer(src.IP, testDst.IP, 0, 64, transportLayer)
+			if err != nil {
+				t.Fatalf("create network layer: %v", err)
+			}
+			networkLayer.Options = tt.options
+			data, err := pcap.Serialize(networkLayer, transportLayer, gopacket.Payload("options"))
+			if err != nil {
+				t.Fatalf("serialize: %v", err)
+			}
+
+			err = handleListen(data, conn)
+			if err != nil {
+				t.Fatalf("handle listen: %v", err)
+			}
+			writes := handle.written()
+			if !tt.isForwarded {
+				if len(writes) != 0 {
+					t.Errorf("writes to upstream = %d, want 0", len(writes))
+				}
+				return
+			}
+			if len(writes) != 1 {
+				t.Fatalf("writes to upstream = %d, want 1", len(writes))
+			}
+
+			packet := gopacket.NewPacket(writes[0], layers.LayerTypeEthernet, gopacket.Default)
+			ipv4Layer := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if isPreserved := len(ipv4Layer.Options) > 0; isPreserved != tt.isPreserved {
+				t.Errorf("options = %v, want preserved %t", ipv4Layer.Options, tt.isPreserved)
+			}
+			for i, option := range ipv4Layer.Options {
+				if tt.isPreserved && i < len(tt.options) && (option.OptionType != tt.options[i].OptionType || !bytes.Equal(option.OptionData, tt.options[i].OptionData)) {
+					t.Errorf("option %d = %d %v, want %d %v", i, option.OptionType, option.OptionData, tt.options[i].OptionType, tt.options[i].OptionData)
+				}
+			}
+			udpLayer, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			if !ok || string(udpLayer.Payload) != "options" {
+				t.Errorf("forwarded packet = %v, want the UDP payload kept", packet)
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      net.IP
+		dropped int
+	}{
+		// Flows are migrated to a device of the same address
+		{name: "same address", ip: testUpIP, dropped: 0},
+		// Flows not drained in time are dropped from a device of another address
+		{name: "another address", ip: net.IPv4(10, 0, 0, 2), dropped: 1},
+	}
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldHandle, restore := resetRouting()
+			defer restore()
+			conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+			defer remove()
+
+			// The flow is active before migrating
+			out := routeOut(t, oldHandle, conn, newEmbUDP(t, src, testDst, 64, []byte("before")))
+			upPort := out.Layer(layers.LayerTypeUDP).(*layers.UDP).SrcPort
+
+			dev := pcap.NewDevice("up1", "up1", []*net.IPNet{{IP: tt.ip, Mask: net.CIDRMask(24, 32)}}, net.HardwareAddr{0x02, 0, 0, 0, 0, 2}, false)
+			handle := &testHandle{linkType: layers.LinkTypeEthernet}
+			dropped, err := switchUpstream(dev, gatewayDev, 0, func(dev, gwDev *pcap.Device) (*pcap.RawConn, error) {
+				return pcap.CreateRawConnWithHandle(dev, gwDev, handle), nil
+			})
+			if err != nil {
+				t.Fatalf("migrate: %v", err)
+			}
+			if dropped != tt.dropped {
+				t.Errorf("dropped = %d, want %d", dropped, tt.dropped)
+			}
+			if isPaused() {
+				t.Error("still paused after migrating")
+			}
+
+			// Packets are sent through the new device, and migrated flows keep their ports
+			out = routeOut(t, handle, conn, newEmbUDP(t, src, testDst, 64, []byte("after")))
+			if n := len(oldHandle.written()); n != 0 {
+				t.Errorf("writes to old upstream = %d, want 0", n)
+			}
+			ipv4Layer := out.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if !ipv4Layer.SrcIP.Equal(tt.ip) {
+				t.Errorf("source = %s, want %s", ipv4Layer.SrcIP, tt.ip)
+			}
+			newPort := out.Layer(layers.LayerTypeUDP).(*layers.UDP).SrcPort
+			if tt.dropped == 0 && newPort != upPort {
+				t.Errorf("port after migrating = %d, want %d", newPort, upPort)
+			}
+
+			// Replies to the new device route to the client
+			reply := pcap.CreateUDPLayer(uint16(testDst.Port), uint16(newPort))
+			networkLayer, err := pcap.CreateIPv4Layer(testDst.IP, tt.ip, 0, 64, reply)
+			if err != nil {
+				t.Fatalf("create network layer: %v", err)
+			}
+			linkLayer, err := pcap.CreateEthernetLayer(testGatewayMAC, dev.HardwareAddr(), networkLayer)
+			if err != nil {
+				t.Fatalf("create link layer: %v", err)
+			}
+			data, err := pcap.Serialize(linkLayer, networkLayer, reply, gopacket.Payload("reply"))
+			if err != nil {
+				t.Fatalf("serialize: %v", err)
+			}
+			in := routeIn(t, conn, gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default))
+			if udpLayer := in.Layer(layers.LayerTypeUDP).(*layers.UDP); int(udpLayer.DstPort) != src.Port {
+				t.Errorf("reply to port %d, want %d", udpLayer.DstPort, src.Port)
+			}
+		})
+	}
+}
+
+// testListener is a listener which accepts no client until it is closed.
+type testListener struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newTestListener() *testListener {
+	return &testListener{closed: make(chan struct{})}
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	<-l.closed
+
+	return nil, errors.New("closed")
+}
+
+func (l *testListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+	})
+
+	return nil
+}
+
+func (l *testListener) Addr() net.Addr {
+	return testListenAddr
+}
+
+// resetServe resets handles of serving, and returns a function restoring them.
+func resetServe() func() {
+	oldListeners, oldEchoConns, oldHousekeeping := listeners, echoConns, housekeeping
+
+	listeners = nil
+	echoConns = nil
+	// Housekeeping is out of the test
+	housekeeping = time.Hour
+
+	return func() {
+		listeners, echoConns, housekeeping = oldListeners, oldEchoConns, oldHousekeeping
+		isClosed = false
+		closeOnce = sync.Once{}
+	}
+}
+
+func TestServeUpstreamEOF(t *testing.T) {
+	handle, restore := resetRouting()
+	defer restore()
+	defer resetServe()()
+
+	listener := newTestListener()
+	listeners = []net.Listener{listener}
+
+	// The upstream is an offline source which reaches its end after a packet
+	reply := pcap.CreateUDPLayer(uint16(testDst.Port), 10000)
+	handle.reads = [][]byte{newUpPacket(t, testDst.IP, 64, reply, []byte("last")).Data()}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(context.Background())
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(shutdownTimeout):
+		t.Fatal("serve does not return at the end of the upstream")
+	}
+	if !errors.Is(err, io.EOF) || !strings.Contains(err.Error(), "closed unexpectedly") {
+		t.Errorf("serve = %v, want upstream closed unexpectedly", err)
+	}
+	if len(handle.reads) != 0 {
+		t.Errorf("unread packets = %d, want 0", len(handle.reads))
+	}
+
+	// Listeners are torn down with the upstream
+	select {
+	case <-listener.closed:
+	default:
+		t.Error("listener not closed")
+	}
+	if !isClosed {
+		t.Error("handles not closed")
+	}
+	if atomic.LoadInt32(&upLooping) != 0 {
+		t.Error("upstream loop still running")
+	}
+}
+
+func TestDistPreserved(t *testing.T) {
+	defer resetFlows()()
+	fake, restoreClock := resetClock()
+	defer restoreClock()
+	defer func(preserve bool, p uint16) {
+		preserveUDP, port = preserve, p
+	}(preserveUDP, port)
+
+	preserveUDP = true
+	port = 1080
+
+	alloc := func(client string, srcPort uint16) uint16 {
+		natLock.Lock()
+		defer natLock.Unlock()
+
+		q := natKey{src: pcap.NewNATGuide(net.IPv4(192, 168, 1, 2), srcPort, layers.LayerTypeUDP), client: client}
+		value, ok, err := allocFlow(q, q.src.String(), 0)
+		if err != nil || !ok {
+			t.Fatalf("alloc flow: %t, %v", ok, err)
+		}
+
+		return value
+	}
+
+	// The source port is preserved if it is free
+	if value := alloc("a", 5000); value != 5000 {
+		t.Errorf("preserved port = %d, want 5000", value)
+	}
+
+	// Another client with the same source port collides and is distributed a port in sequence
+	if value := alloc("b", 5000); value != 49152 {
+		t.Errorf("collided port = %d, want 49152", value)
+	}
+
+	// The listen port is never preserved
+	if value := alloc("a", port); value != 49153 {
+		t.Errorf("listen port = %d, want 49153", value)
+	}
+
+	// The source port is preserved again once the flow holding it is idle
+	fake.Advance(time.Duration(natConfig.UDP+1) * time.Second)
+	if value := alloc("b", 5000); value != 5000 {
+		t.Errorf("recycled port = %d, want 5000", value)
+	}
+
+	natLock.Lock()
+	_, err := distPreserved(layers.LayerTypeTCP, 5000)
+	natLock.Unlock()
+	if err == nil {
+		t.Error("distribute TCP port: want error")
+	}
+}
+
+
+func TestSelectGateway(t *testing.T) {
+	defer func(gws []*weightedGateway, total int) {
+		gateways, totalWeight = gws, total
+	}(gateways, totalWeight)
+
+	gateways, totalWeight = nil, 0
+	for _, s := range []string{"10.0.0.1:1", "10.0.0.2:3", "10.0.0.3"} {
+		gw, err := parseWeightedGateway(s)
+		if err != nil {
+			t.Fatalf("parse gateway %s: %v", s, err)
+		}
+		gateways = append(gateways, gw)
+		totalWeight = totalWeight + gw.weight
+	}
+
+	const flows = 10000
+	counts := make(map[string]int)
+	src := net.IPv4(192, 168, 1, 2)
+	for i := 0; i < flows; i++ {
+		dst := net.IPv4(203, 0, byte(i>>8), byte(i))
+		gw := selectGateway(src, dst)
+		if gw == nil {
+			t.Fatalf("flow %d selects no gateway", i)
+		}
+		if !gw.Equal(selectGateway(src, dst)) {
+			t.Fatalf("flow %d selects different gateways", i)
+		}
+		counts[gw.String()]++
+	}
+
+	// Flows are distributed by weights within a tolerance of 10%
+	for _, gw := range gateways {
+		want := flows * gw.weight / totalWeight
+		if n := counts[gw.ip.String()]; n < want*9/10 || n > want*11/10 {
+			t.Errorf("flows through %s = %d, want about %d", gw.ip, n, want)
+		}
+	}
+}
+
+
+func TestHandleTTLExceeded(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       uint8
+		isForward bool
+	}{
+		{name: "ttl 0", ttl: 0},
+		{name: "ttl 1", ttl: 1},
+		{name: "ttl 2", ttl: 2, isForward: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handle, restore := resetRouting()
+			defer restore()
+			conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+			defer remove()
+
+			decrementTTL = true
+
+			// Outbound
+			src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+			err := handleListen(newEmbUDP(t, src, testDst, tt.ttl, []byte("request")), conn)
+			if err != nil {
+				t.Fatalf("handle listen: %v", err)
+			}
+			writes := handle.written()
+			if tt.isForward != (len(writes) == 1) {
+				t.Fatalf("writes to upstream = %d, want forwarded %t", len(writes), tt.isForward)
+			}
+			if tt.isForward {
+				out := gopacket.NewPacket(writes[0], layers.LayerTypeEthernet, gopacket.Default)
+				if ttl := out.Layer(layers.LayerTypeIPv4).(*layers.IPv4).TTL; ttl != tt.ttl-1 {
+					t.Errorf("outbound ttl = %d, want %d", ttl, tt.ttl-1)
+				}
+			}
+
+			// Inbound of a flow opened with a valid TTL
+			out := routeOut(t, handle, conn, newEmbUDP(t, src, testDst, 64, []byte("request")))
+			upPort := out.Layer(layers.LayerTypeUDP).(*layers.UDP).SrcPort
+			reply := pcap.CreateUDPLayer(uint16(testDst.Port), uint16(upPort))
+			err = handleUpstream(newUpPacket(t, testDst.IP, tt.ttl, reply, []byte("response")))
+			if err != nil {
+				t.Fatalf("handle upstream: %v", err)
+			}
+			writes = conn.written()
+			if tt.isForward != (len(writes) == 1) {
+				t.Fatalf("writes to client = %d, want forwarded %t", len(writes), tt.isForward)
+			}
+			if tt.isForward {
+				in := gopacket.NewPacket(writes[0], layers.LayerTypeIPv4, gopacket.Default)
+				if ttl := in.Layer(layers.LayerTypeIPv4).(*layers.IPv4).TTL; ttl != tt.ttl-1 {
+					t.Errorf("inbound ttl = %d, want %d", ttl, tt.ttl-1)
+				}
+			}
+		})
+	}
+}
+
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		s    string
+		t    gopacket.LayerType
+		min  uint16
+		max  uint16
+		fail bool
+	}{
+		{s: "tcp:443", t: layers.LayerTypeTCP, min: 443, max: 443},
+		{s: "UDP:10000-10100", t: layers.LayerTypeUDP, min: 10000, max: 10100},
+		{s: "udp:1-65535", t: layers.LayerTypeUDP, min: 1, max: 65535},
+		{s: "tcp:0", fail: true},
+		{s: "tcp:65536", fail: true},
+		{s: "tcp:100-99", fail: true},
+		{s: "tcp:1-2-3", fail: true},
+		{s: "icmp:1", fail: true},
+		{s: "443", fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			typ, r, err := parsePortRange(tt.s)
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("parse %s: want error", tt.s)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse %s: %v", tt.s, err)
+			}
+			if typ != tt.t || r.min != tt.min || r.max != tt.max {
+				t.Errorf("parse %s = %s %d - %d, want %s %d - %d", tt.s, typ, r.min, r.max, tt.t, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestIsPortAllowed(t *testing.T) {
+	pol, err := parsePolicy(&config.Config{AllowPorts: []string{"tcp:443", "udp:10000-10100", "udp:53"}})
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		udp     bool
+		port    uint16
+		allowed bool
+	}{
+		{name: "tcp allowed", port: 443, allowed: true},
+		{name: "tcp below", port: 442},
+		{name: "tcp above", port: 444},
+		{name: "tcp in udp range", port: 10000},
+		{name: "udp min", udp: true, port: 10000, allowed: true},
+		{name: "udp max", udp: true, port: 10100, allowed: true},
+		{name: "udp below", udp: true, port: 9999},
+		{name: "udp above", udp: true, port: 10101},
+		{name: "udp single", udp: true, port: 53, allowed: true},
+		{name: "udp in tcp range", udp: true, port: 443},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var transportLayer gopacket.TransportLayer = pcap.CreateTCPLayer(1024, tt.port, 1, 1)
+			if tt.udp {
+				transportLayer = pcap.CreateUDPLayer(1024, tt.port)
+			}
+			indicator, err := pcap.ParseEmbPacket(newEmbPacket(t, net.IPv4(192, 168, 1, 2), testDst.IP, 64, transportLayer, []byte("data")))
+			if err != nil {
+				t.Fatalf("parse packet: %v", err)
+			}
+
+			if allowed := isPortAllowed(pol.allowPorts, indicator); allowed != tt.allowed {
+				t.Errorf("allowed = %t, want %t", allowed, tt.allowed)
+			}
+			if !isPortAllowed(nil, indicator) {
+				t.Error("denied without allowed ports")
+			}
+		})
+	}
+}
+
+
+// newEchoPacket returns an Ethernet frame of an ICMPv4 packet of the type from the client to the destination.
+func newEchoPacket(tb testing.TB, dst net.IP, t uint8, payload []byte) gopacket.Packet {
+	icmpv4Layer := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(t, 0), Id: 1234, Seq: 7}
+	ipv4Layer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    net.IPv4(192, 0, 2, 1),
+		DstIP:    dst,
+	}
+	linkLayer, err := pcap.CreateEthernetLayer(testGatewayMAC, testUpMAC, ipv4Layer)
+	if err != nil {
+		tb.Fatalf("create link layer: %v", err)
+	}
+
+	data, err := pcap.Serialize(linkLayer, ipv4Layer, icmpv4Layer, gopacket.Payload(payload))
+	if err != nil {
+		tb.Fatalf("serialize: %v", err)
+	}
+
+	return gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestHandleEcho(t *testing.T) {
+	tests := []struct {
+		name    string
+		dst     net.IP
+		t       uint8
+		isReply bool
+	}{
+		{name: "request", dst: testUpIP, t: layers.ICMPv4TypeEchoRequest, isReply: true},
+		{name: "request to others", dst: testDst.IP, t: layers.ICMPv4TypeEchoRequest},
+		{name: "reply", dst: testUpIP, t: layers.ICMPv4TypeEchoReply},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dev := pcap.NewDevice("up0", "up0", []*net.IPNet{{IP: testUpIP, Mask: net.CIDRMask(24, 32)}}, testUpMAC, false)
+			handle := &testHandle{linkType: layers.LinkTypeEthernet}
+			conn := pcap.CreateRawConnWithHandle(dev, dev, handle)
+
+			err := handleEcho(newEchoPacket(t, tt.dst, tt.t, []byte("ping")), conn)
+			if err != nil {
+				t.Fatalf("handle echo: %v", err)
+			}
+
+			writes := handle.written()
+			if !tt.isReply {
+				if len(writes) != 0 {
+					t.Errorf("writes = %d, want 0", len(writes))
+				}
+				return
+			}
+			if len(writes) != 1 {
+				t.Fatalf("writes = %d, want 1", len(writes))
+			}
+
+			// The reply is sent back to the client with the same Id, sequence and payload
+			reply := gopacket.NewPacket(writes[0], layers.LayerTypeEthernet, gopacket.Default)
+			ethernetLayer := reply.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+			if !bytes.Equal(ethernetLayer.SrcMAC, testUpMAC) || !bytes.Equal(ethernetLayer.DstMAC, testGatewayMAC) {
+				t.Errorf("link = %s -> %s, want %s -> %s", ethernetLayer.SrcMAC, ethernetLayer.DstMAC, testUpMAC, testGatewayMAC)
+			}
+			ipv4Layer := reply.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if !ipv4Layer.SrcIP.Equal(testUpIP) || !ipv4Layer.DstIP.Equal(net.IPv4(192, 0, 2, 1)) {
+				t.Errorf("network = %s -> %s, want %s -> 192.0.2.1", ipv4Layer.SrcIP, ipv4Layer.DstIP, testUpIP)
+			}
+			icmpv4Layer := reply.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+			if icmpv4Layer.TypeCode.Type() != layers.ICMPv4TypeEchoReply || icmpv4Layer.Id != 1234 || icmpv4Layer.Seq != 7 {
+				t.Errorf("reply = %s %d %d, want EchoReply 1234 7", icmpv4Layer.TypeCode, icmpv4Layer.Id, icmpv4Layer.Seq)
+			}
+			if !bytes.Equal(icmpv4Layer.Payload, []byte("ping")) {
+				t.Errorf("payload = %q, want %q", icmpv4Layer.Payload, "ping")
+			}
+		})
+	}
+}
+
+
+func TestHandleTFO(t *testing.T) {
+	tests := []struct {
+		name      string
+		isProxied bool
+	}{
+		{name: "plain"},
+		{name: "proxied", isProxied: true},
+	}
+
+	defer func(dsts map[string]bool, flows map[string]*proxyFlow) {
+		proxyDsts, proxyFlows = dsts, flows
+	}(proxyDsts, proxyFlows)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handle, restore := resetRouting()
+			defer restore()
+			conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+			defer remove()
+
+			src := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+			dst := &net.TCPAddr{IP: testDst.IP, Port: 443}
+			proxyDsts, proxyFlows = nil, make(map[string]*proxyFlow)
+			var header []byte
+			if tt.isProxied {
+				proxyDsts = map[string]bool{dst.String(): true}
+				var err error
+				header, err = pcap.CreateProxyProtocolHeader(src, dst)
+				if err != nil {
+					t.Fatalf("create proxy protocol header: %v", err)
+				}
+			}
+
+			// The SYN of TCP Fast Open egresses with its data, and creates NAT
+			syn := pcap.CreateTCPLayer(uint16(src.Port), uint16(dst.Port), 1000, 0)
+			pcap.FlagTCPLayer(syn, true, false, false)
+			out := routeOut(t, handle, conn, newEmbPacket(t, src.IP, dst.IP, 64, syn, []byte("GET / HTTP/1.1")))
+			outTCP := out.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			if !outTCP.SYN || outTCP.ACK || outTCP.Seq != 1000 {
+				t.Errorf("segment = SYN %t, ACK %t, seq %d, want a SYN of 1000", outTCP.SYN, outTCP.ACK, outTCP.Seq)
+			}
+			if want := append(append([]byte{}, header...), "GET / HTTP/1.1"...); !bytes.Equal(outTCP.Payload, want) {
+				t.Errorf("payload = %q, want %q", outTCP.Payload, want)
+			}
+			if len(patMap) != 1 {
+				t.Fatalf("flows = %d, want 1", len(patMap))
+			}
+			for q, value := range patMap {
+				if q.src.Value != uint16(src.Port) || value != uint16(outTCP.SrcPort) {
+					t.Errorf("flow = %d -> %d, want %d -> %d", q.src.Value, value, src.Port, outTCP.SrcPort)
+				}
+			}
+
+			// Following segments are shifted by the header injected in the SYN
+			data := pcap.CreateTCPLayer(uint16(src.Port), uint16(dst.Port), 1015, 5001)
+			out = routeOut(t, handle, conn, newEmbPacket(t, src.IP, dst.IP, 64, data, []byte("Host: example.com")))
+			outTCP = out.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			if want := 1015 + uint32(len(header)); outTCP.Seq != want {
+				t.Errorf("seq = %d, want %d", outTCP.Seq, want)
+			}
+			if !bytes.Equal(outTCP.Payload, []byte("Host: example.com")) {
+				t.Errorf("payload = %q, want %q", outTCP.Payload, "Host: example.com")
+			}
+		})
+	}
+}
+
+
+func TestDistHashed(t *testing.T) {
+	defer func(seed []byte) {
+		hashSeed = seed
+	}(hashSeed)
+
+	hashSeed = []byte("seed")
+
+	// A key hashed to the last port, whose probes wrap around
+	key := "192.168.1.2:1024-203.0.113.1:443-TCP"
+	var last string
+	for i := 0; last == ""; i++ {
+		k := fmt.Sprintf("192.168.1.2:%d-203.0.113.1:443-TCP", i)
+		if hashFlow(k)%16384 == 16383 {
+			last = k
+		}
+	}
+
+	distribute := func(key string) uint16 {
+		natLock.Lock()
+		defer natLock.Unlock()
+
+		value, err := distHashed(layers.LayerTypeTCP, key)
+		if err != nil {
+			t.Fatalf("distribute %s: %v", key, err)
+		}
+		tcpPortPool[value-49152] = clock.Now()
+
+		return value
+	}
+
+	// The same flow is distributed the same port across runs
+	start := 49152 + uint16(hashFlow(key)%16384)
+	for i := 0; i < 2; i++ {
+		func() {
+			defer resetFlows()()
+
+			if value := distribute(key); value != start {
+				t.Errorf("run %d port = %d, want %d", i, value, start)
+			}
+		}()
+	}
+
+	// Flows colliding with alive ports probe the following ones
+	defer resetFlows()()
+	distribute(key)
+	if value := distribute(key); value != start+1 {
+		t.Errorf("collided port = %d, want %d", value, start+1)
+	}
+	if value := distribute(key); value != start+2 {
+		t.Errorf("collided port = %d, want %d", value, start+2)
+	}
+	if value := distribute(last); value != 65535 {
+		t.Errorf("last port = %d, want 65535", value)
+	}
+	if value := distribute(last); value != 49152 {
+		t.Errorf("wrapped port = %d, want 49152", value)
+	}
+}
+
+
+func TestIsGroup(t *testing.T) {
+	_, restore := resetUpstream()
+	defer restore()
+
+	tests := []struct {
+		ip   net.IP
+		want bool
+	}{
+		{ip: net.IPv4(224, 0, 0, 251), want: true},
+		{ip: net.IPv4(239, 255, 255, 250), want: true},
+		{ip: net.IPv4bcast, want: true},
+		{ip: net.IPv4(10, 0, 0, 255), want: true},
+		{ip: net.IPv4(10, 0, 0, 2)},
+		{ip: net.IPv4(10, 0, 1, 255)},
+		{ip: net.IPv4(203, 0, 113, 1)},
+	}
+
+	for _, tt := range tests {
+		if group := isGroup(tt.ip); group != tt.want {
+			t.Errorf("isGroup(%s) = %t, want %t", tt.ip, group, tt.want)
+		}
+	}
+}
+
+func TestHandleGroup(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		dst    net.IP
+		mac    net.HardwareAddr
+	}{
+		{name: "drop multicast", policy: multicastDrop, dst: net.IPv4(224, 0, 0, 251)},
+		{name: "drop broadcast", policy: multicastDrop, dst: net.IPv4bcast},
+		{name: "forward multicast", policy: multicastForward, dst: net.IPv4(224, 0, 0, 251), mac: net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfb}},
+		{name: "forward broadcast", policy: multicastForward, dst: net.IPv4(10, 0, 0, 255), mac: layers.EthernetBroadcast},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handle, restore := resetRouting()
+			defer restore()
+			conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+			defer remove()
+
+			multicast = tt.policy
+
+			src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 5353}
+			dst := &net.UDPAddr{IP: tt.dst, Port: 5353}
+			err := handleListen(newEmbUDP(t, src, dst, 64, []byte("query")), conn)
+			if err != nil {
+				t.Fatalf("handle listen: %v", err)
+			}
+
+			// Packets to groups never create NAT, since no reply is expected
+			if len(patMap) != 0 || len(nat) != 0 {
+				t.Errorf("flows = %d, %d, want 0, 0", len(patMap), len(nat))
+			}
+			writes := handle.written()
+			if tt.policy == multicastDrop {
+				if len(writes) != 0 {
+					t.Errorf("writes to upstream = %d, want 0", len(writes))
+				}
+				return
+			}
+			if len(writes) != 1 {
+				t.Fatalf("writes to upstream = %d, want 1", len(writes))
+			}
+
+			// Only the source address is translated
+			out := gopacket.NewPacket(writes[0], layers.LayerTypeEthernet, gopacket.Default)
+			if dstMAC := out.Layer(layers.LayerTypeEthernet).(*layers.Ethernet).DstMAC; !bytes.Equal(dstMAC, tt.mac) {
+				t.Errorf("destination hardware address = %s, want %s", dstMAC, tt.mac)
+			}
+			outIPv4 := out.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if !outIPv4.SrcIP.Equal(testUpIP) || !outIPv4.DstIP.Equal(tt.dst) {
+				t.Errorf("network = %s -> %s, want %s -> %s", outIPv4.SrcIP, outIPv4.DstIP, testUpIP, tt.dst)
+			}
+			outUDP := out.Layer(layers.LayerTypeUDP).(*layers.UDP)
+			if outUDP.SrcPort != 5353 || outUDP.DstPort != 5353 {
+				t.Errorf("ports = %d-%d, want 5353-5353", outUDP.SrcPort, outUDP.DstPort)
+			}
+			if !bytes.Equal(outUDP.Payload, []byte("query")) {
+				t.Errorf("payload = %q, want %q", outUDP.Payload, "query")
+			}
+		})
+	}
+}
+
+
+// resetQueues replaces queues of packets from clients with empty ones, and returns a function restoring them.
+func resetQueues() func() {
+	oldC, oldPrioQueue := c, prioQueue
+
+	c = make(chan pcap.ConnBytes, 1000)
+	prioQueue = make(chan pcap.ConnBytes, 1000)
+
+	return func() {
+		c, prioQueue = oldC, oldPrioQueue
+	}
+}
+
+// runListen handles packets queued from clients until the count of packets are written to the upstream.
+func runListen(t *testing.T, handle *testHandle, n int) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		loopListen(ctx, 0)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for handle.count() < n || len(c) > 0 || len(prioQueue) > 0 {
+		if time.Now().After(deadline) {
+			cancel()
+			<-done
+			t.Fatalf("writes to upstream = %d, want %d", handle.count(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func TestMaxLatency(t *testing.T) {
+	handle, restore := resetRouting()
+	defer restore()
+	defer resetQueues()()
+	fake, restoreClock := resetClock()
+	defer restoreClock()
+	conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+	defer remove()
+	defer func(latency time.Duration, late, prio uint64) {
+		maxLatency = latency
+		atomic.StoreUint64(&lateDrops, late)
+		atomic.StoreUint64(&prioLate, prio)
+	}(maxLatency, atomic.LoadUint64(&lateDrops), atomic.LoadUint64(&prioLate))
+
+	maxLatency = 100 * time.Millisecond
+	atomic.StoreUint64(&lateDrops, 0)
+	atomic.StoreUint64(&prioLate, 0)
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+	enqueue := func(queue chan pcap.ConnBytes, payload string) {
+		queue <- pcap.ConnBytes{Bytes: newEmbUDP(t, src, testDst, 64, []byte(payload)), Conn: conn, Time: clock.Now()}
+	}
+
+	// Packets queued before the delay are dropped, while the one queued after is forwarded
+	enqueue(c, "stale")
+	enqueue(prioQueue, "stale priority")
+	fake.Advance(150 * time.Millisecond)
+	enqueue(c, "fresh")
+
+	runListen(t, handle, 1)
+
+	writes := handle.written()
+	if len(writes) != 1 {
+		t.Fatalf("writes to upstream = %d, want 1", len(writes))
+	}
+	out := gopacket.NewPacket(writes[0], layers.LayerTypeEthernet, gopacket.Default)
+	if payload := out.Layer(layers.LayerTypeUDP).(*layers.UDP).Payload; string(payload) != "fresh" {
+		t.Errorf("payload = %q, want %q", payload, "fresh")
+	}
+	if late, prio := atomic.LoadUint64(&lateDrops), atomic.LoadUint64(&prioLate); late != 2 || prio != 1 {
+		t.Errorf("late drops = %d, %d, want 2, 1", late, prio)
+	}
+}
+
+
+func TestIsPriority(t *testing.T) {
+	defer func(dscps map[uint8]bool, ports map[gopacket.LayerType][]*portRange) {
+		prioDSCPs, prioPorts = dscps, ports
+	}(prioDSCPs, prioPorts)
+
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+	voice := newEmbUDP(t, src, &net.UDPAddr{IP: testDst.IP, Port: 5060}, 64, []byte("invite"))
+	bulk := newEmbUDP(t, src, testDst, 64, []byte("bulk"))
+	expedited := newEmbUDP(t, src, testDst, 64, []byte("expedited"))
+	expedited[1] = 46 << 2
+	ssh := newEmbPacket(t, src.IP, testDst.IP, 64, pcap.CreateTCPLayer(1024, 22, 1, 1), []byte("ssh"))
+	fragment := append([]byte{}, voice...)
+	fragment[6], fragment[7] = 0, 1
+
+	prioDSCPs = nil
+	prioPorts = nil
+	if isPriority(voice) || isPriority(expedited) {
+		t.Error("priority without classifiers")
+	}
+
+	prioDSCPs = map[uint8]bool{46: true}
+	prioPorts = map[gopacket.LayerType][]*portRange{
+		layers.LayerTypeUDP: {{min: 5060, max: 5061}},
+		layers.LayerTypeTCP: {{min: 22, max: 22}},
+	}
+	tests := []struct {
+		name     string
+		contents []byte
+		want     bool
+	}{
+		{name: "port", contents: voice, want: true},
+		{name: "tcp port", contents: ssh, want: true},
+		{name: "dscp", contents: expedited, want: true},
+		{name: "bulk", contents: bulk},
+		{name: "fragment", contents: fragment},
+		{name: "truncated", contents: voice[:10]},
+	}
+	for _, tt := range tests {
+		if prio := isPriority(tt.contents); prio != tt.want {
+			t.Errorf("%s priority = %t, want %t", tt.name, prio, tt.want)
+		}
+	}
+}
+
+func TestPriorityEgress(t *testing.T) {
+	handle, restore := resetRouting()
+	defer restore()
+	defer resetQueues()()
+	conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+	defer remove()
+	defer func(ports map[gopacket.LayerType][]*portRange) {
+		prioPorts = ports
+	}(prioPorts)
+
+	prioPorts = map[gopacket.LayerType][]*portRange{layers.LayerTypeUDP: {{min: 27015, max: 27015}}}
+
+	// Packets are queued as read from the client, bulk ones first
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+	packets := [][]byte{
+		newEmbUDP(t, src, testDst, 64, []byte("bulk 1")),
+		newEmbUDP(t, src, testDst, 64, []byte("bulk 2")),
+		newEmbUDP(t, src, testDst, 64, []byte("bulk 3")),
+		newEmbUDP(t, src, &net.UDPAddr{IP: testDst.IP, Port: 27015}, 64, []byte("invite")),
+	}
+	for _, packet := range packets {
+		queue := c
+		if isPriority(packet) {
+			queue = prioQueue
+		}
+		queue <- pcap.ConnBytes{Bytes: packet, Conn: conn, Time: clock.Now()}
+	}
+
+	runListen(t, handle, len(packets))
+
+	// The packet with priority egresses ahead of bulk ones queued before it
+	writes := handle.written()
+	want := []string{"invite", "bulk 1", "bulk 2", "bulk 3"}
+	if len(writes) != len(want) {
+		t.Fatalf("writes to upstream = %d, want %d", len(writes), len(want))
+	}
+	for i, data := range writes {
+		out := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		if payload := out.Layer(layers.LayerTypeUDP).(*layers.UDP).Payload; string(payload) != want[i] {
+			t.Errorf("write %d payload = %q, want %q", i, payload, want[i])
+		}
+	}
+}
+
+
+// isIPv4ChecksumValid reports whether the checksum of the IPv4 header is valid.
+func isIPv4ChecksumValid(header []byte) bool {
+	var sum uint32
+	for i := 0; i+1 < len(header); i = i + 2 {
+		sum = sum + uint32(header[i])<<8 + uint32(header[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return sum == 0xffff
+}
+
+func TestIPOptionsPreserved(t *testing.T) {
+	handle, restore := resetRouting()
+	defer restore()
+	conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+	defer remove()
+
+	ipOptions = ipOptionsPreserve
+
+	// Router alert and record route, which are aligned without padding
+	options := []layers.IPv4Option{
+		{OptionType: 148, OptionLength: 4, OptionData: []byte{0, 0}},
+		{OptionType: 1, OptionLength: 1},
+		{OptionType: 7, OptionLength: 7, OptionData: []byte{4, 0, 0, 0, 0}},
+	}
+	src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+	udpLayer := pcap.CreateUDPLayer(uint16(src.Port), uint16(testDst.Port))
+	ipv4Layer, err := pcap.CreateIPv4Layer(src.IP, testDst.IP, 0, 64, udpLayer)
+	if err != nil {
+		t.Fatalf("create network layer: %v", err)
+	}
+	ipv4Layer.Options = options
+	data, err := pcap.Serialize(ipv4Layer, udpLayer, gopacket.Payload("request"))
+	if err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+
+	// The packet is reserialized with options as is, and the TTL decremented, with a valid checksum
+	out := routeOut(t, handle, conn, data)
+	outIPv4Layer := out.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if outIPv4Layer.TTL != 63 {
+		t.Errorf("ttl = %d, want 63", outIPv4Layer.TTL)
+	}
+	if outIPv4Layer.IHL != 8 {
+		t.Errorf("ihl = %d, want 8", outIPv4Layer.IHL)
+	}
+	if len(outIPv4Layer.Options) != len(options) {
+		t.Fatalf("options = %d, want %d", len(outIPv4Layer.Options), len(options))
+	}
+	for i, option := range outIPv4Layer.Options {
+		if option.OptionType != options[i].OptionType || !bytes.Equal(option.OptionData, options[i].OptionData) {
+			t.Errorf("option %d = %d %v, want %d %v", i, option.OptionType, option.OptionData, options[i].OptionType, options[i].OptionData)
+		}
+	}
+	if !isIPv4ChecksumValid(outIPv4Layer.Contents) {
+		t.Errorf("checksum %#04x is invalid", outIPv4Layer.Checksum)
+	}
+	if payload := out.Layer(layers.LayerTypeUDP).(*layers.UDP).Payload; string(payload) != "request" {
+		t.Errorf("payload = %q, want %q", payload, "request")
+	}
+}
+
+
+// newARPPacket returns an ARP packet received by the upstream of the operation between the addresses.
+func newARPPacket(tb testing.TB, operation uint16, srcMAC net.HardwareAddr, srcIP net.IP, dstMAC net.HardwareAddr, dstIP net.IP) gopacket.Packet {
+	arpLayer := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         operation,
+		SourceHwAddress:   srcMAC,
+		SourceProtAddress: srcIP.To4(),
+		DstHwAddress:      dstMAC,
+		DstProtAddress:    dstIP.To4(),
+	}
+	linkLayer := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeARP}
+
+	data, err := pcap.Serialize(linkLayer, arpLayer)
+	if err != nil {
+		tb.Fatalf("serialize: %v", err)
+	}
+
+	return gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestUpdateGatewayMAC(t *testing.T) {
+	failoverMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 0xfd}
+
+	tests := []struct {
+		name      string
+		operation uint16
+		srcIP     net.IP
+		dstIP     net.IP
+		want      net.HardwareAddr
+	}{
+		{name: "reply", operation: layers.ARPReply, srcIP: testGatewayIP, dstIP: testUpIP, want: failoverMAC},
+		{name: "gratuitous", operation: layers.ARPRequest, srcIP: testGatewayIP, dstIP: testGatewayIP, want: failoverMAC},
+		{name: "reply of another host", operation: layers.ARPReply, srcIP: net.IPv4(10, 0, 0, 3), dstIP: testUpIP, want: testGatewayMAC},
+		{name: "request", operation: layers.ARPRequest, srcIP: testGatewayIP, dstIP: testUpIP, want: testGatewayMAC},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handle, restore := resetRouting()
+			defer restore()
+			conn, remove := addTestClient(net.IPv4(192, 0, 2, 1))
+			defer remove()
+
+			src := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}
+			out := routeOut(t, handle, conn, newEmbUDP(t, src, testDst, 64, []byte("request 1")))
+			if dstMAC := out.LinkLayer().(*layers.Ethernet).DstMAC; !bytes.Equal(dstMAC, testGatewayMAC) {
+				t.Fatalf("next hop = %s, want %s", dstMAC, testGatewayMAC)
+			}
+
+			err := handleUpstream(newARPPacket(t, tt.operation, failoverMAC, tt.srcIP, testUpMAC, tt.dstIP))
+			if err != nil {
+				t.Fatalf("handle upstream: %v", err)
+			}
+
+			// Packets of the flow follow the gateway once it fails over to another hardware address mid-stream
+			out = routeOut(t, handle, conn, newEmbUDP(t, src, testDst, 64, []byte("request 2")))
+			if dstMAC := out.LinkLayer().(*layers.Ethernet).DstMAC; !bytes.Equal(dstMAC, tt.want) {
+				t.Errorf("next hop = %s, want %s", dstMAC, tt.want)
+			}
+			if len(conn.written()) != 0 {
+				t.Error("arp is written to the client")
+			}
+		})
+	}
+}
+
+
+// BenchmarkPin compares the throughput of the listen path with a listen handle per CPU, with and without pinning
+// handles and the handler to CPUs.
+func BenchmarkPin(b *testing.B) {
+	handle, restore := resetRouting()
+	defer restore()
+	handle.discard = true
+
+	handles := runtime.NumCPU()
+	data := newEmbUDP(b, &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024}, testDst, 64, make([]byte, 1024))
+
+	for _, isPinned := range []bool{false, true} {
+		name := "unpinned"
+		if isPinned {
+			name = "pinned"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			defer func(pinned bool) {
+				pinThread = pinned
+			}(pinThread)
+			pinThread = isPinned
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			conns := make([]*testConn, handles)
+			for i := range conns {
+				var remove func()
+				conns[i], remove = addTestClient(net.IPv4(192, 0, 2, byte(1+i)))
+				defer remove()
+
+				// Packets are shared by handles
+				conns[i].packet = data
+				conns[i].count = b.N / handles
+				if i < b.N%handles {
+					conns[i].count++
+				}
+			}
+			handle.written()
+
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				loopListen(ctx, handles%runtime.NumCPU())
+			}()
+			for i, conn := range conns {
+				wg.Add(1)
+				go func(i int, conn *testConn) {
+					defer wg.Done()
+					readClient(ctx, conn, i%runtime.NumCPU(), pcap.NewBufferPool())
+				}(i, conn)
+			}
+
+			for handle.count() < b.N {
+				runtime.Gosched()
+			}
+			b.StopTimer()
+
+			cancel()
+			wg.Wait()
+		})
+	}
+}
+
+// BenchmarkNATLookup compares looking up NAT of an outbound packet and the reply to it by formatted addresses, as NAT
+// was keyed before, and by NAT guides.
+func BenchmarkNATLookup(b *testing.B) {
+	const flows = 1024
+
+	type stringKey struct {
+		src      string
+		client   string
+		protocol gopacket.LayerType
+	}
+
+	upIP := net.IPv4(10, 0, 0, 1)
+	srcs := make([]*net.UDPAddr, flows)
+	for i := range srcs {
+		srcs[i] = &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1024 + i}
+	}
+
+	b.Run("string", func(b *testing.B) {
+		outbound := make(map[stringKey]uint16, flows)
+		inbound := make(map[string]*natIndicator, flows)
+		for i, src := range srcs {
+			value := uint16(49152 + i)
+			outbound[stringKey{src: src.String(), client: "client", protocol: layers.LayerTypeUDP}] = value
+			inbound[(&net.UDPAddr{IP: upIP, Port: int(value)}).String()] = &natIndicator{embSrc: src}
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			value := outbound[stringKey{src: srcs[i%flows].String(), client: "client", protocol: layers.LayerTypeUDP}]
+			if inbound[(&net.UDPAddr{IP: upIP, Port: int(value)}).String()] == nil {
+				b.Fatal("missing nat")
+			}
+		}
+	})
+
+	b.Run("guide", func(b *testing.B) {
+		outbound := make(map[natKey]uint16, flows)
+		inbound := make(map[pcap.NATGuide]*natIndicator, flows)
+		for i, src := range srcs {
+			value := uint16(49152 + i)
+			outbound[natKey{src: natGuideOf(src, layers.LayerTypeUDP), client: "client"}] = value
+			inbound[natGuide(layers.LayerTypeUDP, upIP, value)] = &natIndicator{embSrc: src}
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+
+		for i := 0; i < b.N; i++ {
+			value := outbound[natKey{src: natGuideOf(srcs[i%flows], layers.LayerTypeUDP), client: "client"}]
+			if inbound[natGuide(layers.LayerTypeUDP, upIP, value)] == nil {
+				b.Fatal("missing nat")
+			}
+		}
+	})
+}
@@ -22,6 +22,22 @@ func (addr ICMPQueryAddr) Network() string {
 	return "icmp query"
 }
 
+// PortAddr represents the address of an end point of a transport which identifies flows by ports, other than TCP and
+// UDP.
+type PortAddr struct {
+	Protocol string
+	IP       net.IP
+	Port     uint16
+}
+
+func (addr PortAddr) String() string {
+	return fmt.Sprintf("%s:%d", formatIP(addr.IP), addr.Port)
+}
+
+func (addr PortAddr) Network() string {
+	return strings.ToLower(addr.Protocol)
+}
+
 // MultiTCPAddr represents multiple TCP addresses.
 type MultiTCPAddr struct {
 	Addrs []*net.TCPAddr
@@ -92,6 +108,17 @@ func DstBPFFilter(addr net.Addr) (string, error) {
 	return bpfFilter("dst", addr)
 }
 
+// SrcNetBPFFilter returns a source BPF filter by the given networks.
+func SrcNetBPFFilter(networks []*net.IPNet) string {
+	s := make([]string, 0)
+
+	for _, network := range networks {
+		s = append(s, fmt.Sprintf("src net %s", network))
+	}
+
+	return fmt.Sprintf("(%s)", strings.Join(s, " || "))
+}
+
 func formatIP(ip net.IP) string {
 	if ip == nil {
 		return ""
@@ -0,0 +1,87 @@
+package addr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// Pool is a pool of IPv4 addresses in a network.
+type Pool struct {
+	lock    sync.Mutex
+	network *net.IPNet
+	first   uint32
+	size    uint32
+	next    uint32
+	used    map[uint32]bool
+}
+
+// ParsePool returns a pool of IPv4 addresses by the given CIDR. The network address and the broadcast address are
+// excluded from the pool.
+func ParsePool(s string) (*Pool, error) {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("parse cidr: %w", err)
+	}
+	if network.IP.To4() == nil {
+		return nil, fmt.Errorf("network %s not support", network)
+	}
+
+	ones, bits := network.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("network %s too small", network)
+	}
+	if bits-ones > 16 {
+		return nil, fmt.Errorf("network %s too large", network)
+	}
+
+	return &Pool{
+		network: network,
+		first:   binary.BigEndian.Uint32(network.IP.To4()) + 1,
+		size:    1<<uint(bits-ones) - 2,
+		used:    make(map[uint32]bool),
+	}, nil
+}
+
+// Network returns the network of the pool.
+func (pool *Pool) Network() *net.IPNet {
+	return pool.network
+}
+
+// Allocate allocates an address from the pool.
+func (pool *Pool) Allocate() (net.IP, error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for i := uint32(0); i < pool.size; i++ {
+		s := pool.first + pool.next%pool.size
+
+		// Point to next address
+		pool.next++
+
+		if !pool.used[s] {
+			pool.used[s] = true
+
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, s)
+
+			return ip, nil
+		}
+	}
+
+	return nil, errors.New("pool empty")
+}
+
+// Release returns an address to the pool.
+func (pool *Pool) Release(ip net.IP) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return
+	}
+
+	pool.lock.Lock()
+	delete(pool.used, binary.BigEndian.Uint32(ip4))
+	pool.lock.Unlock()
+}
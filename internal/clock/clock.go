@@ -0,0 +1,254 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock describes a source of time for timeouts, timers and rate limits.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// After waits for the duration to elapse and then sends the current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+	// NewTimer returns a timer which sends the current time on its channel after at least the duration.
+	NewTimer(d time.Duration) Timer
+	// NewTicker returns a ticker which sends the current time on its channel in every period.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer describes a single event of a clock.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, and returns false if the timer has already expired or been stopped.
+	Stop() bool
+	// Reset changes the timer to expire after the duration, and returns true if the timer had been active.
+	Reset(d time.Duration) bool
+}
+
+// Ticker describes periodic events of a clock.
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered.
+	C() <-chan time.Time
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// Real is the clock of the system.
+var Real Clock = realClock{}
+
+// std is the clock used by the package level functions.
+var std = Real
+
+// Set replaces the clock used by the package level functions, and returns a function which restores the previous one.
+// It is not safe to set the clock while it is being used.
+func Set(c Clock) func() {
+	prev := std
+	std = c
+
+	return func() {
+		std = prev
+	}
+}
+
+// Now returns the current time of the clock.
+func Now() time.Time {
+	return std.Now()
+}
+
+// Since returns the time elapsed since t of the clock.
+func Since(t time.Time) time.Duration {
+	return std.Now().Sub(t)
+}
+
+// After waits for the duration to elapse of the clock and then sends the current time on the returned channel.
+func After(d time.Duration) <-chan time.Time {
+	return std.After(d)
+}
+
+// NewTimer returns a timer of the clock.
+func NewTimer(d time.Duration) Timer {
+	return std.NewTimer(d)
+}
+
+// NewTicker returns a ticker of the clock.
+func NewTicker(d time.Duration) Ticker {
+	return std.NewTicker(d)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// Fake is a clock which only moves when it is advanced, so that timeouts and rate limits can be driven
+// deterministically.
+type Fake struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFake returns a fake clock starting at the given time.
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+// Now returns the current time of the fake clock.
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.now
+}
+
+// After waits for the fake clock to be advanced by the duration and then sends the current time on the returned
+// channel.
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+// NewTimer returns a timer which fires once the fake clock is advanced by the duration.
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{fake: f, c: make(chan time.Time, 1)}
+	t.Reset(d)
+
+	return t
+}
+
+// NewTicker returns a ticker which fires every time the fake clock is advanced by the period.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for ticker")
+	}
+
+	t := &fakeTimer{fake: f, c: make(chan time.Time, 1), period: d}
+	t.Reset(d)
+
+	return fakeTicker{t}
+}
+
+// Advance moves the fake clock forward by the duration, and fires timers and tickers which become due in order.
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	end := f.now.Add(d)
+	for {
+		sort.SliceStable(f.timers, func(i, j int) bool {
+			return f.timers[i].when.Before(f.timers[j].when)
+		})
+		if len(f.timers) <= 0 || f.timers[0].when.After(end) {
+			break
+		}
+
+		t := f.timers[0]
+		f.now = t.when
+		select {
+		case t.c <- f.now:
+		default:
+			// Drop the tick like a ticker of the system does for slow receivers
+		}
+
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+		} else {
+			f.timers = f.timers[1:]
+		}
+	}
+	f.now = end
+}
+
+// Waiters returns the count of active timers and tickers of the fake clock.
+func (f *Fake) Waiters() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.timers)
+}
+
+type fakeTimer struct {
+	fake   *Fake
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.fake.lock.Lock()
+	defer t.fake.lock.Unlock()
+
+	return t.remove()
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.fake.lock.Lock()
+	defer t.fake.lock.Unlock()
+
+	active := t.remove()
+	t.when = t.fake.now.Add(d)
+	if d <= 0 && t.period <= 0 {
+		select {
+		case t.c <- t.when:
+		default:
+		}
+		return active
+	}
+	t.fake.timers = append(t.fake.timers, t)
+
+	return active
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+func (t *fakeTimer) remove() bool {
+	for i, timer := range t.fake.timers {
+		if timer == t {
+			t.fake.timers = append(t.fake.timers[:i], t.fake.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
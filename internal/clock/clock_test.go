@@ -0,0 +1,86 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeTimer(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	f := NewFake(start)
+
+	timer := f.NewTimer(time.Second)
+	stopped := f.NewTimer(time.Second)
+	if !stopped.Stop() {
+		t.Error("stop active timer: want true")
+	}
+
+	f.Advance(time.Second - time.Nanosecond)
+	select {
+	case <-timer.C():
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	f.Advance(time.Nanosecond)
+	select {
+	case now := <-timer.C():
+		if !now.Equal(start.Add(time.Second)) {
+			t.Errorf("fired at %v, want %v", now, start.Add(time.Second))
+		}
+	default:
+		t.Fatal("timer not fired")
+	}
+	select {
+	case <-stopped.C():
+		t.Error("stopped timer fired")
+	default:
+	}
+
+	if timer.Stop() {
+		t.Error("stop expired timer: want false")
+	}
+	if f.Waiters() != 0 {
+		t.Errorf("waiters = %d, want 0", f.Waiters())
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(time.Unix(1600000000, 0))
+
+	ticker := f.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for i := 0; i < 3; i++ {
+		f.Advance(time.Second)
+		select {
+		case <-ticker.C():
+		default:
+			t.Fatalf("tick %d not fired", i)
+		}
+	}
+
+	// Ticks are dropped for slow receivers
+	f.Advance(3 * time.Second)
+	<-ticker.C()
+	select {
+	case <-ticker.C():
+		t.Error("ticks queued for slow receiver")
+	default:
+	}
+}
+
+func TestSet(t *testing.T) {
+	f := NewFake(time.Unix(1600000000, 0))
+
+	restore := Set(f)
+	f.Advance(time.Minute)
+	if d := Since(time.Unix(1600000000, 0)); d != time.Minute {
+		t.Errorf("since = %v, want %v", d, time.Minute)
+	}
+	restore()
+
+	if Now().Before(time.Unix(1600000000, 0).Add(time.Hour)) {
+		t.Error("clock not restored")
+	}
+}
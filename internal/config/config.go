@@ -11,36 +11,110 @@
 
 // Config describes the configuration of IkaGo.
 type Config struct {
-	ListenDevs  []string  `json:"listen-devices"`
-	UpDev       string    `json:"upstream-device"`
-	Gateway     string    `json:"gateway"`
-	Mode        string    `json:"mode"`
-	Method      string    `json:"method"`
-	Password    string    `json:"password"`
-	Rule        bool      `json:"rule"`
-	Monitor     int       `json:"monitor"`
-	Verbose     bool      `json:"verbose"`
-	Log         string    `json:"log"`
-	MTU         int       `json:"mtu"`
-	KCP         bool      `json:"kcp"`
-	KCPConfig   KCPConfig `json:"kcp-tuning"`
-	Fragment    int       `json:"fragment"`
-	Port        int       `json:"port"`
-	Publish     string    `json:"publish"`
-	Sources     []string  `json:"sources"`
-	Server      string    `json:"server"`
-	Destination string    `json:"destination"`
+	ListenDevs    []string  `json:"listen-devices"`
+	UpDev         string    `json:"upstream-device"`
+	Gateway       string    `json:"gateway"`
+	Mode          string    `json:"mode"`
+	Method        string    `json:"method"`
+	Password      string    `json:"password"`
+	Rule          bool      `json:"rule"`
+	Monitor       int       `json:"monitor"`
+	Verbose       bool      `json:"verbose"`
+	Log           string    `json:"log"`
+	DumpDrops     int       `json:"dump-drops"`
+	MTU           int       `json:"mtu"`
+	KCP           bool      `json:"kcp"`
+	KCPConfig     KCPConfig `json:"kcp-tuning"`
+	Fingerprint   string    `json:"fingerprint"`
+	WindowScale   int       `json:"window-scale"`
+	Timestamps    bool      `json:"timestamps"`
+	ECN           bool      `json:"ecn"`
+	IPId          string    `json:"ip-id"`
+	ReplayWindow  int       `json:"replay-window"`
+	Padding       string    `json:"padding"`
+	BatchDelay    int       `json:"batch-delay"`
+	BatchSize     int       `json:"batch-size"`
+	PinThread     bool      `json:"pin-thread"`
+	Egress        string    `json:"egress"`
+	LazyDecode    bool      `json:"lazy-decode"`
+	MaxLatency    int       `json:"max-latency"`
+	SplitUpstream bool      `json:"split-upstream"`
+	VLAN          int       `json:"vlan"`
+	WaitDevs      bool      `json:"wait-devices"`
+	Fragment      int       `json:"fragment"`
+	UpMTU         int       `json:"upstream-mtu"`
+	Port          int       `json:"port"`
+	DecrementTTL  bool      `json:"decrement-ttl"`
+	ExpectedFlows int       `json:"expected-flows"`
+	Pool          string    `json:"pool"`
+	ClientSubnets []string  `json:"client-subnets"`
+	PayloadLimits []string  `json:"payload-limits"`
+	AllowPorts    []string  `json:"allow-ports"`
+	Priority      []string  `json:"priority"`
+	ProxyProtocol []string  `json:"proxy-protocol"`
+	PreserveUDP   bool      `json:"preserve-udp-port"`
+	HashPorts     bool      `json:"hash-ports"`
+	HashSeed      string    `json:"hash-seed"`
+	AnswerPing    bool      `json:"answer-ping"`
+	MaxMemory     int       `json:"max-memory"`
+	Housekeeping  int       `json:"housekeeping"`
+	FlowExport    string    `json:"flow-export"`
+	Checksums     bool      `json:"verify-checksums"`
+	ClientFlows   int       `json:"client-flows"`
+	ClientBytes   int       `json:"client-bytes"`
+	EgressRate    int       `json:"egress-rate"`
+	EgressBurst   int       `json:"egress-burst"`
+	Admin         string    `json:"admin"`
+	AdminToken    string    `json:"admin-token"`
+	HandshakeRate int       `json:"handshake-rate"`
+	SYNCookies    bool      `json:"syn-cookies"`
+	MaxClients    int       `json:"max-clients"`
+	RSTProbes     bool      `json:"rst-probes"`
+	Resume        bool      `json:"resume"`
+	ClientKeys    []string  `json:"client-keys"`
+	KeepAlive     int       `json:"keepalive"`
+	State         string    `json:"state"`
+	Gateways      []string  `json:"gateways"`
+	SNIGateways   []string  `json:"sni-gateways"`
+	GratuitousARP int       `json:"gratuitous-arp"`
+	LogUnmatched  bool      `json:"log-unmatched"`
+	LogNAT        bool      `json:"log-nat"`
+	LogFormat     string    `json:"log-format"`
+	Unsupported   string    `json:"unsupported"`
+	IPOptions     string    `json:"ip-options"`
+	DropSrcRoute  bool      `json:"drop-source-route"`
+	Multicast     string    `json:"multicast"`
+	KillSwitch    int       `json:"kill-switch"`
+	NATConfig     NATConfig `json:"nat-timeout"`
+	Publish       string    `json:"publish"`
+	ClampMSS      bool      `json:"clamp-mss"`
+	Sources       []string  `json:"sources"`
+	Server        string    `json:"server"`
+	Key           string    `json:"key"`
+	Destination   string    `json:"destination"`
 }
 
 // NewConfig returns a new config.
 func NewConfig() *Config {
 	return &Config{
-		Mode:      "faketcp",
-		Method:    "plain",
-		MTU:       1500,
-		KCPConfig: *NewKCPConfig(),
-		Fragment:  1500,
-		Sources:   make([]string, 0),
+		Mode:         "faketcp",
+		Method:       "plain",
+		MTU:          1500,
+		KCPConfig:    *NewKCPConfig(),
+		NATConfig:    *NewNATConfig(),
+		Fingerprint:  "none",
+		WindowScale:  -1,
+		IPId:         "counter",
+		Egress:       "pcap",
+		BatchSize:    1200,
+		Fragment:     1500,
+		Sources:      make([]string, 0),
+		DecrementTTL: true,
+		Housekeeping: 1000,
+		Unsupported:  "log",
+		IPOptions:    "strip",
+		Multicast:    "drop",
+		LogFormat:    "text",
 	}
 }
 
@@ -0,0 +1,21 @@
+package config
+
+// NATConfig describes the configuration of idle timeouts of NAT in seconds.
+type NATConfig struct {
+	TCPSYN         int `json:"tcp-syn"`
+	TCPEstablished int `json:"tcp-established"`
+	TCPClosing     int `json:"tcp-closing"`
+	UDP            int `json:"udp"`
+	ICMP           int `json:"icmp"`
+}
+
+// NewNATConfig returns a new NAT config.
+func NewNATConfig() *NATConfig {
+	return &NATConfig{
+		TCPSYN:         30,
+		TCPEstablished: 30,
+		TCPClosing:     30,
+		UDP:            30,
+		ICMP:           30,
+	}
+}
@@ -0,0 +1,28 @@
+package exec
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// SetAffinity binds the calling OS thread to a specific CPU. The calling goroutine should be locked to its thread by
+// runtime.LockOSThread before.
+func SetAffinity(cpu int) error {
+	var err error
+
+	if cpu < 0 || cpu >= runtime.NumCPU() {
+		return fmt.Errorf("cpu %d out of range", cpu)
+	}
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = setAffinity(cpu)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+package exec
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+func setAffinity(cpu int) error {
+	var set [1024 / 64]uint64
+
+	set[cpu/64] = 1 << (uint(cpu) % 64)
+
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(set)*8), uintptr(unsafe.Pointer(&set)))
+	if errno != 0 {
+		return fmt.Errorf("sched_setaffinity: %w", errno)
+	}
+
+	return nil
+}
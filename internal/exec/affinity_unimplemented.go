@@ -0,0 +1,7 @@
+// +build !linux
+
+package exec
+
+func setAffinity(_ int) error {
+	return nil
+}
@@ -1,17 +1,26 @@
 package log
 
 import (
+	"encoding/hex"
 	"fmt"
+	"github.com/zhxie/ikago/internal/clock"
 	"io"
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const warnLogFileSize int64 = 200 * 1024 * 1024
 
+// dumpInterval is the minimum interval between dumps of dropped packets.
+const dumpInterval = time.Second
+
 var (
 	allowVerbose bool
+	dumpSize     int
+	lastDump     int64
 )
 
 var (
@@ -48,6 +57,31 @@ func SetVerbose(allow bool) {
 	allowVerbose = allow
 }
 
+// SetDump sets the size of the beginning of dropped packets to dump in hex. A size of 0 disables dumping.
+func SetDump(size int) {
+	dumpSize = size
+}
+
+// Dump prints the beginning of a dropped packet in hex to the stderr if dumping is enabled. At most one packet is
+// dumped in an interval to avoid flooding.
+func Dump(reason string, data []byte) {
+	if dumpSize <= 0 || len(data) <= 0 {
+		return
+	}
+
+	now := clock.Now().UnixNano()
+	last := atomic.LoadInt64(&lastDump)
+	if now-last < int64(dumpInterval) || !atomic.CompareAndSwapInt64(&lastDump, last, now) {
+		return
+	}
+
+	size := len(data)
+	if size > dumpSize {
+		size = dumpSize
+	}
+	errLogger.output(fmt.Sprintf("Dump a packet dropped for %s (%d of %d Bytes):\n%s", reason, size, len(data), hex.Dump(data[:size])))
+}
+
 // SetLog sets the path of log file.
 func SetLog(path string) error {
 	if path != "" {
@@ -0,0 +1,119 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/clock"
+	"net"
+	"sync"
+	"time"
+)
+
+// arpRequestInterval is the min interval between ARP requests to the same address.
+const arpRequestInterval = time.Second
+
+type arpIndicator struct {
+	hardwareAddr net.HardwareAddr
+	lastSeen     time.Time
+	lastRequest  time.Time
+}
+
+// ARPCache is a cache of hardware addresses resolved by ARP.
+type ARPCache struct {
+	lock     sync.RWMutex
+	entries  map[string]*arpIndicator
+	deadline time.Duration
+}
+
+// NewARPCache returns a new ARP cache.
+func NewARPCache() *ARPCache {
+	return &ARPCache{entries: make(map[string]*arpIndicator)}
+}
+
+// SetDeadline sets the deadline of entries in the cache.
+func (cache *ARPCache) SetDeadline(t time.Duration) {
+	cache.deadline = t
+}
+
+// Add records the hardware address of an IP.
+func (cache *ARPCache) Add(ip net.IP, hardwareAddr net.HardwareAddr) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	entry, ok := cache.entries[ip.String()]
+	if !ok {
+		entry = &arpIndicator{}
+		cache.entries[ip.String()] = entry
+	}
+	entry.hardwareAddr = hardwareAddr
+	entry.lastSeen = clock.Now()
+}
+
+// Get returns the hardware address of an IP, or nil if it does not exist or is expired.
+func (cache *ARPCache) Get(ip net.IP) net.HardwareAddr {
+	cache.lock.RLock()
+	defer cache.lock.RUnlock()
+
+	entry, ok := cache.entries[ip.String()]
+	if !ok || entry.hardwareAddr == nil {
+		return nil
+	}
+	if cache.deadline > 0 && clock.Now().Sub(entry.lastSeen) > cache.deadline {
+		return nil
+	}
+
+	return entry.hardwareAddr
+}
+
+// ShouldRequest returns if an ARP request of an IP should be sent, and marks it requested.
+func (cache *ARPCache) ShouldRequest(ip net.IP) bool {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	now := clock.Now()
+
+	entry, ok := cache.entries[ip.String()]
+	if !ok {
+		entry = &arpIndicator{}
+		cache.entries[ip.String()] = entry
+	}
+	if now.Sub(entry.lastRequest) < arpRequestInterval {
+		return false
+	}
+	entry.lastRequest = now
+
+	return true
+}
+
+// CreateGratuitousARP returns an Ethernet broadcast gratuitous ARP request announcing the hardware address of the IP,
+// which updates ARP caches of neighbors without waiting for them to ask.
+func CreateGratuitousARP(srcMAC net.HardwareAddr, ip net.IP) ([]byte, error) {
+	return CreateARPRequest(srcMAC, ip, ip)
+}
+
+// CreateARPRequest returns an Ethernet broadcast ARP request asking the hardware address of the destination IP.
+func CreateARPRequest(srcMAC net.HardwareAddr, srcIP, dstIP net.IP) ([]byte, error) {
+	srcIP4, dstIP4 := srcIP.To4(), dstIP.To4()
+	if srcIP4 == nil || dstIP4 == nil {
+		return nil, fmt.Errorf("arp of %s %w", dstIP, ErrUnsupportedProtocol)
+	}
+
+	ethernetLayer := &layers.Ethernet{
+		SrcMAC:       srcMAC,
+		DstMAC:       layers.EthernetBroadcast,
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arpLayer := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   srcMAC,
+		SourceProtAddress: srcIP4,
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    dstIP4,
+	}
+
+	return Serialize(ethernetLayer, arpLayer)
+}
@@ -0,0 +1,59 @@
+package pcap
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestCreateGratuitousARP(t *testing.T) {
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	ip := net.IPv4(10, 0, 0, 1)
+
+	data, err := CreateGratuitousARP(mac, ip)
+	if err != nil {
+		t.Fatalf("create gratuitous arp: %v", err)
+	}
+
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	ethernetLayer, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok {
+		t.Fatalf("missing ethernet layer: %v", packet)
+	}
+	if !bytes.Equal(ethernetLayer.SrcMAC, mac) || !bytes.Equal(ethernetLayer.DstMAC, layers.EthernetBroadcast) {
+		t.Errorf("link = %s -> %s, want %s -> %s", ethernetLayer.SrcMAC, ethernetLayer.DstMAC, mac, net.HardwareAddr(layers.EthernetBroadcast))
+	}
+	if ethernetLayer.EthernetType != layers.EthernetTypeARP {
+		t.Errorf("ethernet type = %s, want %s", ethernetLayer.EthernetType, layers.EthernetTypeARP)
+	}
+
+	// The request announces the hardware address of the IP, and asks for the IP itself
+	arpLayer, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok {
+		t.Fatalf("missing arp layer: %v", packet)
+	}
+	if arpLayer.Operation != layers.ARPRequest {
+		t.Errorf("operation = %d, want %d", arpLayer.Operation, layers.ARPRequest)
+	}
+	if arpLayer.AddrType != layers.LinkTypeEthernet || arpLayer.Protocol != layers.EthernetTypeIPv4 {
+		t.Errorf("types = %s, %s, want %s, %s", arpLayer.AddrType, arpLayer.Protocol, layers.LinkTypeEthernet, layers.EthernetTypeIPv4)
+	}
+	if !bytes.Equal(arpLayer.SourceHwAddress, mac) {
+		t.Errorf("sender hardware address = %s, want %s", net.HardwareAddr(arpLayer.SourceHwAddress), mac)
+	}
+	if !net.IP(arpLayer.SourceProtAddress).Equal(ip) || !net.IP(arpLayer.DstProtAddress).Equal(ip) {
+		t.Errorf("addresses = %s -> %s, want %s -> %s", net.IP(arpLayer.SourceProtAddress), net.IP(arpLayer.DstProtAddress), ip, ip)
+	}
+	if !bytes.Equal(arpLayer.DstHwAddress, make([]byte, 6)) {
+		t.Errorf("target hardware address = %s, want zeros", net.HardwareAddr(arpLayer.DstHwAddress))
+	}
+
+	_, err = CreateGratuitousARP(mac, net.ParseIP("2001:db8::1"))
+	if !errors.Is(err, ErrUnsupportedProtocol) {
+		t.Errorf("create gratuitous arp of ipv6: %v, want %v", err, ErrUnsupportedProtocol)
+	}
+}
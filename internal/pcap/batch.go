@@ -0,0 +1,95 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const batchType = 0x03
+
+// batchHeaderSize is the size of the type and the count of a batch.
+const batchHeaderSize = 2
+
+// batchRecordHeaderSize is the size of the length of each record in a batch.
+const batchRecordHeaderSize = 2
+
+// MaxBatchCount is the max count of records in a batch.
+const MaxBatchCount = 255
+
+// SerializeBatch serializes multiple embedded packets into a batch. Like a hello message, a batch is distinguished from
+// an embedded IPv4 packet by its first byte.
+func SerializeBatch(records [][]byte) ([]byte, error) {
+	if len(records) <= 0 {
+		return nil, errors.New("empty batch")
+	}
+	if len(records) > MaxBatchCount {
+		return nil, fmt.Errorf("batch count %d out of range", len(records))
+	}
+
+	size := batchHeaderSize
+	for _, record := range records {
+		if len(record) <= 0 || len(record) > IPv4MaxSize {
+			return nil, fmt.Errorf("record size %d out of range", len(record))
+		}
+		size = size + batchRecordHeaderSize + len(record)
+	}
+
+	data := make([]byte, size)
+	data[0] = batchType
+	data[1] = uint8(len(records))
+
+	p := batchHeaderSize
+	for _, record := range records {
+		binary.BigEndian.PutUint16(data[p:], uint16(len(record)))
+		p = p + batchRecordHeaderSize
+		copy(data[p:], record)
+		p = p + len(record)
+	}
+
+	return data, nil
+}
+
+// IsBatch returns if the contents is a batch.
+func IsBatch(contents []byte) bool {
+	return len(contents) > 0 && contents[0] == batchType
+}
+
+// ParseBatch parses the contents as a batch and returns embedded packets in it.
+func ParseBatch(contents []byte) ([][]byte, error) {
+	if !IsBatch(contents) || len(contents) < batchHeaderSize {
+		return nil, &ParseError{Err: errors.New("invalid batch")}
+	}
+
+	count := int(contents[1])
+	if count <= 0 {
+		return nil, &ParseError{Err: errors.New("empty batch")}
+	}
+
+	records := make([][]byte, 0, count)
+
+	p := batchHeaderSize
+	for i := 0; i < count; i++ {
+		if len(contents) < p+batchRecordHeaderSize {
+			return nil, &ParseError{Err: errors.New("incomplete batch")}
+		}
+		size := int(binary.BigEndian.Uint16(contents[p:]))
+		p = p + batchRecordHeaderSize
+		if size <= 0 || len(contents) < p+size {
+			return nil, &ParseError{Err: errors.New("incomplete batch")}
+		}
+
+		record := contents[p : p+size]
+		if IsBatch(record) {
+			return nil, &ParseError{Err: errors.New("nested batch")}
+		}
+
+		records = append(records, record)
+		p = p + size
+	}
+	if p != len(contents) {
+		return nil, &ParseError{Err: errors.New("trailing data in batch")}
+	}
+
+	return records, nil
+}
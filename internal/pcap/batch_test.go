@@ -0,0 +1,126 @@
+package pcap
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+type batchRecord struct {
+	protocol gopacket.LayerType
+	srcPort  uint16
+	dstPort  uint16
+	payload  []byte
+}
+
+func newEmbPacket(t *testing.T, r batchRecord) []byte {
+	var transportLayer gopacket.TransportLayer
+
+	switch r.protocol {
+	case layers.LayerTypeTCP:
+		tcpLayer := CreateTCPLayer(r.srcPort, r.dstPort, 1, 1)
+		FlagTCPLayer(tcpLayer, false, true, true)
+		transportLayer = tcpLayer
+	case layers.LayerTypeUDP:
+		transportLayer = CreateUDPLayer(r.srcPort, r.dstPort)
+	default:
+		t.Fatalf("protocol %s not support", r.protocol)
+	}
+
+	return newTestPacket(t, transportLayer, r.payload, false)
+}
+
+func TestBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []batchRecord
+	}{
+		{
+			name:    "single",
+			records: []batchRecord{{layers.LayerTypeUDP, 49152, 10000, []byte("datagram")}},
+		},
+		{
+			name: "mixed",
+			records: []batchRecord{
+				{layers.LayerTypeTCP, 49152, 443, []byte("client hello")},
+				{layers.LayerTypeUDP, 49153, 10001, []byte("datagram")},
+				{layers.LayerTypeTCP, 49154, 80, []byte("GET / HTTP/1.1")},
+				{layers.LayerTypeUDP, 49155, 10002, nil},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var records [][]byte
+			for _, r := range tt.records {
+				records = append(records, newEmbPacket(t, r))
+			}
+
+			data, err := SerializeBatch(records)
+			if err != nil {
+				t.Fatalf("serialize batch: %v", err)
+			}
+			if !IsBatch(data) {
+				t.Fatal("not a batch")
+			}
+
+			parsed, err := ParseBatch(data)
+			if err != nil {
+				t.Fatalf("parse batch: %v", err)
+			}
+			if len(parsed) != len(tt.records) {
+				t.Fatalf("count = %d, want %d", len(parsed), len(tt.records))
+			}
+
+			for i, record := range parsed {
+				if IsBatch(record) {
+					t.Fatalf("record %d is a batch", i)
+				}
+
+				indicator, err := ParseEmbPacket(record)
+				if err != nil {
+					t.Fatalf("parse record %d: %v", i, err)
+				}
+
+				want := tt.records[i]
+				if indicator.TransportProtocol() != want.protocol {
+					t.Errorf("record %d protocol = %s, want %s", i, indicator.TransportProtocol(), want.protocol)
+				}
+				if indicator.SrcPort() != want.srcPort || indicator.DstPort() != want.dstPort {
+					t.Errorf("record %d ports = %d-%d, want %d-%d", i, indicator.SrcPort(), indicator.DstPort(), want.srcPort, want.dstPort)
+				}
+				if !bytes.Equal(indicator.Payload(), want.payload) {
+					t.Errorf("record %d payload = %q, want %q", i, indicator.Payload(), want.payload)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBatchInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents []byte
+	}{
+		{name: "not a batch", contents: []byte{0x45, 0x00}},
+		{name: "missing count", contents: []byte{batchType}},
+		{name: "empty", contents: []byte{batchType, 0}},
+		{name: "missing record", contents: []byte{batchType, 2, 0, 1, 0x45}},
+		{name: "truncated record", contents: []byte{batchType, 1, 0, 2, 0x45}},
+		{name: "empty record", contents: []byte{batchType, 1, 0, 0}},
+		{name: "nested", contents: []byte{batchType, 1, 0, 2, batchType, 0}},
+		{name: "trailing data", contents: []byte{batchType, 1, 0, 1, 0x45, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseBatch(tt.contents)
+			if err == nil {
+				t.Fatal("parse batch: want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package pcap
+
+import "sync"
+
+// BufferPool is a pool of buffers of packets read from a handle. Each handle owns a pool, so that buffers of a handle
+// pinned to a CPU are reused in the cache of the CPU rather than shared with other handles.
+type BufferPool struct {
+	pool sync.Pool
+}
+
+// NewBufferPool returns a new pool of buffers.
+func NewBufferPool() *BufferPool {
+	return &BufferPool{}
+}
+
+// Get returns a buffer of the size from the pool.
+func (p *BufferPool) Get(size int) []byte {
+	b, ok := p.pool.Get().([]byte)
+	if !ok || cap(b) < size {
+		return make([]byte, size)
+	}
+
+	return b[:size]
+}
+
+// Put returns the buffer to the pool. The buffer must not be used after.
+func (p *BufferPool) Put(b []byte) {
+	p.pool.Put(b[:0])
+}
@@ -0,0 +1,78 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var isVerifyChecksums bool
+
+// SetVerifyChecksums sets whether checksums of IPv4 and transport layers are verified when parsing packets.
+func SetVerifyChecksums(enabled bool) {
+	isVerifyChecksums = enabled
+}
+
+func sumBytes(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i = i + 2 {
+		sum = sum + uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 != 0 {
+		sum = sum + uint32(b[len(b)-1])<<8
+	}
+
+	return sum
+}
+
+func foldSum(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return uint16(sum)
+}
+
+// verifyChecksums verifies checksums of the IPv4 layer and the transport layer of a packet. The transport layer of
+// fragments is not verified since its payload is incomplete.
+func verifyChecksums(ipv4Layer *layers.IPv4, transportLayer gopacket.Layer) error {
+	if foldSum(sumBytes(0, ipv4Layer.LayerContents())) != 0xffff {
+		return errors.New("invalid ipv4 checksum")
+	}
+
+	if transportLayer == nil || ipv4Layer.Flags&layers.IPv4MoreFragments != 0 || ipv4Layer.FragOffset != 0 {
+		return nil
+	}
+
+	var sum uint32
+	switch t := transportLayer.LayerType(); t {
+	case layers.LayerTypeTCP, layers.LayerTypeUDP:
+		// UDP checksum is optional
+		if t == layers.LayerTypeUDP && transportLayer.(*layers.UDP).Checksum == 0 {
+			return nil
+		}
+
+		// Pseudo header
+		length := len(transportLayer.LayerContents()) + len(transportLayer.LayerPayload())
+		sum = sumBytes(sum, ipv4Layer.SrcIP.To4())
+		sum = sumBytes(sum, ipv4Layer.DstIP.To4())
+		sum = sum + uint32(ipv4Layer.Protocol) + uint32(length)
+	case layers.LayerTypeICMPv4:
+		break
+	default:
+		// Checksums of registered transports are not verified since their algorithms are unknown
+		if FindTransport(t) != nil {
+			return nil
+		}
+
+		return fmt.Errorf("transport layer type %s %w", t, ErrUnsupportedProtocol)
+	}
+	sum = sumBytes(sum, transportLayer.LayerContents())
+	sum = sumBytes(sum, transportLayer.LayerPayload())
+	if foldSum(sum) != 0xffff {
+		return fmt.Errorf("invalid %s checksum", transportLayer.LayerType())
+	}
+
+	return nil
+}
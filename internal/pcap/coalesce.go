@@ -0,0 +1,140 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxCoalesceSize is the max size of coalesced embedded packets.
+const MaxCoalesceSize = 16384
+
+// CoalescedConn is a connection which coalesces embedded packets written in a short delay into a batch, which saves
+// the overhead of carrying small packets independently.
+type CoalescedConn struct {
+	net.Conn
+	delay     time.Duration
+	size      int
+	lock      sync.Mutex
+	isEnabled bool
+	records   [][]byte
+	pending   int
+	timer     *time.Timer
+}
+
+// NewCoalescedConn returns a connection which coalesces embedded packets written to the connection until the delay
+// elapses or their size reaches the given size. Coalescing is disabled until the peer is known to support batches.
+func NewCoalescedConn(conn net.Conn, delay time.Duration, size int) *CoalescedConn {
+	return &CoalescedConn{Conn: conn, delay: delay, size: size}
+}
+
+// SetVersion enables or disables coalescing by the version of the encapsulation negotiated with the peer.
+func (c *CoalescedConn) SetVersion(version uint8) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.isEnabled = version >= BatchVersion
+	if !c.isEnabled {
+		return c.flush()
+	}
+
+	return nil
+}
+
+// Write buffers an embedded packet for coalescing, or writes it immediately if coalescing is disabled.
+func (c *CoalescedConn) Write(b []byte) (n int, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.isEnabled {
+		return c.Conn.Write(b)
+	}
+
+	// Flush in advance if the packet cannot be coalesced with buffered ones
+	if len(c.records) > 0 && (len(c.records) >= MaxBatchCount || c.pending+batchRecordHeaderSize+len(b) > c.size) {
+		err := c.flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	record := make([]byte, len(b))
+	copy(record, b)
+	c.records = append(c.records, record)
+	c.pending = c.pending + batchRecordHeaderSize + len(b)
+
+	if c.pending >= c.size {
+		err := c.flush()
+		if err != nil {
+			return 0, err
+		}
+	} else if c.timer == nil {
+		c.timer = time.AfterFunc(c.delay, func() {
+			c.lock.Lock()
+			defer c.lock.Unlock()
+
+			err := c.flush()
+			if err != nil {
+				log.Errorln(fmt.Errorf("flush: %w", err))
+			}
+		})
+	}
+
+	return len(b), nil
+}
+
+// Flush writes buffered embedded packets immediately.
+func (c *CoalescedConn) Flush() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.flush()
+}
+
+// Close flushes buffered embedded packets and closes the connection.
+func (c *CoalescedConn) Close() error {
+	err := c.Flush()
+	if err != nil {
+		log.Errorln(fmt.Errorf("flush: %w", err))
+	}
+
+	return c.Conn.Close()
+}
+
+func (c *CoalescedConn) flush() error {
+	var (
+		err  error
+		data []byte
+	)
+
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.records) <= 0 {
+		return nil
+	}
+
+	records := c.records
+	c.records = nil
+	c.pending = 0
+
+	// A single packet is written as is without the overhead of a batch
+	if len(records) == 1 {
+		data = records[0]
+	} else {
+		data, err = SerializeBatch(records)
+		if err != nil {
+			return fmt.Errorf("serialize batch: %w", err)
+		}
+	}
+
+	_, err = c.Conn.Write(data)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
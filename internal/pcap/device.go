@@ -21,6 +21,12 @@ type Device struct {
 	ipAddrs      []*net.IPNet
 	hardwareAddr net.HardwareAddr
 	isLoop       bool
+	mtu          int
+}
+
+// NewDevice returns a device with the given addresses, which is not necessarily a device of the system.
+func NewDevice(name, alias string, ipAddrs []*net.IPNet, hardwareAddr net.HardwareAddr, isLoop bool) *Device {
+	return &Device{name: name, alias: alias, ipAddrs: ipAddrs, hardwareAddr: hardwareAddr, isLoop: isLoop}
 }
 
 // Name returns the pcap name of the device.
@@ -48,6 +54,16 @@ func (dev *Device) IsLoop() bool {
 	return dev.isLoop
 }
 
+// MTU returns the MTU of the device, or 0 if it is unknown.
+func (dev *Device) MTU() int {
+	return dev.mtu
+}
+
+// SetMTU overrides the MTU of the device queried from the OS.
+func (dev *Device) SetMTU(mtu int) {
+	dev.mtu = mtu
+}
+
 // IPAddr returns the first IP address of the device.
 func (dev *Device) IPAddr() *net.IPNet {
 	if len(dev.ipAddrs) > 0 {
@@ -130,7 +146,7 @@ func FindAllDevs() ([]*Device, error) {
 			as = append(as, ipnet)
 		}
 
-		t = append(t, &Device{alias: inter.Name, ipAddrs: as, hardwareAddr: inter.HardwareAddr, isLoop: isLoop})
+		t = append(t, &Device{alias: inter.Name, ipAddrs: as, hardwareAddr: inter.HardwareAddr, isLoop: isLoop, mtu: inter.MTU})
 	}
 
 	// Enumerate pcap devices
@@ -283,28 +299,40 @@ func FindGatewayDev(dev *Device, ip net.IP) (*Device, error) {
 
 // FindListenDevs returns all valid pcap devices for listening.
 func FindListenDevs(names []string) ([]*Device, error) {
-	result := make([]*Device, 0)
-
 	devs, err := FindAllDevs()
 	if err != nil {
 		return nil, fmt.Errorf("find all devices: %w", err)
 	}
 
 	if len(names) <= 0 {
-		result = devs
-	} else {
-		m := make(map[string]*Device)
-		for _, dev := range devs {
-			m[dev.alias] = dev
-		}
+		return devs, nil
+	}
 
-		for _, name := range names {
-			dev, ok := m[name]
-			if !ok {
-				return nil, fmt.Errorf("unknown listen device %s", name)
-			}
-			result = append(result, dev)
+	return selectListenDevs(devs, names)
+}
+
+// selectListenDevs returns devices of the names in order.
+func selectListenDevs(devs []*Device, names []string) ([]*Device, error) {
+	result := make([]*Device, 0)
+
+	m := make(map[string]*Device)
+	for _, dev := range devs {
+		m[dev.alias] = dev
+	}
+
+	// Duplicate devices are opened once, or every packet will be handled twice
+	opened := make(map[string]bool)
+	for _, name := range names {
+		dev, ok := m[name]
+		if !ok {
+			return nil, fmt.Errorf("listen device %s: %w", name, ErrMissingDevice)
+		}
+		if opened[dev.name] {
+			log.Infof("Ignore duplicate listen device %s\n", name)
+			continue
 		}
+		opened[dev.name] = true
+		result = append(result, dev)
 	}
 
 	return result, nil
@@ -326,18 +354,23 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 			}
 		}
 		if upDev == nil {
-			return nil, nil, fmt.Errorf("unknown upstream device %s", name)
+			return nil, nil, fmt.Errorf("upstream device %s: %w", name, ErrMissingDevice)
+		}
+		// Only IPv4 addresses are passed, a device without any of them cannot be the source of packets
+		if len(upDev.ipAddrs) <= 0 {
+			return nil, nil, fmt.Errorf("upstream device %s without ipv4 address: %w", name, ErrMissingDevice)
 		}
 
 		// Find gateway device
 		if upDev.isLoop {
 			gatewayDev = upDev
 		} else {
-			// Find gateway's address
+			// Find gateway's address, the upstream device may be directly connected without a gateway
 			if gateway == nil {
 				gateway, err = FindGatewayAddr()
 				if err != nil {
-					return nil, nil, fmt.Errorf("find gateway address: %w", err)
+					log.Verboseln(fmt.Errorf("find gateway address: %w", err))
+					return upDev, nil, nil
 				}
 			}
 
@@ -356,6 +389,7 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 						ipAddrs:      append(make([]*net.IPNet, 0), a),
 						hardwareAddr: upDev.hardwareAddr,
 						isLoop:       upDev.isLoop,
+						mtu:          upDev.mtu,
 					}
 					break
 				}
@@ -394,6 +428,7 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 						ipAddrs:      append(make([]*net.IPNet, 0), a),
 						hardwareAddr: dev.hardwareAddr,
 						isLoop:       dev.isLoop,
+						mtu:          dev.mtu,
 					}
 					break
 				}
@@ -406,3 +441,41 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 
 	return upDev, gatewayDev, nil
 }
+
+const waitDevsInterval = time.Second
+
+// WaitListenDevs returns all valid pcap devices for listening like FindListenDevs, but waits for missing devices to
+// appear.
+func WaitListenDevs(names []string) ([]*Device, error) {
+	isWaiting := false
+	for {
+		devs, err := FindListenDevs(names)
+		if err == nil || !errors.Is(err, ErrMissingDevice) {
+			return devs, err
+		}
+
+		if !isWaiting {
+			log.Infof("Wait for %s\n", err)
+			isWaiting = true
+		}
+		time.Sleep(waitDevsInterval)
+	}
+}
+
+// WaitUpstreamDevAndGatewayDev returns the pcap device for routing upstream and the gateway like
+// FindUpstreamDevAndGatewayDev, but waits for the missing device to appear.
+func WaitUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDev *Device, err error) {
+	isWaiting := false
+	for {
+		upDev, gatewayDev, err = FindUpstreamDevAndGatewayDev(name, gateway)
+		if err == nil || !errors.Is(err, ErrMissingDevice) {
+			return upDev, gatewayDev, err
+		}
+
+		if !isWaiting {
+			log.Infof("Wait for %s\n", err)
+			isWaiting = true
+		}
+		time.Sleep(waitDevsInterval)
+	}
+}
@@ -0,0 +1,51 @@
+package pcap
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSelectListenDevs(t *testing.T) {
+	devs := []*Device{
+		NewDevice("eth0", "eth0", nil, nil, false),
+		NewDevice("eth1", "eth1", nil, nil, false),
+		NewDevice("lo", "lo", nil, nil, true),
+	}
+
+	tests := []struct {
+		name  string
+		names []string
+		want  []string
+		err   error
+	}{
+		{name: "single", names: []string{"eth1"}, want: []string{"eth1"}},
+		{name: "ordered", names: []string{"lo", "eth0"}, want: []string{"lo", "eth0"}},
+		{name: "duplicate", names: []string{"eth0", "eth1", "eth0"}, want: []string{"eth0", "eth1"}},
+		{name: "missing", names: []string{"eth0", "eth2"}, err: ErrMissingDevice},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := selectListenDevs(devs, tt.names)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("select: %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("select: %v", err)
+			}
+
+			// Duplicate devices are selected once, so packets are not handled twice
+			if len(result) != len(tt.want) {
+				t.Fatalf("devices = %d, want %d", len(result), len(tt.want))
+			}
+			for i, dev := range result {
+				if dev.Name() != tt.want[i] {
+					t.Errorf("device %d = %s, want %s", i, dev.Name(), tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// EchoFilter is the BPF filter of ICMPv4 echo requests.
+const EchoFilter = "icmp && icmp[icmptype] == icmp-echo"
+
+// WriteEchoReply replies an ICMPv4 echo request to an address of the local device of the connection, and returns if
+// the request is replied. Other packets are ignored.
+func WriteEchoReply(conn *RawConn, indicator *PacketIndicator) (bool, error) {
+	var (
+		err       error
+		linkLayer gopacket.SerializableLayer
+	)
+
+	if indicator.ICMPv4Indicator() == nil || indicator.IsFrag() {
+		return false, nil
+	}
+	icmpv4Layer := indicator.ICMPv4Indicator().ICMPv4Layer()
+	if icmpv4Layer.TypeCode.Type() != layers.ICMPv4TypeEchoRequest {
+		return false, nil
+	}
+
+	// Only requests to the device are replied
+	var isLocal bool
+	for _, a := range conn.LocalDev().IPAddrs() {
+		if a.IP.Equal(indicator.DstIP()) {
+			isLocal = true
+			break
+		}
+	}
+	if !isLocal {
+		return false, nil
+	}
+
+	// Create layers
+	newICMPv4Layer := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0),
+		Id:       icmpv4Layer.Id,
+		Seq:      icmpv4Layer.Seq,
+	}
+	newIPv4Layer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		Id:       randomIPv4Id(),
+		TTL:      64,
+		Protocol: layers.IPProtocolICMPv4,
+		SrcIP:    indicator.DstIP(),
+		DstIP:    indicator.SrcIP(),
+	}
+	if !conn.IsRaw() {
+		if conn.IsLoop() {
+			linkLayer, err = CreateLoopbackLayer(newIPv4Layer)
+		} else {
+			linkLayer, err = CreateEthernetLayer(conn.LocalDev().HardwareAddr(), indicator.SrcHardwareAddr(), newIPv4Layer)
+		}
+		if err != nil {
+			return false, fmt.Errorf("create link layer: %w", err)
+		}
+	}
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, newIPv4Layer, newICMPv4Layer, gopacket.Payload(icmpv4Layer.Payload))
+	if err != nil {
+		return false, fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = conn.Write(data)
+	if err != nil {
+		return false, fmt.Errorf("write: %w", err)
+	}
+
+	return true, nil
+}
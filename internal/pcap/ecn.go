@@ -0,0 +1,65 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	ecnMask = 0x03
+	// ecnCE is the codepoint of congestion experienced.
+	ecnCE = 0x03
+)
+
+var isECN bool
+
+// SetECN sets whether the ECN codepoint of embedded IPv4 packets is copied to FakeTCP segments carrying them, and
+// congestion experienced in FakeTCP segments is reflected to embedded packets.
+func SetECN(enabled bool) {
+	isECN = enabled
+}
+
+// embeddedECN returns the ECN codepoint of an embedded IPv4 packet, or 0 if the contents are not an IPv4 packet.
+func embeddedECN(contents []byte) uint8 {
+	if len(contents) < 20 || contents[0]>>4 != 4 {
+		return 0
+	}
+
+	return contents[1] & ecnMask
+}
+
+// applyECN copies the ECN codepoint of embedded contents to the IPv4 layer of a FakeTCP segment. Only the ECN bits
+// of TOS are modified.
+func applyECN(layer *layers.IPv4, contents []byte) {
+	if !isECN {
+		return
+	}
+
+	layer.TOS = layer.TOS&^ecnMask | embeddedECN(contents)
+}
+
+// markCE marks an embedded IPv4 packet which is ECN capable as congestion experienced, and updates its checksum.
+func markCE(contents []byte) {
+	ecn := embeddedECN(contents)
+	if ecn == 0 || ecn == ecnCE {
+		return
+	}
+
+	ihl := int(contents[0]&0x0f) * 4
+	if ihl < 20 || len(contents) < ihl {
+		return
+	}
+
+	contents[1] = contents[1] | ecnCE
+
+	// Checksum
+	binary.BigEndian.PutUint16(contents[10:], 0)
+	var sum uint32
+	for i := 0; i < ihl; i = i + 2 {
+		sum = sum + uint32(binary.BigEndian.Uint16(contents[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(contents[10:], ^uint16(sum))
+}
@@ -0,0 +1,88 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ipv4Checksum returns the checksum of an IPv4 header, which is 0 if the checksum in the header is valid.
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i = i + 2 {
+		sum = sum + uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return ^uint16(sum)
+}
+
+// setTOS sets the TOS of an IPv4 packet, and updates its checksum.
+func setTOS(data []byte, tos uint8) {
+	ihl := int(data[0]&0x0f) * 4
+	data[1] = tos
+	binary.BigEndian.PutUint16(data[10:], 0)
+	binary.BigEndian.PutUint16(data[10:], ipv4Checksum(data[:ihl]))
+}
+
+func TestECN(t *testing.T) {
+	tests := []struct {
+		name      string
+		isECN     bool
+		innerTOS  uint8
+		outerTOS  uint8
+		wantOut   uint8
+		wantInner uint8
+	}{
+		{name: "ect", isECN: true, innerTOS: 0xb8 | 0x02, outerTOS: ecnCE, wantOut: 0x02, wantInner: 0xb8 | ecnCE},
+		{name: "ect 1", isECN: true, innerTOS: 0x01, outerTOS: ecnCE, wantOut: 0x01, wantInner: ecnCE},
+		{name: "not ect", isECN: true, innerTOS: 0xb8, outerTOS: ecnCE, wantOut: 0, wantInner: 0xb8},
+		{name: "no congestion", isECN: true, innerTOS: 0x02, outerTOS: 0x02, wantOut: 0x02, wantInner: 0x02},
+		{name: "disabled", innerTOS: 0x02, outerTOS: ecnCE, wantOut: 0, wantInner: 0x02},
+	}
+
+	defer SetECN(isECN)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetECN(tt.isECN)
+
+			inner := newTestPacket(t, CreateUDPLayer(49152, 10000), []byte("datagram"), false)
+			setTOS(inner, tt.innerTOS)
+
+			// The ECN codepoint of the embedded packet is copied to the segment, while the DSCP is not
+			conn, handle, _ := newEstablishedConn(testClientAddr, testServerAddr, 5000, 9000, 0)
+			_, err := conn.Write(inner)
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			writes := handle.take()
+			if len(writes) != 1 {
+				t.Fatalf("written = %d segments, want 1", len(writes))
+			}
+			outer := gopacket.NewPacket(writes[0], layers.LayerTypeIPv4, gopacket.Default).Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if outer.TOS != tt.wantOut {
+				t.Errorf("outbound tos = %#x, want %#x", outer.TOS, tt.wantOut)
+			}
+
+			// Congestion experienced in the segment is reflected to the embedded packet
+			segment := newSegment(t, testServerAddr, testClientAddr, 9000, 5000, "PA", newFrame(string(inner)))
+			setTOS(segment, tt.outerTOS)
+			handle.feed(segment)
+			contents := readAll(t, conn, handle)
+			if len(contents) != 1 {
+				t.Fatalf("read = %d frames, want 1", len(contents))
+			}
+			if tos := contents[0][1]; tos != tt.wantInner {
+				t.Errorf("inbound tos = %#x, want %#x", tos, tt.wantInner)
+			}
+			if sum := ipv4Checksum(contents[0][:20]); sum != 0 {
+				t.Errorf("inbound checksum invalid: %#x", sum)
+			}
+		})
+	}
+}
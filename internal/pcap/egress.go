@@ -0,0 +1,62 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket/pcap"
+	"runtime"
+)
+
+const (
+	// EgressPcap writes packets through libpcap.
+	EgressPcap = "pcap"
+	// EgressAFPacket writes packets through AF_PACKET sockets with TPACKET_V3, only in Linux.
+	EgressAFPacket = "afpacket"
+)
+
+// writeOnlySnapLen is the snapshot length of write-only handles.
+const writeOnlySnapLen = 64
+
+// writeOnlyFilter is the BPF filter of write-only handles, which matches no packet.
+const writeOnlyFilter = "less 0"
+
+var egress = EgressPcap
+
+// packetWriter is a writer writes packet data to a device.
+type packetWriter interface {
+	WritePacketData(data []byte) error
+	Close()
+}
+
+// SetEgress sets the backend for writing packets in raw connections created later.
+func SetEgress(backend string) error {
+	switch backend {
+	case EgressPcap:
+		break
+	case EgressAFPacket:
+		if t := runtime.GOOS; t != "linux" {
+			return fmt.Errorf("egress %s in os %s %w", backend, t, ErrUnsupportedProtocol)
+		}
+	default:
+		return fmt.Errorf("egress %s %w", backend, ErrUnsupportedProtocol)
+	}
+
+	egress = backend
+
+	return nil
+}
+
+// openPcapWriter opens a pcap handle only for writing packets, which captures no packet.
+func openPcapWriter(dev string) (packetWriter, error) {
+	handle, err := pcap.OpenLive(dev, writeOnlySnapLen, false, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+
+	err = handle.SetBPFFilter(writeOnlyFilter)
+	if err != nil {
+		handle.Close()
+		return nil, err
+	}
+
+	return handle, nil
+}
@@ -0,0 +1,17 @@
+package pcap
+
+import "github.com/google/gopacket/afpacket"
+
+// afpacketBlockSize is the size of each block in the ring. Only writing is performed in the ring, so a small ring is
+// sufficient.
+const afpacketBlockSize = afpacket.DefaultFrameSize * 16
+
+func openAFPacketWriter(dev string) (packetWriter, error) {
+	return afpacket.NewTPacket(
+		afpacket.OptInterface(dev),
+		afpacket.TPacketVersion3,
+		afpacket.OptFrameSize(afpacket.DefaultFrameSize),
+		afpacket.OptBlockSize(afpacketBlockSize),
+		afpacket.OptNumBlocks(1),
+	)
+}
@@ -0,0 +1,40 @@
+package pcap
+
+import "testing"
+
+// benchmarkEgressDev is the device packets are written to in benchmarks of egress.
+const benchmarkEgressDev = "lo"
+
+// BenchmarkEgress compares the sustained transmit rate of writing packets through libpcap and AF_PACKET. Both require
+// the privilege to open the device, and are skipped without it.
+func BenchmarkEgress(b *testing.B) {
+	data := newTestPacket(b, CreateUDPLayer(49152, 9), make([]byte, 1024), true)
+
+	backends := []struct {
+		name string
+		open func(dev string) (packetWriter, error)
+	}{
+		{name: EgressPcap, open: openPcapWriter},
+		{name: EgressAFPacket, open: openAFPacketWriter},
+	}
+
+	for _, backend := range backends {
+		b.Run(backend.name, func(b *testing.B) {
+			writer, err := backend.open(benchmarkEgressDev)
+			if err != nil {
+				b.Skipf("open %s: %v", benchmarkEgressDev, err)
+			}
+			defer writer.Close()
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				err := writer.WritePacketData(data)
+				if err != nil {
+					b.Fatalf("write: %v", err)
+				}
+			}
+		})
+	}
+}
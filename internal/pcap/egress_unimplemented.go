@@ -0,0 +1,9 @@
+// +build !linux
+
+package pcap
+
+import "fmt"
+
+func openAFPacketWriter(_ string) (packetWriter, error) {
+	return nil, fmt.Errorf("egress %s %w", EgressAFPacket, ErrUnsupportedProtocol)
+}
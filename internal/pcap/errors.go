@@ -0,0 +1,117 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"sync/atomic"
+)
+
+var (
+	// ErrMissingDevice describes an error that a device cannot be found.
+	ErrMissingDevice = errors.New("missing device")
+	// ErrParse describes an error occurred when parsing a packet.
+	ErrParse = errors.New("parse")
+	// ErrWrite describes an error occurred when writing a packet.
+	ErrWrite = errors.New("write")
+	// ErrUnsupportedProtocol describes an error that a layer type or a protocol is not supported.
+	ErrUnsupportedProtocol = errors.New("not support")
+)
+
+const (
+	// ParseReasonTruncated describes a parse failure that the packet is truncated.
+	ParseReasonTruncated = "truncated"
+	// ParseReasonUnsupportedNetwork describes a parse failure that the link or network layer is not supported.
+	ParseReasonUnsupportedNetwork = "unsupported-network"
+	// ParseReasonUnsupportedTransport describes a parse failure that the transport layer is not supported.
+	ParseReasonUnsupportedTransport = "unsupported-transport"
+	// ParseReasonDecode describes a parse failure that a layer cannot be decoded.
+	ParseReasonDecode = "decode-error"
+	// ParseReasonChecksum describes a parse failure that a checksum is invalid.
+	ParseReasonChecksum = "bad-checksum"
+)
+
+var parseReasons = []string{
+	ParseReasonTruncated,
+	ParseReasonUnsupportedNetwork,
+	ParseReasonUnsupportedTransport,
+	ParseReasonDecode,
+	ParseReasonChecksum,
+}
+
+var parseFailures = make([]uint64, len(parseReasons))
+
+// ParseFailures returns the count of parse failures by reason.
+func ParseFailures() map[string]uint64 {
+	result := make(map[string]uint64)
+	for i, reason := range parseReasons {
+		result[reason] = atomic.LoadUint64(&parseFailures[i])
+	}
+
+	return result
+}
+
+// ParseError describes an error occurred when parsing a packet. A parse error is recoverable, the packet can be dropped
+// and the handling can continue.
+type ParseError struct {
+	Err    error
+	Reason string
+}
+
+// newParseError returns a parse error with the reason, and counts the failure.
+func newParseError(reason string, err error) *ParseError {
+	for i, r := range parseReasons {
+		if r == reason {
+			atomic.AddUint64(&parseFailures[i], 1)
+			break
+		}
+	}
+
+	return &ParseError{Err: err, Reason: reason}
+}
+
+// parseReason returns the reason why a layer is missing in a packet. The layer is regarded as unsupported if the packet
+// is decoded without errors.
+func parseReason(packet gopacket.Packet, unsupported string) string {
+	if packet.Metadata().Truncated {
+		return ParseReasonTruncated
+	}
+	if packet.ErrorLayer() != nil {
+		return ParseReasonDecode
+	}
+
+	return unsupported
+}
+
+func (err *ParseError) Error() string {
+	if err.Reason != "" {
+		return fmt.Sprintf("%s: %s", err.Reason, err.Err.Error())
+	}
+
+	return err.Err.Error()
+}
+
+func (err *ParseError) Unwrap() error {
+	return err.Err
+}
+
+func (err *ParseError) Is(target error) bool {
+	return target == ErrParse
+}
+
+// WriteError describes an error occurred when writing a packet. A write error may be recoverable.
+type WriteError struct {
+	Err error
+}
+
+func (err *WriteError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *WriteError) Unwrap() error {
+	return err.Err
+}
+
+func (err *WriteError) Is(target error) bool {
+	return target == ErrWrite
+}
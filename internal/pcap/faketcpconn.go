@@ -1,29 +1,101 @@
 package pcap
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/xtaci/kcp-go"
 	"github.com/zhxie/ikago/internal/addr"
+	"github.com/zhxie/ikago/internal/clock"
 	"github.com/zhxie/ikago/internal/config"
 	"github.com/zhxie/ikago/internal/crypto"
 	"github.com/zhxie/ikago/internal/log"
+	"io"
 	"math"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type clientIndicator struct {
-	crypt crypto.Crypt
-	seq   uint32
-	ack   uint32
+	lastSeen     int64
+	crypt        crypto.Crypt
+	seq          uint32
+	ack          uint32
+	tsOffset     uint32
+	tsecr        uint32
+	mss          uint16
+	peerMSS      uint16
+	isScaled     bool
+	isSACK       bool
+	phase        uint8
+	isCE         bool
+	isn          uint32
+	peerISN      uint32
+	reader       frameReader
+	hardwareAddr net.HardwareAddr
+	sendSeq      uint64
+	window       *replayWindow
+	isVerified   bool
+	isResyncing  bool
+}
+
+func newClientIndicator(crypt crypto.Crypt) *clientIndicator {
+	client := &clientIndicator{
+		lastSeen: clock.Now().UnixNano(),
+		crypt:    crypt,
+		seq:      0,
+		ack:      0,
+		tsOffset: newTimestampsOffset(),
+	}
+	if replayWindowSize > 0 {
+		client.window = newReplayWindow(replayWindowSize)
+	}
+
+	return client
+}
+
+// tsval returns the current timestamp value of the client in milliseconds.
+func (client *clientIndicator) tsval() uint32 {
+	return uint32(clock.Now().UnixNano()/int64(time.Millisecond)) + client.tsOffset
+}
+
+// seen marks the client is seen now.
+func (client *clientIndicator) seen() {
+	atomic.StoreInt64(&client.lastSeen, clock.Now().UnixNano())
+}
+
+// seenAt returns when the client is seen last time.
+func (client *clientIndicator) seenAt() int64 {
+	return atomic.LoadInt64(&client.lastSeen)
+}
+
+// pendingContents describes decrypted contents which are waiting to be read.
+type pendingContents struct {
+	contents []byte
+	addr     net.Addr
 }
 
 const establishDeadline = 3 * time.Second
 const keepFragments = 30 * time.Second
 
+var maxClients int
+
+// SetMaxClients sets the maximum count of clients of a listener. If it is exceeded, the client seen least recently will
+// be evicted with its state. A count of 0 means unlimited.
+func SetMaxClients(n int) error {
+	if n < 0 {
+		return fmt.Errorf("max clients %d out of range", n)
+	}
+
+	maxClients = n
+
+	return nil
+}
+
 // FakeTCPConn is a packet pcap network connection add fake TCP header to all traffic.
 type FakeTCPConn struct {
 	lock          sync.Mutex
@@ -39,6 +111,9 @@ type FakeTCPConn struct {
 	isClosed      bool
 	clientsLock   sync.RWMutex
 	clients       map[string]*clientIndicator
+	listener      *FakeTCPListener
+	pendingLock   sync.Mutex
+	pendings      []pendingContents
 	id            uint16
 	readDeadline  time.Time
 	writeDeadline time.Time
@@ -61,6 +136,17 @@ func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, c
 		Port: int(srcPort),
 	}
 
+	// The carrier is always in IPv4
+	if dstAddr.IP.To4() == nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    fmt.Errorf("address family of %s %w", dstAddr.IP, ErrUnsupportedProtocol),
+		}
+	}
+
 	conn, err := dialFakeTCPPassive(srcDev, dstDev, srcPort, dstAddr, crypt, mtu)
 	if err != nil {
 		return nil, &net.OpError{
@@ -86,7 +172,7 @@ func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, c
 		}
 	}
 
-	conn.appear = time.Now()
+	conn.appear = clock.Now()
 
 	go func() {
 		time.Sleep(establishDeadline)
@@ -137,7 +223,7 @@ func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto
 	}
 	srcAddrs := addr.MultiTCPAddr{Addrs: addrs}
 
-	rawConn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("tcp && dst port %d", srcPort))
+	rawConn, err := CreateRawConn(srcDev, dstDev, clientFilter(fmt.Sprintf("tcp && dst port %d", srcPort)))
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -178,25 +264,25 @@ func (c *FakeTCPConn) handshakeSYN() error {
 	c.clientsLock.RUnlock()
 	if !ok {
 		// Initial TCP Seq
-		client = &clientIndicator{
-			crypt: c.crypt,
-			seq:   0,
-		}
+		client = newClientIndicator(c.crypt)
 
 		// Map client
 		c.clientsLock.Lock()
 		c.clients[c.RemoteAddr().String()] = client
 		c.clientsLock.Unlock()
 	}
+	client.mss = uint16(c.mtu - tcpipHeaderSize)
+	seq := client.sendSYN()
 
 	// Create layers
-	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.seq, client.ack, c.conn, c.dstAddr.IP, c.id, 128, c.RemoteDev().HardwareAddr())
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), seq, client.ack, c.conn, c.dstAddr.IP, c.id, 128, c.RemoteDev().HardwareAddr())
 	if err != nil {
 		return err
 	}
 
 	// Make TCP layer SYN
 	FlagTCPLayer(transportLayer.(*layers.TCP), true, false, false)
+	applyFingerprint(transportLayer, networkLayer, client)
 
 	// Serialize layers
 	data, err := Serialize(linkLayer, networkLayer, transportLayer)
@@ -210,9 +296,6 @@ func (c *FakeTCPConn) handshakeSYN() error {
 		return fmt.Errorf("write: %w", err)
 	}
 
-	// TCP Seq
-	client.seq++
-
 	// IPv4 Id
 	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
 		c.id++
@@ -244,26 +327,40 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 	c.clientsLock.RUnlock()
 	if !ok {
 		// Initial TCP Seq
-		client = &clientIndicator{
-			crypt: c.crypt,
-			seq:   0,
-		}
+		client = newClientIndicator(c.crypt)
 
 		// Map client
-		c.clientsLock.Lock()
-		c.clients[indicator.Src().String()] = client
-		c.clientsLock.Unlock()
+		c.mapClient(indicator.Src().String(), client)
+	}
+	if indicator.LinkLayer() != nil {
+		client.hardwareAddr = indicator.SrcHardwareAddr()
+	}
+	if ts, ok := timestampsValue(indicator.TCPLayer()); ok {
+		client.tsecr = ts
+	}
+
+	// Duplicate SYNs are answered as is
+	seq, isNew := client.receiveSYN(indicator.TCPLayer().Seq)
+	if isNew {
+		// The client may restart its sequence numbers
+		if client.window != nil {
+			client.window.reset()
+		}
+
+		// Negotiate options offered by the client
+		client.mss = uint16(c.mtu - tcpipHeaderSize)
+		client.negotiate(indicator.TCPLayer())
 	}
-	client.ack = indicator.TCPLayer().Seq + 1
 
 	// Create layers
-	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, 64, indicator.SrcHardwareAddr())
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), seq, indicator.TCPLayer().Seq+1, c.conn, indicator.SrcIP(), c.id, 64, indicator.SrcHardwareAddr())
 	if err != nil {
 		return fmt.Errorf("create layers: %w", err)
 	}
 
 	// Make TCP layer SYN & ACK
 	FlagTCPLayer(newTransportLayer.(*layers.TCP), true, false, true)
+	applyFingerprint(newTransportLayer, newNetworkLayer, client)
 
 	// Serialize layers
 	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer)
@@ -277,9 +374,6 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 		return fmt.Errorf("write: %w", err)
 	}
 
-	// TCP Seq
-	client.seq++
-
 	// IPv4 Id
 	if newNetworkLayer.LayerType() == layers.LayerTypeIPv4 {
 		c.id++
@@ -313,8 +407,20 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 		return fmt.Errorf("client %s unauthorized", indicator.Src().String())
 	}
 
-	// TCP Ack
-	client.ack = indicator.TCPLayer().Seq + 1
+	if ts, ok := timestampsValue(indicator.TCPLayer()); ok {
+		client.tsecr = ts
+	}
+
+	// TCP Ack, duplicate SYN+ACKs are answered as is
+	if client.receiveSYNACK(indicator.TCPLayer().Seq) {
+		// The server may restart its sequence numbers
+		if client.window != nil {
+			client.window.reset()
+		}
+
+		// Options echoed by the server
+		client.negotiate(indicator.TCPLayer())
+	}
 
 	// Create layers
 	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, 128, indicator.SrcHardwareAddr())
@@ -324,6 +430,7 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 
 	// Make TCP layer ACK
 	FlagTCPLayer(newTransportLayer.(*layers.TCP), false, false, true)
+	applyFingerprint(newTransportLayer, newNetworkLayer, client)
 
 	// Serialize layers
 	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer)
@@ -361,6 +468,19 @@ type tuple struct {
 		err       error
 	}
 
+	// Pending contents drained from previous segments
+	c.pendingLock.Lock()
+	if len(c.pendings) > 0 {
+		pending := c.pendings[0]
+		c.pendings = c.pendings[1:]
+		c.pendingLock.Unlock()
+
+		copy(p, pending.contents)
+
+		return len(pending.contents), pending.addr, nil
+	}
+	c.pendingLock.Unlock()
+
 	ch := make(chan tuple)
 	go func() {
 		for {
@@ -392,9 +512,9 @@ type tuple struct {
 	// Timeout
 	if !c.readDeadline.IsZero() {
 		go func() {
-			duration := c.readDeadline.Sub(time.Now())
+			duration := c.readDeadline.Sub(clock.Now())
 			if duration > 0 {
-				time.Sleep(duration)
+				<-clock.After(duration)
 			}
 			ch <- tuple{err: &timeoutError{Err: "timeout"}}
 		}()
@@ -402,6 +522,15 @@ type tuple struct {
 
 	tu := <-ch
 	if tu.err != nil {
+		// Connections closed by listeners are read as ended
+		if c.isClosed {
+			return 0, nil, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Err:    io.EOF,
+			}
+		}
 		return 0, nil, &net.OpError{
 			Op:     "read",
 			Net:    "pcap",
@@ -427,7 +556,7 @@ type tuple struct {
 				Op:     "read",
 				Net:    "pcap",
 				Source: c.LocalAddr(),
-				Err:    fmt.Errorf("transport layer type %s not support", t),
+				Err:    fmt.Errorf("transport layer type %s %w", t, ErrUnsupportedProtocol),
 			}
 		}
 	}
@@ -437,7 +566,10 @@ type tuple struct {
 		if indicator.IsRST() {
 			log.Errorf("Receive TCP RST: %s <- %s\n", indicator.Dst().String(), addr.String())
 
-			// Re-establish connection
+			// Clients of listeners are forgotten, while connections to servers are re-established
+			if c.listener != nil || c.dstAddr == nil {
+				return c.forget(addr)
+			}
 			err := c.Reconnect()
 			if err != nil {
 				return 0, addr, &net.OpError{
@@ -451,6 +583,10 @@ type tuple struct {
 		}
 		if indicator.IsFIN() {
 			log.Infof("Receive TCP FIN: %s <- %s\n", indicator.Dst().String(), addr.String())
+
+			if c.listener != nil || c.dstAddr == nil {
+				return c.forget(addr)
+			}
 		}
 	}
 
@@ -462,8 +598,7 @@ type tuple struct {
 				log.Verbosef("Receive TCP SYN+ACK: %s <- %s\n", indicator.Dst().String(), addr.String())
 
 				if !c.isConnected {
-					t := time.Now()
-					duration := t.Sub(c.appear)
+					duration := clock.Since(c.appear)
 
 					log.Infof("Connected to server %s in %.3f ms (RTT)\n", addr.String(), float64(duration.Microseconds())/1000)
 
@@ -475,7 +610,17 @@ type tuple struct {
 			} else {
 				log.Verbosef("Receive TCP SYN: %s -> %s\n", addr.String(), indicator.Dst().String())
 
-				err = c.handshakeSYNACK(indicator)
+				// Listeners limit handshakes, while connections of a client do not
+				if c.dstAddr != nil {
+					err = c.handshakeSYNACK(indicator)
+				} else if !allowHandshake() {
+					log.Verbosef("Drop TCP SYN for handshake rate: %s -> %s\n", addr.String(), indicator.Dst().String())
+				} else if isSYNCookies {
+					err = writeSYNACKCookie(c.conn, indicator, c.id)
+					c.id++
+				} else {
+					err = c.handshakeSYNACK(indicator)
+				}
 			}
 			if err != nil {
 				return 0, addr, &net.OpError{
@@ -491,7 +636,42 @@ type tuple struct {
 		}
 	}
 
-	if indicator.Payload() == nil {
+	// Complete handshakes with SYN cookies
+	if c.dstAddr == nil && isSYNCookies && indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP &&
+		indicator.IsACK() && !indicator.IsFIN() && !indicator.IsRST() && indicator.Payload() == nil {
+		client, ok := acceptSYNCookie(indicator, c.crypt)
+		if ok {
+			c.mapClient(addr.String(), client)
+
+			log.Verbosef("Receive TCP ACK with cookie: %s -> %s\n", addr.String(), indicator.Dst().String())
+		}
+
+		return 0, addr, nil
+	}
+
+	// Answer keepalive probes instead of reading them as data
+	c.clientsLock.RLock()
+	prober, ok := c.clients[addr.String()]
+	c.clientsLock.RUnlock()
+	if ok && isKeepAlive(indicator, prober) {
+		log.Verbosef("Receive TCP keepalive: %s -> %s\n", addr.String(), indicator.Dst().String())
+
+		err := c.writeACK(prober, &net.TCPAddr{IP: indicator.SrcIP(), Port: int(indicator.SrcPort())}, false)
+		if err != nil {
+			return 0, addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    fmt.Errorf("answer keepalive: %w", err),
+			}
+		}
+
+		return 0, addr, nil
+	}
+
+	isFIN := indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP && indicator.IsFIN()
+	if indicator.Payload() == nil && !isFIN {
 		return 0, addr, nil
 	}
 
@@ -508,30 +688,150 @@ type tuple struct {
 			Err:    fmt.Errorf("client %s unauthorized", addr.String()),
 		}
 	}
+	client.seen()
 
 	// TCP Ack, always use the expected one
 	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
-		expectedAck := indicator.TCPLayer().Seq + uint32(len(indicator.Payload()))
-		if expectedAck > client.ack || (math.MaxUint32-indicator.TCPLayer().Seq < uint32(len(indicator.Payload()))) {
+		l := segmentLen(indicator.TCPLayer(), len(indicator.Payload()))
+		expectedAck := indicator.TCPLayer().Seq + l
+		if expectedAck > client.ack || (math.MaxUint32-indicator.TCPLayer().Seq < l) {
 			client.ack = expectedAck
 		}
+		if ts, ok := timestampsValue(indicator.TCPLayer()); ok {
+			client.tsecr = ts
+		}
+	}
+	if indicator.Payload() == nil {
+		return 0, addr, nil
 	}
 
-	// Decrypt
-	contents, err := client.crypt.Decrypt(indicator.Payload())
-	if err != nil {
+	// Reassemble frame
+	if indicator.TransportLayer() == nil || indicator.TransportLayer().LayerType() != layers.LayerTypeTCP {
 		return 0, addr, &net.OpError{
 			Op:     "read",
 			Net:    "pcap",
 			Source: c.LocalAddr(),
 			Addr:   addr,
-			Err:    fmt.Errorf("decrypt: %w", err),
+			Err:    fmt.Errorf("transport layer type %s %w", indicator.TransportProtocol(), ErrUnsupportedProtocol),
 		}
 	}
 
+	// A resumed client is read from the first frame after a pushed segment, since its stream is joined halfway
+	if client.isResyncing {
+		if indicator.TCPLayer().PSH {
+			client.isResyncing = false
+		}
+		return 0, addr, nil
+	}
+	client.reader.Append(indicator.TCPLayer().Seq, indicator.Payload(), indicator.TCPLayer().PSH)
+
+	// Congestion experienced in segments is reflected to the next completed frame
+	if isECN && indicator.IPv4Layer().TOS&ecnMask == ecnCE {
+		client.isCE = true
+	}
+
+	// Drain and decrypt all completed frames, the first one is returned and the others are pending. The first frame of
+	// a client of a listener must be carried, or the client is rejected as a probe
+	var (
+		contents   []byte
+		isRead     bool
+		decryptErr error
+	)
+	isProbing := c.dstAddr == nil && !client.isVerified
+	src := indicator.Src().(*net.TCPAddr)
+	for {
+		frame, err := client.reader.Next()
+		if err != nil {
+			if isProbing {
+				return c.rejectProbe(client, src, fmt.Errorf("frame: %w", err))
+			}
+			if decryptErr == nil {
+				decryptErr = err
+			}
+			break
+		}
+		if frame == nil {
+			break
+		}
+
+		decrypted, err := client.crypt.Decrypt(frame)
+		if err != nil {
+			if isProbing {
+				return c.rejectProbe(client, src, fmt.Errorf("decrypt: %w", err))
+			}
+			if decryptErr == nil {
+				decryptErr = err
+			}
+			continue
+		}
+
+		// Padding
+		if isPadding {
+			decrypted, err = openPadding(decrypted)
+			if err != nil {
+				if isProbing {
+					return c.rejectProbe(client, src, fmt.Errorf("open padding: %w", err))
+				}
+				if decryptErr == nil {
+					decryptErr = err
+				}
+				continue
+			}
+		}
+
+		// Replay protection
+		if client.window != nil {
+			decrypted, err = openReplay(client.window, decrypted)
+			if err != nil {
+				if isProbing {
+					return c.rejectProbe(client, src, fmt.Errorf("open replay: %w", err))
+				}
+				if decryptErr == nil {
+					decryptErr = err
+				}
+				continue
+			}
+		}
+
+		if isProbing {
+			if !isCarrier(decrypted) {
+				return c.rejectProbe(client, src, errors.New("not carrier"))
+			}
+			client.isVerified = true
+			isProbing = false
+		}
+
+		if client.isCE {
+			markCE(decrypted)
+			client.isCE = false
+		}
+
+		if !isRead {
+			contents = decrypted
+			isRead = true
+			continue
+		}
+
+		c.pendingLock.Lock()
+		c.pendings = append(c.pendings, pendingContents{contents: decrypted, addr: addr})
+		c.pendingLock.Unlock()
+	}
+	if !isRead {
+		if decryptErr != nil {
+			return 0, addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    fmt.Errorf("decrypt: %w", decryptErr),
+			}
+		}
+		return 0, addr, nil
+	}
+
 	copy(p, contents)
 
-	return len(contents), addr, err
+	return len(contents), addr, nil
 }
 
 func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
@@ -555,7 +855,7 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 			Net:    "pcap",
 			Source: c.LocalAddr(),
 			Addr:   addr,
-			Err:    fmt.Errorf("type %T not support", t),
+			Err:    fmt.Errorf("type %T %w", t, ErrUnsupportedProtocol),
 		}
 	}
 
@@ -580,21 +880,54 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		}
 
 		// Create layers
-		transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, dstPort, client.seq, client.ack, c.conn, dstIP, c.id, 128, c.conn.RemoteDev().HardwareAddr())
+		// Send to the client directly if there is no gateway
+		hardwareAddr := client.hardwareAddr
+		if c.conn.RemoteDev() != nil {
+			hardwareAddr = c.conn.RemoteDev().HardwareAddr()
+		}
+
+		transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, dstPort, client.seq, client.ack, c.conn, dstIP, c.id, 128, hardwareAddr)
 		if err != nil {
 			ch <- fmt.Errorf("create layers: %w", err)
 			return
 		}
+		applyFingerprint(transportLayer, networkLayer, client)
+		applyECN(networkLayer.(*layers.IPv4), p)
+
+		// Replay protection
+		plaintext := p
+		if client.window != nil {
+			client.sendSeq++
+			plaintext = sealReplay(client.sendSeq, p)
+		}
+
+		// Padding
+		if isPadding {
+			plaintext = sealPadding(plaintext)
+		}
 
 		// Encrypt
-		contents, err := client.crypt.Encrypt(p)
+		contents, err := client.crypt.Encrypt(plaintext)
 		if err != nil {
 			ch <- fmt.Errorf("encrypt: %w", err)
 			return
 		}
 
+		// Frame
+		if len(contents) > math.MaxUint16 {
+			ch <- fmt.Errorf("frame size %d out of range", len(contents))
+			return
+		}
+		frame := make([]byte, frameHeaderSize+len(contents))
+		binary.BigEndian.PutUint16(frame, uint16(len(contents)))
+		copy(frame[frameHeaderSize:], contents)
+
 		// Fragment
-		fragments, err = CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), contents, c.mtu)
+		var link gopacket.Layer
+		if linkLayer != nil {
+			link = linkLayer.(gopacket.Layer)
+		}
+		fragments, err = CreateFragmentPackets(link, networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), frame, client.segmentSize(c.mtu))
 		if err != nil {
 			ch <- fmt.Errorf("fragment: %w", err)
 			return
@@ -610,7 +943,7 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		}
 
 		// TCP Seq
-		client.seq = client.seq + uint32(len(contents))
+		client.seq = client.seq + uint32(len(frame))
 
 		// IPv4 Id
 		if networkLayer.LayerType() == layers.LayerTypeIPv4 {
@@ -628,9 +961,9 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	// Timeout
 	if !c.writeDeadline.IsZero() {
 		go func() {
-			duration := c.readDeadline.Sub(time.Now())
+			duration := c.readDeadline.Sub(clock.Now())
 			if duration > 0 {
-				time.Sleep(duration)
+				<-clock.After(duration)
 			}
 			ch <- &timeoutError{Err: "timeout"}
 		}()
@@ -652,6 +985,9 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 
 func (c *FakeTCPConn) Close() error {
 	c.isClosed = true
+	if c.listener != nil {
+		c.listener.release(c)
+	}
 
 	err := c.conn.Close()
 	if err != nil {
@@ -733,13 +1069,81 @@ func (c *FakeTCPConn) Reconnect() error {
 	return nil
 }
 
+// mapClient maps a client, and evicts the client seen least recently if there are too many clients of a listening
+// connection.
+func (c *FakeTCPConn) mapClient(addr string, client *clientIndicator) {
+	c.clientsLock.Lock()
+	defer c.clientsLock.Unlock()
+
+	if c.dstAddr == nil && maxClients > 0 && len(c.clients) >= maxClients {
+		var (
+			evicted string
+			last    int64
+		)
+		for a, client := range c.clients {
+			if evicted == "" || client.seenAt() < last {
+				evicted = a
+				last = client.seenAt()
+			}
+		}
+
+		delete(c.clients, evicted)
+		log.Infof("Evict client %s for max clients\n", evicted)
+	}
+
+	c.clients[addr] = client
+}
+
+// forget removes the state of a client which tears down its connection. A connection accepted by a listener serves
+// only the client, so it is closed and read as ended.
+func (c *FakeTCPConn) forget(addr net.Addr) (int, net.Addr, error) {
+	c.clientsLock.Lock()
+	delete(c.clients, addr.String())
+	c.clientsLock.Unlock()
+
+	if c.listener == nil {
+		return 0, addr, nil
+	}
+
+	err := c.Close()
+	if err != nil {
+		return 0, addr, err
+	}
+
+	return 0, addr, &net.OpError{
+		Op:     "read",
+		Net:    "pcap",
+		Source: c.LocalAddr(),
+		Addr:   addr,
+		Err:    io.EOF,
+	}
+}
+
+// lastSeen returns when any client of the connection is seen last time.
+func (c *FakeTCPConn) lastSeen() int64 {
+	c.clientsLock.RLock()
+	defer c.clientsLock.RUnlock()
+
+	var last int64
+	for _, client := range c.clients {
+		if client.seenAt() > last {
+			last = client.seenAt()
+		}
+	}
+
+	return last
+}
+
 // FakeTCPListener is a pcap network listener in FakeTCP network.
 type FakeTCPListener struct {
 	conn    *RawConn
 	srcPort uint16
 	crypt   crypto.Crypt
 	mtu     int
-	clients map[string]net.Conn
+	lock    sync.Mutex
+	clients map[string]*FakeTCPConn
+	id      uint16
+	dial    func(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error)
 }
 
 // ListenFakeTCP announces on the local network address in FakeTCP network.
@@ -750,7 +1154,16 @@ func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, m
 	}
 	srcAddrs := addr.MultiTCPAddr{Addrs: addrs}
 
-	conn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("tcp && tcp[tcpflags] & tcp-syn != 0 && dst port %d", srcPort))
+	// Pure ACKs complete handshakes with SYN cookies
+	filter := fmt.Sprintf("tcp && tcp[tcpflags] & tcp-syn != 0 && dst port %d", srcPort)
+	if isSYNCookies {
+		filter = fmt.Sprintf("tcp && dst port %d && (tcp[tcpflags] & tcp-syn != 0 || (tcp[tcpflags] & (tcp-syn|tcp-fin|tcp-rst|tcp-ack) = tcp-ack && ip[2:2] - ((ip[0] & 0xf) << 2) - ((tcp[12] & 0xf0) >> 2) = 0))", srcPort)
+	}
+	if isResume {
+		filter = fmt.Sprintf("(%s) || (tcp && dst port %d && %s)", filter, srcPort, resumeFilter)
+	}
+
+	conn, err := CreateRawConn(srcDev, dstDev, clientFilter(filter))
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -765,7 +1178,8 @@ func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, m
 		srcPort: srcPort,
 		crypt:   crypt,
 		mtu:     mtu,
-		clients: make(map[string]net.Conn),
+		clients: make(map[string]*FakeTCPConn),
+		dial:    dialFakeTCPPassive,
 	}
 
 	return listener, nil
@@ -793,13 +1207,33 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 		}
 	}
 
+	l.lock.Lock()
 	_, ok := l.clients[indicator.Src().String()]
+	l.lock.Unlock()
 	if ok {
 		// Duplicate
 		return nil, nil
 	}
 
-	conn, err := dialFakeTCPPassive(l.Dev(), l.conn.RemoteDev(), l.srcPort, indicator.Src().(*net.TCPAddr), l.crypt, l.mtu)
+	// Data of an unknown but established connection
+	if !indicator.IsSYN() && len(indicator.Payload()) > 0 {
+		if isResume {
+			return l.acceptResume(indicator)
+		}
+		return nil, nil
+	}
+
+	// SYN cookies, the connection is created after the client acknowledges the cookie
+	if isSYNCookies {
+		return l.acceptSYNCookie(indicator)
+	}
+
+	if !allowHandshake() {
+		log.Verbosef("Drop TCP SYN for handshake rate: %s -> %s\n", indicator.Src().String(), indicator.Dst().String())
+		return nil, nil
+	}
+
+	conn, err := l.dial(l.Dev(), l.conn.RemoteDev(), l.srcPort, indicator.Src().(*net.TCPAddr), l.crypt, l.mtu)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -810,11 +1244,7 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 		}
 	}
 
-	conn.clients[indicator.Src().String()] = &clientIndicator{
-		crypt: l.crypt,
-		seq:   0,
-		ack:   0,
-	}
+	conn.clients[indicator.Src().String()] = newClientIndicator(l.crypt)
 
 	// Handshaking with client (SYN+ACK)
 	err = conn.handshakeSYNACK(indicator)
@@ -829,11 +1259,101 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 	}
 
 	// Map client
-	l.clients[indicator.Src().String()] = conn
+	l.admit(indicator.Src().String(), conn)
+
+	return conn, nil
+}
+
+func (l *FakeTCPListener) acceptSYNCookie(indicator *PacketIndicator) (net.Conn, error) {
+	// SYN
+	if indicator.IsSYN() {
+		if !allowHandshake() {
+			log.Verbosef("Drop TCP SYN for handshake rate: %s -> %s\n", indicator.Src().String(), indicator.Dst().String())
+			return nil, nil
+		}
+
+		err := writeSYNACKCookie(l.conn, indicator, l.id)
+		if err != nil {
+			return nil, &net.OpError{
+				Op:     "handshake",
+				Net:    "pcap",
+				Source: l.Addr(),
+				Addr:   indicator.Src(),
+				Err:    err,
+			}
+		}
+		l.id++
+
+		log.Verbosef("Send TCP SYN+ACK with cookie: %s <- %s\n", indicator.Src().String(), indicator.Dst().String())
+
+		return nil, nil
+	}
+
+	// ACK
+	client, ok := acceptSYNCookie(indicator, l.crypt)
+	if !ok {
+		log.Verbosef("Drop TCP ACK with invalid cookie: %s -> %s\n", indicator.Src().String(), indicator.Dst().String())
+		return nil, nil
+	}
+
+	conn, err := l.dial(l.Dev(), l.conn.RemoteDev(), l.srcPort, indicator.Src().(*net.TCPAddr), l.crypt, l.mtu)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: l.Addr(),
+			Addr:   indicator.Src(),
+			Err:    err,
+		}
+	}
+
+	conn.clients[indicator.Src().String()] = client
+
+	// Map client
+	l.admit(indicator.Src().String(), conn)
+
+	log.Verbosef("Receive TCP ACK with cookie: %s -> %s\n", indicator.Src().String(), indicator.Dst().String())
 
 	return conn, nil
 }
 
+// admit maps a connection of a client, and evicts the client seen least recently if there are too many clients.
+func (l *FakeTCPListener) admit(addr string, conn *FakeTCPConn) {
+	conn.listener = l
+
+	l.lock.Lock()
+	var evicted *FakeTCPConn
+	if maxClients > 0 && len(l.clients) >= maxClients {
+		for _, c := range l.clients {
+			if evicted == nil || c.lastSeen() < evicted.lastSeen() {
+				evicted = c
+			}
+		}
+	}
+	l.clients[addr] = conn
+	l.lock.Unlock()
+
+	if evicted != nil {
+		log.Infof("Evict client %s for max clients\n", evicted.RemoteAddr().String())
+
+		err := evicted.Close()
+		if err != nil {
+			log.Errorln(fmt.Errorf("close %s: %w", evicted.RemoteAddr().String(), err))
+		}
+	}
+}
+
+// release unmaps a connection of a client, so that the client can connect again.
+func (l *FakeTCPListener) release(conn *FakeTCPConn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	a := conn.RemoteAddr().String()
+	if l.clients[a] == conn {
+		delete(l.clients, a)
+	}
+}
+
 func (l *FakeTCPListener) Close() error {
 	err := l.conn.Close()
 	if err != nil {
@@ -945,6 +1465,20 @@ func TuneKCP(sess *kcp.UDPSession, config *config.KCPConfig) error {
 	return nil
 }
 
+// segmentLen returns the length of sequence space consumed by a TCP segment, where SYN and FIN each consume one in
+// addition to the payload.
+func segmentLen(layer *layers.TCP, payloadLen int) uint32 {
+	l := uint32(payloadLen)
+	if layer.SYN {
+		l++
+	}
+	if layer.FIN {
+		l++
+	}
+
+	return l
+}
+
 func btoi(b bool) int {
 	if b {
 		return 1
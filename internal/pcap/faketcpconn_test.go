@@ -0,0 +1,555 @@
+package pcap
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/clock"
+	"github.com/zhxie/ikago/internal/crypto"
+)
+
+var (
+	testClientAddr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 49152}
+	testServerAddr = &net.TCPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+)
+
+// testHandle is a handle of a raw device, or an Ethernet device if isEthernet is set, which reads packets fed to it
+// and records packets written to it.
+type testHandle struct {
+	lock       sync.Mutex
+	isEthernet bool
+	reads      [][]byte
+	writes     [][]byte
+}
+
+func (h *testHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if len(h.reads) <= 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data := h.reads[0]
+	h.reads = h.reads[1:]
+
+	return data, gopacket.CaptureInfo{CaptureLength: len(data), Length: len(data)}, nil
+}
+
+func (h *testHandle) WritePacketData(data []byte) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	b := make([]byte, len(data))
+	copy(b, data)
+	h.writes = append(h.writes, b)
+
+	return nil
+}
+
+func (h *testHandle) LinkType() layers.LinkType {
+	if h.isEthernet {
+		return layers.LinkTypeEthernet
+	}
+
+	return layers.LinkTypeRaw
+}
+
+func (h *testHandle) Close() {}
+
+// feed queues a packet to be read.
+func (h *testHandle) feed(data []byte) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.reads = append(h.reads, data)
+}
+
+// pending returns the count of packets fed but not read yet.
+func (h *testHandle) pending() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return len(h.reads)
+}
+
+// take returns packets written and clears them.
+func (h *testHandle) take() [][]byte {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	writes := h.writes
+	h.writes = nil
+
+	return writes
+}
+
+// relay feeds packets written to the handle to another handle, and returns TCP layers of them.
+func (h *testHandle) relay(tb testing.TB, to *testHandle) []*layers.TCP {
+	writes := h.take()
+	for _, data := range writes {
+		to.feed(data)
+	}
+
+	return decodeSegments(tb, writes)
+}
+
+// written returns TCP layers of packets written and clears them.
+func (h *testHandle) written(tb testing.TB) []*layers.TCP {
+	return decodeSegments(tb, h.take())
+}
+
+// decodeSegments returns TCP layers of packets.
+func decodeSegments(tb testing.TB, packets [][]byte) []*layers.TCP {
+	var segments []*layers.TCP
+	for _, data := range packets {
+		packet := gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.Default)
+		tcpLayer, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok {
+			tb.Fatalf("written packet is not TCP: %v", packet)
+		}
+		segments = append(segments, tcpLayer)
+	}
+
+	return segments
+}
+
+// newTestConn returns a connection from the local address to the remote address on a raw handle, which serves any
+// client if the remote address is nil.
+func newTestConn(local, remote *net.TCPAddr) (*FakeTCPConn, *testHandle) {
+	handle := &testHandle{}
+	srcDev := NewDevice("test0", "test0", []*net.IPNet{{IP: local.IP, Mask: net.CIDRMask(24, 32)}}, nil, false)
+	dstDev := NewDevice("", "Gateway", nil, nil, false)
+
+	conn := newConn()
+	conn.srcPort = uint16(local.Port)
+	conn.dstAddr = remote
+	conn.crypt = crypto.CreatePlainCrypt()
+	conn.conn = CreateRawConnWithHandle(srcDev, dstDev, handle)
+	conn.appear = clock.Now()
+
+	return conn, handle
+}
+
+// readAll reads all packets fed to the connection, and returns contents read from them.
+func readAll(tb testing.TB, conn *FakeTCPConn, handle *testHandle) [][]byte {
+	var contents [][]byte
+	for handle.pending() > 0 {
+		p := make([]byte, 65535)
+		n, _, err := conn.ReadFrom(p)
+		if err != nil {
+			tb.Fatalf("read: %v", err)
+		}
+		if n > 0 {
+			contents = append(contents, p[:n])
+		}
+	}
+
+	return contents
+}
+
+// newSegment returns a TCP segment with flags and the payload from the source to the destination.
+func newSegment(tb testing.TB, src, dst *net.TCPAddr, seq, ack uint32, flags string, payload []byte) []byte {
+	tcpLayer := CreateTCPLayer(uint16(src.Port), uint16(dst.Port), seq, ack)
+	FlagTCPLayer(tcpLayer, false, false, false)
+	for _, flag := range flags {
+		switch flag {
+		case 'S':
+			tcpLayer.SYN = true
+		case 'A':
+			tcpLayer.ACK = true
+		case 'P':
+			tcpLayer.PSH = true
+		case 'F':
+			tcpLayer.FIN = true
+		case 'R':
+			tcpLayer.RST = true
+		default:
+			tb.Fatalf("flag %c not support", flag)
+		}
+	}
+
+	networkLayer, err := CreateIPv4Layer(src.IP, dst.IP, 0, 64, tcpLayer)
+	if err != nil {
+		tb.Fatalf("create network layer: %v", err)
+	}
+
+	data, err := Serialize(networkLayer, tcpLayer, gopacket.Payload(payload))
+	if err != nil {
+		tb.Fatalf("serialize: %v", err)
+	}
+
+	return data
+}
+
+func TestSegmentLen(t *testing.T) {
+	tests := []struct {
+		name    string
+		syn     bool
+		fin     bool
+		payload int
+		want    uint32
+	}{
+		{name: "empty", want: 0},
+		{name: "data", payload: 10, want: 10},
+		{name: "syn", syn: true, want: 1},
+		{name: "syn with data", syn: true, payload: 10, want: 11},
+		{name: "fin", fin: true, want: 1},
+		{name: "fin with data", fin: true, payload: 10, want: 11},
+		{name: "syn and fin with data", syn: true, fin: true, payload: 10, want: 12},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if l := segmentLen(&layers.TCP{SYN: tt.syn, FIN: tt.fin}, tt.payload); l != tt.want {
+				t.Errorf("segmentLen = %d, want %d", l, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadAck(t *testing.T) {
+	data := newFrame("0123456789")
+
+	tests := []struct {
+		name    string
+		ack     uint32
+		seq     uint32
+		flags   string
+		payload []byte
+		want    uint32
+	}{
+		{name: "data", ack: 1000, seq: 1000, flags: "PA", payload: data, want: 1000 + uint32(len(data))},
+		{name: "fin", ack: 1000, seq: 1000, flags: "FA", want: 1001},
+		{name: "fin with data", ack: 1000, seq: 1000, flags: "FPA", payload: data, want: 1001 + uint32(len(data))},
+		{name: "retransmitted", ack: 1000, seq: 1000 - uint32(len(data)), flags: "PA", payload: data, want: 1000},
+		{name: "wrapped", ack: math.MaxUint32 - 4, seq: math.MaxUint32 - 4, flags: "PA", payload: data, want: uint32(len(data)) - 5},
+		{name: "wrapped fin", ack: math.MaxUint32, seq: math.MaxUint32, flags: "FA", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The connection to the server reads FINs of the server as data
+			conn, handle := newTestConn(testClientAddr, testServerAddr)
+			client := newClientIndicator(conn.crypt)
+			client.ack = tt.ack
+			conn.clients[testServerAddr.String()] = client
+
+			handle.feed(newSegment(t, testServerAddr, testClientAddr, tt.seq, 1, tt.flags, tt.payload))
+			_, _, err := conn.ReadFrom(make([]byte, 1500))
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+
+			if client.ack != tt.want {
+				t.Errorf("ack = %d, want %d", client.ack, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandshakeSYNWithData(t *testing.T) {
+	conn, handle := newTestConn(testServerAddr, testClientAddr)
+
+	// Data in SYNs is not accepted, so only the SYN is acknowledged and the data is expected again
+	handle.feed(newSegment(t, testClientAddr, testServerAddr, 1000, 0, "S", []byte("early data")))
+	_, _, err := conn.ReadFrom(make([]byte, 1500))
+	if err != nil {
+		t.Fatalf("read syn: %v", err)
+	}
+
+	segments := handle.written(t)
+	if len(segments) != 1 || !segments[0].SYN || !segments[0].ACK {
+		t.Fatalf("written = %v, want a SYN+ACK", segments)
+	}
+	if segments[0].Ack != 1001 {
+		t.Errorf("ack of SYN+ACK = %d, want 1001", segments[0].Ack)
+	}
+	client := conn.clients[testClientAddr.String()]
+	if client.ack != 1001 {
+		t.Errorf("ack = %d, want 1001", client.ack)
+	}
+
+	data := newFrame("early data")
+	handle.feed(newSegment(t, testClientAddr, testServerAddr, 1001, segments[0].Seq+1, "PA", data))
+	n, _, err := conn.ReadFrom(make([]byte, 1500))
+	if err != nil {
+		t.Fatalf("read data: %v", err)
+	}
+	if n != len("early data") {
+		t.Errorf("read = %d, want %d", n, len("early data"))
+	}
+	if want := 1001 + uint32(len(data)); client.ack != want {
+		t.Errorf("ack after data = %d, want %d", client.ack, want)
+	}
+}
+
+func TestHandshakeSeq(t *testing.T) {
+	tests := []struct {
+		name         string
+		isSYNCookies bool
+	}{
+		{name: "stateful"},
+		{name: "syn cookie", isSYNCookies: true},
+	}
+
+	defer func(enabled bool) {
+		isSYNCookies = enabled
+	}(isSYNCookies)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := SetSYNCookies(tt.isSYNCookies)
+			if err != nil {
+				t.Fatalf("set syn cookies: %v", err)
+			}
+
+			// Connections accepted with SYN cookies are not created until the handshake completes, so the server
+			// serves any client
+			serverRemote := testClientAddr
+			if tt.isSYNCookies {
+				serverRemote = nil
+			}
+			client, clientHandle := newTestConn(testClientAddr, testServerAddr)
+			server, serverHandle := newTestConn(testServerAddr, serverRemote)
+
+			// SYN
+			err = client.handshakeSYN()
+			if err != nil {
+				t.Fatalf("handshake: %v", err)
+			}
+			syn := clientHandle.relay(t, serverHandle)
+			if len(syn) != 1 || !syn[0].SYN || syn[0].ACK {
+				t.Fatalf("written = %v, want a SYN", syn)
+			}
+			clientISN := syn[0].Seq
+
+			// SYN+ACK
+			readAll(t, server, serverHandle)
+			synACK := serverHandle.relay(t, clientHandle)
+			if len(synACK) != 1 || !synACK[0].SYN || !synACK[0].ACK {
+				t.Fatalf("written = %v, want a SYN+ACK", synACK)
+			}
+			serverISN := synACK[0].Seq
+			if synACK[0].Ack != clientISN+1 {
+				t.Errorf("ack of SYN+ACK = %d, want %d", synACK[0].Ack, clientISN+1)
+			}
+
+			// ACK
+			readAll(t, client, clientHandle)
+			ack := clientHandle.relay(t, serverHandle)
+			if len(ack) != 1 || ack[0].SYN || !ack[0].ACK {
+				t.Fatalf("written = %v, want an ACK", ack)
+			}
+			if ack[0].Seq != clientISN+1 || ack[0].Ack != serverISN+1 {
+				t.Errorf("ACK = %d, %d, want %d, %d", ack[0].Seq, ack[0].Ack, clientISN+1, serverISN+1)
+			}
+			readAll(t, server, serverHandle)
+
+			// The first data segments of both sides follow their SYNs, and the first frame of a client must be carried
+			request := newTestPacket(t, CreateUDPLayer(49152, 10000), []byte("request"), false)
+			_, err = client.Write(request)
+			if err != nil {
+				t.Fatalf("write request: %v", err)
+			}
+			data := clientHandle.relay(t, serverHandle)
+			if len(data) != 1 {
+				t.Fatalf("written = %d segments, want 1", len(data))
+			}
+			if data[0].Seq != clientISN+1 || data[0].Ack != serverISN+1 {
+				t.Errorf("request = %d, %d, want %d, %d", data[0].Seq, data[0].Ack, clientISN+1, serverISN+1)
+			}
+			contents := readAll(t, server, serverHandle)
+			if len(contents) != 1 || !bytes.Equal(contents[0], request) {
+				t.Fatalf("read = %q, want %q", contents, request)
+			}
+
+			_, err = server.WriteTo([]byte("response"), testClientAddr)
+			if err != nil {
+				t.Fatalf("write response: %v", err)
+			}
+			data = serverHandle.relay(t, clientHandle)
+			if len(data) != 1 {
+				t.Fatalf("written = %d segments, want 1", len(data))
+			}
+			wantAck := clientISN + 1 + uint32(frameHeaderSize+len(request))
+			if data[0].Seq != serverISN+1 || data[0].Ack != wantAck {
+				t.Errorf("response = %d, %d, want %d, %d", data[0].Seq, data[0].Ack, serverISN+1, wantAck)
+			}
+		})
+	}
+}
+
+// newTestListener returns a listener on a raw handle of the local address, and handles of connections it accepts by
+// addresses of clients.
+func newTestListener(local *net.TCPAddr) (*FakeTCPListener, *testHandle, map[string]*testHandle) {
+	handle := &testHandle{}
+	handles := make(map[string]*testHandle)
+	srcDev := NewDevice("test0", "test0", []*net.IPNet{{IP: local.IP, Mask: net.CIDRMask(24, 32)}}, nil, false)
+	dstDev := NewDevice("", "Gateway", nil, nil, false)
+
+	listener := &FakeTCPListener{
+		conn:    CreateRawConnWithHandle(srcDev, dstDev, handle),
+		srcPort: uint16(local.Port),
+		crypt:   crypto.CreatePlainCrypt(),
+		mtu:     MaxEthernetMTU,
+		clients: make(map[string]*FakeTCPConn),
+		dial: func(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
+			conn, h := newTestConn(&net.TCPAddr{IP: srcDev.IPAddr().IP, Port: int(srcPort)}, dstAddr)
+			handles[dstAddr.String()] = h
+
+			return conn, nil
+		},
+	}
+
+	return listener, handle, handles
+}
+
+// newEstablishedConn returns a connection to the remote address which is established with the sequence and the
+// acknowledgement, and sends segments of at most the size.
+func newEstablishedConn(local, remote *net.TCPAddr, seq, ack uint32, mss uint16) (*FakeTCPConn, *testHandle, *clientIndicator) {
+	conn, handle := newTestConn(local, remote)
+
+	client := newClientIndicator(conn.crypt)
+	client.seq = seq
+	client.ack = ack
+	client.phase = handshakeEstablished
+	client.peerMSS = mss
+	conn.clients[remote.String()] = client
+
+	return conn, handle, client
+}
+
+func TestResume(t *testing.T) {
+	tests := []struct {
+		name        string
+		first       int
+		isResyncing bool
+	}{
+		// The listener first sees a segment in the middle of a frame, and skips to the first frame after a push
+		{name: "mid frame", first: 1, isResyncing: true},
+		// The listener first sees the last segment of a frame, and reads from the next frame
+		{name: "after push", first: -1},
+	}
+
+	defer SetResume(isResume)
+	SetResume(true)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The client sends a frame split into segments and another frame, while the server loses its state
+			client, clientHandle, _ := newEstablishedConn(testClientAddr, testServerAddr, 5000, 9000, 100)
+			_, err := client.Write(make([]byte, 250))
+			if err != nil {
+				t.Fatalf("write first frame: %v", err)
+			}
+			frame := clientHandle.take()
+			_, err = client.Write([]byte("second"))
+			if err != nil {
+				t.Fatalf("write second frame: %v", err)
+			}
+			next := clientHandle.take()
+			if len(frame) < 3 || len(next) != 1 {
+				t.Fatalf("segments = %d, %d, want at least 3, 1", len(frame), len(next))
+			}
+
+			first := tt.first
+			if first < 0 {
+				first = len(frame) + first
+			}
+
+			listener, handle, handles := newTestListener(testServerAddr)
+			handle.feed(frame[first])
+			c, err := listener.Accept()
+			if err != nil {
+				t.Fatalf("accept: %v", err)
+			}
+			conn, ok := c.(*FakeTCPConn)
+			if !ok {
+				t.Fatalf("accepted %v, want a connection", c)
+			}
+
+			segment := decodeSegments(t, frame[first:first+1])[0]
+			resumed := conn.clients[testClientAddr.String()]
+			if resumed == nil {
+				t.Fatal("client not resumed")
+			}
+			if resumed.seq != segment.Ack || resumed.ack != segment.Seq+uint32(len(segment.Payload)) {
+				t.Errorf("resumed = %d, %d, want %d, %d", resumed.seq, resumed.ack, segment.Ack, segment.Seq+uint32(len(segment.Payload)))
+			}
+			if resumed.isResyncing != tt.isResyncing {
+				t.Errorf("resyncing = %t, want %t", resumed.isResyncing, tt.isResyncing)
+			}
+
+			// Only the frame after the push is read
+			connHandle := handles[testClientAddr.String()]
+			for _, data := range append(frame[first+1:], next...) {
+				connHandle.feed(data)
+			}
+			contents := readAll(t, conn, connHandle)
+			if len(contents) != 1 || string(contents[0]) != "second" {
+				t.Errorf("read = %q, want %q", contents, "second")
+			}
+			if resumed.isResyncing {
+				t.Error("still resyncing after a push")
+			}
+
+			// Replies continue the stream of the client
+			_, err = conn.Write([]byte("reply"))
+			if err != nil {
+				t.Fatalf("write reply: %v", err)
+			}
+			end := decodeSegments(t, next)[0]
+			reply := connHandle.written(t)
+			if len(reply) != 1 || reply[0].Seq != 9000 || reply[0].Ack != end.Seq+uint32(len(end.Payload)) {
+				t.Errorf("reply = %v, want %d, %d", reply, 9000, end.Seq+uint32(len(end.Payload)))
+			}
+		})
+	}
+}
+
+func TestWritePSH(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		segments int
+	}{
+		{name: "single", size: 50, segments: 1},
+		{name: "split", size: 250, segments: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, handle, _ := newEstablishedConn(testClientAddr, testServerAddr, 5000, 9000, 100)
+
+			_, err := conn.Write(make([]byte, tt.size))
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			segments := handle.written(t)
+			if len(segments) != tt.segments {
+				t.Fatalf("written = %d segments, want %d", len(segments), tt.segments)
+			}
+
+			// Only the segment completing the frame is pushed
+			seq := uint32(5000)
+			for i, segment := range segments {
+				if isLast := i == len(segments)-1; segment.PSH != isLast {
+					t.Errorf("segment %d PSH = %t, want %t", i, segment.PSH, isLast)
+				}
+				if segment.Seq != seq {
+					t.Errorf("segment %d seq = %d, want %d", i, segment.Seq, seq)
+				}
+				seq = seq + uint32(len(segment.Payload))
+			}
+			if want := 5000 + uint32(frameHeaderSize+tt.size); seq != want {
+				t.Errorf("next seq = %d, want %d", seq, want)
+			}
+		})
+	}
+}
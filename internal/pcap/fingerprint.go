@@ -0,0 +1,157 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	// FingerprintNone keeps the TCP characteristics of FakeTCP as is.
+	FingerprintNone = "none"
+	// FingerprintLinux mimics the TCP characteristics of Linux.
+	FingerprintLinux = "linux"
+	// FingerprintWindows mimics the TCP characteristics of Windows.
+	FingerprintWindows = "windows"
+)
+
+// tcpFingerprint describes TCP characteristics of segments in FakeTCP.
+type tcpFingerprint struct {
+	ttl         uint8
+	window      uint16
+	windowScale uint8
+	mss         uint16
+	// options are kinds of options in SYN segments in order.
+	options []layers.TCPOptionKind
+}
+
+var fingerprints = map[string]*tcpFingerprint{
+	FingerprintLinux: {
+		ttl:         64,
+		window:      64240,
+		windowScale: 7,
+		mss:         1460,
+		options: []layers.TCPOptionKind{
+			layers.TCPOptionKindMSS,
+			layers.TCPOptionKindSACKPermitted,
+			layers.TCPOptionKindTimestamps,
+			layers.TCPOptionKindNop,
+			layers.TCPOptionKindWindowScale,
+		},
+	},
+	FingerprintWindows: {
+		ttl:         128,
+		window:      64240,
+		windowScale: 8,
+		mss:         1460,
+		options: []layers.TCPOptionKind{
+			layers.TCPOptionKindMSS,
+			layers.TCPOptionKindNop,
+			layers.TCPOptionKindWindowScale,
+			layers.TCPOptionKindNop,
+			layers.TCPOptionKindNop,
+			layers.TCPOptionKindSACKPermitted,
+		},
+	},
+}
+
+var fingerprint *tcpFingerprint
+
+// SetFingerprint sets the TCP fingerprint of FakeTCP connections.
+func SetFingerprint(name string) error {
+	if name == FingerprintNone {
+		fingerprint = nil
+		return nil
+	}
+
+	fp, ok := fingerprints[name]
+	if !ok {
+		return fmt.Errorf("fingerprint %s %w", name, ErrUnsupportedProtocol)
+	}
+
+	fingerprint = fp
+
+	return nil
+}
+
+// applyFingerprint applies the TCP fingerprint, options negotiated with and the timestamps option of the client to
+// the layers of a FakeTCP segment. It must be applied after the TCP layer is flagged.
+func applyFingerprint(transportLayer, networkLayer gopacket.SerializableLayer, client *clientIndicator) {
+	if fingerprint == nil {
+		tcpLayer, ok := transportLayer.(*layers.TCP)
+		if !ok {
+			return
+		}
+		if tcpLayer.SYN {
+			appendSYNOptions(tcpLayer, client)
+		}
+		if isTimestamps {
+			appendTimestampsOption(tcpLayer, client)
+		}
+		return
+	}
+
+	// Network layer
+	if ipv4Layer, ok := networkLayer.(*layers.IPv4); ok {
+		ipv4Layer.TTL = fingerprint.ttl
+		FlagIPv4Layer(ipv4Layer, true, false, 0)
+	}
+
+	tcpLayer, ok := transportLayer.(*layers.TCP)
+	if !ok {
+		return
+	}
+
+	// Window, the window is scaled after the handshake if the window scale is negotiated
+	if tcpLayer.SYN || !client.isScaled {
+		tcpLayer.Window = fingerprint.window
+	} else {
+		tcpLayer.Window = fingerprint.window >> announcedWindowScale()
+	}
+
+	// Options
+	tcpLayer.Options = make([]layers.TCPOption, 0)
+	if tcpLayer.SYN {
+		for i, kind := range fingerprint.options {
+			switch kind {
+			case layers.TCPOptionKindNop:
+				// Padding of an option which is not echoed
+				if i+1 < len(fingerprint.options) && !isOffered(tcpLayer, client, fingerprint.options[i+1]) {
+					break
+				}
+				tcpLayer.Options = append(tcpLayer.Options, layers.TCPOption{OptionType: kind, OptionLength: 1})
+			case layers.TCPOptionKindMSS:
+				mss := fingerprint.mss
+				if client.mss > 0 && client.mss < mss {
+					mss = client.mss
+				}
+				tcpLayer.Options = append(tcpLayer.Options, createMSSOption(mss))
+			case layers.TCPOptionKindSACKPermitted:
+				if isOffered(tcpLayer, client, kind) {
+					tcpLayer.Options = append(tcpLayer.Options, layers.TCPOption{OptionType: kind, OptionLength: 2})
+				}
+			case layers.TCPOptionKindWindowScale:
+				if isOffered(tcpLayer, client, kind) {
+					tcpLayer.Options = append(tcpLayer.Options, createWindowScaleOption(announcedWindowScale()))
+				}
+			case layers.TCPOptionKindTimestamps:
+				tcpLayer.Options = append(tcpLayer.Options, createTimestampsOption(client.tsval(), client.tsecr))
+			}
+		}
+		if isTimestamps && !fingerprint.hasTimestamps() {
+			appendTimestampsOption(tcpLayer, client)
+		}
+	} else if hasTimestamps() {
+		appendTimestampsOption(tcpLayer, client)
+	}
+}
+
+func (fp *tcpFingerprint) hasTimestamps() bool {
+	for _, kind := range fp.options {
+		if kind == layers.TCPOptionKindTimestamps {
+			return true
+		}
+	}
+
+	return false
+}
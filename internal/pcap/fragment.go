@@ -6,6 +6,7 @@
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/ip4defrag"
 	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/clock"
 	"github.com/zhxie/ikago/internal/log"
 	"sort"
 	"time"
@@ -19,6 +20,7 @@ type fragFlow struct {
 type fragIndicator struct {
 	length   uint16
 	offset   uint16
+	size     int
 	frags    []*PacketIndicator
 	lastSeen time.Time
 }
@@ -26,13 +28,14 @@ type fragIndicator struct {
 func newFragIndicator() *fragIndicator {
 	return &fragIndicator{
 		frags:    make([]*PacketIndicator, 0),
-		lastSeen: time.Now(),
+		lastSeen: clock.Now(),
 	}
 }
 
 func (indicator *fragIndicator) append(ind *PacketIndicator) {
 	indicator.frags = append(indicator.frags, ind)
-	indicator.lastSeen = time.Now()
+	indicator.size = indicator.size + ind.Size()
+	indicator.lastSeen = clock.Now()
 
 	if ind.MoreFragments() {
 		indicator.length = indicator.length + uint16(len(ind.NetworkPayload()))
@@ -76,7 +79,7 @@ func (indicator *fragIndicator) concatenate() (*PacketIndicator, error) {
 
 		FlagIPv4Layer(newNetworkLayer.(*layers.IPv4), false, false, 0)
 	default:
-		return nil, fmt.Errorf("network layer type %s not support", t)
+		return nil, fmt.Errorf("network layer type %s %w", t, ErrUnsupportedProtocol)
 	}
 
 	// Concatenate network payloads
@@ -130,6 +133,7 @@ type Defragmenter interface {
 // EasyDefragmenter is a machine defragments packets which also accepts non-standard packets.
 type EasyDefragmenter struct {
 	frags    map[fragFlow]*fragIndicator
+	size     int
 	deadline time.Duration
 }
 
@@ -161,20 +165,23 @@ func (defrag *EasyDefragmenter) AppendOriginal(ind *PacketIndicator) (*PacketInd
 	}
 
 	// Replace old fragments
-	if defrag.deadline > 0 && time.Now().Sub(fragIndicator.lastSeen) > defrag.deadline {
+	if defrag.deadline > 0 && clock.Now().Sub(fragIndicator.lastSeen) > defrag.deadline {
 		log.Verbosef("Recycle fragments %d from %s\n", flow.id, flow.src)
+		defrag.size = defrag.size - fragIndicator.size
 		fragIndicator = newFragIndicator()
 		defrag.frags[flow] = fragIndicator
 	}
 
 	fragIndicator.append(ind)
+	defrag.size = defrag.size + ind.Size()
 
 	if !fragIndicator.isCompleted() {
 		return nil, nil, nil
 	}
 
 	// Remove completed fragments
-	defrag.frags[flow] = nil
+	delete(defrag.frags, flow)
+	defrag.size = defrag.size - fragIndicator.size
 
 	// Concatenate fragments
 	indicator, err := fragIndicator.concatenate()
@@ -189,6 +196,22 @@ func (defrag *EasyDefragmenter) SetDeadline(t time.Duration) {
 	defrag.deadline = t
 }
 
+// Size returns the approximate size of incomplete fragments in the defragmenter.
+func (defrag *EasyDefragmenter) Size() int {
+	return defrag.size
+}
+
+// Discard discards all incomplete fragments in the defragmenter.
+func (defrag *EasyDefragmenter) Discard() {
+	if len(defrag.frags) <= 0 {
+		return
+	}
+
+	log.Verbosef("Discard fragments of %d packets\n", len(defrag.frags))
+	defrag.frags = make(map[fragFlow]*fragIndicator)
+	defrag.size = 0
+}
+
 // StrictDefragmenter is a machine defragments packets which drops invalid packets.
 type StrictDefragmenter struct {
 	defragmenter *ip4defrag.IPv4Defragmenter
@@ -207,7 +230,7 @@ func (defrag *StrictDefragmenter) Append(ind *PacketIndicator) (*PacketIndicator
 
 	// Discard old fragments
 	if defrag.deadline > 0 {
-		defrag.defragmenter.DiscardOlderThan(time.Now().Add(-defrag.deadline))
+		defrag.defragmenter.DiscardOlderThan(clock.Now().Add(-defrag.deadline))
 	}
 
 	layer, err := defrag.defragmenter.DefragIPv4(ind.IPv4Layer())
@@ -245,6 +268,11 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer gopacket.Laye
 
 	switch t := networkLayer.LayerType(); t {
 	case layers.LayerTypeIPv4:
+		// Fragments have no transport layer
+		if transportLayer == nil {
+			return CreateIPv4FragmentPackets(linkLayer, networkLayer.(*layers.IPv4), payload, fragment)
+		}
+
 		networkPayload, err := Serialize(transportLayer.(gopacket.SerializableLayer), payload)
 		if err != nil {
 			return nil, fmt.Errorf("serialize: %w", err)
@@ -252,7 +280,7 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer gopacket.Laye
 
 		return CreateIPv4FragmentPackets(linkLayer, networkLayer.(*layers.IPv4), networkPayload, fragment)
 	default:
-		return nil, fmt.Errorf("network layer type %s not support", t)
+		return nil, fmt.Errorf("network layer type %s %w", t, ErrUnsupportedProtocol)
 	}
 }
 
@@ -277,6 +305,7 @@ func CreateIPv4FragmentPackets(linkLayer gopacket.Layer, ipv4Layer *layers.IPv4,
 		// Create new IPv4 layer
 		temp := *ipv4Layer
 		newIPv4Layer := &temp
+		scrubIPv4FragmentId(newIPv4Layer)
 
 		// Create fragments
 		for i := 0; i < len(payload); {
@@ -307,7 +336,7 @@ func CreateIPv4FragmentPackets(linkLayer gopacket.Layer, ipv4Layer *layers.IPv4,
 					FlagIPv4Layer(newIPv4Layer, false, true, uint16(i/8))
 				}
 			default:
-				return nil, fmt.Errorf("network layer type %s not support", t)
+				return nil, fmt.Errorf("network layer type %s %w", t, ErrUnsupportedProtocol)
 			}
 
 			// Serialize layers
@@ -322,6 +351,12 @@ func CreateIPv4FragmentPackets(linkLayer gopacket.Layer, ipv4Layer *layers.IPv4,
 
 			fragments = append(fragments, data)
 
+			// Options without the copied flag only go along with the first fragment
+			if i == 0 && len(newIPv4Layer.Options) > 0 {
+				newIPv4Layer.Options = copiedIPv4Options(newIPv4Layer.Options)
+				newIPv4Layer.Padding = nil
+			}
+
 			i = i + length
 		}
 	} else {
@@ -346,6 +381,18 @@ func CreateIPv4FragmentPackets(linkLayer gopacket.Layer, ipv4Layer *layers.IPv4,
 	return fragments, nil
 }
 
+// copiedIPv4Options returns IPv4 options which must be copied into all fragments, whose copied flag is set.
+func copiedIPv4Options(options []layers.IPv4Option) []layers.IPv4Option {
+	result := make([]layers.IPv4Option, 0)
+	for _, option := range options {
+		if option.OptionType&0x80 != 0 {
+			result = append(result, option)
+		}
+	}
+
+	return result
+}
+
 // CreateTCPSegmentPackets creates TCP segments by given layers and fragment size.
 func CreateTCPSegmentPackets(linkLayer gopacket.Layer, networkLayer gopacket.NetworkLayer, tcpLayer *layers.TCP, payload gopacket.Payload, fragment int) ([][]byte, error) {
 	var (
@@ -388,19 +435,25 @@ func CreateTCPSegmentPackets(linkLayer gopacket.Layer, networkLayer gopacket.Net
 				temp := *ipv4Layer
 				newNetworkLayer = &temp
 
-				newNetworkLayer.(*layers.IPv4).Id = newNetworkLayer.(*layers.IPv4).Id + n
+				if ipIdMode == IPIdCounter {
+					newNetworkLayer.(*layers.IPv4).Id = newNetworkLayer.(*layers.IPv4).Id + n
+				} else {
+					scrubIPv4Id(newNetworkLayer.(*layers.IPv4))
+				}
 			case layers.LayerTypeIPv6:
 				ipv6Layer := networkLayer.(*layers.IPv6)
 				temp := *ipv6Layer
 				newNetworkLayer = &temp
 			default:
-				return nil, fmt.Errorf("network layer type %s not support", t)
+				return nil, fmt.Errorf("network layer type %s %w", t, ErrUnsupportedProtocol)
 			}
 
 			// Create new TCP layer
 			tempTCPLayer := *tcpLayer
 			newTCPLayer = &tempTCPLayer
 			newTCPLayer.Seq = newTCPLayer.Seq + uint32(i)
+			// Only the last segment is pushed, like TCP segmentation offload
+			newTCPLayer.PSH = tcpLayer.PSH && i+length >= len(payload)
 
 			// Set network layer for transport layer
 			err = newTCPLayer.SetNetworkLayerForChecksum(newNetworkLayer)
@@ -414,7 +467,7 @@ func CreateTCPSegmentPackets(linkLayer gopacket.Layer, networkLayer gopacket.Net
 			} else {
 				data, err = Serialize(linkLayer.(gopacket.SerializableLayer),
 					newNetworkLayer.(gopacket.SerializableLayer),
-					tcpLayer,
+					newTCPLayer,
 					payload[i:i+length])
 			}
 			if err != nil {
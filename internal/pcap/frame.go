@@ -0,0 +1,83 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/zhxie/ikago/internal/log"
+)
+
+// frameHeaderSize is the size of the length prefixed to each frame.
+const frameHeaderSize = 2
+
+// frameReader is a stream decoder which accumulates payloads of TCP segments in a flow and drains length-prefixed
+// frames from them. A frame may be split across segments, and a segment may contain multiple frames.
+type frameReader struct {
+	buffer     []byte
+	nextSeq    uint32
+	isStarted  bool
+	isSkipping bool
+	isPushed   bool
+}
+
+// Append appends the payload of a segment with the PSH flag, which marks the end of a write, to the stream. Duplicate
+// segments are ignored, and segments overlapping with the stream are trimmed. If a segment is lost, the incomplete
+// frame in the stream will be discarded, and so will segments until the end of the write, since a frame always starts
+// at the beginning of a write.
+func (r *frameReader) Append(seq uint32, data []byte, psh bool) {
+	if r.isStarted {
+		diff := int32(seq - r.nextSeq)
+		switch {
+		case diff < 0:
+			if int(-diff) >= len(data) {
+				return
+			}
+			data = data[-diff:]
+			seq = r.nextSeq
+		case diff > 0 && !r.isSkipping:
+			log.Verboseln("Discard incomplete frame for lost segment")
+			r.buffer = nil
+			r.isSkipping = true
+		}
+	}
+	r.nextSeq = seq + uint32(len(data))
+	r.isStarted = true
+
+	if r.isSkipping {
+		r.isSkipping = !psh
+		return
+	}
+
+	r.buffer = append(r.buffer, data...)
+	r.isPushed = psh
+}
+
+// Next returns the next completed frame in the stream, or nil if there is no completed frame. Since a write always
+// ends with a frame, an error is returned if a write ends in the middle of a frame, which means the peer does not frame
+// payloads, like one before framing, and the incomplete frame is discarded.
+func (r *frameReader) Next() ([]byte, error) {
+	if len(r.buffer) <= 0 {
+		return nil, nil
+	}
+	var length int
+	if len(r.buffer) >= frameHeaderSize {
+		length = frameHeaderSize + int(binary.BigEndian.Uint16(r.buffer))
+	}
+	if length <= 0 || len(r.buffer) < length {
+		if r.isPushed {
+			r.buffer = nil
+			return nil, errors.New("incomplete frame at the end of write")
+		}
+		return nil, nil
+	}
+
+	frame := make([]byte, length-frameHeaderSize)
+	copy(frame, r.buffer[frameHeaderSize:length])
+
+	if len(r.buffer) > length {
+		r.buffer = r.buffer[length:]
+	} else {
+		r.buffer = nil
+	}
+
+	return frame, nil
+}
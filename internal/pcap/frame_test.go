@@ -0,0 +1,203 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+type frameSegment struct {
+	seq  uint32
+	data []byte
+	psh  bool
+}
+
+func newFrame(contents string) []byte {
+	frame := make([]byte, frameHeaderSize+len(contents))
+	binary.BigEndian.PutUint16(frame, uint16(len(contents)))
+	copy(frame[frameHeaderSize:], contents)
+
+	return frame
+}
+
+func concat(slices ...[]byte) []byte {
+	return bytes.Join(slices, nil)
+}
+
+func TestFrameReader(t *testing.T) {
+	a, b, c := newFrame("alpha"), newFrame("bravo-bravo"), newFrame("charlie")
+	ab := concat(a, b)
+
+	tests := []struct {
+		name     string
+		segments []frameSegment
+		frames   []string
+	}{
+		{
+			name:     "single",
+			segments: []frameSegment{{0, a, true}},
+			frames:   []string{"alpha"},
+		},
+		{
+			name: "split",
+			segments: []frameSegment{
+				{0, b[:1], false},
+				{1, b[1:6], false},
+				{6, b[6:], true},
+			},
+			frames: []string{"bravo-bravo"},
+		},
+		{
+			name:     "multiple in one segment",
+			segments: []frameSegment{{0, concat(a, b, c), true}},
+			frames:   []string{"alpha", "bravo-bravo", "charlie"},
+		},
+		{
+			name: "multiple across segments",
+			segments: []frameSegment{
+				{0, ab[:4], false},
+				{4, ab[4:10], false},
+				{10, ab[10:], true},
+				{uint32(len(ab)), c, true},
+			},
+			frames: []string{"alpha", "bravo-bravo", "charlie"},
+		},
+		{
+			name: "gap",
+			segments: []frameSegment{
+				{0, b[:4], false},
+				{8, b[8:], true},
+				{uint32(len(b)), c, true},
+			},
+			frames: []string{"charlie"},
+		},
+		{
+			name: "gap until the end of the write",
+			segments: []frameSegment{
+				{0, a, true},
+				{uint32(len(a) + 3), b[3:6], false},
+				{uint32(len(a) + 6), b[6:], true},
+				{uint32(len(a) + len(b)), c, true},
+			},
+			frames: []string{"alpha", "charlie"},
+		},
+		{
+			name: "lost first segment",
+			segments: []frameSegment{
+				{0, a, true},
+				{uint32(len(a) + 4), b[4:], true},
+				{uint32(len(a) + len(b)), c, true},
+			},
+			frames: []string{"alpha", "charlie"},
+		},
+		{
+			name: "duplicate",
+			segments: []frameSegment{
+				{0, b[:4], false},
+				{0, b[:4], false},
+				{4, b[4:], true},
+				{4, b[4:], true},
+			},
+			frames: []string{"bravo-bravo"},
+		},
+		{
+			name: "overlap",
+			segments: []frameSegment{
+				{0, b[:6], false},
+				{3, b[3:], true},
+			},
+			frames: []string{"bravo-bravo"},
+		},
+		{
+			name: "sequence wraparound",
+			segments: []frameSegment{
+				{0xfffffffe, b[:4], false},
+				{2, b[4:], true},
+			},
+			frames: []string{"bravo-bravo"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				r      frameReader
+				frames []string
+			)
+
+			for _, s := range tt.segments {
+				r.Append(s.seq, s.data, s.psh)
+				for {
+					frame, err := r.Next()
+					if err != nil {
+						t.Fatalf("next: %v", err)
+					}
+					if frame == nil {
+						break
+					}
+					frames = append(frames, string(frame))
+				}
+			}
+
+			if len(frames) != len(tt.frames) {
+				t.Fatalf("frames = %q, want %q", frames, tt.frames)
+			}
+			for i := range frames {
+				if frames[i] != tt.frames[i] {
+					t.Fatalf("frames = %q, want %q", frames, tt.frames)
+				}
+			}
+		})
+	}
+}
+
+func TestFrameReaderIncomplete(t *testing.T) {
+	b := newFrame("bravo-bravo")
+
+	tests := []struct {
+		name     string
+		segments []frameSegment
+	}{
+		{
+			name:     "not framed",
+			segments: []frameSegment{{0, []byte{0x45, 0x00, 0x00, 0x54, 0x00}, true}},
+		},
+		{
+			name:     "joined halfway",
+			segments: []frameSegment{{4, b[4:], true}},
+		},
+		{
+			name:     "truncated header",
+			segments: []frameSegment{{0, b[:1], true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				r    frameReader
+				next uint32
+			)
+
+			for _, s := range tt.segments {
+				r.Append(s.seq, s.data, s.psh)
+				next = s.seq + uint32(len(s.data))
+			}
+
+			_, err := r.Next()
+			if err == nil {
+				t.Fatal("next: want error")
+			}
+
+			// The incomplete frame is discarded, so the stream continues from the next write
+			r.Append(next, b, true)
+			frame, err := r.Next()
+			if err != nil {
+				t.Fatalf("next: %v", err)
+			}
+			if string(frame) != "bravo-bravo" {
+				t.Fatalf("frame = %q, want %q", frame, "bravo-bravo")
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package pcap
+
+// Handshake phases of a client.
+const (
+	handshakeNone = iota
+	handshakeSYNSent
+	handshakeSYNReceived
+	handshakeEstablished
+)
+
+// sendSYN records a SYN sent to the client, and returns its sequence.
+func (client *clientIndicator) sendSYN() uint32 {
+	client.isn = client.seq
+	client.seq++
+	client.phase = handshakeSYNSent
+
+	return client.isn
+}
+
+// receiveSYN records a SYN received from the client, and returns the sequence of the SYN+ACK in reply and if the
+// SYN is new. A duplicate SYN is answered by the same SYN+ACK, and a SYN received after sending a SYN, which is a
+// simultaneous open, is answered with the sequence of the SYN sent.
+func (client *clientIndicator) receiveSYN(peerISN uint32) (uint32, bool) {
+	switch {
+	case client.phase >= handshakeSYNReceived && client.peerISN == peerISN:
+		return client.isn, false
+	case client.phase == handshakeSYNSent:
+		break
+	default:
+		client.isn = client.seq
+		client.seq++
+	}
+
+	client.peerISN = peerISN
+	client.ack = peerISN + 1
+	client.phase = handshakeSYNReceived
+
+	return client.isn, true
+}
+
+// receiveSYNACK records a SYN+ACK received from the client, and reports if the SYN+ACK is new. A duplicate SYN+ACK
+// is answered by the same ACK without resetting the connection.
+func (client *clientIndicator) receiveSYNACK(peerISN uint32) bool {
+	if client.phase == handshakeEstablished && client.peerISN == peerISN {
+		return false
+	}
+
+	client.peerISN = peerISN
+	client.ack = peerISN + 1
+	client.phase = handshakeEstablished
+
+	return true
+}
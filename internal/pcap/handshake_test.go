@@ -0,0 +1,124 @@
+package pcap
+
+import "testing"
+
+// checkConverged checks both sides of a connection have sequences acknowledged by each other.
+func checkConverged(tb testing.TB, local, remote *FakeTCPConn) {
+	tb.Helper()
+
+	l := local.clients[testServerAddr.String()]
+	r := remote.clients[testClientAddr.String()]
+	if l.seq != r.ack || r.seq != l.ack {
+		tb.Errorf("seq, ack = %d, %d and %d, %d, not converged", l.seq, l.ack, r.seq, r.ack)
+	}
+}
+
+func TestHandshakeLostSYNACK(t *testing.T) {
+	client, clientHandle := newTestConn(testClientAddr, testServerAddr)
+	server, serverHandle := newTestConn(testServerAddr, testClientAddr)
+
+	err := client.handshakeSYN()
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	syn := clientHandle.take()
+	if len(syn) != 1 {
+		t.Fatalf("written = %d segments, want 1", len(syn))
+	}
+
+	// The SYN+ACK is lost, and the client retransmits the SYN
+	serverHandle.feed(syn[0])
+	readAll(t, server, serverHandle)
+	lost := serverHandle.take()
+	serverHandle.feed(syn[0])
+	readAll(t, server, serverHandle)
+	synACK := serverHandle.relay(t, clientHandle)
+	if len(lost) != 1 || len(synACK) != 1 {
+		t.Fatalf("written = %d, %d segments, want 1, 1", len(lost), len(synACK))
+	}
+	if first := decodeSegments(t, lost)[0]; first.Seq != synACK[0].Seq || first.Ack != synACK[0].Ack {
+		t.Errorf("retransmitted SYN+ACK = %d, %d, want %d, %d", synACK[0].Seq, synACK[0].Ack, first.Seq, first.Ack)
+	}
+
+	readAll(t, client, clientHandle)
+	ack := clientHandle.relay(t, serverHandle)
+	if len(ack) != 1 || ack[0].SYN || !ack[0].ACK {
+		t.Fatalf("written = %v, want an ACK", ack)
+	}
+	readAll(t, server, serverHandle)
+	checkConverged(t, client, server)
+
+	// The lost SYN+ACK arrives late, and is answered by the same ACK
+	clientHandle.feed(lost[0])
+	readAll(t, client, clientHandle)
+	dup := clientHandle.written(t)
+	if len(dup) != 1 || dup[0].Seq != ack[0].Seq || dup[0].Ack != ack[0].Ack {
+		t.Errorf("written = %v, want the same ACK", dup)
+	}
+	checkConverged(t, client, server)
+}
+
+func TestHandshakeSimultaneousOpen(t *testing.T) {
+	client, clientHandle := newTestConn(testClientAddr, testServerAddr)
+	server, serverHandle := newTestConn(testServerAddr, testClientAddr)
+
+	// Both sides send SYNs which cross
+	err := client.handshakeSYN()
+	if err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	err = server.handshakeSYN()
+	if err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+	clientSYN := clientHandle.relay(t, serverHandle)
+	serverSYN := serverHandle.relay(t, clientHandle)
+	if len(clientSYN) != 1 || len(serverSYN) != 1 {
+		t.Fatalf("written = %d, %d segments, want 1, 1", len(clientSYN), len(serverSYN))
+	}
+
+	// Both sides answer SYN+ACKs with sequences of their SYNs
+	readAll(t, client, clientHandle)
+	readAll(t, server, serverHandle)
+	clientSYNACK := clientHandle.relay(t, serverHandle)
+	serverSYNACK := serverHandle.relay(t, clientHandle)
+	if len(clientSYNACK) != 1 || len(serverSYNACK) != 1 {
+		t.Fatalf("written = %d, %d segments, want 1, 1", len(clientSYNACK), len(serverSYNACK))
+	}
+	if clientSYNACK[0].Seq != clientSYN[0].Seq || clientSYNACK[0].Ack != serverSYN[0].Seq+1 {
+		t.Errorf("client SYN+ACK = %d, %d, want %d, %d", clientSYNACK[0].Seq, clientSYNACK[0].Ack, clientSYN[0].Seq, serverSYN[0].Seq+1)
+	}
+	if serverSYNACK[0].Seq != serverSYN[0].Seq || serverSYNACK[0].Ack != clientSYN[0].Seq+1 {
+		t.Errorf("server SYN+ACK = %d, %d, want %d, %d", serverSYNACK[0].Seq, serverSYNACK[0].Ack, serverSYN[0].Seq, clientSYN[0].Seq+1)
+	}
+
+	// Both sides acknowledge the SYN+ACKs
+	readAll(t, client, clientHandle)
+	readAll(t, server, serverHandle)
+	clientHandle.relay(t, serverHandle)
+	serverHandle.relay(t, clientHandle)
+	readAll(t, client, clientHandle)
+	readAll(t, server, serverHandle)
+	checkConverged(t, client, server)
+	if phase := client.clients[testServerAddr.String()].phase; phase != handshakeEstablished {
+		t.Errorf("client phase = %d, want %d", phase, handshakeEstablished)
+	}
+	if phase := server.clients[testClientAddr.String()].phase; phase != handshakeEstablished {
+		t.Errorf("server phase = %d, want %d", phase, handshakeEstablished)
+	}
+
+	// Data follows the SYNs
+	request := newTestPacket(t, CreateUDPLayer(49152, 10000), []byte("request"), false)
+	_, err = client.Write(request)
+	if err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	data := clientHandle.relay(t, serverHandle)
+	if len(data) != 1 || data[0].Seq != clientSYN[0].Seq+1 || data[0].Ack != serverSYN[0].Seq+1 {
+		t.Fatalf("written = %v, want a segment of %d, %d", data, clientSYN[0].Seq+1, serverSYN[0].Seq+1)
+	}
+	contents := readAll(t, server, serverHandle)
+	if len(contents) != 1 {
+		t.Errorf("read = %d frames, want 1", len(contents))
+	}
+}
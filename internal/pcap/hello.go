@@ -0,0 +1,231 @@
+package pcap
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/zhxie/ikago/internal/clock"
+	"net"
+	"time"
+)
+
+const (
+	// HelloVersion is the version of the hello message, which is the latest version of the encapsulation.
+	HelloVersion = 2
+	// MinHelloVersion is the earliest version of the encapsulation which can be served.
+	MinHelloVersion = 1
+	// BatchVersion is the version of the encapsulation from which batches are supported.
+	BatchVersion = 2
+)
+
+const (
+	helloTypeClient = 0x01
+	helloTypeServer = 0x02
+)
+
+// helloHeaderSize is the size of the type and the length of a hello message.
+const helloHeaderSize = 3
+
+// helloIdentitySize is the size of the signed time, the public key and the signature of a client hello.
+const helloIdentitySize = 8 + ed25519.PublicKeySize + ed25519.SignatureSize
+
+// helloSignWindow is the max difference between the signed time of a client hello and the time it is verified.
+const helloSignWindow = 60 * time.Second
+
+// Hello describes a hello message exchanged between the client and the server before transmission. A hello message
+// is distinguished from an embedded IPv4 packet by its first byte.
+type Hello struct {
+	IsServer bool
+	Version  uint8
+	Mode     string
+	MTU      uint16
+	KCP      bool
+	// Addr is the inner address assigned to the client by the server, only in server hello.
+	Addr net.IP
+	// Key is the public key of the client, only in signed client hello.
+	Key ed25519.PublicKey
+	// Time is the time the client hello is signed at in Unix seconds.
+	Time      int64
+	Signature []byte
+	signed    []byte
+}
+
+// NewClientHello returns a new client hello.
+func NewClientHello(mode string, mtu int, isKCP bool) *Hello {
+	return &Hello{Version: HelloVersion, Mode: mode, MTU: uint16(mtu), KCP: isKCP}
+}
+
+// NewServerHello returns a new server hello.
+func NewServerHello(mode string, mtu int, isKCP bool) *Hello {
+	return &Hello{IsServer: true, Version: HelloVersion, Mode: mode, MTU: uint16(mtu), KCP: isKCP}
+}
+
+// Serialize serializes the hello message.
+func (hello *Hello) Serialize() ([]byte, error) {
+	if len(hello.Mode) > 255 {
+		return nil, fmt.Errorf("mode %s too long", hello.Mode)
+	}
+
+	size := helloHeaderSize + 5 + len(hello.Mode) + net.IPv4len
+	if hello.Key != nil {
+		size = size + helloIdentitySize
+	}
+	data := make([]byte, size)
+
+	// Type and length
+	if hello.IsServer {
+		data[0] = helloTypeServer
+	} else {
+		data[0] = helloTypeClient
+	}
+	binary.BigEndian.PutUint16(data[1:], uint16(size-helloHeaderSize))
+
+	// Body
+	data[3] = hello.Version
+	if hello.KCP {
+		data[4] = 1
+	}
+	binary.BigEndian.PutUint16(data[5:], hello.MTU)
+	data[7] = uint8(len(hello.Mode))
+	copy(data[8:], hello.Mode)
+	if ip4 := hello.Addr.To4(); ip4 != nil {
+		copy(data[8+len(hello.Mode):], ip4)
+	}
+
+	// Identity
+	if hello.Key != nil {
+		n := 8 + len(hello.Mode) + net.IPv4len
+		binary.BigEndian.PutUint64(data[n:], uint64(hello.Time))
+		copy(data[n+8:], hello.Key)
+		copy(data[n+8+ed25519.PublicKeySize:], hello.Signature)
+	}
+
+	return data, nil
+}
+
+// Sign signs the client hello with the private key of the client, so that the client can be authenticated by its
+// public key.
+func (hello *Hello) Sign(key ed25519.PrivateKey) ([]byte, error) {
+	hello.Key = key.Public().(ed25519.PublicKey)
+	hello.Time = clock.Now().Unix()
+	hello.Signature = make([]byte, ed25519.SignatureSize)
+
+	data, err := hello.Serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	// All the hello but the signature is signed
+	n := len(data) - ed25519.SignatureSize
+	hello.Signature = ed25519.Sign(key, data[:n])
+	copy(data[n:], hello.Signature)
+
+	return data, nil
+}
+
+// VerifySignature checks if the client hello is signed by the private key of its public key recently.
+func (hello *Hello) VerifySignature() error {
+	if hello.Key == nil {
+		return errors.New("missing key")
+	}
+	if !ed25519.Verify(hello.Key, hello.signed, hello.Signature) {
+		return errors.New("invalid signature")
+	}
+
+	d := clock.Now().Sub(time.Unix(hello.Time, 0))
+	if d > helloSignWindow || d < -helloSignWindow {
+		return fmt.Errorf("signed time %s out of range", time.Unix(hello.Time, 0))
+	}
+
+	return nil
+}
+
+// NegotiateVersion returns the version of the encapsulation used with a peer in the given version, which is the earlier
+// one of the version and ours.
+func NegotiateVersion(version uint8) uint8 {
+	if version > HelloVersion {
+		return HelloVersion
+	}
+
+	return version
+}
+
+// Verify checks if the hello message is compatible with the given parameters. A hello in a later version is
+// compatible, and the version of the encapsulation should be negotiated by NegotiateVersion.
+func (hello *Hello) Verify(mode string, isKCP bool) error {
+	if hello.Version < MinHelloVersion {
+		return fmt.Errorf("version %d %w", hello.Version, ErrUnsupportedProtocol)
+	}
+	if hello.Mode != mode {
+		return fmt.Errorf("mode %s mismatch", hello.Mode)
+	}
+	if hello.KCP != isKCP {
+		return errors.New("kcp mismatch")
+	}
+
+	return nil
+}
+
+// IsHello returns if the contents is a hello message.
+func IsHello(contents []byte) bool {
+	return len(contents) > 0 && (contents[0] == helloTypeClient || contents[0] == helloTypeServer)
+}
+
+// helloSize returns the total size of the hello message in the contents.
+func helloSize(contents []byte) (int, bool) {
+	if len(contents) < helloHeaderSize {
+		return 0, false
+	}
+
+	return helloHeaderSize + int(binary.BigEndian.Uint16(contents[1:])), true
+}
+
+// ParseHello parses the contents as a hello message.
+func ParseHello(contents []byte) (*Hello, error) {
+	if !IsHello(contents) {
+		return nil, &ParseError{Err: errors.New("invalid hello")}
+	}
+
+	size, ok := helloSize(contents)
+	if !ok || size < helloHeaderSize+5 || len(contents) < size {
+		return nil, &ParseError{Err: errors.New("incomplete hello")}
+	}
+	body := contents[helloHeaderSize:size]
+
+	modeLen := int(body[4])
+	if len(body) < 5+modeLen {
+		return nil, &ParseError{Err: errors.New("incomplete hello")}
+	}
+
+	hello := &Hello{
+		IsServer: contents[0] == helloTypeServer,
+		Version:  body[0],
+		KCP:      body[1] != 0,
+		MTU:      binary.BigEndian.Uint16(body[2:]),
+		Mode:     string(body[5 : 5+modeLen]),
+	}
+
+	// Assigned address
+	if len(body) >= 5+modeLen+net.IPv4len {
+		ip := net.IP(body[5+modeLen : 5+modeLen+net.IPv4len])
+		if !ip.Equal(net.IPv4zero) {
+			hello.Addr = make(net.IP, net.IPv4len)
+			copy(hello.Addr, ip)
+		}
+	}
+
+	// Identity
+	if n := 5 + modeLen + net.IPv4len; len(body) >= n+helloIdentitySize {
+		identity := body[n : n+helloIdentitySize]
+		hello.Time = int64(binary.BigEndian.Uint64(identity))
+		hello.Key = make(ed25519.PublicKey, ed25519.PublicKeySize)
+		copy(hello.Key, identity[8:])
+		hello.Signature = make([]byte, ed25519.SignatureSize)
+		copy(hello.Signature, identity[8+ed25519.PublicKeySize:])
+		hello.signed = make([]byte, helloHeaderSize+n+helloIdentitySize-ed25519.SignatureSize)
+		copy(hello.signed, contents)
+	}
+
+	return hello, nil
+}
@@ -52,12 +52,12 @@ func ParseICMPv4Layer(layer *layers.ICMPv4) (*ICMPv4Indicator, error) {
 		// Parse network layer
 		networkLayer := packet.Layers()[0]
 		if t := networkLayer.LayerType(); t != layers.LayerTypeIPv4 {
-			return nil, fmt.Errorf("network layer type %s not support", t)
+			return nil, fmt.Errorf("network layer type %s %w", t, ErrUnsupportedProtocol)
 		}
 
 		embIPv4Layer = networkLayer.(*layers.IPv4)
 		if embIPv4Layer.Version != 4 {
-			return nil, errors.New("network layer type not support")
+			return nil, fmt.Errorf("network layer type %w", ErrUnsupportedProtocol)
 		}
 
 		_, err := parseIPProtocol(embIPv4Layer.Protocol)
@@ -71,10 +71,10 @@ func ParseICMPv4Layer(layer *layers.ICMPv4) (*ICMPv4Indicator, error) {
 		case layers.LayerTypeTCP, layers.LayerTypeUDP, layers.LayerTypeICMPv4:
 			break
 		default:
-			return nil, fmt.Errorf("transport layer type %s not support", t)
+			return nil, fmt.Errorf("transport layer type %s %w", t, ErrUnsupportedProtocol)
 		}
 	default:
-		return nil, fmt.Errorf("icmpv4 type %d not support", t)
+		return nil, fmt.Errorf("icmpv4 type %d %w", t, ErrUnsupportedProtocol)
 	}
 
 	return &ICMPv4Indicator{
@@ -0,0 +1,64 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// IPIdCounter identifies IPv4 packets of a FakeTCP connection by an incrementing counter.
+	IPIdCounter = "counter"
+	// IPIdZero identifies IPv4 packets by zero with DF flag set, and by random values when they are fragmented.
+	IPIdZero = "zero"
+	// IPIdRandom identifies IPv4 packets by random values.
+	IPIdRandom = "random"
+)
+
+var (
+	ipIdMode = IPIdCounter
+	ipIdLock sync.Mutex
+	ipIdRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// SetIPId sets how IPv4 packets created by FakeTCP are identified. Unlike a counter, zero and random values do not leak
+// the packet rate or restarts to observers.
+func SetIPId(mode string) error {
+	switch mode {
+	case IPIdCounter, IPIdZero, IPIdRandom:
+		ipIdMode = mode
+	default:
+		return fmt.Errorf("ip id %s %w", mode, ErrUnsupportedProtocol)
+	}
+
+	return nil
+}
+
+func randomIPv4Id() uint16 {
+	ipIdLock.Lock()
+	defer ipIdLock.Unlock()
+
+	return uint16(ipIdRand.Uint32())
+}
+
+// scrubIPv4Id scrubs the identification of an IPv4 layer which will not be fragmented.
+func scrubIPv4Id(layer *layers.IPv4) {
+	switch ipIdMode {
+	case IPIdZero:
+		// Zero is only valid in atomic datagrams
+		FlagIPv4Layer(layer, true, false, 0)
+		layer.Id = 0
+	case IPIdRandom:
+		layer.Id = randomIPv4Id()
+	}
+}
+
+// scrubIPv4FragmentId scrubs the identification of an IPv4 layer which will be fragmented. The identification is
+// shared by all fragments, so it can not be zero.
+func scrubIPv4FragmentId(layer *layers.IPv4) {
+	if ipIdMode != IPIdCounter {
+		layer.Id = randomIPv4Id()
+	}
+}
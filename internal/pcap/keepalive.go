@@ -0,0 +1,104 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/log"
+	"net"
+)
+
+// isKeepAlive reports whether a TCP segment is a keepalive probe of the client. A keepalive probe carries no more than
+// 1 Byte before the expected sequence number, which must not be appended to the stream as data.
+func isKeepAlive(indicator *PacketIndicator, client *clientIndicator) bool {
+	if indicator.TransportLayer() == nil || indicator.TransportLayer().LayerType() != layers.LayerTypeTCP {
+		return false
+	}
+	if !indicator.IsACK() || indicator.IsSYN() || indicator.IsFIN() || indicator.IsRST() {
+		return false
+	}
+
+	return len(indicator.Payload()) <= 1 && indicator.TCPLayer().Seq == client.ack-1
+}
+
+// KeepAlive sends keepalive probes to all clients of the connection, which keeps the connection alive in NATs and
+// firewalls between them when it is idle.
+func (c *FakeTCPConn) KeepAlive() error {
+	c.clientsLock.RLock()
+	addrs := make([]string, 0, len(c.clients))
+	for addr, client := range c.clients {
+		// Clients which have not answered handshakes are skipped
+		if client.phase != handshakeNone && client.phase != handshakeSYNSent {
+			addrs = append(addrs, addr)
+		}
+	}
+	c.clientsLock.RUnlock()
+
+	for _, addr := range addrs {
+		dst, err := net.ResolveTCPAddr("tcp4", addr)
+		if err != nil {
+			return fmt.Errorf("resolve %s: %w", addr, err)
+		}
+
+		c.clientsLock.RLock()
+		client, ok := c.clients[addr]
+		c.clientsLock.RUnlock()
+		if !ok {
+			continue
+		}
+
+		err = c.writeACK(client, dst, true)
+		if err != nil {
+			return fmt.Errorf("write keepalive: %w", err)
+		}
+
+		log.Verbosef("Send TCP keepalive: %s -> %s\n", c.LocalAddr().String(), dst.String())
+	}
+
+	return nil
+}
+
+// writeACK writes a pure ACK to the client, or a keepalive probe whose sequence number is 1 before the next one.
+func (c *FakeTCPConn) writeACK(client *clientIndicator, dst *net.TCPAddr, isProbe bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Send to the client directly if there is no gateway
+	hardwareAddr := client.hardwareAddr
+	if c.conn.RemoteDev() != nil {
+		hardwareAddr = c.conn.RemoteDev().HardwareAddr()
+	}
+
+	seq := client.seq
+	if isProbe {
+		seq--
+	}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(dst.Port), seq, client.ack, c.conn, dst.IP, c.id, 128, hardwareAddr)
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	// Make TCP layer ACK
+	FlagTCPLayer(transportLayer.(*layers.TCP), false, false, true)
+	applyFingerprint(transportLayer, networkLayer, client)
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, networkLayer, transportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	return nil
+}
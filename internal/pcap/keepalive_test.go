@@ -0,0 +1,87 @@
+package pcap
+
+import "testing"
+
+func TestIsKeepAlive(t *testing.T) {
+	tests := []struct {
+		name    string
+		seq     uint32
+		flags   string
+		payload []byte
+		want    bool
+	}{
+		{name: "probe", seq: 8999, flags: "A", want: true},
+		{name: "probe with garbage", seq: 8999, flags: "A", payload: []byte{0}, want: true},
+		{name: "data", seq: 9000, flags: "PA", payload: []byte{0}},
+		{name: "ack", seq: 9000, flags: "A"},
+		{name: "retransmitted data", seq: 8998, flags: "PA", payload: []byte{0, 0}},
+		{name: "overlapping data", seq: 8999, flags: "PA", payload: []byte{0, 0}},
+		{name: "fin", seq: 8999, flags: "FA"},
+		{name: "rst", seq: 8999, flags: "RA"},
+		{name: "no ack", seq: 8999, flags: "P", payload: []byte{0}},
+	}
+
+	client := newClientIndicator(nil)
+	client.ack = 9000
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			indicator, err := ParseEmbPacket(newSegment(t, testClientAddr, testServerAddr, tt.seq, 5000, tt.flags, tt.payload))
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+
+			if keepAlive := isKeepAlive(indicator, client); keepAlive != tt.want {
+				t.Errorf("keepalive = %t, want %t", keepAlive, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	conn, handle, client := newEstablishedConn(testServerAddr, testClientAddr, 5000, 9000, 0)
+
+	// A probe is answered by an ACK, and is not read as data
+	handle.feed(newSegment(t, testClientAddr, testServerAddr, 8999, 5000, "A", []byte{0}))
+	contents := readAll(t, conn, handle)
+	if len(contents) != 0 {
+		t.Errorf("read = %q, want nothing", contents)
+	}
+	ack := handle.written(t)
+	if len(ack) != 1 || ack[0].Seq != 5000 || ack[0].Ack != 9000 || len(ack[0].Payload) != 0 {
+		t.Fatalf("written = %v, want an ACK of 5000, 9000", ack)
+	}
+	if client.ack != 9000 {
+		t.Errorf("ack = %d, want 9000", client.ack)
+	}
+
+	// 1 Byte data segments are appended to the stream
+	frame := newFrame("a")
+	for i := range frame {
+		flags := "A"
+		if i == len(frame)-1 {
+			flags = "PA"
+		}
+		handle.feed(newSegment(t, testClientAddr, testServerAddr, 9000+uint32(i), 5000, flags, frame[i:i+1]))
+	}
+	contents = readAll(t, conn, handle)
+	if len(contents) != 1 || string(contents[0]) != "a" {
+		t.Errorf("read = %q, want %q", contents, "a")
+	}
+	if want := 9000 + uint32(len(frame)); client.ack != want {
+		t.Errorf("ack = %d, want %d", client.ack, want)
+	}
+	if n := len(handle.take()); n != 0 {
+		t.Errorf("written = %d segments, want 0", n)
+	}
+
+	// Probes sent are 1 before the next sequence number
+	err := conn.KeepAlive()
+	if err != nil {
+		t.Fatalf("keepalive: %v", err)
+	}
+	probe := handle.written(t)
+	if len(probe) != 1 || probe[0].Seq != 4999 || probe[0].Ack != client.ack {
+		t.Errorf("written = %v, want a probe of 4999, %d", probe, client.ack)
+	}
+}
@@ -74,7 +74,7 @@ func CreateIPv4Layer(srcIP, dstIP net.IP, id uint16, ttl uint8, transportLayer g
 			return nil, fmt.Errorf("set network layer for checksum: %w", err)
 		}
 	default:
-		return nil, fmt.Errorf("transport layer type %s not support", t)
+		return nil, fmt.Errorf("transport layer type %s %w", t, ErrUnsupportedProtocol)
 	}
 
 	return ipv4Layer, nil
@@ -104,7 +104,7 @@ func CreateLoopbackLayer(networkLayer gopacket.NetworkLayer) (*layers.Loopback,
 	case layers.LayerTypeIPv4:
 		loopbackLayer.Family = layers.ProtocolFamilyIPv4
 	default:
-		return nil, fmt.Errorf("network layer type %s not support", t)
+		return nil, fmt.Errorf("network layer type %s %w", t, ErrUnsupportedProtocol)
 	}
 
 	return loopbackLayer, nil
@@ -123,7 +123,7 @@ func CreateEthernetLayer(srcMAC, dstMAC net.HardwareAddr, networkLayer gopacket.
 	case layers.LayerTypeIPv4:
 		ethernetLayer.EthernetType = layers.EthernetTypeIPv4
 	default:
-		return nil, fmt.Errorf("network layer type %s not support", t)
+		return nil, fmt.Errorf("network layer type %s %w", t, ErrUnsupportedProtocol)
 	}
 
 	return ethernetLayer, nil
@@ -135,7 +135,7 @@ func Serialize(layers ...gopacket.SerializableLayer) ([]byte, error) {
 	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
 	buffer := gopacket.NewSerializeBuffer()
 
-	err := gopacket.SerializeLayers(buffer, options, layers...)
+	err := gopacket.SerializeLayers(buffer, options, skipNilLayers(layers)...)
 	if err != nil {
 		return nil, err
 	}
@@ -149,7 +149,7 @@ func SerializeRaw(layers ...gopacket.SerializableLayer) ([]byte, error) {
 	options := gopacket.SerializeOptions{}
 	buffer := gopacket.NewSerializeBuffer()
 
-	err := gopacket.SerializeLayers(buffer, options, layers...)
+	err := gopacket.SerializeLayers(buffer, options, skipNilLayers(layers)...)
 	if err != nil {
 		return nil, err
 	}
@@ -157,6 +157,18 @@ func SerializeRaw(layers ...gopacket.SerializableLayer) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// skipNilLayers removes nil layers, like the missing link layer in raw connections.
+func skipNilLayers(layers []gopacket.SerializableLayer) []gopacket.SerializableLayer {
+	result := make([]gopacket.SerializableLayer, 0, len(layers))
+	for _, layer := range layers {
+		if layer != nil {
+			result = append(result, layer)
+		}
+	}
+
+	return result
+}
+
 // CreateLayers return layers of transmission between client and server.
 func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP net.IP, id uint16, hop uint8,
 	dstHardwareAddr net.HardwareAddr) (transportLayer, networkLayer, linkLayer gopacket.SerializableLayer, err error) {
@@ -164,6 +176,11 @@ func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP
 		linkLayerType gopacket.LayerType
 	)
 
+	// The carrier must be in the same family of the device, which is always IPv4
+	if dstIP.To4() == nil {
+		return nil, nil, nil, fmt.Errorf("address family of %s %w", dstIP, ErrUnsupportedProtocol)
+	}
+
 	// Create transport layer
 	transportLayer = CreateTCPLayer(srcPort, dstPort, seq, ack)
 
@@ -172,6 +189,12 @@ func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("create network layer: %w", err)
 	}
+	scrubIPv4Id(networkLayer.(*layers.IPv4))
+
+	// Raw connections have no link layer
+	if conn.IsRaw() {
+		return transportLayer, networkLayer, nil, nil
+	}
 
 	// Decide Loopback or Ethernet
 	if conn.IsLoop() {
@@ -187,7 +210,7 @@ func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP
 	case layers.LayerTypeEthernet:
 		linkLayer, err = CreateEthernetLayer(conn.LocalDev().HardwareAddr(), dstHardwareAddr, networkLayer.(gopacket.NetworkLayer))
 	default:
-		return nil, nil, nil, fmt.Errorf("link layer type %s not support", linkLayerType)
+		return nil, nil, nil, fmt.Errorf("link layer type %s %w", linkLayerType, ErrUnsupportedProtocol)
 	}
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("create link layer: %w", err)
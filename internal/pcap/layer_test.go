@@ -0,0 +1,33 @@
+package pcap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+)
+
+// newTestPacket returns a packet of the transport layer with the payload from 10.0.0.1 to 10.0.0.2, which begins with an
+// Ethernet layer if isEthernet is set, or the IPv4 layer otherwise.
+func newTestPacket(tb testing.TB, transportLayer gopacket.TransportLayer, payload []byte, isEthernet bool) []byte {
+	networkLayer, err := CreateIPv4Layer(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 0, 64, transportLayer)
+	if err != nil {
+		tb.Fatalf("create network layer: %v", err)
+	}
+
+	ls := []gopacket.SerializableLayer{networkLayer, transportLayer.(gopacket.SerializableLayer), gopacket.Payload(payload)}
+	if isEthernet {
+		linkLayer, err := CreateEthernetLayer(make(net.HardwareAddr, 6), make(net.HardwareAddr, 6), networkLayer)
+		if err != nil {
+			tb.Fatalf("create link layer: %v", err)
+		}
+		ls = append([]gopacket.SerializableLayer{linkLayer}, ls...)
+	}
+
+	data, err := Serialize(ls...)
+	if err != nil {
+		tb.Fatalf("serialize: %v", err)
+	}
+
+	return data
+}
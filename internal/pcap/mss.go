@@ -0,0 +1,53 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/crypto"
+)
+
+// tcpipHeaderSize is the size of IPv4 and TCP headers without options.
+const tcpipHeaderSize = 40
+
+// MaxSegmentSize returns the maximum segment size of embedded TCP connections which guarantees an embedded packet fits
+// in a single FakeTCP segment of the given MTU. The fingerprint, the timestamps and the replay window should be set
+// before calling it.
+func MaxSegmentSize(mtu int, crypt crypto.Crypt) int {
+	size := mtu - tcpipHeaderSize - frameHeaderSize - crypt.Cost() - tcpipHeaderSize
+
+	// Sequence number of replay protection
+	if replayWindowSize > 0 {
+		size = size - replaySeqSize
+	}
+
+	// Timestamps option
+	if hasTimestamps() {
+		size = size - timestampsOptionSize
+	}
+
+	return size
+}
+
+// ClampMSS lowers the MSS option of a TCP SYN segment to the given size, and reports whether the segment is modified.
+func ClampMSS(layer *layers.TCP, mss uint16) bool {
+	if !layer.SYN {
+		return false
+	}
+
+	for i, option := range layer.Options {
+		if option.OptionType != layers.TCPOptionKindMSS || len(option.OptionData) != 2 {
+			continue
+		}
+		if binary.BigEndian.Uint16(option.OptionData) <= mss {
+			return false
+		}
+
+		data := make([]byte, 2)
+		binary.BigEndian.PutUint16(data, mss)
+		layer.Options[i].OptionData = data
+
+		return true
+	}
+
+	return false
+}
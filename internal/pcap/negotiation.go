@@ -0,0 +1,114 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket/layers"
+)
+
+// windowScale is the window scale announced by FakeTCP without a fingerprint.
+const windowScale = 7
+
+// MaxWindowScale is the max window scale of TCP.
+const MaxWindowScale = 14
+
+var carrierScale = -1
+
+// SetWindowScale sets the window scale announced by FakeTCP, which overrides the one of the fingerprint. A scale of -1
+// means the default one.
+func SetWindowScale(scale int) error {
+	if scale < -1 || scale > MaxWindowScale {
+		return fmt.Errorf("window scale %d out of range", scale)
+	}
+
+	carrierScale = scale
+
+	return nil
+}
+
+// announcedWindowScale returns the window scale announced by FakeTCP.
+func announcedWindowScale() uint8 {
+	if carrierScale >= 0 {
+		return uint8(carrierScale)
+	}
+	if fingerprint != nil {
+		return fingerprint.windowScale
+	}
+
+	return windowScale
+}
+
+// negotiate records options offered or echoed in a SYN or SYN+ACK segment from the peer.
+func (client *clientIndicator) negotiate(layer *layers.TCP) {
+	client.peerMSS = 0
+	client.isScaled = false
+	client.isSACK = false
+
+	for _, option := range layer.Options {
+		switch option.OptionType {
+		case layers.TCPOptionKindMSS:
+			if len(option.OptionData) == 2 {
+				client.peerMSS = binary.BigEndian.Uint16(option.OptionData)
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(option.OptionData) == 1 {
+				client.isScaled = true
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			client.isSACK = true
+		}
+	}
+}
+
+// segmentSize returns the maximum size of FakeTCP segments to the client in the given MTU, bounded by the MSS of the
+// peer.
+func (client *clientIndicator) segmentSize(mtu int) int {
+	if client.peerMSS > 0 && int(client.peerMSS)+tcpipHeaderSize < mtu {
+		return int(client.peerMSS) + tcpipHeaderSize
+	}
+
+	return mtu
+}
+
+// isOffered returns if an option should be carried in a SYN segment. A SYN offers all options, while a SYN+ACK only
+// echoes options offered by the peer.
+func isOffered(layer *layers.TCP, client *clientIndicator, kind layers.TCPOptionKind) bool {
+	if !layer.ACK {
+		return true
+	}
+
+	switch kind {
+	case layers.TCPOptionKindWindowScale:
+		return client.isScaled
+	case layers.TCPOptionKindSACKPermitted:
+		return client.isSACK
+	default:
+		return true
+	}
+}
+
+func createMSSOption(mss uint16) layers.TCPOption {
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, mss)
+
+	return layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: data}
+}
+
+func createWindowScaleOption(scale uint8) layers.TCPOption {
+	return layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{scale}}
+}
+
+// appendSYNOptions appends MSS, SACK permitted and window scale options to a SYN segment without a fingerprint.
+func appendSYNOptions(layer *layers.TCP, client *clientIndicator) {
+	if client.mss > 0 {
+		layer.Options = append(layer.Options, createMSSOption(client.mss))
+	}
+	if isOffered(layer, client, layers.TCPOptionKindSACKPermitted) {
+		layer.Options = append(layer.Options, layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2})
+	}
+	if isOffered(layer, client, layers.TCPOptionKindWindowScale) {
+		layer.Options = append(layer.Options,
+			layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+			createWindowScaleOption(announcedWindowScale()))
+	}
+}
@@ -0,0 +1,211 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// newSYN returns a SYN segment with options from the source to the destination.
+func newSYN(tb testing.TB, src, dst *net.TCPAddr, seq uint32, options []layers.TCPOption) []byte {
+	tcpLayer := CreateTCPLayer(uint16(src.Port), uint16(dst.Port), seq, 0)
+	FlagTCPLayer(tcpLayer, true, false, false)
+	tcpLayer.Options = options
+
+	networkLayer, err := CreateIPv4Layer(src.IP, dst.IP, 0, 64, tcpLayer)
+	if err != nil {
+		tb.Fatalf("create network layer: %v", err)
+	}
+
+	data, err := Serialize(networkLayer, tcpLayer)
+	if err != nil {
+		tb.Fatalf("serialize: %v", err)
+	}
+
+	return data
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []layers.TCPOption
+		peerMSS  uint16
+		isScaled bool
+		isSACK   bool
+	}{
+		{
+			name: "all options",
+			options: []layers.TCPOption{
+				createMSSOption(1200),
+				{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+				{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+				createWindowScaleOption(8),
+			},
+			peerMSS:  1200,
+			isScaled: true,
+			isSACK:   true,
+		},
+		{
+			name:    "mss only",
+			options: []layers.TCPOption{createMSSOption(1200)},
+			peerMSS: 1200,
+		},
+		{name: "no options"},
+	}
+
+	defer func(fp *tcpFingerprint, scale int) {
+		fingerprint, carrierScale = fp, scale
+	}(fingerprint, carrierScale)
+	fingerprint, carrierScale = nil, -1
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, handle := newTestConn(testServerAddr, testClientAddr)
+
+			handle.feed(newSYN(t, testClientAddr, testServerAddr, 1000, tt.options))
+			readAll(t, conn, handle)
+			synACK := handle.written(t)
+			if len(synACK) != 1 || !synACK[0].SYN || !synACK[0].ACK {
+				t.Fatalf("written = %v, want a SYN+ACK", synACK)
+			}
+
+			// The SYN+ACK announces the MSS of the server, and only echoes options offered by the client
+			var (
+				mss      uint16
+				isScaled bool
+				isSACK   bool
+			)
+			for _, option := range synACK[0].Options {
+				switch option.OptionType {
+				case layers.TCPOptionKindMSS:
+					mss = binary.BigEndian.Uint16(option.OptionData)
+				case layers.TCPOptionKindWindowScale:
+					isScaled = true
+					if option.OptionData[0] != windowScale {
+						t.Errorf("window scale = %d, want %d", option.OptionData[0], windowScale)
+					}
+				case layers.TCPOptionKindSACKPermitted:
+					isSACK = true
+				}
+			}
+			if want := uint16(conn.mtu - tcpipHeaderSize); mss != want {
+				t.Errorf("mss = %d, want %d", mss, want)
+			}
+			if isScaled != tt.isScaled || isSACK != tt.isSACK {
+				t.Errorf("window scale, sack = %t, %t, want %t, %t", isScaled, isSACK, tt.isScaled, tt.isSACK)
+			}
+
+			// Options negotiated are recorded for the client
+			client := conn.clients[testClientAddr.String()]
+			if client.peerMSS != tt.peerMSS || client.isScaled != tt.isScaled || client.isSACK != tt.isSACK {
+				t.Errorf("negotiated = %d, %t, %t, want %d, %t, %t", client.peerMSS, client.isScaled, client.isSACK, tt.peerMSS, tt.isScaled, tt.isSACK)
+			}
+
+			// Data segments to the client are bounded by the MSS of the client
+			handle.feed(newSegment(t, testClientAddr, testServerAddr, 1001, synACK[0].Seq+1, "A", nil))
+			readAll(t, conn, handle)
+			_, err := conn.WriteTo(make([]byte, 3000), testClientAddr)
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			maxSize := conn.mtu - tcpipHeaderSize
+			if tt.peerMSS > 0 {
+				maxSize = int(tt.peerMSS)
+			}
+			segments := decodeSegments(t, handle.take())
+			if len(segments) < 2 {
+				t.Fatalf("written = %d segments, want at least 2", len(segments))
+			}
+			for i, segment := range segments {
+				if len(segment.Payload) > maxSize {
+					t.Errorf("segment %d size = %d, want at most %d", i, len(segment.Payload), maxSize)
+				}
+			}
+		})
+	}
+}
+
+func TestSetWindowScale(t *testing.T) {
+	tests := []struct {
+		name        string
+		fingerprint string
+		scale       int
+		want        uint8
+	}{
+		{name: "default", fingerprint: FingerprintNone, scale: -1, want: windowScale},
+		{name: "set", fingerprint: FingerprintNone, scale: 10, want: 10},
+		{name: "fingerprint", fingerprint: FingerprintWindows, scale: -1, want: 8},
+		{name: "fingerprint set", fingerprint: FingerprintWindows, scale: 3, want: 3},
+		{name: "unscaled", fingerprint: FingerprintLinux, scale: 0, want: 0},
+	}
+
+	defer func(fp *tcpFingerprint, scale int) {
+		fingerprint, carrierScale = fp, scale
+	}(fingerprint, carrierScale)
+
+	for _, scale := range []int{-2, MaxWindowScale + 1} {
+		if err := SetWindowScale(scale); err == nil {
+			t.Errorf("set window scale %d: want error", scale)
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := SetFingerprint(tt.fingerprint)
+			if err != nil {
+				t.Fatalf("set fingerprint: %v", err)
+			}
+			err = SetWindowScale(tt.scale)
+			if err != nil {
+				t.Fatalf("set window scale: %v", err)
+			}
+
+			conn, handle := newTestConn(testServerAddr, testClientAddr)
+
+			handle.feed(newSYN(t, testClientAddr, testServerAddr, 1000, []layers.TCPOption{createWindowScaleOption(8)}))
+			readAll(t, conn, handle)
+			synACK := handle.written(t)
+			if len(synACK) != 1 || !synACK[0].SYN || !synACK[0].ACK {
+				t.Fatalf("written = %v, want a SYN+ACK", synACK)
+			}
+
+			// The SYN+ACK announces the window scale set, or the one of the fingerprint
+			scales := 0
+			for _, option := range synACK[0].Options {
+				if option.OptionType != layers.TCPOptionKindWindowScale {
+					continue
+				}
+				scales++
+				if option.OptionData[0] != tt.want {
+					t.Errorf("window scale = %d, want %d", option.OptionData[0], tt.want)
+				}
+			}
+			if scales != 1 {
+				t.Fatalf("window scale options = %d, want 1", scales)
+			}
+			if fingerprint == nil {
+				return
+			}
+
+			// The window of the fingerprint is scaled by the window scale after the handshake
+			if synACK[0].Window != fingerprint.window {
+				t.Errorf("handshake window = %d, want %d", synACK[0].Window, fingerprint.window)
+			}
+			handle.feed(newSegment(t, testClientAddr, testServerAddr, 1001, synACK[0].Seq+1, "A", nil))
+			readAll(t, conn, handle)
+			_, err = conn.WriteTo([]byte("data"), testClientAddr)
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			segments := decodeSegments(t, handle.take())
+			if len(segments) != 1 {
+				t.Fatalf("written = %d segments, want 1", len(segments))
+			}
+			if want := fingerprint.window >> tt.want; segments[0].Window != want {
+				t.Errorf("window = %d, want %d", segments[0].Window, want)
+			}
+		})
+	}
+}
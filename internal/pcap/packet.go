@@ -7,6 +7,14 @@
 	"github.com/google/gopacket/layers"
 	"github.com/zhxie/ikago/internal/addr"
 	"net"
+	"time"
+)
+
+const (
+	// ipv4OptionLSRR is the type of IPv4 loose source and record route option.
+	ipv4OptionLSRR = 131
+	// ipv4OptionSSRR is the type of IPv4 strict source and record route option.
+	ipv4OptionSSRR = 137
 )
 
 // ConnPacket describes a packet and its connection.
@@ -23,16 +31,39 @@ type ConnBytes struct {
 	Bytes []byte
 	// Conn is the connection of the bytes.
 	Conn net.Conn
+	// Time is the time the bytes are received.
+	Time time.Time
+	// Pool is the pool the bytes are from, which they are returned to after handled.
+	Pool *BufferPool
 }
 
-// NATGuide describes simplified information about a NAT.
+// NATGuide describes simplified information about a NAT. It is comparable without formatting addresses, so it can be
+// used as a key of maps in the hot path.
 type NATGuide struct {
-	// Src is the source in NAT.
-	Src string
+	// IP is the IPv4 address of the source in NAT.
+	IP [net.IPv4len]byte
+	// Value is the port, or the Id in ICMPv4, of the source in NAT.
+	Value uint16
 	// Protocol is the protocol in NAT.
 	Protocol gopacket.LayerType
 }
 
+// NewNATGuide returns a NAT guide of the IPv4 address, and the port or Id in the protocol.
+func NewNATGuide(ip net.IP, value uint16, protocol gopacket.LayerType) NATGuide {
+	guide := NATGuide{Value: value, Protocol: protocol}
+	copy(guide.IP[:], ip.To4())
+
+	return guide
+}
+
+func (guide NATGuide) String() string {
+	if guide.Protocol == layers.LayerTypeICMPv4 {
+		return addr.ICMPQueryAddr{IP: guide.IP[:], Id: guide.Value}.String()
+	}
+
+	return fmt.Sprintf("%s:%d", net.IP(guide.IP[:]), guide.Value)
+}
+
 // PacketIndicator indicates a packet.
 type PacketIndicator struct {
 	packet           gopacket.Packet
@@ -49,15 +80,20 @@ func (indicator *PacketIndicator) LinkLayer() gopacket.Layer {
 	return indicator.linkLayer
 }
 
-// LinkLayerType returns the type of the link layer.
+// LinkLayerType returns the type of the link layer. Raw packets have no link layer, and their link layer type is
+// gopacket.LayerTypeZero.
 func (indicator *PacketIndicator) LinkLayerType() gopacket.LayerType {
+	if indicator.linkLayer == nil {
+		return gopacket.LayerTypeZero
+	}
+
 	return indicator.linkLayer.LayerType()
 }
 
 // SrcHardwareAddr returns the source hardware address.
 func (indicator *PacketIndicator) SrcHardwareAddr() net.HardwareAddr {
 	switch t := indicator.LinkLayerType(); t {
-	case layers.LayerTypeLoopback:
+	case gopacket.LayerTypeZero, layers.LayerTypeLoopback:
 		return nil
 	case layers.LayerTypeEthernet:
 		return indicator.linkLayer.(*layers.Ethernet).SrcMAC
@@ -69,7 +105,7 @@ func (indicator *PacketIndicator) SrcHardwareAddr() net.HardwareAddr {
 // DstHardwareAddr returns the destination hardware address.
 func (indicator *PacketIndicator) DstHardwareAddr() net.HardwareAddr {
 	switch t := indicator.LinkLayerType(); t {
-	case layers.LayerTypeLoopback:
+	case gopacket.LayerTypeZero, layers.LayerTypeLoopback:
 		return nil
 	case layers.LayerTypeEthernet:
 		return indicator.linkLayer.(*layers.Ethernet).DstMAC
@@ -181,6 +217,42 @@ func (indicator *PacketIndicator) MoreFragments() bool {
 	}
 }
 
+// DontFragment returns if the packet must not be fragmented.
+func (indicator *PacketIndicator) DontFragment() bool {
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		return indicator.IPv4Layer().Flags&layers.IPv4DontFragment != 0
+	default:
+		panic(fmt.Errorf("network layer type %s not support", t))
+	}
+}
+
+// HasIPOptions returns if the packet carries IP options.
+func (indicator *PacketIndicator) HasIPOptions() bool {
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		return len(indicator.IPv4Layer().Options) > 0
+	default:
+		panic(fmt.Errorf("network layer type %s not support", t))
+	}
+}
+
+// HasSourceRoute returns if the packet carries loose or strict source and record route options.
+func (indicator *PacketIndicator) HasSourceRoute() bool {
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeIPv4:
+		for _, option := range indicator.IPv4Layer().Options {
+			if option.OptionType == ipv4OptionLSRR || option.OptionType == ipv4OptionSSRR {
+				return true
+			}
+		}
+
+		return false
+	default:
+		panic(fmt.Errorf("network layer type %s not support", t))
+	}
+}
+
 // TransportProtocol returns the protocol of the transport layer.
 func (indicator *PacketIndicator) TransportProtocol() gopacket.LayerType {
 	switch t := indicator.NetworkLayer().LayerType(); t {
@@ -232,7 +304,14 @@ func (indicator *PacketIndicator) SrcPort() uint16 {
 	case layers.LayerTypeUDP:
 		return uint16(indicator.UDPLayer().SrcPort)
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		handler := FindTransport(t)
+		if handler == nil {
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+
+		port, _ := handler.Ports(indicator.TransportLayer())
+
+		return port
 	}
 }
 
@@ -244,7 +323,14 @@ func (indicator *PacketIndicator) DstPort() uint16 {
 	case layers.LayerTypeUDP:
 		return uint16(indicator.UDPLayer().DstPort)
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		handler := FindTransport(t)
+		if handler == nil {
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+
+		_, port := handler.Ports(indicator.TransportLayer())
+
+		return port
 	}
 }
 
@@ -311,7 +397,15 @@ func (indicator *PacketIndicator) NATSrc() net.Addr {
 
 		return indicator.icmpv4Indicator.EmbSrc()
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		if FindTransport(t) == nil {
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+
+		return &addr.PortAddr{
+			Protocol: t.String(),
+			IP:       indicator.SrcIP(),
+			Port:     indicator.SrcPort(),
+		}
 	}
 }
 
@@ -338,7 +432,15 @@ func (indicator *PacketIndicator) NATDst() net.Addr {
 
 		return indicator.icmpv4Indicator.EmbDst()
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		if FindTransport(t) == nil {
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+
+		return &addr.PortAddr{
+			Protocol: t.String(),
+			IP:       indicator.DstIP(),
+			Port:     indicator.DstPort(),
+		}
 	}
 }
 
@@ -354,7 +456,11 @@ func (indicator *PacketIndicator) NATProtocol() gopacket.LayerType {
 
 		return indicator.icmpv4Indicator.EmbTransportLayer().LayerType()
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		if FindTransport(t) == nil {
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+
+		return t
 	}
 }
 
@@ -387,7 +493,15 @@ func (indicator *PacketIndicator) Src() net.Addr {
 
 		return &net.IPAddr{IP: indicator.SrcIP()}
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		if FindTransport(t) == nil {
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+
+		return &addr.PortAddr{
+			Protocol: t.String(),
+			IP:       indicator.SrcIP(),
+			Port:     indicator.SrcPort(),
+		}
 	}
 }
 
@@ -420,7 +534,15 @@ func (indicator *PacketIndicator) Dst() net.Addr {
 
 		return &net.IPAddr{IP: indicator.DstIP()}
 	default:
-		panic(fmt.Errorf("transport layer type %s not support", t))
+		if FindTransport(t) == nil {
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+
+		return &addr.PortAddr{
+			Protocol: t.String(),
+			IP:       indicator.DstIP(),
+			Port:     indicator.DstPort(),
+		}
 	}
 }
 
@@ -479,7 +601,7 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		// Guess ARP
 		networkLayer = packet.Layer(layers.LayerTypeARP)
 		if networkLayer == nil {
-			return nil, errors.New("missing network layer")
+			return nil, newParseError(parseReason(packet, ParseReasonUnsupportedNetwork), errors.New("missing network layer"))
 		}
 
 		return &PacketIndicator{
@@ -496,7 +618,7 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		if transportLayer == nil {
 			// Guess fragment
 			if packet.Layer(gopacket.LayerTypeFragment) == nil {
-				return nil, errors.New("missing transport layer")
+				return nil, newParseError(parseReason(packet, ParseReasonUnsupportedTransport), errors.New("missing transport layer"))
 			}
 		}
 	}
@@ -510,12 +632,18 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		case layers.LayerTypeEthernet:
 			ethernetLayer := linkLayer.(*layers.Ethernet)
 
-			_, err := parseEthernetType(ethernetLayer.EthernetType)
+			// Frames tagged with 802.1Q are parsed by the type in the tag
+			ethernetType := ethernetLayer.EthernetType
+			if dot1QLayer := packet.Layer(layers.LayerTypeDot1Q); ethernetType == layers.EthernetTypeDot1Q && dot1QLayer != nil {
+				ethernetType = dot1QLayer.(*layers.Dot1Q).Type
+			}
+
+			_, err := parseEthernetType(ethernetType)
 			if err != nil {
-				return nil, err
+				return nil, newParseError(ParseReasonUnsupportedNetwork, err)
 			}
 		default:
-			return nil, fmt.Errorf("link layer type %s not support", t)
+			return nil, newParseError(ParseReasonUnsupportedNetwork, fmt.Errorf("link layer type %s %w", t, ErrUnsupportedProtocol))
 		}
 	}
 
@@ -526,12 +654,20 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 
 		_, err := parseIPProtocol(ipv4Layer.Protocol)
 		if err != nil {
-			return nil, err
+			return nil, newParseError(ParseReasonUnsupportedTransport, err)
+		}
+
+		// Verify checksums
+		if isVerifyChecksums {
+			err := verifyChecksums(ipv4Layer, transportLayer)
+			if err != nil {
+				return nil, newParseError(ParseReasonChecksum, err)
+			}
 		}
 	case layers.LayerTypeARP:
 		break
 	default:
-		return nil, fmt.Errorf("network layer type %s not support", t)
+		return nil, newParseError(ParseReasonUnsupportedNetwork, fmt.Errorf("network layer type %s %w", t, ErrUnsupportedProtocol))
 	}
 
 	// Parse transport layer
@@ -543,10 +679,12 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 			var err error
 			icmpv4Indicator, err = ParseICMPv4Layer(transportLayer.(*layers.ICMPv4))
 			if err != nil {
-				return nil, fmt.Errorf("parse icmpv4 layer: %w", err)
+				return nil, newParseError(ParseReasonDecode, fmt.Errorf("parse icmpv4 layer: %w", err))
 			}
 		default:
-			return nil, fmt.Errorf("transport layer type %s not support", t)
+			if FindTransport(t) == nil {
+				return nil, newParseError(ParseReasonUnsupportedTransport, fmt.Errorf("transport layer type %s %w", t, ErrUnsupportedProtocol))
+			}
 		}
 	}
 
@@ -574,16 +712,16 @@ func ParseEmbPacket(contents []byte) (*PacketIndicator, error) {
 	packet := gopacket.NewPacket(contents, layers.LayerTypeIPv4, gopacket.NoCopy)
 	networkLayer := packet.NetworkLayer()
 	if networkLayer == nil {
-		return nil, errors.New("missing network layer")
+		return nil, newParseError(parseReason(packet, ParseReasonUnsupportedNetwork), errors.New("missing network layer"))
 	}
 	if networkLayer.LayerType() != layers.LayerTypeIPv4 {
-		return nil, errors.New("network layer type not support")
+		return nil, newParseError(ParseReasonUnsupportedNetwork, fmt.Errorf("network layer type %w", ErrUnsupportedProtocol))
 	}
 	switch networkLayer.(*layers.IPv4).Version {
 	case 4:
 		break
 	default:
-		return nil, errors.New("network layer type not support")
+		return nil, newParseError(ParseReasonUnsupportedNetwork, fmt.Errorf("network layer type %w", ErrUnsupportedProtocol))
 	}
 
 	// Parse packet
@@ -599,7 +737,7 @@ func ParseRawPacket(contents []byte) (gopacket.Packet, error) {
 	// Guess link layer type, and here we regard Ethernet layer as a link layer
 	packet := gopacket.NewPacket(contents, layers.LayerTypeEthernet, gopacket.NoCopy)
 	if len(packet.Layers()) < 0 {
-		return nil, errors.New("missing link layer")
+		return nil, newParseError(ParseReasonDecode, errors.New("missing link layer"))
 	}
 
 	linkLayer := packet.LinkLayer()
@@ -609,14 +747,14 @@ func ParseRawPacket(contents []byte) (gopacket.Packet, error) {
 
 		linkLayer := packet.Layer(layers.LayerTypeLoopback)
 		if linkLayer == nil {
-			return nil, errors.New("missing link layer")
+			return nil, newParseError(parseReason(packet, ParseReasonUnsupportedNetwork), errors.New("missing link layer"))
 		}
 
 		return packet, nil
 	}
 
 	if t := linkLayer.LayerType(); t != layers.LayerTypeEthernet {
-		return nil, fmt.Errorf("link layer type %s not support", t)
+		return nil, newParseError(ParseReasonUnsupportedNetwork, fmt.Errorf("link layer type %s %w", t, ErrUnsupportedProtocol))
 	}
 
 	return packet, nil
@@ -665,7 +803,12 @@ func parseIPProtocol(protocol layers.IPProtocol) (gopacket.LayerType, error) {
 	case layers.IPProtocolICMPv4:
 		return layers.LayerTypeICMPv4, nil
 	default:
-		return gopacket.LayerTypeZero, fmt.Errorf("ip protocol %s not support", protocol)
+		t, ok := transportTypes[protocol]
+		if !ok {
+			return gopacket.LayerTypeZero, fmt.Errorf("ip protocol %s %w", protocol, ErrUnsupportedProtocol)
+		}
+
+		return t, nil
 	}
 }
 
@@ -676,6 +819,6 @@ func parseEthernetType(t layers.EthernetType) (gopacket.LayerType, error) {
 	case layers.EthernetTypeARP:
 		return layers.LayerTypeARP, nil
 	default:
-		return gopacket.LayerTypeZero, fmt.Errorf("ethernet type %s not support", t)
+		return gopacket.LayerTypeZero, fmt.Errorf("ethernet type %s %w", t, ErrUnsupportedProtocol)
 	}
 }
@@ -0,0 +1,106 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// paddingLengthSize is the size of the length of the plaintext prefixed to each plaintext with padding.
+const paddingLengthSize = 2
+
+// MaxPadding is the maximum size of padding blocks and random padding.
+const MaxPadding = MaxEthernetMTU
+
+var (
+	isPadding    bool
+	paddingBlock int
+	paddingMin   int
+	paddingMax   int
+)
+
+// SetPadding sets the padding policy of FakeTCP connections, which pads plaintexts before encryption so that sizes of
+// packets do not reveal sizes of embedded packets. A policy in format `block:size` pads plaintexts up to the next
+// multiple of the size, and `random:min-max` pads plaintexts with a random size in the range. An empty policy disables
+// padding.
+func SetPadding(policy string) error {
+	if policy == "" {
+		isPadding = false
+		return nil
+	}
+
+	strs := strings.SplitN(policy, ":", 2)
+	if len(strs) != 2 {
+		return fmt.Errorf("padding %s not support", policy)
+	}
+
+	switch strs[0] {
+	case "block":
+		block, err := strconv.Atoi(strs[1])
+		if err != nil {
+			return fmt.Errorf("parse block: %w", err)
+		}
+		if block <= 0 || block > MaxPadding {
+			return fmt.Errorf("block %d out of range", block)
+		}
+
+		paddingBlock, paddingMin, paddingMax = block, 0, 0
+	case "random":
+		bounds := strings.SplitN(strs[1], "-", 2)
+		if len(bounds) != 2 {
+			return fmt.Errorf("range %s not support", strs[1])
+		}
+		from, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return fmt.Errorf("parse min: %w", err)
+		}
+		to, err := strconv.Atoi(bounds[1])
+		if err != nil {
+			return fmt.Errorf("parse max: %w", err)
+		}
+		if from < 0 || to < from || to > MaxPadding {
+			return fmt.Errorf("range %d-%d out of range", from, to)
+		}
+
+		paddingBlock, paddingMin, paddingMax = 0, from, to
+	default:
+		return fmt.Errorf("padding %s not support", strs[0])
+	}
+
+	isPadding = true
+
+	return nil
+}
+
+// sealPadding prefixes the length to the plaintext and pads it by the policy.
+func sealPadding(p []byte) []byte {
+	size := paddingLengthSize + len(p)
+	if paddingBlock > 0 {
+		size = (size + paddingBlock - 1) / paddingBlock * paddingBlock
+	} else {
+		size = size + paddingMin + rand.Intn(paddingMax-paddingMin+1)
+	}
+
+	data := make([]byte, size)
+	binary.BigEndian.PutUint16(data, uint16(len(p)))
+	copy(data[paddingLengthSize:], p)
+
+	return data
+}
+
+// openPadding returns the plaintext without the length prefixed and the padding.
+func openPadding(data []byte) ([]byte, error) {
+	if len(data) < paddingLengthSize {
+		return nil, errors.New("missing length")
+	}
+
+	length := int(binary.BigEndian.Uint16(data))
+	if paddingLengthSize+length > len(data) {
+		return nil, fmt.Errorf("length %d out of range", length)
+	}
+
+	return data[paddingLengthSize : paddingLengthSize+length], nil
+}
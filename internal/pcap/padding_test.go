@@ -0,0 +1,65 @@
+package pcap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPadding(t *testing.T) {
+	tests := []struct {
+		policy string
+		check  func(size, padded int) bool
+	}{
+		{policy: "block:64", check: func(size, padded int) bool {
+			return padded%64 == 0 && padded-size < 64
+		}},
+		{policy: "block:1", check: func(size, padded int) bool {
+			return padded == size
+		}},
+		{policy: "random:16-32", check: func(size, padded int) bool {
+			return padded-size >= 16 && padded-size <= 32
+		}},
+		{policy: "random:0-0", check: func(size, padded int) bool {
+			return padded == size
+		}},
+	}
+
+	defer func(padding bool, block, min, max int) {
+		isPadding, paddingBlock, paddingMin, paddingMax = padding, block, min, max
+	}(isPadding, paddingBlock, paddingMin, paddingMax)
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			err := SetPadding(tt.policy)
+			if err != nil {
+				t.Fatalf("set padding: %v", err)
+			}
+
+			// Plaintexts are padded by the policy, and opened as is
+			for _, n := range []int{0, 1, 62, 63, 64, 1000} {
+				p := bytes.Repeat([]byte{0xa5}, n)
+
+				data := sealPadding(p)
+				if !tt.check(paddingLengthSize+n, len(data)) {
+					t.Errorf("size %d padded = %d", n, len(data))
+				}
+
+				result, err := openPadding(data)
+				if err != nil {
+					t.Fatalf("open %d: %v", n, err)
+				}
+				if !bytes.Equal(result, p) {
+					t.Errorf("open %d = %d bytes, want %d", n, len(result), n)
+				}
+			}
+		})
+	}
+
+	// Invalid paddings are not opened
+	for _, data := range [][]byte{nil, {0}, {0, 3, 0, 0}} {
+		_, err := openPadding(data)
+		if err == nil {
+			t.Errorf("open %v: want error", data)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/log"
+	"net"
+	"sync/atomic"
+)
+
+var (
+	isRSTProbes bool
+	probes      uint64
+)
+
+// SetRSTProbes sets whether listeners reset probes, which are clients completing handshakes but not speaking the
+// carrier, like port scanners. Probes are always forgotten, the reset only tells them to go away.
+func SetRSTProbes(enabled bool) {
+	isRSTProbes = enabled
+}
+
+// Probes returns the count of probes rejected by listeners.
+func Probes() uint64 {
+	return atomic.LoadUint64(&probes)
+}
+
+// isCarrier reports whether the contents of the first frame of a client can be carried, which must be a hello, a batch
+// or an embedded IPv4 packet.
+func isCarrier(contents []byte) bool {
+	if IsHello(contents) || IsBatch(contents) {
+		return true
+	}
+
+	return len(contents) >= 20 && contents[0]>>4 == 4 && contents[0]&0x0f >= 5
+}
+
+// rejectProbe forgets a client whose first frame cannot be carried, and resets it if required.
+func (c *FakeTCPConn) rejectProbe(client *clientIndicator, dst *net.TCPAddr, err error) (int, net.Addr, error) {
+	atomic.AddUint64(&probes, 1)
+	log.Verbosef("Reject probe %s: %s\n", dst, err)
+
+	if isRSTProbes {
+		err := c.writeRST(client, dst)
+		if err != nil {
+			log.Errorln(fmt.Errorf("reset probe %s: %w", dst, err))
+		}
+	}
+
+	return c.forget(dst)
+}
+
+// writeRST resets the connection of the client.
+func (c *FakeTCPConn) writeRST(client *clientIndicator, dst *net.TCPAddr) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Send to the client directly if there is no gateway
+	hardwareAddr := client.hardwareAddr
+	if c.conn.RemoteDev() != nil {
+		hardwareAddr = c.conn.RemoteDev().HardwareAddr()
+	}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(dst.Port), client.seq, client.ack, c.conn, dst.IP, c.id, 128, hardwareAddr)
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	// Make TCP layer RST+ACK
+	FlagTCPLayer(transportLayer.(*layers.TCP), false, false, true)
+	transportLayer.(*layers.TCP).RST = true
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, networkLayer, transportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	return nil
+}
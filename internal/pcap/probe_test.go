@@ -0,0 +1,65 @@
+package pcap
+
+import "testing"
+
+func TestRejectProbe(t *testing.T) {
+	carried := newTestPacket(t, CreateUDPLayer(49152, 10000), []byte("request"), false)
+
+	tests := []struct {
+		name        string
+		payload     []byte
+		isRSTProbes bool
+		isProbe     bool
+	}{
+		{name: "junk", payload: []byte("GET / HTTP/1.1\r\n\r\n"), isProbe: true},
+		{name: "junk with rst", payload: []byte("GET / HTTP/1.1\r\n\r\n"), isRSTProbes: true, isProbe: true},
+		{name: "not carrier", payload: newFrame("hello, world"), isRSTProbes: true, isProbe: true},
+		{name: "carrier", payload: newFrame(string(carried)), isRSTProbes: true},
+	}
+
+	defer SetRSTProbes(isRSTProbes)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetRSTProbes(tt.isRSTProbes)
+
+			// The listening connection serves any client
+			conn, handle := newTestConn(testServerAddr, nil)
+
+			handle.feed(newSegment(t, testClientAddr, testServerAddr, 1000, 0, "S", nil))
+			readAll(t, conn, handle)
+			synACK := handle.written(t)
+			if len(synACK) != 1 || !synACK[0].SYN || !synACK[0].ACK {
+				t.Fatalf("written = %v, want a SYN+ACK", synACK)
+			}
+
+			before := Probes()
+			handle.feed(newSegment(t, testClientAddr, testServerAddr, 1001, synACK[0].Seq+1, "PA", tt.payload))
+			contents := readAll(t, conn, handle)
+			written := handle.written(t)
+
+			_, isKept := conn.clients[testClientAddr.String()]
+			if !tt.isProbe {
+				if len(contents) != 1 || !isKept || Probes() != before {
+					t.Errorf("read = %d frames, kept %t, probes %d, want 1 frame from a kept client", len(contents), isKept, Probes()-before)
+				}
+				return
+			}
+
+			// Probes are not read, counted and forgotten, and reset if required
+			if len(contents) != 0 {
+				t.Errorf("read = %q, want nothing", contents)
+			}
+			if n := Probes() - before; n != 1 {
+				t.Errorf("probes = %d, want 1", n)
+			}
+			if isKept {
+				t.Error("probe is not forgotten")
+			}
+			isRST := len(written) == 1 && written[0].RST
+			if isRST != tt.isRSTProbes || len(written) > 1 {
+				t.Errorf("written = %v, want reset %t", written, tt.isRSTProbes)
+			}
+		})
+	}
+}
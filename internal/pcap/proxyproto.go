@@ -0,0 +1,40 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// proxyProtocolSignature is the signature of PROXY protocol v2.
+var proxyProtocolSignature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+const (
+	// proxyProtocolVersionCommand is version 2 with command PROXY.
+	proxyProtocolVersionCommand = 0x21
+	// proxyProtocolTCPv4 is address family AF_INET with transport protocol STREAM.
+	proxyProtocolTCPv4 = 0x11
+)
+
+// CreateProxyProtocolHeader returns a PROXY protocol v2 header conveying the given source and destination.
+func CreateProxyProtocolHeader(src, dst *net.TCPAddr) ([]byte, error) {
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if srcIP == nil || dstIP == nil {
+		return nil, fmt.Errorf("address family of %s -> %s %w", src, dst, ErrUnsupportedProtocol)
+	}
+
+	header := make([]byte, len(proxyProtocolSignature)+4+12)
+	n := copy(header, proxyProtocolSignature)
+	header[n] = proxyProtocolVersionCommand
+	header[n+1] = proxyProtocolTCPv4
+	binary.BigEndian.PutUint16(header[n+2:], 12)
+
+	// Addresses
+	n = n + 4
+	copy(header[n:], srcIP)
+	copy(header[n+4:], dstIP)
+	binary.BigEndian.PutUint16(header[n+8:], uint16(src.Port))
+	binary.BigEndian.PutUint16(header[n+10:], uint16(dst.Port))
+
+	return header, nil
+}
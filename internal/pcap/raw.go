@@ -1,7 +1,11 @@
 package pcap
 
 import (
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 )
 
@@ -27,16 +31,33 @@ func (err *timeoutError) Timeout() bool {
 // maxSnapLen is the max size of each packet in pcap raw conn.
 const maxSnapLen = 65535
 
+// Handle is a handle reading and writing packets of a device, which is implemented by pcap handles.
+type Handle interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	WritePacketData(data []byte) error
+	LinkType() layers.LinkType
+	Close()
+}
+
 // RawConn is a raw network connection.
 type RawConn struct {
 	srcDev *Device
 	dstDev *Device
-	handle *pcap.Handle
-	buffer []byte
+	handle Handle
+	writer packetWriter
+	vlan   uint16
+}
+
+var isLazyDecode bool
+
+// SetLazyDecode sets whether packets read from raw connections are decoded lazily, which only decodes layers when they
+// are accessed and saves allocations of layers never used.
+func SetLazyDecode(enabled bool) {
+	isLazyDecode = enabled
 }
 
 func newRawConn() *RawConn {
-	return &RawConn{buffer: make([]byte, maxSnapLen)}
+	return &RawConn{}
 }
 
 func createPureRawConn(dev, filter string) (*RawConn, error) {
@@ -47,12 +68,24 @@ func createPureRawConn(dev, filter string) (*RawConn, error) {
 
 	err = handle.SetBPFFilter(filter)
 	if err != nil {
+		handle.Close()
 		return nil, err
 	}
 
 	conn := newRawConn()
 	conn.handle = handle
 
+	// Egress
+	if egress == EgressAFPacket {
+		writer, err := openAFPacketWriter(dev)
+		if err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("open egress: %w", err)
+		}
+
+		conn.writer = writer
+	}
+
 	return conn, nil
 }
 
@@ -69,6 +102,46 @@ func CreateRawConn(srcDev, dstDev *Device, filter string) (*RawConn, error) {
 	return conn, nil
 }
 
+// CreateRawConnWithHandle creates a raw connection between devices which reads and writes packets through the handle,
+// like a handle of a capture file.
+func CreateRawConnWithHandle(srcDev, dstDev *Device, handle Handle) *RawConn {
+	conn := newRawConn()
+	conn.srcDev = srcDev
+	conn.dstDev = dstDev
+	conn.handle = handle
+
+	return conn
+}
+
+// CreateSplitRawConn creates a raw connection between devices with BPF filter, which writes packets through a separate
+// write-only handle and reads only packets received by the source device, so that packets written will never be read
+// back and reading and writing will not contend for the same handle.
+func CreateSplitRawConn(srcDev, dstDev *Device, filter string) (*RawConn, error) {
+	conn, err := CreateRawConn(srcDev, dstDev, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.handle.(*pcap.Handle).SetDirection(pcap.DirectionIn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("set direction: %w", err)
+	}
+
+	// Writers of other backends are separate already
+	if conn.writer == nil {
+		writer, err := openPcapWriter(srcDev.Name())
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("open writer: %w", err)
+		}
+
+		conn.writer = writer
+	}
+
+	return conn, nil
+}
+
 func (c *RawConn) Read(b []byte) (n int, err error) {
 	d, _, err := c.handle.ZeroCopyReadPacketData()
 	if err != nil {
@@ -82,23 +155,56 @@ func (c *RawConn) Read(b []byte) (n int, err error) {
 
 // ReadPacket reads packet from the connection.
 func (c *RawConn) ReadPacket() (gopacket.Packet, error) {
-	n, err := c.Read(c.buffer)
+	d, ci, err := c.handle.ZeroCopyReadPacketData()
 	if err != nil {
 		return nil, err
 	}
 
-	b := make([]byte, n)
-	copy(b, c.buffer[:n])
+	// Packets in raw connections begin with IPv4 headers
+	var decoder gopacket.Decoder = c.handle.LinkType()
+	if c.IsRaw() {
+		decoder = layers.LayerTypeIPv4
+	}
 
-	packet := gopacket.NewPacket(b, c.handle.LinkType(), gopacket.NoCopy)
+	packet := decodePacket(d, decoder)
+	packet.Metadata().CaptureInfo = ci
 
 	return packet, nil
 }
 
+// decodePacket decodes data read with zero copy as a packet.
+func decodePacket(d []byte, decoder gopacket.Decoder) gopacket.Packet {
+	// Data read with zero copy is only valid until the next read, so it is copied once for the packet
+	b := make([]byte, len(d))
+	copy(b, d)
+
+	options := gopacket.NoCopy
+	if isLazyDecode {
+		options = gopacket.DecodeOptions{Lazy: true, NoCopy: true}
+	}
+
+	return gopacket.NewPacket(b, decoder, options)
+}
+
 func (c *RawConn) Write(b []byte) (n int, err error) {
-	err = c.handle.WritePacketData(b)
+	data := b
+
+	// 802.1Q tag is inserted after the destination and source MAC addresses
+	if c.vlan != 0 && len(b) >= 14 {
+		data = make([]byte, len(b)+4)
+		copy(data, b[:12])
+		binary.BigEndian.PutUint16(data[12:], uint16(layers.EthernetTypeDot1Q))
+		binary.BigEndian.PutUint16(data[14:], c.vlan)
+		copy(data[16:], b[12:])
+	}
+
+	if c.writer != nil {
+		err = c.writer.WritePacketData(data)
+	} else {
+		err = c.handle.WritePacketData(data)
+	}
 	if err != nil {
-		return 0, err
+		return 0, &WriteError{Err: err}
 	}
 
 	return len(b), nil
@@ -106,6 +212,24 @@ func (c *RawConn) Write(b []byte) (n int, err error) {
 
 func (c *RawConn) Close() error {
 	c.handle.Close()
+	if c.writer != nil {
+		c.writer.Close()
+	}
+
+	return nil
+}
+
+// SetVLAN sets the VLAN ID of frames written to the connection, which tags them with 802.1Q. An ID of 0 means
+// untagged.
+func (c *RawConn) SetVLAN(id uint16) error {
+	if id > 4094 {
+		return fmt.Errorf("vlan id %d out of range", id)
+	}
+	if id != 0 && (c.IsRaw() || c.IsLoop()) {
+		return errors.New("vlan without ethernet")
+	}
+
+	c.vlan = id
 
 	return nil
 }
@@ -120,11 +244,23 @@ func (c *RawConn) RemoteDev() *Device {
 	return c.dstDev
 }
 
-// IsLoop returns if the connection is to a loopback device.
+// IsLoop returns if the connection is to a loopback device. If the connection has no remote device, the local device
+// will be tested instead.
 func (c *RawConn) IsLoop() bool {
+	if c.dstDev == nil {
+		return c.srcDev.IsLoop()
+	}
+
 	return c.dstDev.IsLoop()
 }
 
+// IsRaw returns if the connection reads and writes raw IP packets without link layers, like in a tun device.
+func (c *RawConn) IsRaw() bool {
+	t := c.handle.LinkType()
+
+	return t == layers.LinkTypeRaw || t == layers.LinkTypeIPv4
+}
+
 // Reader is a reader reads packets from a pcap file.
 type Reader struct {
 	handle *pcap.Handle
@@ -0,0 +1,128 @@
+package pcap
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// BenchmarkDecodePacket compares the rate of reading and parsing packets like a packet source, which copies data read
+// and decodes it eagerly, with decoding data read with zero copy eagerly and lazily.
+func BenchmarkDecodePacket(b *testing.B) {
+	transportLayer := CreateTCPLayer(443, 49152, 1, 1)
+	FlagTCPLayer(transportLayer, false, true, true)
+	data := newTestPacket(b, transportLayer, make([]byte, 1024), true)
+
+	// ReadPacketData copies data read, and so does decoding with default options
+	source := func(d []byte, decoder gopacket.Decoder) gopacket.Packet {
+		contents := make([]byte, len(d))
+		copy(contents, d)
+
+		return gopacket.NewPacket(contents, decoder, gopacket.Default)
+	}
+
+	tests := []struct {
+		name   string
+		decode func(d []byte, decoder gopacket.Decoder) gopacket.Packet
+		isLazy bool
+	}{
+		{name: "source", decode: source},
+		{name: "eager", decode: decodePacket},
+		{name: "lazy", decode: decodePacket, isLazy: true},
+	}
+
+	defer func(isLazy bool) {
+		isLazyDecode = isLazy
+	}(isLazyDecode)
+
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			isLazyDecode = tt.isLazy
+
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				_, err := ParsePacket(tt.decode(data, layers.LayerTypeEthernet))
+				if err != nil {
+					b.Fatalf("parse: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSetVLAN(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         uint16
+		isEthernet bool
+		fail       bool
+	}{
+		{name: "untagged", id: 0, isEthernet: true},
+		{name: "tagged", id: 100, isEthernet: true},
+		{name: "max", id: 4094, isEthernet: true},
+		{name: "out of range", id: 4095, isEthernet: true, fail: true},
+		{name: "raw", id: 100, fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handle := &testHandle{isEthernet: tt.isEthernet}
+			dev := NewDevice("test0", "test0", nil, make(net.HardwareAddr, 6), false)
+			conn := CreateRawConnWithHandle(dev, dev, handle)
+
+			err := conn.SetVLAN(tt.id)
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("set vlan %d: want error", tt.id)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("set vlan %d: %v", tt.id, err)
+			}
+
+			data := newTestPacket(t, CreateUDPLayer(49152, 10000), []byte("datagram"), true)
+			_, err = conn.Write(data)
+			if err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			writes := handle.take()
+			if len(writes) != 1 {
+				t.Fatalf("written = %d, want 1", len(writes))
+			}
+
+			packet := gopacket.NewPacket(writes[0], layers.LayerTypeEthernet, gopacket.Default)
+			dot1QLayer, ok := packet.Layer(layers.LayerTypeDot1Q).(*layers.Dot1Q)
+			if tt.id == 0 {
+				if ok || !bytes.Equal(writes[0], data) {
+					t.Errorf("written = %v, want the frame as is", packet)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("missing 802.1Q tag: %v", packet)
+			}
+			if dot1QLayer.VLANIdentifier != tt.id || dot1QLayer.Type != layers.EthernetTypeIPv4 {
+				t.Errorf("tag = %d %s, want %d %s", dot1QLayer.VLANIdentifier, dot1QLayer.Type, tt.id, layers.EthernetTypeIPv4)
+			}
+			if len(writes[0]) != len(data)+4 || !bytes.Equal(writes[0][18:], data[14:]) {
+				t.Errorf("tagged frame = %x, want %x with a tag", writes[0], data)
+			}
+
+			// The network layer is not modified by the tag
+			indicator, err := ParsePacket(packet)
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if !bytes.Equal(indicator.Payload(), []byte("datagram")) {
+				t.Errorf("payload = %q, want %q", indicator.Payload(), "datagram")
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// replaySeqSize is the size of the sequence number prefixed to each plaintext with replay protection.
+const replaySeqSize = 8
+
+// MaxReplayWindow is the maximum size of the replay protection window.
+const MaxReplayWindow = 65536
+
+var (
+	replayWindowSize int
+	replays          uint64
+)
+
+// SetReplayWindow sets the size of the replay protection window of FakeTCP connections created later. A size of 0
+// disables replay protection, and the size will be rounded up to a multiple of 64.
+func SetReplayWindow(size int) error {
+	if size < 0 || size > MaxReplayWindow {
+		return fmt.Errorf("replay window %d out of range", size)
+	}
+
+	replayWindowSize = (size + 63) / 64 * 64
+
+	return nil
+}
+
+// Replays returns the count of packets rejected by replay protection.
+func Replays() uint64 {
+	return atomic.LoadUint64(&replays)
+}
+
+// replayWindow is a sliding window recording received sequence numbers to reject duplicate or too old ones.
+type replayWindow struct {
+	max    uint64
+	bitmap []uint64
+}
+
+func newReplayWindow(size int) *replayWindow {
+	return &replayWindow{bitmap: make([]uint64, size/64)}
+}
+
+func (w *replayWindow) size() uint64 {
+	return uint64(len(w.bitmap)) * 64
+}
+
+// check reports whether a sequence number is acceptable and records it.
+func (w *replayWindow) check(seq uint64) bool {
+	// Sequence numbers start from 1
+	if seq == 0 {
+		return false
+	}
+
+	// Too old
+	if seq+w.size() <= w.max {
+		return false
+	}
+
+	// Slide window
+	if seq > w.max {
+		diff := seq - w.max
+		if diff >= w.size() {
+			for i := range w.bitmap {
+				w.bitmap[i] = 0
+			}
+		} else {
+			for s := w.max + 1; s <= seq; s++ {
+				w.clear(s)
+			}
+		}
+		w.max = seq
+		w.set(seq)
+
+		return true
+	}
+
+	// Duplicate
+	if w.isSet(seq) {
+		return false
+	}
+	w.set(seq)
+
+	return true
+}
+
+func (w *replayWindow) reset() {
+	w.max = 0
+	for i := range w.bitmap {
+		w.bitmap[i] = 0
+	}
+}
+
+func (w *replayWindow) index(seq uint64) (int, uint64) {
+	bit := seq % w.size()
+	return int(bit / 64), 1 << (bit % 64)
+}
+
+func (w *replayWindow) set(seq uint64) {
+	i, mask := w.index(seq)
+	w.bitmap[i] |= mask
+}
+
+func (w *replayWindow) clear(seq uint64) {
+	i, mask := w.index(seq)
+	w.bitmap[i] &^= mask
+}
+
+func (w *replayWindow) isSet(seq uint64) bool {
+	i, mask := w.index(seq)
+	return w.bitmap[i]&mask != 0
+}
+
+// sealReplay prefixes a sequence number to the plaintext.
+func sealReplay(seq uint64, p []byte) []byte {
+	data := make([]byte, replaySeqSize+len(p))
+	binary.BigEndian.PutUint64(data, seq)
+	copy(data[replaySeqSize:], p)
+
+	return data
+}
+
+// openReplay verifies the sequence number prefixed to the plaintext by the window and returns the plaintext without it.
+func openReplay(w *replayWindow, data []byte) ([]byte, error) {
+	if len(data) < replaySeqSize {
+		return nil, errors.New("missing sequence number")
+	}
+
+	seq := binary.BigEndian.Uint64(data)
+	if !w.check(seq) {
+		atomic.AddUint64(&replays, 1)
+		return nil, fmt.Errorf("replayed sequence number %d", seq)
+	}
+
+	return data[replaySeqSize:], nil
+}
@@ -0,0 +1,66 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/crypto"
+	"github.com/zhxie/ikago/internal/log"
+	"net"
+)
+
+// resumeFilter is the BPF filter of TCP segments with payload but without SYN, FIN or RST, which resume connections
+// established before listeners are created.
+const resumeFilter = "(tcp[tcpflags] & (tcp-syn|tcp-fin|tcp-rst|tcp-ack) = tcp-ack && ip[2:2] - ((ip[0] & 0xf) << 2) - ((tcp[12] & 0xf0) >> 2) > 0)"
+
+var isResume bool
+
+// SetResume sets whether listeners created later resume connections of clients which are established but unknown, like
+// ones established before the server restarts, instead of requiring fresh handshakes.
+func SetResume(enabled bool) {
+	isResume = enabled
+}
+
+// resumeClient returns a client inferred from a segment with payload of an established connection. The stream is
+// joined halfway, so the client is resynchronized to the first frame after a pushed segment.
+func resumeClient(indicator *PacketIndicator, crypt crypto.Crypt, mtu int) *clientIndicator {
+	client := newClientIndicator(crypt)
+	client.seq = indicator.TCPLayer().Ack
+	client.ack = indicator.TCPLayer().Seq + uint32(len(indicator.Payload()))
+	client.phase = handshakeEstablished
+	client.mss = uint16(mtu - tcpipHeaderSize)
+	client.isResyncing = !indicator.TCPLayer().PSH
+	if ts, ok := timestampsValue(indicator.TCPLayer()); ok {
+		client.tsecr = ts
+	}
+	if indicator.LinkLayer() != nil {
+		client.hardwareAddr = indicator.SrcHardwareAddr()
+	}
+
+	return client
+}
+
+func (l *FakeTCPListener) acceptResume(indicator *PacketIndicator) (net.Conn, error) {
+	if !allowHandshake() {
+		log.Verbosef("Drop TCP segment for handshake rate: %s -> %s\n", indicator.Src().String(), indicator.Dst().String())
+		return nil, nil
+	}
+
+	conn, err := l.dial(l.Dev(), l.conn.RemoteDev(), l.srcPort, indicator.Src().(*net.TCPAddr), l.crypt, l.mtu)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: l.Addr(),
+			Addr:   indicator.Src(),
+			Err:    fmt.Errorf("resume: %w", err),
+		}
+	}
+
+	conn.clients[indicator.Src().String()] = resumeClient(indicator, l.crypt, l.mtu)
+
+	// Map client
+	l.admit(indicator.Src().String(), conn)
+
+	log.Infof("Resume TCP connection: %s -> %s\n", indicator.Src().String(), indicator.Dst().String())
+
+	return conn, nil
+}
@@ -1,6 +1,7 @@
 package pcap
 
 import (
+	"github.com/zhxie/ikago/internal/clock"
 	"github.com/zhxie/ikago/internal/log"
 	"time"
 )
@@ -15,7 +16,7 @@ type Desticker struct {
 
 // NewDesticker returns a new desticker.
 func NewDesticker() *Desticker {
-	return &Desticker{data: make([]byte, 0), appear: time.Now()}
+	return &Desticker{data: make([]byte, 0), appear: clock.Now()}
 }
 
 // Append adds a sticky data to the Desticker. This is a copy method.
@@ -23,7 +24,7 @@ func (d *Desticker) Append(data []byte) ([][]byte, error) {
 	packets := make([][]byte, 0)
 
 	// Discard old data
-	if d.deadline > 0 && time.Now().Sub(d.appear) > d.deadline {
+	if d.deadline > 0 && clock.Now().Sub(d.appear) > d.deadline {
 		log.Verboseln("Discard previous data")
 
 		d.data = make([]byte, 0)
@@ -47,6 +48,20 @@ func (d *Desticker) Append(data []byte) ([][]byte, error) {
 			} else {
 				break
 			}
+		} else if IsHello(d.data) {
+			// Hello message
+			size, ok := helloSize(d.data)
+			if !ok || len(d.data) < size {
+				break
+			}
+
+			packets = append(packets, d.data[:size])
+
+			if len(d.data) > size {
+				d.data = d.data[size:]
+			} else {
+				d.data = make([]byte, 0)
+			}
 		} else {
 			// Parse embedded packet
 			indicator, err := ParseEmbPacket(d.data)
@@ -61,7 +76,7 @@ func (d *Desticker) Append(data []byte) ([][]byte, error) {
 	}
 
 	if len(packets) > 0 {
-		d.appear = time.Now()
+		d.appear = clock.Now()
 	}
 
 	return packets, nil
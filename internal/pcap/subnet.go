@@ -0,0 +1,38 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/zhxie/ikago/internal/addr"
+	"net"
+)
+
+var clientSubnets []*net.IPNet
+
+// SetClientSubnets restricts listeners created later to accept clients in the given subnets only. Clients will not be
+// restricted if no subnet is given.
+func SetClientSubnets(subnets []*net.IPNet) {
+	clientSubnets = subnets
+}
+
+// clientFilter extends a BPF filter of listening with a constraint of client subnets.
+func clientFilter(filter string) string {
+	if len(clientSubnets) <= 0 {
+		return filter
+	}
+
+	return fmt.Sprintf("%s && %s", filter, addr.SrcNetBPFFilter(clientSubnets))
+}
+
+func isClientAllowed(ip net.IP) bool {
+	if len(clientSubnets) <= 0 {
+		return true
+	}
+
+	for _, subnet := range clientSubnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,75 @@
+package pcap
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientFilter(t *testing.T) {
+	const filter = "tcp && dst port 443"
+
+	tests := []struct {
+		name    string
+		subnets []string
+		want    string
+	}{
+		{name: "unrestricted", want: filter},
+		{name: "ipv4", subnets: []string{"192.168.1.0/24"}, want: filter + " && (src net 192.168.1.0/24)"},
+		{
+			name:    "multiple ipv4",
+			subnets: []string{"192.168.1.0/24", "10.0.0.0/8"},
+			want:    filter + " && (src net 192.168.1.0/24 || src net 10.0.0.0/8)",
+		},
+		{name: "ipv6", subnets: []string{"2001:db8::/32"}, want: filter + " && (src net 2001:db8::/32)"},
+		{
+			name:    "ipv4 and ipv6",
+			subnets: []string{"192.168.1.0/24", "2001:db8::/32", "172.16.0.1/12"},
+			want:    filter + " && (src net 192.168.1.0/24 || src net 2001:db8::/32 || src net 172.16.0.0/12)",
+		},
+	}
+
+	defer SetClientSubnets(clientSubnets)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var subnets []*net.IPNet
+			for _, s := range tt.subnets {
+				_, subnet, err := net.ParseCIDR(s)
+				if err != nil {
+					t.Fatalf("parse %s: %v", s, err)
+				}
+				subnets = append(subnets, subnet)
+			}
+			SetClientSubnets(subnets)
+
+			if f := clientFilter(filter); f != tt.want {
+				t.Errorf("filter = %q, want %q", f, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsClientAllowed(t *testing.T) {
+	defer SetClientSubnets(clientSubnets)
+
+	_, v4, _ := net.ParseCIDR("192.168.1.0/24")
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+	SetClientSubnets([]*net.IPNet{v4, v6})
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "192.168.1.1", want: true},
+		{ip: "192.168.1.255", want: true},
+		{ip: "192.168.2.1", want: false},
+		{ip: "2001:db8::1", want: true},
+		{ip: "2001:db9::1", want: false},
+	}
+
+	for _, tt := range tests {
+		if allowed := isClientAllowed(net.ParseIP(tt.ip)); allowed != tt.want {
+			t.Errorf("isClientAllowed(%s) = %t, want %t", tt.ip, allowed, tt.want)
+		}
+	}
+}
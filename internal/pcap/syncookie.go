@@ -0,0 +1,179 @@
+package pcap
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/clock"
+	"github.com/zhxie/ikago/internal/crypto"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cookieSlot is the duration a SYN cookie is valid in, a cookie is accepted in its slot and the next one.
+const cookieSlot = 64 * time.Second
+
+var (
+	handshakeRate  int
+	handshakeLock  sync.Mutex
+	handshakeToken float64
+	handshakeLast  time.Time
+	handshakeDrops uint64
+	isSYNCookies   bool
+	cookieSecret   []byte
+)
+
+// SetHandshakeRate sets the maximum rate of handshakes per second accepted by listeners. Excess handshakes will be
+// dropped. A rate of 0 means unlimited.
+func SetHandshakeRate(rate int) error {
+	if rate < 0 {
+		return fmt.Errorf("handshake rate %d out of range", rate)
+	}
+
+	handshakeLock.Lock()
+	defer handshakeLock.Unlock()
+
+	handshakeRate = rate
+	handshakeToken = float64(rate)
+	handshakeLast = clock.Now()
+
+	return nil
+}
+
+// SetSYNCookies sets whether listeners created later answer handshakes with SYN cookies, so that no state of a client
+// will be created until it completes the handshake.
+func SetSYNCookies(enabled bool) error {
+	if enabled && cookieSecret == nil {
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return fmt.Errorf("generate secret: %w", err)
+		}
+
+		cookieSecret = secret
+	}
+
+	isSYNCookies = enabled
+
+	return nil
+}
+
+// HandshakeDrops returns the count of handshakes dropped by the rate limit or invalid SYN cookies.
+func HandshakeDrops() uint64 {
+	return atomic.LoadUint64(&handshakeDrops)
+}
+
+// allowHandshake reports whether a handshake is allowed by the rate limit, and counts it if not.
+func allowHandshake() bool {
+	if handshakeRate <= 0 {
+		return true
+	}
+
+	handshakeLock.Lock()
+	defer handshakeLock.Unlock()
+
+	// Refill tokens
+	now := clock.Now()
+	handshakeToken = handshakeToken + now.Sub(handshakeLast).Seconds()*float64(handshakeRate)
+	if handshakeToken > float64(handshakeRate) {
+		handshakeToken = float64(handshakeRate)
+	}
+	handshakeLast = now
+
+	if handshakeToken < 1 {
+		atomic.AddUint64(&handshakeDrops, 1)
+		return false
+	}
+	handshakeToken--
+
+	return true
+}
+
+func createSYNCookie(src *net.TCPAddr, dstPort uint16, isn uint32, slot uint32) uint32 {
+	data := make([]byte, 16)
+	copy(data, src.IP.To4())
+	binary.BigEndian.PutUint16(data[4:], uint16(src.Port))
+	binary.BigEndian.PutUint16(data[6:], dstPort)
+	binary.BigEndian.PutUint32(data[8:], isn)
+	binary.BigEndian.PutUint32(data[12:], slot)
+
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write(data)
+
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
+
+func currentCookieSlot() uint32 {
+	return uint32(clock.Now().UnixNano() / int64(cookieSlot))
+}
+
+// writeSYNACKCookie replies a SYN with a SYN+ACK whose sequence number is a SYN cookie without creating any state.
+func writeSYNACKCookie(conn *RawConn, indicator *PacketIndicator, id uint16) error {
+	isn := indicator.TCPLayer().Seq
+	cookie := createSYNCookie(indicator.Src().(*net.TCPAddr), indicator.DstPort(), isn, currentCookieSlot())
+
+	// A temporary client for the fingerprint
+	client := &clientIndicator{seq: cookie, ack: isn + 1, tsOffset: cookie}
+	if ts, ok := timestampsValue(indicator.TCPLayer()); ok {
+		client.tsecr = ts
+	}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, conn, indicator.SrcIP(), id, 64, indicator.SrcHardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	// Make TCP layer SYN & ACK
+	FlagTCPLayer(transportLayer.(*layers.TCP), true, false, true)
+	applyFingerprint(transportLayer, networkLayer, client)
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, networkLayer, transportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	return nil
+}
+
+// acceptSYNCookie validates the SYN cookie acknowledged in an ACK, and returns a client of the established connection
+// if it is valid. Invalid cookies are counted as dropped handshakes.
+func acceptSYNCookie(indicator *PacketIndicator, crypt crypto.Crypt) (*clientIndicator, bool) {
+	isn := indicator.TCPLayer().Seq - 1
+	cookie := indicator.TCPLayer().Ack - 1
+	slot := currentCookieSlot()
+
+	src := indicator.Src().(*net.TCPAddr)
+	if cookie != createSYNCookie(src, indicator.DstPort(), isn, slot) && cookie != createSYNCookie(src, indicator.DstPort(), isn, slot-1) {
+		atomic.AddUint64(&handshakeDrops, 1)
+		return nil, false
+	}
+
+	client := newClientIndicator(crypt)
+	client.seq = cookie + 1
+	client.ack = indicator.TCPLayer().Seq
+	client.phase = handshakeEstablished
+	client.isn = cookie
+	client.peerISN = isn
+	client.tsOffset = cookie
+	if ts, ok := timestampsValue(indicator.TCPLayer()); ok {
+		client.tsecr = ts
+	}
+	if indicator.LinkLayer() != nil {
+		client.hardwareAddr = indicator.SrcHardwareAddr()
+	}
+
+	return client, true
+}
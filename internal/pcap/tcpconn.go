@@ -2,6 +2,7 @@
 
 import (
 	"fmt"
+	"github.com/zhxie/ikago/internal/clock"
 	"github.com/zhxie/ikago/internal/crypto"
 	"github.com/zhxie/ikago/internal/log"
 	"net"
@@ -37,9 +38,20 @@ func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Cry
 		Port: int(srcPort),
 	}
 
+	// The carrier is always in IPv4
+	if dstAddr.IP.To4() == nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    fmt.Errorf("address family of %s %w", dstAddr.IP, ErrUnsupportedProtocol),
+		}
+	}
+
 	log.Infof("Connect to server %s\n", dstAddr.String())
 
-	t := time.Now()
+	t := clock.Now()
 
 	conn, err := net.DialTCP("tcp4", srcAddr, dstAddr)
 	if err != nil {
@@ -52,7 +64,7 @@ func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Cry
 		}
 	}
 
-	duration := time.Now().Sub(t)
+	duration := clock.Since(t)
 
 	log.Infof("Connected to server %s in %.3f ms (RTT)\n", dstAddr.String(), float64(duration.Microseconds())/1000)
 
@@ -184,6 +196,13 @@ func (l *TCPListener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
+	// Client subnets
+	remoteAddr := conn.RemoteAddr().(*net.TCPAddr)
+	if !isClientAllowed(remoteAddr.IP) {
+		conn.Close()
+		return nil, fmt.Errorf("client %s unauthorized", remoteAddr)
+	}
+
 	tcpConn := newTCPConn()
 	tcpConn.conn = conn
 	tcpConn.crypt = l.crypt
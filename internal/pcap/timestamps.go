@@ -0,0 +1,55 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket/layers"
+	"math/rand"
+	"time"
+)
+
+// timestampsOptionSize is the size of the timestamps option with its 2 leading NOPs.
+const timestampsOptionSize = 12
+
+var isTimestamps bool
+
+// SetTimestamps sets whether FakeTCP segments carry the TCP timestamps option regardless of the fingerprint.
+func SetTimestamps(enabled bool) {
+	isTimestamps = enabled
+}
+
+// hasTimestamps returns if FakeTCP segments carry the TCP timestamps option.
+func hasTimestamps() bool {
+	return isTimestamps || (fingerprint != nil && fingerprint.hasTimestamps())
+}
+
+// newTimestampsOffset returns a random offset of timestamp values of a flow, so that flows do not share the same clock.
+func newTimestampsOffset() uint32 {
+	return rand.New(rand.NewSource(time.Now().UnixNano())).Uint32()
+}
+
+func createTimestampsOption(tsval, tsecr uint32) layers.TCPOption {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, tsval)
+	binary.BigEndian.PutUint32(data[4:], tsecr)
+
+	return layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: data}
+}
+
+// appendTimestampsOption appends the timestamps option of the client with 2 leading NOPs to a TCP layer.
+func appendTimestampsOption(layer *layers.TCP, client *clientIndicator) {
+	layer.Options = append(layer.Options,
+		layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+		layers.TCPOption{OptionType: layers.TCPOptionKindNop, OptionLength: 1},
+		createTimestampsOption(client.tsval(), client.tsecr))
+}
+
+// timestampsValue returns the timestamp value in the timestamps option of a TCP layer.
+func timestampsValue(layer *layers.TCP) (uint32, bool) {
+	for _, option := range layer.Options {
+		if option.OptionType == layers.TCPOptionKindTimestamps && len(option.OptionData) == 8 {
+			return binary.BigEndian.Uint32(option.OptionData), true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,104 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/zhxie/ikago/internal/clock"
+)
+
+// timestampsOption returns the timestamp value and the timestamp echo reply in the timestamps option of a TCP layer.
+func timestampsOption(tb testing.TB, layer *layers.TCP) (uint32, uint32) {
+	for _, option := range layer.Options {
+		if option.OptionType == layers.TCPOptionKindTimestamps && len(option.OptionData) == 8 {
+			return binary.BigEndian.Uint32(option.OptionData), binary.BigEndian.Uint32(option.OptionData[4:])
+		}
+	}
+	tb.Fatalf("segment %d-%d has no timestamps option", layer.Seq, layer.Ack)
+
+	return 0, 0
+}
+
+func TestTimestamps(t *testing.T) {
+	fake := clock.NewFake(time.Unix(1600000000, 0))
+	defer clock.Set(fake)()
+	defer SetTimestamps(isTimestamps)
+	SetTimestamps(true)
+
+	client, clientHandle := newTestConn(testClientAddr, testServerAddr)
+	server, serverHandle := newTestConn(testServerAddr, testClientAddr)
+
+	// SYN
+	err := client.handshakeSYN()
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	syn := clientHandle.relay(t, serverHandle)
+	if len(syn) != 1 {
+		t.Fatalf("written = %d segments, want 1", len(syn))
+	}
+	synTSval, synTSecr := timestampsOption(t, syn[0])
+	if synTSecr != 0 {
+		t.Errorf("tsecr of SYN = %d, want 0", synTSecr)
+	}
+
+	// SYN+ACK echoes the SYN
+	fake.Advance(10 * time.Millisecond)
+	readAll(t, server, serverHandle)
+	synACK := serverHandle.relay(t, clientHandle)
+	if len(synACK) != 1 {
+		t.Fatalf("written = %d segments, want 1", len(synACK))
+	}
+	synACKTSval, synACKTSecr := timestampsOption(t, synACK[0])
+	if synACKTSecr != synTSval {
+		t.Errorf("tsecr of SYN+ACK = %d, want %d", synACKTSecr, synTSval)
+	}
+
+	// ACK echoes the SYN+ACK, and the timestamp value of the client follows its clock
+	fake.Advance(10 * time.Millisecond)
+	readAll(t, client, clientHandle)
+	ack := clientHandle.relay(t, serverHandle)
+	if len(ack) != 1 {
+		t.Fatalf("written = %d segments, want 1", len(ack))
+	}
+	ackTSval, ackTSecr := timestampsOption(t, ack[0])
+	if ackTSecr != synACKTSval {
+		t.Errorf("tsecr of ACK = %d, want %d", ackTSecr, synACKTSval)
+	}
+	if ackTSval-synTSval != 20 {
+		t.Errorf("tsval of ACK = %d, want %d", ackTSval, synTSval+20)
+	}
+	readAll(t, server, serverHandle)
+
+	// Data segments echo the latest timestamp value of the peer
+	fake.Advance(10 * time.Millisecond)
+	request := newTestPacket(t, CreateUDPLayer(49152, 10000), []byte("request"), false)
+	_, err = client.Write(request)
+	if err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	data := clientHandle.relay(t, serverHandle)
+	if len(data) != 1 {
+		t.Fatalf("written = %d segments, want 1", len(data))
+	}
+	requestTSval, _ := timestampsOption(t, data[0])
+	readAll(t, server, serverHandle)
+
+	_, err = server.WriteTo([]byte("response"), testClientAddr)
+	if err != nil {
+		t.Fatalf("write response: %v", err)
+	}
+	data = serverHandle.written(t)
+	if len(data) != 1 {
+		t.Fatalf("written = %d segments, want 1", len(data))
+	}
+	responseTSval, responseTSecr := timestampsOption(t, data[0])
+	if responseTSecr != requestTSval {
+		t.Errorf("tsecr of response = %d, want %d", responseTSecr, requestTSval)
+	}
+	if responseTSval-synACKTSval != 20 {
+		t.Errorf("tsval of response = %d, want %d", responseTSval, synACKTSval+20)
+	}
+}
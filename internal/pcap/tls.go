@@ -0,0 +1,131 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// tlsRecordHandshake is the content type of TLS handshake records.
+	tlsRecordHandshake = 0x16
+	// tlsHandshakeClientHello is the type of TLS ClientHello handshake messages.
+	tlsHandshakeClientHello = 0x01
+	// tlsExtensionServerName is the type of TLS server name indication extensions.
+	tlsExtensionServerName = 0x0000
+	// tlsServerNameHost is the type of host names in TLS server name indication extensions.
+	tlsServerNameHost = 0x00
+)
+
+// ParseSNI returns the server name indicated in a TLS ClientHello at the beginning of the payload. Only the cleartext
+// ClientHello in the first record is inspected, so a ClientHello across segments cannot be parsed.
+func ParseSNI(payload []byte) (string, error) {
+	// Record
+	if len(payload) < 5 || payload[0] != tlsRecordHandshake {
+		return "", errors.New("not tls handshake")
+	}
+	length := int(binary.BigEndian.Uint16(payload[3:5]))
+	b := payload[5:]
+	if len(b) > length {
+		b = b[:length]
+	}
+
+	// Handshake
+	if len(b) < 4 || b[0] != tlsHandshakeClientHello {
+		return "", errors.New("not client hello")
+	}
+	length = int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+	b = b[4:]
+	if len(b) < length {
+		return "", errors.New("truncated client hello")
+	}
+	b = b[:length]
+
+	// Version and random
+	b, ok := skipBytes(b, 34)
+	if !ok {
+		return "", errors.New("truncated random")
+	}
+	// Session ID
+	b, ok = skipVector(b, 1)
+	if !ok {
+		return "", errors.New("truncated session id")
+	}
+	// Cipher suites
+	b, ok = skipVector(b, 2)
+	if !ok {
+		return "", errors.New("truncated cipher suites")
+	}
+	// Compression methods
+	b, ok = skipVector(b, 1)
+	if !ok {
+		return "", errors.New("truncated compression methods")
+	}
+
+	// Extensions
+	if len(b) < 2 {
+		return "", errors.New("missing extensions")
+	}
+	length = int(binary.BigEndian.Uint16(b))
+	b = b[2:]
+	if len(b) < length {
+		return "", errors.New("truncated extensions")
+	}
+	b = b[:length]
+	for len(b) >= 4 {
+		t := binary.BigEndian.Uint16(b)
+		length = int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+		if len(b) < length {
+			return "", errors.New("truncated extension")
+		}
+		if t != tlsExtensionServerName {
+			b = b[length:]
+			continue
+		}
+
+		// Server name list
+		names := b[:length]
+		if len(names) < 2 {
+			return "", errors.New("truncated server name list")
+		}
+		names = names[2:]
+		for len(names) >= 3 {
+			nameType := names[0]
+			l := int(binary.BigEndian.Uint16(names[1:]))
+			names = names[3:]
+			if len(names) < l {
+				return "", errors.New("truncated server name")
+			}
+			if nameType == tlsServerNameHost {
+				return string(names[:l]), nil
+			}
+			names = names[l:]
+		}
+
+		return "", errors.New("missing host name")
+	}
+
+	return "", errors.New("missing server name")
+}
+
+func skipBytes(b []byte, n int) ([]byte, bool) {
+	if len(b) < n {
+		return nil, false
+	}
+
+	return b[n:], true
+}
+
+// skipVector skips a vector whose length is prefixed in the given size.
+func skipVector(b []byte, size int) ([]byte, bool) {
+	if len(b) < size {
+		return nil, false
+	}
+
+	var length int
+	for i := 0; i < size; i++ {
+		length = length<<8 | int(b[i])
+	}
+
+	return skipBytes(b, size+length)
+}
@@ -0,0 +1,124 @@
+package pcap
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sort"
+	"strings"
+)
+
+// TransportHandler handles a transport layer which identifies flows by ports like TCP and UDP, so that packets of it
+// can be translated without knowing the protocol.
+type TransportHandler interface {
+	// Ports returns the source and destination ports of the transport layer.
+	Ports(layer gopacket.Layer) (uint16, uint16)
+	// Rewrite returns a copy of the transport layer with the source and destination ports replaced, which must be a
+	// gopacket.SerializableLayer.
+	Rewrite(layer gopacket.Layer, srcPort, dstPort uint16) (gopacket.Layer, error)
+	// SetNetworkLayerForChecksum sets the network layer of a transport layer returned by Rewrite for calculating its
+	// checksum when serializing.
+	SetNetworkLayerForChecksum(layer gopacket.Layer, networkLayer gopacket.NetworkLayer) error
+}
+
+var (
+	transportTypes    = make(map[layers.IPProtocol]gopacket.LayerType)
+	transportHandlers = make(map[gopacket.LayerType]TransportHandler)
+)
+
+func init() {
+	_ = RegisterTransport(layers.IPProtocolTCP, layers.LayerTypeTCP, &tcpHandler{})
+	_ = RegisterTransport(layers.IPProtocolUDP, layers.LayerTypeUDP, &udpHandler{})
+}
+
+// RegisterTransport registers a handler of a transport layer carried in the IP protocol. The layer must be decoded by
+// gopacket as a transport layer. Transports should be registered in init functions, before any packet is parsed.
+func RegisterTransport(protocol layers.IPProtocol, t gopacket.LayerType, handler TransportHandler) error {
+	if protocol == layers.IPProtocolICMPv4 || t == layers.LayerTypeICMPv4 {
+		return fmt.Errorf("transport layer type %s %w", t, ErrUnsupportedProtocol)
+	}
+	if _, ok := transportTypes[protocol]; ok {
+		return fmt.Errorf("ip protocol %s registered", protocol)
+	}
+	if _, ok := transportHandlers[t]; ok {
+		return fmt.Errorf("transport layer type %s registered", t)
+	}
+
+	transportTypes[protocol] = t
+	transportHandlers[t] = handler
+
+	return nil
+}
+
+// FindTransport returns the handler of a transport layer, or nil if it is not registered.
+func FindTransport(t gopacket.LayerType) TransportHandler {
+	return transportHandlers[t]
+}
+
+// Transports returns all registered transport layers.
+func Transports() []gopacket.LayerType {
+	result := make([]gopacket.LayerType, 0, len(transportHandlers))
+	for t := range transportHandlers {
+		result = append(result, t)
+	}
+
+	return result
+}
+
+// TransportFilter returns a BPF filter matching registered transports other than TCP and UDP, or an empty string if
+// there is none.
+func TransportFilter() string {
+	fs := make([]string, 0)
+	for protocol := range transportTypes {
+		if protocol != layers.IPProtocolTCP && protocol != layers.IPProtocolUDP {
+			fs = append(fs, fmt.Sprintf("ip proto %d", protocol))
+		}
+	}
+	sort.Strings(fs)
+
+	return strings.Join(fs, " || ")
+}
+
+type tcpHandler struct{}
+
+func (h *tcpHandler) Ports(layer gopacket.Layer) (uint16, uint16) {
+	tcpLayer := layer.(*layers.TCP)
+
+	return uint16(tcpLayer.SrcPort), uint16(tcpLayer.DstPort)
+}
+
+func (h *tcpHandler) Rewrite(layer gopacket.Layer, srcPort, dstPort uint16) (gopacket.Layer, error) {
+	temp := *layer.(*layers.TCP)
+	newTCPLayer := &temp
+
+	newTCPLayer.SrcPort = layers.TCPPort(srcPort)
+	newTCPLayer.DstPort = layers.TCPPort(dstPort)
+
+	return newTCPLayer, nil
+}
+
+func (h *tcpHandler) SetNetworkLayerForChecksum(layer gopacket.Layer, networkLayer gopacket.NetworkLayer) error {
+	return layer.(*layers.TCP).SetNetworkLayerForChecksum(networkLayer)
+}
+
+type udpHandler struct{}
+
+func (h *udpHandler) Ports(layer gopacket.Layer) (uint16, uint16) {
+	udpLayer := layer.(*layers.UDP)
+
+	return uint16(udpLayer.SrcPort), uint16(udpLayer.DstPort)
+}
+
+func (h *udpHandler) Rewrite(layer gopacket.Layer, srcPort, dstPort uint16) (gopacket.Layer, error) {
+	temp := *layer.(*layers.UDP)
+	newUDPLayer := &temp
+
+	newUDPLayer.SrcPort = layers.UDPPort(srcPort)
+	newUDPLayer.DstPort = layers.UDPPort(dstPort)
+
+	return newUDPLayer, nil
+}
+
+func (h *udpHandler) SetNetworkLayerForChecksum(layer gopacket.Layer, networkLayer gopacket.NetworkLayer) error {
+	return layer.(*layers.UDP).SetNetworkLayerForChecksum(networkLayer)
+}
@@ -0,0 +1,104 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// stubHandler is a handler of UDP-Lite, which only reports ports.
+type stubHandler struct{}
+
+func (h *stubHandler) Ports(layer gopacket.Layer) (uint16, uint16) {
+	udpLiteLayer := layer.(*layers.UDPLite)
+
+	return uint16(udpLiteLayer.SrcPort), uint16(udpLiteLayer.DstPort)
+}
+
+func (h *stubHandler) Rewrite(layer gopacket.Layer, srcPort, dstPort uint16) (gopacket.Layer, error) {
+	return nil, errors.New("rewrite not support")
+}
+
+func (h *stubHandler) SetNetworkLayerForChecksum(layer gopacket.Layer, networkLayer gopacket.NetworkLayer) error {
+	return nil
+}
+
+// newUDPLitePacket returns an IPv4 packet of UDP-Lite with the payload between the ports.
+func newUDPLitePacket(tb testing.TB, srcPort, dstPort uint16, payload []byte) []byte {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint16(header, srcPort)
+	binary.BigEndian.PutUint16(header[2:], dstPort)
+	binary.BigEndian.PutUint16(header[4:], 8)
+
+	ipv4Layer := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDPLite,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+
+	data, err := Serialize(ipv4Layer, gopacket.Payload(append(header, payload...)))
+	if err != nil {
+		tb.Fatalf("serialize: %v", err)
+	}
+
+	return data
+}
+
+func TestRegisterTransport(t *testing.T) {
+	data := newUDPLitePacket(t, 49152, 5000, []byte("datagram"))
+
+	_, err := ParseEmbPacket(data)
+	if !errors.Is(err, ErrUnsupportedProtocol) {
+		t.Fatalf("parse unregistered: %v, want %v", err, ErrUnsupportedProtocol)
+	}
+
+	handler := &stubHandler{}
+	err = RegisterTransport(layers.IPProtocolUDPLite, layers.LayerTypeUDPLite, handler)
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	defer func() {
+		delete(transportTypes, layers.IPProtocolUDPLite)
+		delete(transportHandlers, layers.LayerTypeUDPLite)
+	}()
+
+	if FindTransport(layers.LayerTypeUDPLite) != handler {
+		t.Error("handler not found")
+	}
+	if f := TransportFilter(); f != "ip proto 136" {
+		t.Errorf("filter = %q, want %q", f, "ip proto 136")
+	}
+
+	// Packets of the registered transport are parsed with ports by the handler
+	indicator, err := ParseEmbPacket(data)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if indicator.TransportProtocol() != layers.LayerTypeUDPLite {
+		t.Errorf("protocol = %s, want %s", indicator.TransportProtocol(), layers.LayerTypeUDPLite)
+	}
+	if indicator.SrcPort() != 49152 || indicator.DstPort() != 5000 {
+		t.Errorf("ports = %d-%d, want 49152-5000", indicator.SrcPort(), indicator.DstPort())
+	}
+
+	// Transports are registered once, and ICMPv4 is handled by itself
+	err = RegisterTransport(layers.IPProtocolUDPLite, layers.LayerTypeUDPLite, handler)
+	if err == nil {
+		t.Error("register twice: want error")
+	}
+	err = RegisterTransport(layers.IPProtocolTCP, layers.LayerTypeSCTP, handler)
+	if err == nil {
+		t.Error("register registered protocol: want error")
+	}
+	err = RegisterTransport(layers.IPProtocolICMPv4, layers.LayerTypeICMPv4, handler)
+	if !errors.Is(err, ErrUnsupportedProtocol) {
+		t.Errorf("register icmpv4: %v, want %v", err, ErrUnsupportedProtocol)
+	}
+}
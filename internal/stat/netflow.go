@@ -0,0 +1,180 @@
+package stat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/zhxie/ikago/internal/clock"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	netFlowVersion    = 9
+	netFlowHeaderSize = 20
+	netFlowTemplateId = 256
+	// netFlowMaxRecords is the maximum count of records in a single export packet, which keeps the packet in an
+	// Ethernet MTU.
+	netFlowMaxRecords = 24
+	// netFlowTemplateInterval is the count of export packets between template refreshing.
+	netFlowTemplateInterval = 20
+)
+
+// netFlowFields are types and lengths of fields in the template of NetFlow v9 records.
+var netFlowFields = [][2]uint16{
+	{8, 4},   // IPV4_SRC_ADDR
+	{12, 4},  // IPV4_DST_ADDR
+	{7, 2},   // L4_SRC_PORT
+	{11, 2},  // L4_DST_PORT
+	{4, 1},   // PROTOCOL
+	{1, 8},   // IN_BYTES
+	{2, 8},   // IN_PKTS
+	{22, 4},  // FIRST_SWITCHED
+	{21, 4},  // LAST_SWITCHED
+	{225, 4}, // postNATSourceIPv4Address
+	{226, 4}, // postNATDestinationIPv4Address
+	{227, 2}, // postNAPTSourceTransportPort
+	{228, 2}, // postNAPTDestinationTransportPort
+}
+
+// netFlowRecordSize is the size of a record in the template.
+const netFlowRecordSize = 4 + 4 + 2 + 2 + 1 + 8 + 8 + 4 + 4 + 4 + 4 + 2 + 2
+
+// FlowRecord describes an unidirectional flow before and after translation.
+type FlowRecord struct {
+	SrcIP       net.IP
+	DstIP       net.IP
+	SrcPort     uint16
+	DstPort     uint16
+	Protocol    uint8
+	PostSrcIP   net.IP
+	PostDstIP   net.IP
+	PostSrcPort uint16
+	PostDstPort uint16
+	Bytes       uint64
+	Packets     uint64
+	Start       time.Time
+	End         time.Time
+}
+
+// Add counts a packet of the flow.
+func (record *FlowRecord) Add(size int, t time.Time) {
+	if record.Start.IsZero() {
+		record.Start = t
+	}
+	record.Bytes = record.Bytes + uint64(size)
+	record.Packets++
+	record.End = t
+}
+
+// FlowExporter exports flow records to a collector in NetFlow v9.
+type FlowExporter struct {
+	lock     sync.Mutex
+	conn     net.Conn
+	boot     time.Time
+	sequence uint32
+	packets  int
+}
+
+// NewFlowExporter returns a new flow exporter sending to the collector.
+func NewFlowExporter(collector string) (*FlowExporter, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", collector, err)
+	}
+
+	return &FlowExporter{conn: conn, boot: clock.Now()}, nil
+}
+
+// Export sends flow records to the collector.
+func (exporter *FlowExporter) Export(records []*FlowRecord) error {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+
+	for i := 0; i < len(records); i = i + netFlowMaxRecords {
+		end := i + netFlowMaxRecords
+		if end > len(records) {
+			end = len(records)
+		}
+
+		_, err := exporter.conn.Write(exporter.createPacket(records[i:end]))
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the exporter.
+func (exporter *FlowExporter) Close() error {
+	return exporter.conn.Close()
+}
+
+func (exporter *FlowExporter) uptime(t time.Time) uint32 {
+	return uint32(t.Sub(exporter.boot) / time.Millisecond)
+}
+
+func (exporter *FlowExporter) createPacket(records []*FlowRecord) []byte {
+	var (
+		count uint16
+		now   = clock.Now()
+	)
+
+	data := make([]byte, netFlowHeaderSize)
+
+	// Template flowset, which is refreshed periodically since the transport is unreliable
+	if exporter.packets%netFlowTemplateInterval == 0 {
+		template := make([]byte, 8+4*len(netFlowFields))
+		binary.BigEndian.PutUint16(template, 0)
+		binary.BigEndian.PutUint16(template[2:], uint16(len(template)))
+		binary.BigEndian.PutUint16(template[4:], netFlowTemplateId)
+		binary.BigEndian.PutUint16(template[6:], uint16(len(netFlowFields)))
+		for i, field := range netFlowFields {
+			binary.BigEndian.PutUint16(template[8+4*i:], field[0])
+			binary.BigEndian.PutUint16(template[10+4*i:], field[1])
+		}
+
+		data = append(data, template...)
+		count++
+	}
+	exporter.packets++
+
+	// Data flowset padded to 4 Bytes
+	size := 4 + netFlowRecordSize*len(records)
+	if size%4 != 0 {
+		size = size + 4 - size%4
+	}
+	flowset := make([]byte, size)
+	binary.BigEndian.PutUint16(flowset, netFlowTemplateId)
+	binary.BigEndian.PutUint16(flowset[2:], uint16(size))
+	for i, record := range records {
+		b := flowset[4+netFlowRecordSize*i:]
+		copy(b, record.SrcIP.To4())
+		copy(b[4:], record.DstIP.To4())
+		binary.BigEndian.PutUint16(b[8:], record.SrcPort)
+		binary.BigEndian.PutUint16(b[10:], record.DstPort)
+		b[12] = record.Protocol
+		binary.BigEndian.PutUint64(b[13:], record.Bytes)
+		binary.BigEndian.PutUint64(b[21:], record.Packets)
+		binary.BigEndian.PutUint32(b[29:], exporter.uptime(record.Start))
+		binary.BigEndian.PutUint32(b[33:], exporter.uptime(record.End))
+		copy(b[37:], record.PostSrcIP.To4())
+		copy(b[41:], record.PostDstIP.To4())
+		binary.BigEndian.PutUint16(b[45:], record.PostSrcPort)
+		binary.BigEndian.PutUint16(b[47:], record.PostDstPort)
+	}
+	data = append(data, flowset...)
+	count = count + uint16(len(records))
+
+	// Header
+	binary.BigEndian.PutUint16(data, netFlowVersion)
+	binary.BigEndian.PutUint16(data[2:], count)
+	binary.BigEndian.PutUint32(data[4:], exporter.uptime(now))
+	binary.BigEndian.PutUint32(data[8:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(data[12:], exporter.sequence)
+	binary.BigEndian.PutUint32(data[16:], 0)
+	exporter.sequence++
+
+	return data
+}
@@ -4,6 +4,7 @@
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/zhxie/ikago/internal/clock"
 	"github.com/zhxie/ikago/internal/log"
 	"strings"
 	"time"
@@ -41,7 +42,7 @@ func (indicator *TrafficIndicator) LastSeen() time.Time {
 func (indicator *TrafficIndicator) Add(size uint) {
 	indicator.count++
 	indicator.size = indicator.size + uint64(size)
-	indicator.lastSeen = time.Now()
+	indicator.lastSeen = clock.Now()
 }
 
 func (indicator *TrafficIndicator) MarshalJSON() ([]byte, error) {
@@ -97,7 +98,7 @@ func (manager *TrafficManager) Add(node string, size uint) {
 	indicator, ok := manager.indicators[node]
 	if !ok {
 		manager.nodes = append(manager.nodes, node)
-		indicator = &TrafficIndicator{appear: time.Now()}
+		indicator = &TrafficIndicator{appear: clock.Now()}
 		manager.indicators[node] = indicator
 		log.Verbosef("Track new traffic from %s\n", node)
 	}